@@ -0,0 +1,150 @@
+// Package blocks stores the block lists users manage, the lists are kept in a
+// JetStream key-value bucket and cached in memory on every CAP.
+package blocks
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/hamidoujand/echo/chat"
+	"github.com/hamidoujand/echo/kvstore"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+type list struct {
+	// Updated is the timestamp of the last signed control message applied.
+	Updated int64            `json:"updated"`
+	Blocked []common.Address `json:"blocked"`
+}
+
+type Store struct {
+	log   *slog.Logger
+	kv    jetstream.KeyValue
+	lists map[common.Address]list
+	mu    sync.RWMutex
+}
+
+func New(log *slog.Logger, conn *nats.Conn, bucket string) (*Store, error) {
+	ctx := context.Background()
+
+	js, err := jetstream.New(conn)
+	if err != nil {
+		return nil, fmt.Errorf("create jetStream: %w", err)
+	}
+
+	kv, err := js.CreateOrUpdateKeyValue(ctx, jetstream.KeyValueConfig{
+		Bucket: bucket,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("creating key-value bucket: %w", err)
+	}
+
+	watcher, err := kv.WatchAll(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("watching key-value bucket: %w", err)
+	}
+
+	s := Store{
+		log:   log,
+		kv:    kv,
+		lists: make(map[common.Address]list),
+	}
+
+	//keep the cache in sync with changes made by other CAPs.
+	go s.watch(watcher)
+
+	return &s, nil
+}
+
+func (s *Store) Block(ctx context.Context, owner common.Address, target common.Address, at time.Time) error {
+	return s.update(ctx, owner, at, func(l list) list {
+		if !slices.Contains(l.Blocked, target) {
+			l.Blocked = append(l.Blocked, target)
+		}
+		return l
+	})
+}
+
+func (s *Store) Unblock(ctx context.Context, owner common.Address, target common.Address, at time.Time) error {
+	return s.update(ctx, owner, at, func(l list) list {
+		l.Blocked = slices.DeleteFunc(l.Blocked, func(a common.Address) bool {
+			return a == target
+		})
+		return l
+	})
+}
+
+// IsBlocked reports whether owner has blocked sender.
+func (s *Store) IsBlocked(owner common.Address, sender common.Address) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	l, ok := s.lists[owner]
+	if !ok {
+		return false
+	}
+
+	return slices.Contains(l.Blocked, sender)
+}
+
+func (s *Store) update(ctx context.Context, owner common.Address, at time.Time, fn func(l list) list) error {
+	var updated list
+	err := kvstore.Update(ctx, s.kv, owner.Hex(), func(l list, exists bool) (list, error) {
+		//control messages are signed with a timestamp, an older one is a replay.
+		if at.UnixNano() <= l.Updated {
+			return l, chat.ErrStaleControl
+		}
+
+		updated = fn(l)
+		updated.Updated = at.UnixNano()
+		return updated, nil
+	})
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	s.lists[owner] = updated
+	s.mu.Unlock()
+
+	return nil
+}
+
+func (s *Store) watch(watcher jetstream.KeyWatcher) {
+	for entry := range watcher.Updates() {
+		//nil marks the end of the initial values.
+		if entry == nil {
+			continue
+		}
+
+		if !common.IsHexAddress(entry.Key()) {
+			s.log.Error("blocks: invalid key in bucket", "key", entry.Key())
+			continue
+		}
+		owner := common.HexToAddress(entry.Key())
+
+		if entry.Operation() != jetstream.KeyValuePut {
+			s.mu.Lock()
+			delete(s.lists, owner)
+			s.mu.Unlock()
+			continue
+		}
+
+		var l list
+		if err := json.Unmarshal(entry.Value(), &l); err != nil {
+			s.log.Error("blocks: unmarshal list failed", "owner", owner, "err", err)
+			continue
+		}
+
+		s.mu.Lock()
+		s.lists[owner] = l
+		s.mu.Unlock()
+	}
+}
@@ -14,6 +14,7 @@ import (
 	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
 	"github.com/hamidoujand/echo/errs"
+	"github.com/hamidoujand/echo/keys"
 	"github.com/hamidoujand/echo/signature"
 	"github.com/nats-io/nats.go"
 	"github.com/nats-io/nats.go/jetstream"
@@ -22,8 +23,14 @@ import (
 var (
 	ErrUserNotFound      = errors.New("user not found")
 	ErrUserAlreadyExists = errors.New("user already exists")
+	ErrRateLimited       = errors.New("rate limit exceeded")
+	ErrQuotaExceeded     = errors.New("daily quota exceeded")
+	ErrStaleControl      = errors.New("stale control message")
 )
 
+// controlMaxSkew is how far a control message timestamp can be from the CAP's clock.
+const controlMaxSkew = 5 * time.Minute
+
 type users interface {
 	Add(usr User) error
 	Remove(userID common.Address)
@@ -33,29 +40,65 @@ type users interface {
 	UpdateLastPing(usrID common.Address) error
 }
 
+type limiter interface {
+	Allow(ctx context.Context, from common.Address, to common.Address) (time.Duration, error)
+	AllowControl(ctx context.Context, from common.Address) (time.Duration, error)
+}
+
+type blocks interface {
+	Block(ctx context.Context, owner common.Address, target common.Address, at time.Time) error
+	Unblock(ctx context.Context, owner common.Address, target common.Address, at time.Time) error
+	IsBlocked(owner common.Address, sender common.Address) bool
+}
+
+type keyDirectory interface {
+	Publish(ctx context.Context, b keys.Bundle) error
+}
+
+type Config struct {
+	Log     *slog.Logger
+	Users   users
+	Limiter limiter
+	Blocks  blocks
+	Keys    keyDirectory
+	Hooks   []Hook
+	Conn    *nats.Conn
+	Subject string
+	CapID   uuid.UUID
+}
+
 type Chat struct {
 	capID    uuid.UUID
 	log      *slog.Logger
 	users    users
+	limiter  limiter
+	blocks   blocks
+	keys     keyDirectory
+	pipeline pipeline
 	js       jetstream.JetStream
 	consumer jetstream.Consumer
 	stream   jetstream.Stream
 	subject  string
 }
 
-func New(log *slog.Logger, users users, conn *nats.Conn, subject string, capID uuid.UUID) (*Chat, error) {
+func New(cfg Config) (*Chat, error) {
 	ctx := context.Background()
 
+	p, err := newPipeline(cfg.Hooks)
+	if err != nil {
+		return nil, fmt.Errorf("creating pipeline: %w", err)
+	}
+
 	//create jetstream
-	js, err := jetstream.New(conn)
+	js, err := jetstream.New(cfg.Conn)
 	if err != nil {
 		return nil, fmt.Errorf("create jetStream: %w", err)
 	}
 
 	//create a stream
 	stream, err := js.CreateStream(ctx, jetstream.StreamConfig{
-		Name:     subject,
-		Subjects: []string{subject},
+		Name:     cfg.Subject,
+		Subjects: []string{cfg.Subject},
 		MaxAge:   20 * time.Hour,
 	})
 	if err != nil {
@@ -63,7 +106,7 @@ func New(log *slog.Logger, users users, conn *nats.Conn, subject string, capID u
 	}
 
 	consumer, err := stream.CreateOrUpdateConsumer(ctx, jetstream.ConsumerConfig{
-		Durable:       capID.String(),
+		Durable:       cfg.CapID.String(),
 		AckPolicy:     jetstream.AckExplicitPolicy,
 		DeliverPolicy: jetstream.DeliverNewPolicy,
 	})
@@ -73,13 +116,17 @@ func New(log *slog.Logger, users users, conn *nats.Conn, subject string, capID u
 	}
 
 	c := Chat{
-		capID:    capID,
-		log:      log,
-		users:    users,
+		capID:    cfg.CapID,
+		log:      cfg.Log,
+		users:    cfg.Users,
+		limiter:  cfg.Limiter,
+		blocks:   cfg.Blocks,
+		keys:     cfg.Keys,
+		pipeline: p,
 		js:       js,
 		consumer: consumer,
 		stream:   stream,
-		subject:  subject,
+		subject:  cfg.Subject,
 	}
 
 	const maxWait = time.Second * 10
@@ -119,6 +166,13 @@ func (c *Chat) Handshake(ctx context.Context, w http.ResponseWriter, r *http.Req
 		return User{}, fmt.Errorf("unmarshal msg: %w", err)
 	}
 
+	var hs struct {
+		Key *keys.Bundle `json:"key"`
+	}
+	if err := json.Unmarshal(msg, &hs); err != nil {
+		return User{}, fmt.Errorf("unmarshal msg: %w", err)
+	}
+
 	//add user
 	if err := c.users.Add(usr); err != nil {
 		defer func() { _ = conn.Close() }()
@@ -131,6 +185,22 @@ func (c *Chat) Handshake(ctx context.Context, w http.ResponseWriter, r *http.Req
 		return User{}, fmt.Errorf("adding user: %w", err)
 	}
 
+	//a bad key does not stop the user from chatting, only from being found.
+	if hs.Key != nil && c.keys != nil {
+		switch {
+		case hs.Key.ID != usr.ID:
+			c.log.Error("handshake: key bundle belongs to another user", "id", usr.ID, "bundle", hs.Key.ID)
+		default:
+			//ctx only covers reading the handshake message.
+			pubCtx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+			defer cancel()
+
+			if err := c.keys.Publish(pubCtx, *hs.Key); err != nil {
+				c.log.Error("handshake: publishing key failed", "id", usr.ID, "err", err)
+			}
+		}
+	}
+
 	usr.Conn.SetPongHandler(c.pong(usr.ID))
 	//send an ack
 	ack := fmt.Sprintf("Welcome, %s", usr.Name)
@@ -176,8 +246,14 @@ func (c *Chat) Listen(ctx context.Context, usr User) {
 			c.log.Error("unmarshaling inMessage failed", "err", err)
 			continue
 		}
+		in.Scheme = legacyScheme(in.Scheme, in.Encrypted)
+
+		if in.Control != nil {
+			c.processControl(ctx, usr, *in.Control)
+			continue
+		}
 
-		c.log.Info("received message", "from", usr.ID, "to", in.ToID, "msg type", websocket.TextMessage, "encrypted", in.Encrypted)
+		c.log.Info("received message", "from", usr.ID, "to", in.ToID, "msg type", websocket.TextMessage, "scheme", in.Scheme)
 
 		signedData := struct {
 			ToID      common.Address
@@ -200,24 +276,78 @@ func (c *Chat) Listen(ctx context.Context, usr User) {
 			continue
 		}
 
+		if c.limiter != nil {
+			retryAfter, err := c.limiter.Allow(ctx, usr.ID, in.ToID)
+			if err != nil {
+				c.log.Error("message rejected by limiter", "from", usr.ID, "to", in.ToID, "err", err)
+
+				var code string
+				switch {
+				case errors.Is(err, ErrRateLimited):
+					code = "rate_limited"
+				case errors.Is(err, ErrQuotaExceeded):
+					code = "quota_exceeded"
+				}
+
+				if code != "" {
+					if err := c.sendError(usr, code, err.Error(), in, retryAfter); err != nil {
+						c.log.Error("sending throttled frame failed", "err", err)
+					}
+				}
+				continue
+			}
+		}
+
+		m := Message{
+			FromID:    usr.ID,
+			FromName:  usr.Name,
+			ToID:      in.ToID,
+			Text:      in.Text,
+			FromNonce: in.FromNonce,
+			Scheme:    in.Scheme,
+		}
+
+		if err := c.pipeline.run(ctx, &m); err != nil {
+			c.log.Error("message stopped by pipeline", "from", usr.ID, "to", in.ToID, "err", err)
+
+			var rejectErr *RejectError
+			if errors.As(err, &rejectErr) {
+				if err := c.sendError(usr, "rejected", rejectErr.Reason, in, 0); err != nil {
+					c.log.Error("sending rejected frame failed", "err", err)
+				}
+			}
+			continue
+		}
+
+		//do not reveal to the sender that it is blocked, its nonce is lost
+		//and clients accept the gap.
+		if c.blocks != nil && c.blocks.IsBlocked(in.ToID, usr.ID) {
+			c.log.Info("message dropped, sender is blocked by the recipient", "from", usr.ID, "to", in.ToID)
+			continue
+		}
+
 		to, err := c.users.Retrieve(in.ToID)
 		if err != nil {
 			if errors.Is(err, ErrUserNotFound) {
 				//send to the BUS
-				m := busMessage{
+				bm := busMessage{
 					CapID:     c.capID,
 					FromID:    usr.ID,
 					FromName:  usr.Name,
 					ToID:      in.ToID,
 					Text:      in.Text,
 					FromNonce: in.FromNonce,
-					Encrypted: in.Encrypted,
+					Scheme:    in.Scheme,
+					Encrypted: in.Scheme == schemeRSA,
+					Metadata:  m.Metadata,
 					V:         in.V,
 					R:         in.R,
 					S:         in.S,
 				}
 
-				c.sendMessageToBUS(ctx, m)
+				if err := c.sendMessageToBUS(ctx, bm); err != nil {
+					c.log.Error("sending message to BUS failed", "err", err)
+				}
 			} else {
 				c.log.Error("failed to retrieve the message's recipient", "err", err)
 			}
@@ -225,7 +355,7 @@ func (c *Chat) Listen(ctx context.Context, usr User) {
 			continue
 		}
 
-		if err := c.sendMessage(usr, to, in.FromNonce, in.Encrypted, in.Text); err != nil {
+		if err := c.sendMessage(m, to); err != nil {
 			c.log.Error("sending message failed", "err", err)
 		}
 
@@ -251,7 +381,8 @@ func (c *Chat) ListenBUS(msg jetstream.Msg) {
 	if bm.CapID == c.capID {
 		return
 	}
-	c.log.Info("received message from BUS", "from", bm.FromID, "to", bm.ToID, "msg type", websocket.TextMessage, "encrypted", bm.Encrypted)
+	bm.Scheme = legacyScheme(bm.Scheme, bm.Encrypted)
+	c.log.Info("received message from BUS", "from", bm.FromID, "to", bm.ToID, "msg type", websocket.TextMessage, "scheme", bm.Scheme)
 
 	signedData := struct {
 		ToID      common.Address
@@ -274,6 +405,12 @@ func (c *Chat) ListenBUS(msg jetstream.Msg) {
 		return
 	}
 
+	//the block list might have changed while the message was on the BUS.
+	if c.blocks != nil && c.blocks.IsBlocked(bm.ToID, bm.FromID) {
+		c.log.Info("listenBUS: message dropped, sender is blocked by the recipient", "from", bm.FromID, "to", bm.ToID)
+		return
+	}
+
 	to, err := c.users.Retrieve(bm.ToID)
 	if err != nil {
 		//not found in this cap
@@ -281,12 +418,19 @@ func (c *Chat) ListenBUS(msg jetstream.Msg) {
 		return
 	}
 
-	from := User{
-		ID:   bm.FromID,
-		Name: bm.FromName,
+	//the CAP of the sender already filtered, enriched and audited the message,
+	//it is only delivered here.
+	m := Message{
+		FromID:    bm.FromID,
+		FromName:  bm.FromName,
+		ToID:      bm.ToID,
+		Text:      bm.Text,
+		FromNonce: bm.FromNonce,
+		Scheme:    bm.Scheme,
+		Metadata:  bm.Metadata,
 	}
 
-	if err := c.sendMessage(from, to, bm.FromNonce, bm.Encrypted, bm.Text); err != nil {
+	if err := c.sendMessage(m, to); err != nil {
 		c.log.Error("listenBUS: sending message failed", "err", err)
 	}
 
@@ -294,6 +438,102 @@ func (c *Chat) ListenBUS(msg jetstream.Msg) {
 
 }
 
+func (c *Chat) processControl(ctx context.Context, usr User, ctrl controlMessage) {
+	c.log.Info("received control message", "from", usr.ID, "action", ctrl.Action, "target", ctrl.Target)
+
+	fail := func(reason string) {
+		in := inMessage{ToID: ctrl.Target}
+		if err := c.sendError(usr, "control_failed", reason, in, 0); err != nil {
+			c.log.Error("sending control failed frame failed", "err", err)
+		}
+	}
+
+	//every control message costs a write to the block lists, it is charged
+	//like a message.
+	if c.limiter != nil {
+		retryAfter, err := c.limiter.AllowControl(ctx, usr.ID)
+		if err != nil {
+			c.log.Error("control: rejected by limiter", "from", usr.ID, "err", err)
+
+			code := "control_failed"
+			switch {
+			case errors.Is(err, ErrRateLimited):
+				code = "rate_limited"
+			case errors.Is(err, ErrQuotaExceeded):
+				code = "quota_exceeded"
+			}
+
+			in := inMessage{ToID: ctrl.Target}
+			if err := c.sendError(usr, code, err.Error(), in, retryAfter); err != nil {
+				c.log.Error("sending throttled frame failed", "err", err)
+			}
+			return
+		}
+	}
+
+	signedData := struct {
+		Action    string
+		Target    common.Address
+		Timestamp int64
+	}{
+		Action:    ctrl.Action,
+		Target:    ctrl.Target,
+		Timestamp: ctrl.Timestamp,
+	}
+
+	from, err := signature.FromAddress(signedData, ctrl.V, ctrl.R, ctrl.S)
+	if err != nil {
+		c.log.Error("control: parsing signature failed", "err", err)
+		fail("invalid signature")
+		return
+	}
+
+	if from != usr.ID.Hex() {
+		c.log.Error("control: signature check failed")
+		fail("invalid signature")
+		return
+	}
+
+	at := time.Unix(0, ctrl.Timestamp)
+	if skew := time.Since(at).Abs(); skew > controlMaxSkew {
+		c.log.Error("control: timestamp out of range", "skew", skew)
+		fail("timestamp out of range, check your clock")
+		return
+	}
+
+	if c.blocks == nil {
+		fail("block lists are not supported")
+		return
+	}
+
+	switch ctrl.Action {
+	case ActionBlock:
+		err = c.blocks.Block(ctx, usr.ID, ctrl.Target, at)
+	case ActionUnblock:
+		err = c.blocks.Unblock(ctx, usr.ID, ctrl.Target, at)
+	default:
+		fail(fmt.Sprintf("unknown action %q", ctrl.Action))
+		return
+	}
+
+	if err != nil {
+		c.log.Error("control: applying action failed", "action", ctrl.Action, "err", err)
+		fail(fmt.Sprintf("%s failed", ctrl.Action))
+		return
+	}
+
+	ack := controlAckMessage{
+		Control: controlAck{
+			Action: ctrl.Action,
+			Target: ctrl.Target,
+		},
+	}
+
+	if err := usr.Conn.WriteJSON(ack); err != nil {
+		c.log.Error("control: sending ack failed", "err", err)
+	}
+}
+
 func (c *Chat) pong(usrID common.Address) func(appData string) error {
 	h := func(appData string) error {
 		usr, err := c.users.UpdateLastPong(usrID)
@@ -381,11 +621,13 @@ func (c *Chat) readMessage(ctx context.Context, usr User) ([]byte, error) {
 	}
 }
 
-func (c *Chat) sendMessage(from User, to User, fromNonce uint64, encrypted bool, msg []byte) error {
+func (c *Chat) sendMessage(msg Message, to User) error {
 	m := outMessage{
-		From:      outgoingUser{ID: from.ID, Name: from.Name, Nonce: fromNonce},
-		Text:      msg,
-		Encrypted: encrypted,
+		From:      outgoingUser{ID: msg.FromID, Name: msg.FromName, Nonce: msg.FromNonce},
+		Text:      msg.Text,
+		Scheme:    msg.Scheme,
+		Encrypted: msg.Scheme == schemeRSA,
+		Metadata:  msg.Metadata,
 	}
 
 	if err := to.Conn.WriteJSON(m); err != nil {
@@ -395,6 +637,25 @@ func (c *Chat) sendMessage(from User, to User, fromNonce uint64, encrypted bool,
 	return nil
 }
 
+// sendError lets the sender know its message was not delivered.
+func (c *Chat) sendError(usr User, code string, reason string, in inMessage, retryAfter time.Duration) error {
+	m := errorMessage{
+		Error: errorFrame{
+			Code:         code,
+			Message:      reason,
+			ToID:         in.ToID,
+			FromNonce:    in.FromNonce,
+			RetryAfterMS: retryAfter.Milliseconds(),
+		},
+	}
+
+	if err := usr.Conn.WriteJSON(m); err != nil {
+		return fmt.Errorf("writing message: %w", err)
+	}
+
+	return nil
+}
+
 func (c *Chat) sendMessageToBUS(ctx context.Context, msg busMessage) error {
 	bs, err := json.Marshal(msg)
 	if err != nil {
@@ -23,33 +23,88 @@ type outgoingUser struct {
 	Nonce uint64         `json:"nonce"`
 }
 
+// Actions supported by control messages.
+const (
+	ActionBlock   = "block"
+	ActionUnblock = "unblock"
+)
+
+// schemeRSA is the scheme of a message that only carries the encrypted flag
+// clients and CAPs sent before the scheme, the flag is still read and sent so
+// they keep working.
+const schemeRSA = "rsa"
+
+// legacyScheme returns the scheme of a message, encrypted is the legacy flag.
+func legacyScheme(scheme string, encrypted bool) string {
+	if scheme == "" && encrypted {
+		return schemeRSA
+	}
+	return scheme
+}
+
 type inMessage struct {
-	ToID      common.Address `json:"toID"`
-	Text      []byte         `json:"text"`
-	FromNonce uint64         `json:"fromNonce"`
-	Encrypted bool           `json:"encrypted"`
+	ToID      common.Address  `json:"toID"`
+	Text      []byte          `json:"text"`
+	FromNonce uint64          `json:"fromNonce"`
+	Scheme    string          `json:"scheme"`
+	Encrypted bool            `json:"encrypted,omitempty"`
+	V         *big.Int        `json:"v"`
+	R         *big.Int        `json:"r"`
+	S         *big.Int        `json:"s"`
+	Control   *controlMessage `json:"control,omitempty"`
+}
+
+type controlMessage struct {
+	Action    string         `json:"action"`
+	Target    common.Address `json:"target"`
+	Timestamp int64          `json:"timestamp"`
 	V         *big.Int       `json:"v"`
 	R         *big.Int       `json:"r"`
 	S         *big.Int       `json:"s"`
 }
 
+type controlAck struct {
+	Action string         `json:"action"`
+	Target common.Address `json:"target"`
+}
+
+type controlAckMessage struct {
+	Control controlAck `json:"control"`
+}
+
 type outMessage struct {
-	Encrypted bool         `json:"encrypted"`
-	From      outgoingUser `json:"from"`
-	Text      []byte       `json:"text"`
+	Scheme    string            `json:"scheme"`
+	Encrypted bool              `json:"encrypted,omitempty"`
+	From      outgoingUser      `json:"from"`
+	Text      []byte            `json:"text"`
+	Metadata  map[string]string `json:"metadata,omitempty"`
+}
+
+type errorFrame struct {
+	Code         string         `json:"code"`
+	Message      string         `json:"message"`
+	ToID         common.Address `json:"toID"`
+	FromNonce    uint64         `json:"fromNonce"`
+	RetryAfterMS int64          `json:"retryAfterMS"`
+}
+
+type errorMessage struct {
+	Error errorFrame `json:"error"`
 }
 
 type busMessage struct {
-	CapID     uuid.UUID      `json:"capID"`
-	FromID    common.Address `json:"fromID"`
-	FromName  string         `json:"fromName"`
-	ToID      common.Address `json:"toID"`
-	Text      []byte         `json:"text"`
-	FromNonce uint64         `json:"fromNonce"`
-	Encrypted bool           `json:"encrypted"`
-	V         *big.Int       `json:"v"`
-	R         *big.Int       `json:"r"`
-	S         *big.Int       `json:"s"`
+	CapID     uuid.UUID         `json:"capID"`
+	FromID    common.Address    `json:"fromID"`
+	FromName  string            `json:"fromName"`
+	ToID      common.Address    `json:"toID"`
+	Text      []byte            `json:"text"`
+	FromNonce uint64            `json:"fromNonce"`
+	Scheme    string            `json:"scheme"`
+	Encrypted bool              `json:"encrypted,omitempty"`
+	Metadata  map[string]string `json:"metadata,omitempty"`
+	V         *big.Int          `json:"v"`
+	R         *big.Int          `json:"r"`
+	S         *big.Int          `json:"s"`
 }
 
 type Connection struct {
@@ -0,0 +1,137 @@
+package chat
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// ErrDrop tells the pipeline to silently drop the message, the sender has
+// used up its nonce so the recipient sees a gap in the nonces and goes on.
+var ErrDrop = errors.New("message dropped")
+
+// RejectError tells the pipeline to drop the message and let the sender know
+// the reason.
+type RejectError struct {
+	Hook   string
+	Reason string
+}
+
+func Reject(hook string, format string, args ...any) *RejectError {
+	return &RejectError{
+		Hook:   hook,
+		Reason: fmt.Sprintf(format, args...),
+	}
+}
+
+func (e *RejectError) Error() string {
+	return fmt.Sprintf("rejected by %s: %s", e.Hook, e.Reason)
+}
+
+// Message is the view of a signed message that hooks work with, Text is the
+// payload exactly as the client sent it, so it can be encrypted. A message
+// goes through the pipeline once, on the CAP the sender is connected to.
+type Message struct {
+	FromID    common.Address
+	FromName  string
+	ToID      common.Address
+	Text      []byte
+	FromNonce uint64
+	Scheme    string
+	Metadata  map[string]string
+}
+
+// Hook is the base of every server-side plugin, a hook must implement at
+// least one of Filter, Enricher or Auditor to take part in the pipeline.
+type Hook interface {
+	Name() string
+}
+
+// Filter runs before routing, returning ErrDrop or a *RejectError stops the
+// message. Any other error is treated as a drop.
+type Filter interface {
+	Hook
+	Filter(ctx context.Context, msg Message) error
+}
+
+// Enricher runs after all the filters passed and can attach metadata.
+type Enricher interface {
+	Hook
+	Enrich(ctx context.Context, msg *Message) error
+}
+
+// Auditor sees every message with the final verdict, nil means the message
+// was routed.
+type Auditor interface {
+	Hook
+	Audit(ctx context.Context, msg Message, verdict error)
+}
+
+type pipeline struct {
+	filters   []Filter
+	enrichers []Enricher
+	auditors  []Auditor
+}
+
+func newPipeline(hooks []Hook) (pipeline, error) {
+	var p pipeline
+	for _, h := range hooks {
+		var used bool
+		if f, ok := h.(Filter); ok {
+			p.filters = append(p.filters, f)
+			used = true
+		}
+		if e, ok := h.(Enricher); ok {
+			p.enrichers = append(p.enrichers, e)
+			used = true
+		}
+		if a, ok := h.(Auditor); ok {
+			p.auditors = append(p.auditors, a)
+			used = true
+		}
+
+		if !used {
+			return pipeline{}, fmt.Errorf("hook %s does not implement Filter, Enricher or Auditor", h.Name())
+		}
+	}
+
+	return p, nil
+}
+
+// run passes the message through the filters and enrichers in registration
+// order, the returned error is the verdict.
+func (p pipeline) run(ctx context.Context, msg *Message) error {
+	if msg.Metadata == nil {
+		msg.Metadata = make(map[string]string)
+	}
+
+	verdict := p.process(ctx, msg)
+
+	for _, a := range p.auditors {
+		a.Audit(ctx, *msg, verdict)
+	}
+
+	return verdict
+}
+
+func (p pipeline) process(ctx context.Context, msg *Message) error {
+	for _, f := range p.filters {
+		if err := f.Filter(ctx, *msg); err != nil {
+			var rejectErr *RejectError
+			if errors.Is(err, ErrDrop) || errors.As(err, &rejectErr) {
+				return err
+			}
+			return fmt.Errorf("filter %s: %w: %w", f.Name(), ErrDrop, err)
+		}
+	}
+
+	for _, e := range p.enrichers {
+		if err := e.Enrich(ctx, msg); err != nil {
+			return fmt.Errorf("enricher %s: %w: %w", e.Name(), ErrDrop, err)
+		}
+	}
+
+	return nil
+}
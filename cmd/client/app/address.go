@@ -0,0 +1,33 @@
+package app
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// ParseAddress reads a hex address, a mixed case address has to match its
+// EIP-55 checksum so a mistyped one is caught.
+func ParseAddress(s string) (common.Address, error) {
+	s = strings.TrimSpace(s)
+
+	if !strings.HasPrefix(s, "0x") || !common.IsHexAddress(s) {
+		return common.Address{}, fmt.Errorf("invalid address %q", s)
+	}
+
+	id := common.HexToAddress(s)
+
+	//an address in a single case carries no checksum.
+	hex := s[2:]
+	if hex != strings.ToLower(hex) && hex != strings.ToUpper(hex) && id.Hex() != s {
+		return common.Address{}, fmt.Errorf("invalid checksum of address %s, did you mean %s?", s, id.Hex())
+	}
+
+	if id == (common.Address{}) {
+		return common.Address{}, errors.New("the zero address is not valid")
+	}
+
+	return id, nil
+}
@@ -0,0 +1,36 @@
+package app_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/hamidoujand/echo/cmd/client/app"
+)
+
+func Test_ParseAddress(t *testing.T) {
+	const checksummed = "0x5aAeb6053F3E94C9b9A09f33669435E7Ef1BeAed"
+
+	for _, s := range []string{checksummed, strings.ToLower(checksummed), "0x" + strings.ToUpper(checksummed[2:])} {
+		id, err := app.ParseAddress(s)
+		if err != nil {
+			t.Fatalf("Should be able to parse %s: %s", s, err)
+		}
+
+		if id.Hex() != checksummed {
+			t.Fatalf("Should parse %s: got %s, exp %s", s, id.Hex(), checksummed)
+		}
+	}
+
+	invalid := []string{
+		"0x5aAeb6053F3E94C9b9A09f33669435E7Ef1BeAeD",
+		"5aAeb6053F3E94C9b9A09f33669435E7Ef1BeAed",
+		"0x5aaeb6053f3e94c9b9a09f33669435e7ef1bea",
+		"0x0000000000000000000000000000000000000000",
+	}
+
+	for _, s := range invalid {
+		if _, err := app.ParseAddress(s); err == nil {
+			t.Fatalf("Should not accept %s", s)
+		}
+	}
+}
@@ -2,14 +2,22 @@ package app
 
 import (
 	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/gdamore/tcell/v2"
 	"github.com/rivo/tview"
 )
 
+// historyPageSize is the number of messages loaded at a time.
+const historyPageSize = 50
+
 type App struct {
 	app      *tview.Application
+	pages    *tview.Pages
 	flex     *tview.Flex
 	textView *tview.TextView
 	button   *tview.Button
@@ -17,9 +25,34 @@ type App struct {
 	textArea *tview.TextArea
 	client   *Client
 	db       *Database
+	commands *commandSet
+
+	// the unlocked profiles, active is the one on screen.
+	mu       sync.Mutex
+	sessions []*Session
+	active   *Session
+	root     string
+	open     OpenProfile
+
+	// notifyCmd is how new messages are notified, it is guarded by mu. bell
+	// is set until the next draw rings it.
+	notifyCmd string
+	bell      atomic.Bool
+
+	// the conversation on screen, oldest and newest are the positions of
+	// the messages in the history around it and match is the position of a
+	// search result, -1 without one.
+	shown    common.Address
+	messages []message
+	oldest   int
+	newest   int
+	latest   bool
+	match    int
 }
 
-func New(client *Client, db *Database) *App {
+// New creates the UI of the session s, the other profiles under root are
+// unlocked with open.
+func New(s *Session, root string, open OpenProfile) *App {
 
 	app := tview.NewApplication()
 
@@ -32,45 +65,17 @@ func New(client *Client, db *Database) *App {
 		})
 
 	textView.SetBorder(true)
-	textView.SetTitle(fmt.Sprintf("*** %s ***", db.MyAccount().ID))
 	// -------------------------------------------------------------------------
 
 	list := tview.NewList()
 	list.SetBorder(true)
 	list.SetTitle("Users")
-	list.SetChangedFunc(func(index int, name, id string, shortcut rune) {
-		textView.Clear()
-
-		commonID := common.HexToAddress(id)
-
-		usr, err := db.LookupContact(commonID)
-		if err != nil {
-			textView.ScrollToEnd()
-			fmt.Fprintln(textView, "--------------------------------------")
-			fmt.Fprintln(textView, "system: "+err.Error())
-			return
-		}
-		for i, msg := range usr.Messages {
-			fmt.Fprintln(textView, string(msg.Text))
-			if i < len(usr.Messages)-1 {
-				fmt.Fprintln(textView, "--------------------------------------")
-			}
-		}
-
-		list.SetItemText(index, usr.Name, usr.ID.String())
-	})
-
-	users := db.Contacts()
-	for i, c := range users {
-		shortcut := rune(i + 49)
-		list.AddItem(c.Name, c.ID.Hex(), shortcut, nil)
-	}
 
 	// -------------------------------------------------------------------------
 
 	button := tview.NewButton("SUBMIT")
-	button.SetStyle(tcell.StyleDefault.Background(tcell.ColorBlack).Foreground(tcell.ColorGreen).Bold(true))
-	button.SetActivatedStyle(tcell.StyleDefault.Background(tcell.ColorBlack).Foreground(tcell.ColorGreen).Bold(true))
+	button.SetStyle(tcell.StyleDefault.Background(tview.Styles.PrimitiveBackgroundColor).Foreground(tcell.ColorGreen).Bold(true))
+	button.SetActivatedStyle(tcell.StyleDefault.Background(tview.Styles.PrimitiveBackgroundColor).Foreground(tcell.ColorGreen).Bold(true))
 	button.SetBorder(true)
 	button.SetBorderPadding(0, 1, 0, 0)
 	button.SetBorderColor(tcell.ColorGreen)
@@ -97,33 +102,767 @@ func New(client *Client, db *Database) *App {
 				0, 1, false),
 			0, 1, false)
 
+	pages := tview.NewPages().
+		AddPage("main", flex, true, true)
+
+	a := &App{
+		app:       app,
+		pages:     pages,
+		flex:      flex,
+		textView:  textView,
+		button:    button,
+		textArea:  textArea,
+		client:    s.Client,
+		list:      list,
+		db:        s.DB,
+		sessions:  []*Session{s},
+		active:    s,
+		root:      root,
+		open:      open,
+		commands:  defaultCommands(),
+		notifyCmd: NotifyBell,
+	}
+
+	app.SetBeforeDrawFunc(func(screen tcell.Screen) bool {
+		if a.bell.Swap(false) {
+			screen.Beep()
+		}
+		return false
+	})
+
 	flex.SetInputCapture(func(event *tcell.EventKey) *tcell.EventKey {
 		switch event.Key() {
 		case tcell.KeyEscape, tcell.KeyCtrlQ:
 			app.Stop()
 			return nil
+		case tcell.KeyCtrlB:
+			a.showBlocked()
+			return nil
+		case tcell.KeyCtrlR:
+			a.showRequests()
+			return nil
+		case tcell.KeyCtrlF:
+			a.showSearch()
+			return nil
+		case tcell.KeyCtrlP:
+			a.showProfiles()
+			return nil
 		}
 		return event
 	})
 
-	a := &App{
-		app:      app,
-		flex:     flex,
-		textView: textView,
-		button:   button,
-		textArea: textArea,
-		client:   client,
-		list:     list,
-		db:       db,
-	}
+	list.SetChangedFunc(a.openContact)
+
+	a.loadContacts()
+	a.updateTitle()
+
+	//more messages are loaded when scrolling past the top or the bottom.
+	textView.SetInputCapture(func(event *tcell.EventKey) *tcell.EventKey {
+		switch event.Key() {
+		case tcell.KeyUp, tcell.KeyPgUp, tcell.KeyHome:
+			if row, _ := textView.GetScrollOffset(); row == 0 {
+				a.loadOlder()
+			}
+		case tcell.KeyDown, tcell.KeyPgDn, tcell.KeyEnd:
+			if a.atBottom() {
+				a.loadNewer()
+			}
+		}
+		return event
+	})
+
+	textView.SetMouseCapture(func(action tview.MouseAction, event *tcell.EventMouse) (tview.MouseAction, *tcell.EventMouse) {
+		switch action {
+		case tview.MouseScrollUp:
+			if row, _ := textView.GetScrollOffset(); row == 0 {
+				a.loadOlder()
+			}
+		case tview.MouseScrollDown:
+			if a.atBottom() {
+				a.loadNewer()
+			}
+		}
+		return action, event
+	})
+
+	textArea.SetInputCapture(func(event *tcell.EventKey) *tcell.EventKey {
+		if event.Key() == tcell.KeyTab && a.completeCommand() {
+			return nil
+		}
+		return event
+	})
 
 	button.SetSelectedFunc(a.buttonHandler)
 
 	return a
 }
 
+// loadContacts fills the contact list of the profile on screen.
+func (a *App) loadContacts() {
+	a.list.Clear()
+	for i, c := range a.db.Contacts() {
+		shortcut := rune(i + 49)
+		a.list.AddItem(displayName(c), c.ID.Hex(), shortcut, nil)
+	}
+}
+
+// openContact shows the conversation of the contact selected in the list,
+// its messages are read from now on.
+func (a *App) openContact(index int, name string, idStr string, shortcut rune) {
+	id := common.HexToAddress(idStr)
+	a.showHistory(id)
+
+	if err := a.db.MarkRead(id); err != nil {
+		a.WriteMessage("system", systemErrorMessage("marking the messages read failed: %s", err))
+	}
+
+	if usr, err := a.db.LookupContact(id); err == nil {
+		a.list.SetItemText(index, displayName(usr), usr.ID.String())
+	}
+}
+
+// sortContacts puts the contact list in the order of the database again,
+// the selected contact stays selected without loading its conversation
+// again.
+func (a *App) sortContacts() {
+	contacts := a.db.Contacts()
+	if len(contacts) != a.list.GetItemCount() {
+		return
+	}
+
+	selected, _ := a.selectedContact()
+
+	a.list.SetChangedFunc(nil)
+	defer a.list.SetChangedFunc(a.openContact)
+
+	for i, c := range contacts {
+		a.list.SetItemText(i, displayName(c), c.ID.Hex())
+		if c.ID == selected {
+			a.list.SetCurrentItem(i)
+		}
+	}
+}
+
+// showHistory shows the last page of the conversation with id.
+func (a *App) showHistory(id common.Address) {
+	a.shown = id
+	a.messages = nil
+	a.oldest, a.newest = 0, 0
+	a.latest = true
+	a.match = -1
+
+	msgs, start, err := a.db.History(id, -1, historyPageSize)
+	if err != nil {
+		a.textView.Clear()
+		fmt.Fprintln(a.textView, "--------------------------------------")
+		fmt.Fprintln(a.textView, "system: "+err.Error())
+		return
+	}
+
+	a.messages = msgs
+	a.oldest = start
+	a.newest = start + len(msgs)
+	a.renderHistory()
+	a.textView.ScrollToEnd()
+}
+
+// showHistoryAt shows the page around the message at pos and scrolls to it.
+func (a *App) showHistoryAt(id common.Address, pos int) {
+	a.showHistory(id)
+
+	//the message is on the last page already.
+	if pos >= a.oldest {
+		a.match = pos
+		a.renderHistory()
+		a.textView.ScrollTo(a.rowOf(pos), 0)
+		return
+	}
+
+	msgs, start, err := a.db.History(id, pos+1+historyPageSize/2, historyPageSize)
+	if err != nil {
+		a.WriteMessage("system", systemErrorMessage("loading the message failed: %s", err))
+		return
+	}
+
+	a.messages = msgs
+	a.oldest = start
+	a.newest = start + len(msgs)
+	a.latest = false
+	a.match = pos
+	a.renderHistory()
+	a.textView.ScrollTo(a.rowOf(pos), 0)
+}
+
+// loadOlder puts the page before the first message on screen above it.
+func (a *App) loadOlder() {
+	if a.oldest == 0 {
+		return
+	}
+
+	msgs, start, err := a.db.History(a.shown, a.oldest, historyPageSize)
+	if err != nil {
+		a.WriteMessage("system", systemErrorMessage("loading older messages failed: %s", err))
+		return
+	}
+
+	//keep the message that was at the top in place.
+	top := a.oldest
+
+	a.messages = append(msgs, a.messages...)
+	a.oldest = start
+	a.renderHistory()
+	a.textView.ScrollTo(a.rowOf(top), 0)
+}
+
+// loadNewer puts the page after the last message on screen below it, until
+// the conversation is back at its newest message.
+func (a *App) loadNewer() {
+	if a.latest {
+		return
+	}
+
+	msgs, start, err := a.db.History(a.shown, a.newest+historyPageSize, historyPageSize)
+	if err != nil {
+		a.WriteMessage("system", systemErrorMessage("loading newer messages failed: %s", err))
+		return
+	}
+
+	//the page is cut at the end of the history, it may overlap.
+	if start < a.newest {
+		msgs = msgs[min(a.newest-start, len(msgs)):]
+	}
+
+	if len(msgs) < historyPageSize {
+		a.latest = true
+	}
+
+	row, _ := a.textView.GetScrollOffset()
+
+	a.messages = append(a.messages, msgs...)
+	a.newest += len(msgs)
+	a.renderHistory()
+	a.textView.ScrollTo(row, 0)
+}
+
+func (a *App) renderHistory() {
+	a.textView.Clear()
+
+	if usr, err := a.db.LookupContact(a.shown); err == nil && usr.FormerName != "" {
+		fmt.Fprintf(a.textView, "%s, formerly known as %s\n", usr.Name, usr.FormerName)
+	}
+
+	if a.oldest > 0 {
+		fmt.Fprintln(a.textView, "... scroll up for older messages ...")
+	}
+
+	for i, msg := range a.messages {
+		fmt.Fprintln(a.textView, "--------------------------------------")
+
+		prefix := ""
+		if a.oldest+i == a.match {
+			prefix = ">> "
+		}
+		fmt.Fprintf(a.textView, "%s%s: %s\n", prefix, msg.Name, string(msg.Text))
+	}
+
+	if !a.latest {
+		fmt.Fprintln(a.textView, "... scroll down for newer messages ...")
+	}
+}
+
+// rowOf returns the row the message at pos starts on. Long lines wrap, so
+// it is only close enough to scroll to.
+func (a *App) rowOf(pos int) int {
+	var row int
+	if a.oldest > 0 {
+		row++
+	}
+
+	for i := range min(pos-a.oldest, len(a.messages)) {
+		row += 2 + strings.Count(string(a.messages[i].Text), "\n")
+	}
+
+	return row
+}
+
+func (a *App) atBottom() bool {
+	row, _ := a.textView.GetScrollOffset()
+	_, _, _, height := a.textView.GetInnerRect()
+	return row+height >= a.textView.GetOriginalLineCount()
+}
+
 func (a *App) Run() error {
-	return a.app.SetRoot(a.flex, true).EnableMouse(true).Run()
+	return a.app.SetRoot(a.pages, true).EnableMouse(true).Run()
+}
+
+// showBlocked opens the blocked contacts view, selecting a contact unblocks it.
+func (a *App) showBlocked() {
+	const page = "blocked"
+
+	list := tview.NewList()
+	list.SetBorder(true)
+	list.SetTitle("Blocked (enter: unblock, esc: close)")
+
+	for _, id := range a.db.Blocked() {
+		name := "unknown"
+		if usr, err := a.db.LookupContact(id); err == nil {
+			name = usr.Name
+		}
+		list.AddItem(name, id.Hex(), 0, nil)
+	}
+
+	if list.GetItemCount() == 0 {
+		list.AddItem("no blocked contacts", "", 0, nil)
+	}
+
+	list.SetSelectedFunc(func(index int, name, id string, shortcut rune) {
+		if id == "" {
+			return
+		}
+
+		a.closeModal(page)
+		if err := a.client.SendControl(actionUnblock, common.HexToAddress(id)); err != nil {
+			a.WriteMessage("system", systemErrorMessage("unblock failed: %s", err))
+		}
+	})
+
+	list.SetInputCapture(func(event *tcell.EventKey) *tcell.EventKey {
+		if event.Key() == tcell.KeyEscape {
+			a.closeModal(page)
+			return nil
+		}
+		return event
+	})
+
+	a.showModal(page, list, 60, 20)
+}
+
+func (a *App) selectedContact() (common.Address, bool) {
+	if a.list.GetItemCount() == 0 {
+		return common.Address{}, false
+	}
+
+	_, id := a.list.GetItemText(a.list.GetCurrentItem())
+	if !common.IsHexAddress(id) {
+		return common.Address{}, false
+	}
+
+	return common.HexToAddress(id), true
+}
+
+// showVerify shows the safety number of the conversation with id, the user
+// compares it with the contact over a trusted channel.
+func (a *App) showVerify(id common.Address) {
+	const page = "verify"
+
+	const (
+		verified = "Mark as verified"
+		cancel   = "Cancel"
+	)
+
+	usr, err := a.db.LookupContact(id)
+	if err != nil {
+		a.WriteMessage("system", systemErrorMessage("verify failed: %s", err))
+		return
+	}
+
+	if len(usr.Key) == 0 && len(usr.PendingKey) == 0 {
+		a.WriteMessage("system", systemErrorMessage("%s has no key yet, there is nothing to verify", usr.Name))
+		return
+	}
+
+	me := a.db.MyAccount()
+
+	var text strings.Builder
+	if len(usr.Key) != 0 {
+		number := safetyNumber(me.ID, []byte(a.client.id.RSAPublicKey), usr.ID, usr.Key)
+		fmt.Fprintf(&text, "Safety number with %s\n\n%s\n\n", usr.Name, number)
+		fmt.Fprintf(&text, "Their key: %s\n", keyFingerprint(usr.Key))
+	}
+	if usr.InviteKey != "" {
+		fmt.Fprintf(&text, "Key in their invite: %s\n", usr.InviteKey)
+	}
+	if len(usr.PendingKey) != 0 {
+		fmt.Fprintf(&text, "New key (pending): %s\n", keyFingerprint(usr.PendingKey))
+		number := safetyNumber(me.ID, []byte(a.client.id.RSAPublicKey), usr.ID, usr.PendingKey)
+		fmt.Fprintf(&text, "Safety number with the new key\n\n%s\n", number)
+	}
+	text.WriteString("\nCompare it with your contact in person or over a call.")
+
+	modal := tview.NewModal().
+		SetText(text.String()).
+		AddButtons([]string{verified, cancel}).
+		SetDoneFunc(func(buttonIndex int, buttonLabel string) {
+			a.pages.RemovePage(page)
+			a.app.SetFocus(a.textArea)
+
+			if buttonLabel != verified {
+				return
+			}
+
+			if err := a.db.SetVerified(id, true); err != nil {
+				a.WriteMessage("system", systemErrorMessage("verify failed: %s", err))
+				return
+			}
+			a.refreshContact(id)
+			a.WriteMessage("system", systemErrorMessage("%s is verified", usr.Name))
+		})
+
+	a.pages.AddPage(page, modal, true, true)
+	a.app.SetFocus(modal)
+}
+
+// refreshContact redraws the list item of the contact.
+func (a *App) refreshContact(id common.Address) {
+	usr, err := a.db.LookupContact(id)
+	if err != nil {
+		return
+	}
+
+	for i := range a.list.GetItemCount() {
+		_, idStr := a.list.GetItemText(i)
+		if idStr == id.Hex() {
+			a.list.SetItemText(i, displayName(usr), idStr)
+			return
+		}
+	}
+}
+
+// RefreshContact redraws the contact id after it changed.
+func (a *App) RefreshContact(id string) {
+	a.refreshContact(common.HexToAddress(id))
+	a.app.Draw()
+}
+
+// displayName decorates the contact name with its trust state, whether it
+// is pinned or muted and its unread messages.
+func displayName(usr User) string {
+	name := usr.Name
+	switch {
+	case len(usr.PendingKey) != 0:
+		name = "! " + name
+	case usr.Verified:
+		name = "✓ " + name
+	}
+
+	if usr.Pinned {
+		name = "★ " + name
+	}
+	if usr.Muted {
+		name += " [m]"
+	}
+	if usr.Unread > 0 {
+		name += fmt.Sprintf(" (%d)", usr.Unread)
+	}
+
+	return name
+}
+
+// showFindResults lists the directory search results, selecting one adds it
+// to the contacts.
+func (a *App) showFindResults(query string, profiles []directoryProfile) {
+	const page = "find"
+
+	list := tview.NewList()
+	list.SetBorder(true)
+	list.SetTitle(fmt.Sprintf("Results for %q (enter: add, esc: close)", query))
+
+	for _, p := range profiles {
+		secondary := p.ID.Hex()
+		if p.Avatar != "" {
+			secondary = p.Avatar + "  " + secondary
+		}
+		list.AddItem(p.Name, secondary, 0, nil)
+	}
+
+	if len(profiles) == 0 {
+		list.AddItem("no results", "", 0, nil)
+	}
+
+	list.SetSelectedFunc(func(index int, name, secondary string, shortcut rune) {
+		if index >= len(profiles) {
+			return
+		}
+
+		a.closeModal(page)
+		a.addContact(profiles[index].ID, profiles[index].Name, []byte(profiles[index].Key))
+	})
+
+	list.SetInputCapture(func(event *tcell.EventKey) *tcell.EventKey {
+		if event.Key() == tcell.KeyEscape {
+			a.closeModal(page)
+			return nil
+		}
+		return event
+	})
+
+	a.showModal(page, list, 80, 20)
+}
+
+// showSearch opens the search form, the results are listed in their own
+// view.
+func (a *App) showSearch() {
+	const page = "search"
+
+	const (
+		textLabel    = "Text"
+		contactLabel = "Contact"
+		fromLabel    = "From (YYYY-MM-DD)"
+		toLabel      = "To (YYYY-MM-DD)"
+	)
+
+	contacts := a.db.Contacts()
+	options := []string{"All contacts"}
+	for _, c := range contacts {
+		options = append(options, c.Name)
+	}
+
+	form := tview.NewForm().
+		AddInputField(textLabel, "", 40, nil, nil).
+		AddDropDown(contactLabel, options, 0, nil).
+		AddInputField(fromLabel, "", 12, nil, nil).
+		AddInputField(toLabel, "", 12, nil, nil)
+
+	form.AddButton("Search", func() {
+		q := SearchQuery{
+			Text: form.GetFormItemByLabel(textLabel).(*tview.InputField).GetText(),
+		}
+
+		if i, _ := form.GetFormItemByLabel(contactLabel).(*tview.DropDown).GetCurrentOption(); i > 0 {
+			q.Contacts = []common.Address{contacts[i-1].ID}
+		}
+
+		var err error
+		if q.From, err = parseDate(form.GetFormItemByLabel(fromLabel).(*tview.InputField).GetText()); err != nil {
+			a.WriteMessage("system", systemErrorMessage("invalid from date: %s", err))
+			return
+		}
+
+		if q.To, err = parseDate(form.GetFormItemByLabel(toLabel).(*tview.InputField).GetText()); err != nil {
+			a.WriteMessage("system", systemErrorMessage("invalid to date: %s", err))
+			return
+		}
+
+		//the whole last day is included.
+		if !q.To.IsZero() {
+			q.To = q.To.AddDate(0, 0, 1).Add(-time.Second)
+		}
+
+		results, err := a.db.Search(q)
+		if err != nil {
+			a.WriteMessage("system", systemErrorMessage("search failed: %s", err))
+			return
+		}
+
+		a.closeModal(page)
+		a.showSearchResults(q.Text, results)
+	})
+
+	form.AddButton("Cancel", func() {
+		a.closeModal(page)
+	})
+
+	form.SetCancelFunc(func() {
+		a.closeModal(page)
+	})
+
+	form.SetBorder(true)
+	form.SetTitle("Search messages (esc: close)")
+
+	a.showModal(page, form, 70, 13)
+}
+
+// showSearchResults lists the messages found, selecting one shows it in the
+// conversation.
+func (a *App) showSearchResults(query string, results []SearchResult) {
+	const page = "results"
+
+	list := tview.NewList()
+	list.SetBorder(true)
+	list.SetTitle(fmt.Sprintf("%d results for %q (enter: show, esc: close)", len(results), query))
+
+	for _, r := range results {
+		name := r.Contact.Hex()
+		if usr, err := a.db.LookupContact(r.Contact); err == nil {
+			name = usr.Name
+		}
+
+		main := fmt.Sprintf("%s, %s", name, r.Message.Timestamp.Format("2006-01-02 15:04"))
+		list.AddItem(main, snippet(string(r.Message.Text), 70), 0, nil)
+	}
+
+	if len(results) == 0 {
+		list.AddItem("no results", "", 0, nil)
+	}
+
+	list.SetSelectedFunc(func(index int, main, secondary string, shortcut rune) {
+		if index >= len(results) {
+			return
+		}
+
+		a.closeModal(page)
+		a.jumpTo(results[index])
+	})
+
+	list.SetInputCapture(func(event *tcell.EventKey) *tcell.EventKey {
+		if event.Key() == tcell.KeyEscape {
+			a.closeModal(page)
+			return nil
+		}
+		return event
+	})
+
+	a.showModal(page, list, 80, 20)
+}
+
+// jumpTo selects the contact of r and shows the message in its conversation.
+func (a *App) jumpTo(r SearchResult) {
+	for i := range a.list.GetItemCount() {
+		_, id := a.list.GetItemText(i)
+		if id == r.Contact.Hex() {
+			a.list.SetCurrentItem(i)
+			break
+		}
+	}
+
+	a.showHistoryAt(r.Contact, r.Position)
+}
+
+func parseDate(s string) (time.Time, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return time.Time{}, nil
+	}
+
+	return time.ParseInLocation(time.DateOnly, s, time.Local)
+}
+
+// snippet returns the first line of text, cut at n characters.
+func snippet(text string, n int) string {
+	text, _, _ = strings.Cut(text, "\n")
+
+	runes := []rune(text)
+	if len(runes) > n {
+		return string(runes[:n]) + "..."
+	}
+
+	return text
+}
+
+// UpdateRequests refreshes the pending requests counter.
+func (a *App) UpdateRequests() {
+	title := "Users"
+	if n := len(a.db.Requests()); n > 0 {
+		title = fmt.Sprintf("Users (%d requests)", n)
+	}
+
+	a.list.SetTitle(title)
+	a.app.Draw()
+}
+
+// showRequests opens the contact requests inbox.
+func (a *App) showRequests() {
+	const page = "requests"
+
+	list := tview.NewList()
+	list.SetBorder(true)
+	list.SetTitle("Contact requests (enter: review, esc: close)")
+
+	for _, req := range a.db.Requests() {
+		secondary := fmt.Sprintf("%s, %d messages", req.ID.Hex(), len(req.Messages))
+		list.AddItem(req.Name, secondary, 0, nil)
+	}
+
+	if list.GetItemCount() == 0 {
+		list.AddItem("no contact requests", "", 0, nil)
+	}
+
+	list.SetSelectedFunc(func(index int, name, secondary string, shortcut rune) {
+		reqs := a.db.Requests()
+		if index >= len(reqs) {
+			return
+		}
+
+		a.closeModal(page)
+		a.reviewRequest(reqs[index])
+	})
+
+	list.SetInputCapture(func(event *tcell.EventKey) *tcell.EventKey {
+		if event.Key() == tcell.KeyEscape {
+			a.closeModal(page)
+			return nil
+		}
+		return event
+	})
+
+	a.showModal(page, list, 70, 20)
+}
+
+func (a *App) reviewRequest(req Request) {
+	const page = "review"
+
+	const (
+		accept       = "Accept"
+		decline      = "Decline"
+		declineBlock = "Decline & Block"
+		cancel       = "Cancel"
+	)
+
+	var text strings.Builder
+	fmt.Fprintf(&text, "%s\n%s\n", req.Name, req.ID.Hex())
+	for _, msg := range req.Messages {
+		fmt.Fprintf(&text, "\n%s", string(msg.Text))
+	}
+
+	modal := tview.NewModal().
+		SetText(text.String()).
+		AddButtons([]string{accept, decline, declineBlock, cancel}).
+		SetDoneFunc(func(buttonIndex int, buttonLabel string) {
+			a.pages.RemovePage(page)
+			a.app.SetFocus(a.textArea)
+
+			switch buttonLabel {
+			case accept:
+				usr, err := a.acceptRequest(req.ID)
+				if err != nil {
+					a.WriteMessage("system", systemErrorMessage("accept request failed: %s", err))
+					return
+				}
+				a.UpdateContact(usr.ID.Hex(), usr.Name)
+			case decline:
+				a.db.DeclineRequest(req.ID)
+			case declineBlock:
+				a.db.DeclineRequest(req.ID)
+				if err := a.client.SendControl(actionBlock, req.ID); err != nil {
+					a.WriteMessage("system", systemErrorMessage("block failed: %s", err))
+				}
+			}
+
+			a.UpdateRequests()
+		})
+
+	a.pages.AddPage(page, modal, true, true)
+	a.app.SetFocus(modal)
+}
+
+func (a *App) showModal(name string, p tview.Primitive, width, height int) {
+	modal := tview.NewFlex().
+		AddItem(nil, 0, 1, false).
+		AddItem(tview.NewFlex().
+			SetDirection(tview.FlexRow).
+			AddItem(nil, 0, 1, false).
+			AddItem(p, height, 1, true).
+			AddItem(nil, 0, 1, false),
+			width, 1, true).
+		AddItem(nil, 0, 1, false)
+
+	a.pages.AddPage(name, modal, true, true)
+	a.app.SetFocus(p)
+}
+
+func (a *App) closeModal(name string) {
+	a.pages.RemovePage(name)
+	a.app.SetFocus(a.textArea)
 }
 
 func (a *App) WriteMessage(id string, msg message) {
@@ -143,35 +882,47 @@ func (a *App) WriteMessage(id string, msg message) {
 		}
 
 		if id == currentID {
-			fmt.Fprintln(a.textView, "--------------------------------------")
-			fmt.Fprintf(a.textView, "%s: %s\n", msg.Name, string(msg.Text))
-			return
-		}
+			if err := a.db.MarkRead(common.HexToAddress(id)); err != nil {
+				a.WriteMessage("system", systemErrorMessage("marking the messages read failed: %s", err))
+			}
+			a.sortContacts()
 
-		for i := range a.list.GetItemCount() {
-			name, idStr := a.list.GetItemText(i)
-			if idStr == id {
-				a.list.SetItemText(i, "* "+name, idStr)
-				a.app.Draw()
+			//the message is loaded with the newer ones when scrolling down.
+			if !a.latest {
 				return
 			}
+
+			a.messages = append(a.messages, msg)
+			a.newest++
+			fmt.Fprintln(a.textView, "--------------------------------------")
+			fmt.Fprintf(a.textView, "%s: %s\n", msg.Name, string(msg.Text))
+			return
 		}
 
+		//the contact moves up with its unread messages.
+		a.sortContacts()
+		a.app.Draw()
 	}
 
 }
 
 func (a *App) buttonHandler() {
-	if len(a.db.contacts) == 0 {
+	msg := a.textArea.GetText()
+	if msg == "" {
 		return
 	}
-	_, receiverID := a.list.GetItemText(a.list.GetCurrentItem())
 
-	msg := a.textArea.GetText()
-	if msg == "" {
+	if strings.HasPrefix(strings.TrimSpace(msg), "/") {
+		a.runCommand(msg)
+		a.textArea.SetText("", false)
 		return
 	}
 
+	if len(a.db.contacts) == 0 {
+		return
+	}
+	_, receiverID := a.list.GetItemText(a.list.GetCurrentItem())
+
 	id := common.HexToAddress(receiverID)
 
 	if err := a.client.Send(id, []byte(msg)); err != nil {
@@ -190,3 +941,26 @@ func (a *App) UpdateContact(id string, name string) {
 	shortcut := rune(a.list.GetItemCount() + 49)
 	a.list.AddItem(name, id, shortcut, nil)
 }
+
+// MoveContact points the list item of a contact that changed its address to
+// the new one.
+func (a *App) MoveContact(from string, to string) {
+	for i := range a.list.GetItemCount() {
+		_, idStr := a.list.GetItemText(i)
+		if idStr != from {
+			continue
+		}
+
+		usr, err := a.db.LookupContact(common.HexToAddress(to))
+		if err != nil {
+			return
+		}
+		a.list.SetItemText(i, displayName(usr), to)
+
+		if a.shown == common.HexToAddress(from) {
+			a.showHistory(usr.ID)
+		}
+		a.app.Draw()
+		return
+	}
+}
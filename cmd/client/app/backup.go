@@ -0,0 +1,455 @@
+package app
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"maps"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// A backup is a tar.gz of the private keys in plaintext and the database
+// files as they are on disk, sealed like a key file with the backup
+// passphrase. The manifest holds a SHA-256 of every file, a backup is checked
+// completely before anything is restored.
+
+const (
+	backupVersion  = 1
+	backupManifest = "manifest.json"
+	backupKeysDir  = "keys"
+	backupDBDir    = "db"
+)
+
+// Restore actions.
+const (
+	ActionCreate    = "create"
+	ActionOverwrite = "overwrite"
+	ActionUnchanged = "unchanged"
+	ActionDelete    = "delete"
+)
+
+// BackupManifest describes the content of a backup.
+type BackupManifest struct {
+	Version int            `json:"version"`
+	Address common.Address `json:"address"`
+	Created time.Time      `json:"created"`
+	History bool           `json:"history"`
+	Files   []BackupFile   `json:"files"`
+}
+
+type BackupFile struct {
+	Name   string `json:"name"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// RestoreReport tells what a restore changes in the configuration directory.
+type RestoreReport struct {
+	Manifest BackupManifest
+	// ReplacesIdentity is set when the directory has an identity already.
+	ReplacesIdentity bool
+	Changes          []RestoreChange
+}
+
+type RestoreChange struct {
+	Name   string
+	Action string
+}
+
+// backupKeys are the files of the id directory in a backup.
+var backupKeys = []string{idFilename, encryptionFilename, dhFilename, dataKeyFilename}
+
+// WriteBackup writes a backup of the identity and the database in confDir
+// to w. The keys are opened with passphrase and the backup is sealed with
+// backupPassphrase, the histories are only included when history is set.
+func WriteBackup(w io.Writer, confDir string, passphrase []byte, backupPassphrase []byte, history bool) (BackupManifest, error) {
+	if len(backupPassphrase) == 0 {
+		return BackupManifest{}, errors.New("backup passphrase can not be empty")
+	}
+
+	files := make(map[string][]byte)
+
+	for _, name := range backupKeys {
+		data, err := os.ReadFile(filepath.Join(confDir, "id", name))
+		if err != nil {
+			return BackupManifest{}, fmt.Errorf("reading key file: %w", err)
+		}
+
+		if !isSealed(data) {
+			return BackupManifest{}, fmt.Errorf("key file %s is not protected by a passphrase yet, start the client once", name)
+		}
+
+		raw, err := openKey(data, passphrase)
+		if err != nil {
+			return BackupManifest{}, fmt.Errorf("%s: %w", name, err)
+		}
+		files[path.Join(backupKeysDir, name)] = raw
+	}
+
+	address, _, err := readKeyID(files[path.Join(backupKeysDir, idFilename)])
+	if err != nil {
+		return BackupManifest{}, fmt.Errorf("readKeyID: %w", err)
+	}
+
+	dbFiles, err := databaseFiles(confDir)
+	if err != nil {
+		return BackupManifest{}, err
+	}
+
+	for _, rel := range dbFiles {
+		if isHistoryFile(rel) && !history {
+			continue
+		}
+
+		//the indexes are built again from the histories.
+		if strings.HasSuffix(rel, historyIndexExt) {
+			continue
+		}
+
+		data, err := os.ReadFile(filepath.Join(confDir, rel))
+		if err != nil {
+			return BackupManifest{}, fmt.Errorf("read %s: %w", rel, err)
+		}
+		files[path.Join(backupDBDir, filepath.ToSlash(rel))] = data
+	}
+
+	manifest := BackupManifest{
+		Version: backupVersion,
+		Address: address,
+		Created: time.Now().UTC(),
+		History: history,
+	}
+
+	names := slices.Sorted(maps.Keys(files))
+
+	for _, name := range names {
+		sum := sha256.Sum256(files[name])
+		manifest.Files = append(manifest.Files, BackupFile{
+			Name:   name,
+			Size:   int64(len(files[name])),
+			SHA256: hex.EncodeToString(sum[:]),
+		})
+	}
+
+	jsn, err := json.Marshal(manifest)
+	if err != nil {
+		return BackupManifest{}, fmt.Errorf("marshal manifest: %w", err)
+	}
+	files[backupManifest] = jsn
+	names = append([]string{backupManifest}, names...)
+
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+
+	for _, name := range names {
+		hdr := tar.Header{
+			Name:    name,
+			Mode:    0600,
+			Size:    int64(len(files[name])),
+			ModTime: manifest.Created,
+		}
+
+		if err := tw.WriteHeader(&hdr); err != nil {
+			return BackupManifest{}, fmt.Errorf("tar header: %w", err)
+		}
+
+		if _, err := tw.Write(files[name]); err != nil {
+			return BackupManifest{}, fmt.Errorf("tar write: %w", err)
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		return BackupManifest{}, fmt.Errorf("tar close: %w", err)
+	}
+
+	if err := gz.Close(); err != nil {
+		return BackupManifest{}, fmt.Errorf("gzip close: %w", err)
+	}
+
+	sealed, err := sealKey(buf.Bytes(), backupPassphrase)
+	if err != nil {
+		return BackupManifest{}, fmt.Errorf("sealKey: %w", err)
+	}
+
+	if _, err := w.Write(sealed); err != nil {
+		return BackupManifest{}, fmt.Errorf("write: %w", err)
+	}
+
+	return manifest, nil
+}
+
+// RestoreBackup verifies the backup read from r and restores it into
+// confDir, replacing the database there. The keys are sealed with
+// backupPassphrase again. With dryRun set nothing is written, the report
+// tells what would change. An existing identity is only replaced with force.
+func RestoreBackup(confDir string, r io.Reader, backupPassphrase []byte, dryRun bool, force bool) (RestoreReport, error) {
+	manifest, files, err := readBackup(r, backupPassphrase)
+	if err != nil {
+		return RestoreReport{}, err
+	}
+
+	report := RestoreReport{
+		Manifest: manifest,
+	}
+
+	if _, err := os.Stat(filepath.Join(confDir, "id", idFilename)); err == nil {
+		report.ReplacesIdentity = true
+	}
+
+	//everything that ends up on disk, relative to confDir.
+	restored := make(map[string][]byte)
+	for name, data := range files {
+		switch dir, rel, _ := strings.Cut(name, "/"); dir {
+		case backupKeysDir:
+			restored[filepath.Join("id", rel)] = data
+		case backupDBDir:
+			restored[filepath.FromSlash(rel)] = data
+		}
+	}
+
+	for _, rel := range slices.Sorted(maps.Keys(restored)) {
+		current, err := os.ReadFile(filepath.Join(confDir, rel))
+		switch {
+		case errors.Is(err, fs.ErrNotExist):
+			report.Changes = append(report.Changes, RestoreChange{Name: rel, Action: ActionCreate})
+		case err != nil:
+			return RestoreReport{}, fmt.Errorf("read %s: %w", rel, err)
+		case filepath.Dir(rel) != "id" && bytes.Equal(current, restored[rel]):
+			report.Changes = append(report.Changes, RestoreChange{Name: rel, Action: ActionUnchanged})
+		default:
+			//the keys are sealed again, they always change.
+			report.Changes = append(report.Changes, RestoreChange{Name: rel, Action: ActionOverwrite})
+		}
+	}
+
+	//the database is replaced, files the backup does not have are removed.
+	current, err := databaseFiles(confDir)
+	if err != nil {
+		return RestoreReport{}, err
+	}
+
+	var stale []string
+	for _, rel := range current {
+		if _, ok := restored[rel]; ok || strings.HasSuffix(rel, historyIndexExt) {
+			continue
+		}
+		stale = append(stale, rel)
+		report.Changes = append(report.Changes, RestoreChange{Name: rel, Action: ActionDelete})
+	}
+
+	if dryRun {
+		return report, nil
+	}
+
+	if report.ReplacesIdentity && !force {
+		return report, fmt.Errorf("%s already has an identity, it is replaced by %s only when forced", confDir, manifest.Address.Hex())
+	}
+
+	for _, rel := range stale {
+		if err := os.Remove(filepath.Join(confDir, rel)); err != nil {
+			return report, fmt.Errorf("remove %s: %w", rel, err)
+		}
+	}
+
+	//the search index and the history indexes are built again.
+	if err := os.RemoveAll(filepath.Join(confDir, searchDir)); err != nil {
+		return report, fmt.Errorf("remove search index: %w", err)
+	}
+
+	for _, rel := range current {
+		if strings.HasSuffix(rel, historyIndexExt) {
+			if err := os.Remove(filepath.Join(confDir, rel)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+				return report, fmt.Errorf("remove %s: %w", rel, err)
+			}
+		}
+	}
+
+	//the keys are written last, a restore that stops half way is done
+	//again with the same backup.
+	for _, rel := range slices.Sorted(maps.Keys(restored)) {
+		data := restored[rel]
+
+		if filepath.Dir(rel) == "id" {
+			continue
+		}
+
+		if err := os.MkdirAll(filepath.Join(confDir, filepath.Dir(rel)), 0700); err != nil {
+			return report, fmt.Errorf("mkdirAll: %w", err)
+		}
+
+		if err := writeFileAtomic(filepath.Join(confDir, rel), data); err != nil {
+			return report, fmt.Errorf("write %s: %w", rel, err)
+		}
+	}
+
+	if err := os.MkdirAll(filepath.Join(confDir, "id"), 0700); err != nil {
+		return report, fmt.Errorf("mkdirAll: %w", err)
+	}
+
+	for _, name := range backupKeys {
+		sealed, err := sealKey(files[path.Join(backupKeysDir, name)], backupPassphrase)
+		if err != nil {
+			return report, fmt.Errorf("sealKey: %w", err)
+		}
+
+		if err := writeFileAtomic(filepath.Join(confDir, "id", name), sealed); err != nil {
+			return report, fmt.Errorf("write %s: %w", name, err)
+		}
+	}
+
+	return report, nil
+}
+
+// =============================================================================
+
+// readBackup opens the backup and checks every file against the manifest,
+// the keys and the account have to belong to the same address.
+func readBackup(r io.Reader, passphrase []byte) (BackupManifest, map[string][]byte, error) {
+	sealed, err := io.ReadAll(r)
+	if err != nil {
+		return BackupManifest{}, nil, fmt.Errorf("read: %w", err)
+	}
+
+	data, err := openKey(sealed, passphrase)
+	if err != nil {
+		if errors.Is(err, ErrWrongPassphrase) {
+			return BackupManifest{}, nil, errors.New("wrong passphrase or the backup was modified")
+		}
+		return BackupManifest{}, nil, fmt.Errorf("open backup: %w", err)
+	}
+
+	gz, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return BackupManifest{}, nil, fmt.Errorf("gzip: %w", err)
+	}
+
+	files := make(map[string][]byte)
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return BackupManifest{}, nil, fmt.Errorf("tar: %w", err)
+		}
+
+		if !filepath.IsLocal(filepath.FromSlash(hdr.Name)) {
+			return BackupManifest{}, nil, fmt.Errorf("invalid file name %q in backup", hdr.Name)
+		}
+
+		content, err := io.ReadAll(tr)
+		if err != nil {
+			return BackupManifest{}, nil, fmt.Errorf("tar read: %w", err)
+		}
+		files[hdr.Name] = content
+	}
+
+	var manifest BackupManifest
+	if err := json.Unmarshal(files[backupManifest], &manifest); err != nil {
+		return BackupManifest{}, nil, fmt.Errorf("backup has no valid manifest: %w", err)
+	}
+	delete(files, backupManifest)
+
+	if manifest.Version != backupVersion {
+		return BackupManifest{}, nil, fmt.Errorf("unsupported backup version %d", manifest.Version)
+	}
+
+	if len(manifest.Files) != len(files) {
+		return BackupManifest{}, nil, fmt.Errorf("backup has %d files, the manifest lists %d", len(files), len(manifest.Files))
+	}
+
+	for _, f := range manifest.Files {
+		content, ok := files[f.Name]
+		if !ok {
+			return BackupManifest{}, nil, fmt.Errorf("%s is missing from the backup", f.Name)
+		}
+
+		sum := sha256.Sum256(content)
+		if int64(len(content)) != f.Size || hex.EncodeToString(sum[:]) != f.SHA256 {
+			return BackupManifest{}, nil, fmt.Errorf("%s does not match the manifest", f.Name)
+		}
+
+		dir, _, _ := strings.Cut(f.Name, "/")
+		if dir != backupKeysDir && dir != backupDBDir {
+			return BackupManifest{}, nil, fmt.Errorf("unexpected file %s in backup", f.Name)
+		}
+	}
+
+	if err := checkBackupKeys(manifest, files); err != nil {
+		return BackupManifest{}, nil, err
+	}
+
+	return manifest, files, nil
+}
+
+func checkBackupKeys(manifest BackupManifest, files map[string][]byte) error {
+	for _, name := range backupKeys {
+		if _, ok := files[path.Join(backupKeysDir, name)]; !ok {
+			return fmt.Errorf("backup has no %s", name)
+		}
+	}
+
+	address, _, err := readKeyID(files[path.Join(backupKeysDir, idFilename)])
+	if err != nil {
+		return fmt.Errorf("readKeyID: %w", err)
+	}
+
+	if address != manifest.Address {
+		return fmt.Errorf("backup keys belong to %s, the manifest to %s", address.Hex(), manifest.Address.Hex())
+	}
+
+	if _, err := readEncryptKey(files[path.Join(backupKeysDir, encryptionFilename)]); err != nil {
+		return fmt.Errorf("readEncryptKey: %w", err)
+	}
+
+	if _, err := readDHKey(files[path.Join(backupKeysDir, dhFilename)]); err != nil {
+		return fmt.Errorf("readDHKey: %w", err)
+	}
+
+	//the database has to open with the data key in the backup.
+	v, err := newVault(files[path.Join(backupKeysDir, dataKeyFilename)])
+	if err != nil {
+		return fmt.Errorf("newVault: %w", err)
+	}
+
+	record, ok := files[path.Join(backupDBDir, dbFilename)]
+	if !ok {
+		return fmt.Errorf("backup has no %s", dbFilename)
+	}
+
+	jsn, err := v.open(dbFilename, bytes.TrimSpace(record))
+	if err != nil {
+		return fmt.Errorf("open %s: %w", dbFilename, err)
+	}
+
+	var acc account
+	if err := json.Unmarshal(jsn, &acc); err != nil {
+		return fmt.Errorf("decode %s: %w", dbFilename, err)
+	}
+
+	if acc.MyAccount.ID != manifest.Address {
+		return fmt.Errorf("backup database belongs to %s, the keys to %s", acc.MyAccount.ID.Hex(), manifest.Address.Hex())
+	}
+
+	return nil
+}
+
+func isHistoryFile(rel string) bool {
+	return filepath.Dir(rel) == chatHistoryDir
+}
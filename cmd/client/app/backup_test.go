@@ -0,0 +1,126 @@
+package app_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/hamidoujand/echo/cmd/client/app"
+)
+
+func Test_BackupRestore(t *testing.T) {
+	passphrase := []byte("correct horse")
+	backupPassphrase := []byte("battery staple")
+
+	src := t.TempDir()
+
+	id, err := app.NewID(src, passphrase)
+	if err != nil {
+		t.Fatalf("Should be able to create an identity: %s", err)
+	}
+
+	dataKey, err := app.LoadDataKey(src, passphrase)
+	if err != nil {
+		t.Fatalf("Should be able to create a data key: %s", err)
+	}
+
+	if _, err := app.NewDatabase(src, id.Address, dataKey); err != nil {
+		t.Fatalf("Should be able to create a database: %s", err)
+	}
+
+	var archive bytes.Buffer
+	manifest, err := app.WriteBackup(&archive, src, passphrase, backupPassphrase, true)
+	if err != nil {
+		t.Fatalf("Should be able to write a backup: %s", err)
+	}
+
+	if manifest.Address != id.Address {
+		t.Fatalf("Should back up the identity: got %s, exp %s", manifest.Address, id.Address)
+	}
+
+	dst := t.TempDir()
+
+	//a dry run reports the changes without writing anything.
+	report, err := app.RestoreBackup(dst, bytes.NewReader(archive.Bytes()), backupPassphrase, true, false)
+	if err != nil {
+		t.Fatalf("Should be able to verify the backup: %s", err)
+	}
+
+	if len(report.Changes) == 0 || report.ReplacesIdentity {
+		t.Fatalf("Should only create files: %+v", report)
+	}
+
+	for _, c := range report.Changes {
+		if c.Action != app.ActionCreate {
+			t.Fatalf("Should create %s, got %s", c.Name, c.Action)
+		}
+	}
+
+	if has, _ := app.HasSealedID(dst); has {
+		t.Fatal("Should not write anything in a dry run")
+	}
+
+	if _, err := app.RestoreBackup(dst, bytes.NewReader(archive.Bytes()), backupPassphrase, false, false); err != nil {
+		t.Fatalf("Should be able to restore the backup: %s", err)
+	}
+
+	restored, err := app.NewID(dst, backupPassphrase)
+	if err != nil {
+		t.Fatalf("Should be able to open the restored identity: %s", err)
+	}
+
+	if restored.Address != id.Address {
+		t.Fatalf("Should restore the address: got %s, exp %s", restored.Address, id.Address)
+	}
+
+	dataKey, err = app.LoadDataKey(dst, backupPassphrase)
+	if err != nil {
+		t.Fatalf("Should be able to open the restored data key: %s", err)
+	}
+
+	if _, err := app.NewDatabase(dst, id.Address, dataKey); err != nil {
+		t.Fatalf("Should be able to open the restored database: %s", err)
+	}
+
+	//an identity is only replaced when forced.
+	if _, err := app.RestoreBackup(dst, bytes.NewReader(archive.Bytes()), backupPassphrase, false, false); err == nil {
+		t.Fatal("Should not replace an identity without force")
+	}
+}
+
+func Test_RestoreVerify(t *testing.T) {
+	passphrase := []byte("correct horse")
+
+	src := t.TempDir()
+
+	id, err := app.NewID(src, passphrase)
+	if err != nil {
+		t.Fatalf("Should be able to create an identity: %s", err)
+	}
+
+	dataKey, err := app.LoadDataKey(src, passphrase)
+	if err != nil {
+		t.Fatalf("Should be able to create a data key: %s", err)
+	}
+
+	if _, err := app.NewDatabase(src, id.Address, dataKey); err != nil {
+		t.Fatalf("Should be able to create a database: %s", err)
+	}
+
+	var archive bytes.Buffer
+	if _, err := app.WriteBackup(&archive, src, passphrase, passphrase, false); err != nil {
+		t.Fatalf("Should be able to write a backup: %s", err)
+	}
+
+	if _, err := app.RestoreBackup(t.TempDir(), bytes.NewReader(archive.Bytes()), []byte("wrong"), true, false); err == nil {
+		t.Fatal("Should not open a backup with the wrong passphrase")
+	}
+
+	//flip a character inside the sealed content.
+	tampered := bytes.Clone(archive.Bytes())
+	i := bytes.Index(tampered, []byte(`"ciphertext":"`)) + len(`"ciphertext":"`) + 10
+	tampered[i] ^= 'A' ^ 'B'
+
+	if _, err := app.RestoreBackup(t.TempDir(), bytes.NewReader(tampered), passphrase, true, false); err == nil {
+		t.Fatal("Should not accept a modified backup")
+	}
+}
@@ -7,7 +7,12 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"log/slog"
 	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/ethereum/go-ethereum/common"
@@ -17,6 +22,10 @@ import (
 
 type UIWriter func(id string, msg message)
 type UpdateContact func(id, name string)
+type UpdateRequests func()
+type MoveContact func(from, to string)
+type RefreshContact func(id string)
+type Notify func(id string)
 
 type user struct {
 	ID    common.Address `json:"id"`
@@ -24,53 +33,130 @@ type user struct {
 	Nonce uint64         `json:"nonce"`
 }
 
+type errorFrame struct {
+	Code         string         `json:"code"`
+	Message      string         `json:"message"`
+	ToID         common.Address `json:"toID"`
+	FromNonce    uint64         `json:"fromNonce"`
+	RetryAfterMS int64          `json:"retryAfterMS"`
+}
+
+// actions supported by control messages.
+const (
+	actionBlock   = "block"
+	actionUnblock = "unblock"
+)
+
+type controlAck struct {
+	Action string         `json:"action"`
+	Target common.Address `json:"target"`
+}
+
 type inMessage struct {
-	Encrypted bool   `json:"encrypted"`
-	From      user   `json:"from"`
-	Text      []byte `json:"text"`
+	Scheme    string      `json:"scheme"`
+	Encrypted bool        `json:"encrypted,omitempty"`
+	From      user        `json:"from"`
+	Text      []byte      `json:"text"`
+	Error     *errorFrame `json:"error,omitempty"`
+	Control   *controlAck `json:"control,omitempty"`
+}
+
+type controlMessage struct {
+	Action    string         `json:"action"`
+	Target    common.Address `json:"target"`
+	Timestamp int64          `json:"timestamp"`
+	V         *big.Int       `json:"v"`
+	R         *big.Int       `json:"r"`
+	S         *big.Int       `json:"s"`
+}
+
+type outControl struct {
+	Control controlMessage `json:"control"`
 }
 
 type outMessage struct {
 	ToID      common.Address `json:"toID"`
 	Text      []byte         `json:"text"`
 	FromNonce uint64         `json:"fromNonce"`
-	Encrypted bool           `json:"encrypted"`
+	Scheme    string         `json:"scheme"`
 	V         *big.Int       `json:"v"`
 	R         *big.Int       `json:"r"`
 	S         *big.Int       `json:"s"`
 }
 
+// ClientConfig is how the client reaches the servers.
+type ClientConfig struct {
+	// Servers are the websocket URLs of the servers, they are tried in order
+	// until one accepts the connection.
+	Servers []string
+	// Proxy is the URL of an HTTP or SOCKS5 proxy, nil to connect directly.
+	Proxy *url.URL
+	Log   *slog.Logger
+}
+
 type Client struct {
-	id       ID
-	conn     *websocket.Conn
-	url      string
-	db       *Database
-	uiWriter UIWriter
+	id             ID
+	conn           *websocket.Conn
+	servers        []string
+	url            string
+	dialer         websocket.Dialer
+	http           http.Client
+	log            *slog.Logger
+	db             *Database
+	uiWriter       UIWriter
+	updateRequests UpdateRequests
+	moveContact    MoveContact
+	refreshContact RefreshContact
+	keyMisses      map[common.Address]time.Time
+	preKeyMisses   map[common.Address]time.Time
+	keyMu          sync.Mutex
+	sessionMu      sync.Mutex
 }
 
-func NewClient(id ID, url string, db *Database) *Client {
-	return &Client{
-		id:  id,
-		url: url,
-		db:  db,
+func NewClient(id ID, db *Database, cfg ClientConfig) *Client {
+	c := Client{
+		id:           id,
+		servers:      cfg.Servers,
+		dialer:       *websocket.DefaultDialer,
+		http:         http.Client{Timeout: 10 * time.Second},
+		log:          cfg.Log,
+		db:           db,
+		keyMisses:    make(map[common.Address]time.Time),
+		preKeyMisses: make(map[common.Address]time.Time),
+	}
+
+	if c.log == nil {
+		c.log = slog.New(slog.DiscardHandler)
+	}
+
+	if cfg.Proxy != nil {
+		c.dialer.Proxy = http.ProxyURL(cfg.Proxy)
+		c.http.Transport = &http.Transport{Proxy: http.ProxyURL(cfg.Proxy)}
 	}
+
+	return &c
 }
 
 func (c *Client) Close() error {
-	if c == nil {
+	if c == nil || c.conn == nil {
 		return nil
 	}
 	return c.conn.Close()
 }
 
-func (c *Client) Handshake(name string, uiWriter UIWriter, updateContact UpdateContact) error {
-	conn, _, err := websocket.DefaultDialer.Dial(c.url, nil)
+func (c *Client) Handshake(name string, uiWriter UIWriter, updateRequests UpdateRequests, moveContact MoveContact, refreshContact RefreshContact, notify Notify) error {
+	conn, err := c.dial()
 	if err != nil {
 		return fmt.Errorf("dial: %w", err)
 	}
 
+	uiWriter = c.logSystem(uiWriter)
+
 	c.conn = conn
 	c.uiWriter = uiWriter
+	c.updateRequests = updateRequests
+	c.moveContact = moveContact
+	c.refreshContact = refreshContact
 
 	_, msg, err := conn.ReadMessage()
 	if err != nil {
@@ -81,12 +167,19 @@ func (c *Client) Handshake(name string, uiWriter UIWriter, updateContact UpdateC
 		return fmt.Errorf("expected message to be Hello, got %s", string(msg))
 	}
 
+	bundle, err := c.keyBundle()
+	if err != nil {
+		return fmt.Errorf("keyBundle: %w", err)
+	}
+
 	user := struct {
 		ID   string
 		Name string
+		Key  keyBundle `json:"key"`
 	}{
 		ID:   c.id.Address.Hex(),
 		Name: name,
+		Key:  bundle,
 	}
 
 	bs, err := json.Marshal(user)
@@ -104,6 +197,14 @@ func (c *Client) Handshake(name string, uiWriter UIWriter, updateContact UpdateC
 	}
 	uiWriter("system", systemErrorMessage("system: %s", msg))
 
+	if err := c.UploadPreKeys(); err != nil {
+		uiWriter("system", systemErrorMessage("failed to upload prekeys, new sessions will fall back to RSA: %s", err))
+	}
+
+	if err := c.sendMigration(); err != nil {
+		uiWriter("system", systemErrorMessage("failed to tell the contacts about the new address: %s", err))
+	}
+
 	//=========================================================================
 	// listener goroutine
 	go func() {
@@ -119,52 +220,96 @@ func (c *Client) Handshake(name string, uiWriter UIWriter, updateContact UpdateC
 				uiWriter("system", systemErrorMessage("unmarshaling message failed: %s", err))
 				return
 			}
+
+			//CAPs older than the scheme only send the encrypted flag.
+			if inMsg.Scheme == "" && inMsg.Encrypted {
+				inMsg.Scheme = schemeRSA
+			}
+
+			if inMsg.Error != nil {
+				c.processErrorFrame(*inMsg.Error)
+				continue
+			}
+
+			if inMsg.Control != nil {
+				c.processControlAck(*inMsg.Control)
+				continue
+			}
+
+			//the server should have dropped it already, its nonce is used up
+			//anyway so the conversation goes on after an unblock.
+			if c.db.IsBlocked(inMsg.From.ID) {
+				if usr, err := c.db.LookupContact(inMsg.From.ID); err == nil && checkNonce(usr.IncomingNonce, inMsg.From.Nonce) == nil {
+					if err := c.db.UpdateIncomingNonce(inMsg.From.ID, inMsg.From.Nonce); err != nil {
+						uiWriter("system", systemErrorMessage("failed to update contact nonce: %s", err))
+					}
+				}
+				continue
+			}
 			//find the username
 			usr, err := c.db.LookupContact(inMsg.From.ID)
-			switch {
-			case err != nil:
-				var err error
-				usr, err = c.db.AddContact(inMsg.From.ID, inMsg.From.Name)
-				if err != nil {
-					uiWriter("system", systemErrorMessage("failed to add user into contacts: %s", err))
-					return
+			if err != nil && isMigration(inMsg) {
+				if err := c.processMigration(inMsg); err != nil {
+					uiWriter("system", systemErrorMessage("failed to process address change: %s", err))
 				}
+				continue
+			}
 
-				updateContact(inMsg.From.ID.Hex(), inMsg.From.Name)
-			default:
-				inMsg.From.Name = usr.Name
+			if err != nil {
+				//unknown sender, nothing is stored until the request is accepted.
+				if err := c.processRequest(inMsg); err != nil {
+					uiWriter("system", systemErrorMessage("failed to process contact request: %s", err))
+				}
+				continue
 			}
 
-			//check nonce
-			expectedNonce := usr.IncomingNonce + 1
-			if expectedNonce != inMsg.From.Nonce {
-				uiWriter("system", systemErrorMessage("invalid nonce: got %d, expected %d", inMsg.From.Nonce, expectedNonce))
-				return
+			inMsg.From.Name = usr.Name
+
+			//check nonce, a replayed message is dropped and the rest still
+			//arrives.
+			if err := checkNonce(usr.IncomingNonce, inMsg.From.Nonce); err != nil {
+				uiWriter("system", systemErrorMessage("message from %s dropped: %s", usr.Name, err))
+				continue
 			}
 
 			//update nonce to the new value
-			if err := c.db.UpdateIncomingNonce(inMsg.From.ID, expectedNonce); err != nil {
+			if err := c.db.UpdateIncomingNonce(inMsg.From.ID, inMsg.From.Nonce); err != nil {
 				uiWriter("system", systemErrorMessage("failed to update contact nonce: %s", err))
-				return
+				continue
 			}
 
+			text, err := c.decrypt(inMsg, func() *session {
+				return c.db.Session(inMsg.From.ID)
+			}, func(s *session) error {
+				return c.db.SaveSession(inMsg.From.ID, s)
+			})
+			if err != nil {
+				uiWriter("system", systemErrorMessage("failed to decrypt message from %s: %s", inMsg.From.Name, err))
+				continue
+			}
+			inMsg.Text = text
+
+			//a bad command of one contact does not stop the messages of the
+			//others.
 			onScreen, err := c.processReceivedMessages(inMsg)
 			if err != nil {
-				uiWriter("system", systemErrorMessage("failed to process received messages: %s", err))
-				return
+				uiWriter("system", systemErrorMessage("failed to process message from %s: %s", inMsg.From.Name, err))
+				continue
 			}
 
 			if !bytes.HasPrefix(inMsg.Text, []byte("/")) {
 				m := message{
-					Name: inMsg.From.Name,
-					Text: onScreen,
+					Name:      inMsg.From.Name,
+					Text:      onScreen,
+					Timestamp: time.Now().UTC(),
 				}
 
-				if err := c.db.AddMessage(inMsg.From.ID, m); err != nil {
+				if err := c.db.AddReceivedMessage(inMsg.From.ID, m); err != nil {
 					uiWriter("system", systemErrorMessage("failed to add message: %s", err))
-					return
+					continue
 				}
 				uiWriter(inMsg.From.ID.Hex(), m)
+				notify(inMsg.From.ID.Hex())
 			}
 		}
 	}()
@@ -172,6 +317,39 @@ func (c *Client) Handshake(name string, uiWriter UIWriter, updateContact UpdateC
 	return nil
 }
 
+// logSystem writes the system messages to the log as well.
+func (c *Client) logSystem(uiWriter UIWriter) UIWriter {
+	return func(id string, msg message) {
+		if id == "system" {
+			c.log.Info(string(msg.Text))
+		}
+		uiWriter(id, msg)
+	}
+}
+
+// dial connects to the first server that answers.
+func (c *Client) dial() (*websocket.Conn, error) {
+	if len(c.servers) == 0 {
+		return nil, errors.New("no server configured")
+	}
+
+	var errs []error
+	for _, server := range c.servers {
+		conn, _, err := c.dialer.Dial(server, nil)
+		if err != nil {
+			c.log.Warn("connecting failed", "server", server, "err", err)
+			errs = append(errs, fmt.Errorf("%s: %w", server, err))
+			continue
+		}
+
+		c.log.Info("connected", "server", server)
+		c.url = server
+		return conn, nil
+	}
+
+	return nil, errors.Join(errs...)
+}
+
 func (c *Client) Send(to common.Address, msg []byte) error {
 	if c.conn == nil {
 		return fmt.Errorf("no connection")
@@ -181,25 +359,103 @@ func (c *Client) Send(to common.Address, msg []byte) error {
 		return errors.New("message can not be empty")
 	}
 
-	usr, err := c.db.LookupContact(to)
+	//the commands are run by the UI.
+	if bytes.HasPrefix(msg, []byte("/")) {
+		return errors.New("a message can not start with /")
+	}
+
+	usr, err := c.recipient(to)
 	if err != nil {
-		return fmt.Errorf("lookup contact: %w", err)
+		return err
+	}
+
+	//try the key directory so the first message is already encrypted.
+	if len(usr.Key) == 0 {
+		usr, err = c.resolveKey(usr)
+		if err != nil && !errors.Is(err, errNoKey) {
+			c.uiWriter("system", systemErrorMessage("no encryption key for %s, sending in plain text: %s", usr.Name, err))
+		}
 	}
 
 	nonce := usr.OutgoingNonce + 1
 
-	encrypted, decrypted, err := c.processSendMessages(usr, msg)
+	scheme, encrypted, err := c.encrypt(usr, msg)
+	if err != nil {
+		return fmt.Errorf("encrypt: %w", err)
+	}
+
+	if err := c.write(to, scheme, encrypted, nonce); err != nil {
+		return err
+	}
+
+	m := message{
+		Name:      "You",
+		Text:      msg,
+		Timestamp: time.Now().UTC(),
+	}
+
+	if err := c.db.AddMessage(to, m); err != nil {
+		return fmt.Errorf("addMessage: %w", err)
+	}
+
+	c.uiWriter(to.String(), m)
+
+	return nil
+}
+
+// ShareKey sends the RSA public key to the contact to.
+func (c *Client) ShareKey(to common.Address) error {
+	if c.conn == nil {
+		return fmt.Errorf("no connection")
+	}
+
+	if c.id.RSAPublicKey == "" {
+		return errors.New("no key to share")
+	}
+
+	usr, err := c.recipient(to)
+	if err != nil {
+		return err
+	}
+
+	return c.write(to, schemeNone, fmt.Appendf(nil, "/key %s", c.id.RSAPublicKey), usr.OutgoingNonce+1)
+}
+
+// recipient returns the contact to, the signed name goes first to a contact
+// that did not get a message yet since the name relayed by the server is
+// not trusted.
+func (c *Client) recipient(to common.Address) (User, error) {
+	usr, err := c.db.LookupContact(to)
+	if err != nil {
+		return User{}, fmt.Errorf("lookup contact: %w", err)
+	}
+
+	if usr.OutgoingNonce != 0 {
+		return usr, nil
+	}
+
+	if err := c.sendName(to); err != nil {
+		return User{}, fmt.Errorf("sendName: %w", err)
+	}
+
+	usr, err = c.db.LookupContact(to)
 	if err != nil {
-		return fmt.Errorf("processSendMessages: %w", err)
+		return User{}, fmt.Errorf("lookup contact: %w", err)
 	}
 
+	return usr, nil
+}
+
+// write signs and sends a message that is ready to go, nonce is stored once
+// it is written.
+func (c *Client) write(to common.Address, scheme string, text []byte, nonce uint64) error {
 	dataToSign := struct {
 		ToID      common.Address
 		Text      []byte
 		FromNonce uint64
 	}{
 		ToID:      to,
-		Text:      encrypted,
+		Text:      text,
 		FromNonce: nonce,
 	}
 
@@ -208,12 +464,11 @@ func (c *Client) Send(to common.Address, msg []byte) error {
 		return fmt.Errorf("sign: %w", err)
 	}
 
-	isEncrypted := len(usr.Key) != 0
 	outMsg := outMessage{
 		ToID:      to,
-		Text:      encrypted,
+		Text:      text,
 		FromNonce: nonce,
-		Encrypted: isEncrypted,
+		Scheme:    scheme,
 		V:         v,
 		R:         r,
 		S:         s,
@@ -232,102 +487,294 @@ func (c *Client) Send(to common.Address, msg []byte) error {
 		return fmt.Errorf("updateAppNonce: %w", err)
 	}
 
-	if !bytes.HasPrefix(msg, []byte("/")) {
-		m := message{
-			Name:      "You",
-			Text:      decrypted,
-			Timestamp: time.Now().UTC(),
+	return nil
+}
+
+// SendControl asks the server to apply a signed control action on target.
+func (c *Client) SendControl(action string, target common.Address) error {
+	if c.conn == nil {
+		return fmt.Errorf("no connection")
+	}
+
+	ctrl := controlMessage{
+		Action:    action,
+		Target:    target,
+		Timestamp: time.Now().UnixNano(),
+	}
+
+	dataToSign := struct {
+		Action    string
+		Target    common.Address
+		Timestamp int64
+	}{
+		Action:    ctrl.Action,
+		Target:    ctrl.Target,
+		Timestamp: ctrl.Timestamp,
+	}
+
+	v, r, s, err := signature.Sign(dataToSign, c.id.ECDSAKey)
+	if err != nil {
+		return fmt.Errorf("sign: %w", err)
+	}
+	ctrl.V, ctrl.R, ctrl.S = v, r, s
+
+	bs, err := json.Marshal(outControl{Control: ctrl})
+	if err != nil {
+		return fmt.Errorf("marshaling control: %w", err)
+	}
+
+	if err := c.conn.WriteMessage(websocket.TextMessage, bs); err != nil {
+		return fmt.Errorf("writing control to the conn: %w", err)
+	}
+
+	return nil
+}
+
+func (c *Client) processControlAck(ack controlAck) {
+	switch ack.Action {
+	case actionBlock:
+		if err := c.db.Block(ack.Target); err != nil {
+			c.uiWriter("system", systemErrorMessage("failed to store blocked contact: %s", err))
+			return
 		}
+		c.uiWriter("system", systemErrorMessage("blocked %s", ack.Target))
+	case actionUnblock:
+		if err := c.db.Unblock(ack.Target); err != nil {
+			c.uiWriter("system", systemErrorMessage("failed to remove blocked contact: %s", err))
+			return
+		}
+		c.uiWriter("system", systemErrorMessage("unblocked %s", ack.Target))
+	}
+}
 
-		if err := c.db.AddMessage(to, m); err != nil {
-			return fmt.Errorf("addMessage: %w", err)
+func (c *Client) processErrorFrame(frame errorFrame) {
+	retryAfter := time.Duration(frame.RetryAfterMS) * time.Millisecond
+
+	//the server dropped the message, so the nonce it used was never seen by
+	//the contact. It is only given back when nothing was sent after it, a
+	//gap is fine, contacts take any nonce after the last they saw.
+	usr, err := c.db.LookupContact(frame.ToID)
+	if err == nil && frame.FromNonce != 0 && usr.OutgoingNonce == frame.FromNonce {
+		if err := c.db.UpdateOutgoingNonce(frame.ToID, frame.FromNonce-1); err != nil {
+			c.uiWriter("system", systemErrorMessage("failed to roll back nonce: %s", err))
 		}
+	}
 
-		c.uiWriter(to.String(), m)
+	switch frame.Code {
+	case "rate_limited", "quota_exceeded":
+		c.uiWriter("system", systemErrorMessage("message to %s was not delivered: %s, retry in %s", frame.ToID, frame.Message, retryAfter.Round(time.Millisecond)))
+	case "control_failed":
+		c.uiWriter("system", systemErrorMessage("request for %s failed: %s", frame.ToID, frame.Message))
+	case "rejected":
+		c.uiWriter("system", systemErrorMessage("message to %s was rejected: %s", frame.ToID, frame.Message))
+	default:
+		c.uiWriter("system", systemErrorMessage("server error: %s: %s", frame.Code, frame.Message))
 	}
+}
 
+// checkNonce accepts any nonce after last. The server drops messages without
+// telling the sender, from blocked senders or by a hook, so the nonces of a
+// contact can skip some, only a nonce seen before is a replay.
+func checkNonce(last uint64, nonce uint64) error {
+	if nonce <= last {
+		return fmt.Errorf("invalid nonce: got %d, already seen %d", nonce, last)
+	}
 	return nil
 }
 
-func (c *Client) processSendMessages(usr User, msg []byte) (encrypted []byte, decrypted []byte, err error) {
-	//not a command, normal messages
-	if !bytes.HasPrefix(msg, []byte("/")) {
-		//usr does not have a key for encryption
-		if len(usr.Key) == 0 {
-			return msg, msg, nil
+// encrypt seals msg for usr with the best scheme it supports.
+func (c *Client) encrypt(usr User, msg []byte) (scheme string, encrypted []byte, err error) {
+	sealed, err := c.sealRatchet(usr, msg)
+	if err == nil {
+		return schemeRatchet, sealed, nil
+	}
+
+	if !errors.Is(err, errNoPreKeys) {
+		c.uiWriter("system", systemErrorMessage("could not use a session with %s, falling back to RSA: %s", usr.Name, err))
+	}
+
+	//usr does not have a key for encryption
+	if len(usr.Key) == 0 {
+		return schemeNone, msg, nil
+	}
+
+	//usr does have a key, encrypt messages
+	pk, err := parseRSAPublicKey(usr.Key)
+	if err != nil {
+		return "", nil, fmt.Errorf("parseRSAPublicKey: %w", err)
+	}
+
+	encryptedData, err := rsa.EncryptPKCS1v15(rand.Reader, pk, msg)
+	if err != nil {
+		return "", nil, fmt.Errorf("encrypt messages: %w", err)
+	}
+
+	return schemeRSA, encryptedData, nil
+}
+
+func (c *Client) processRequest(msg inMessage) error {
+	req, ok := c.db.LookupRequest(msg.From.ID)
+	if !ok {
+		req = Request{
+			ID:       msg.From.ID,
+			Name:     msg.From.Name,
+			Received: time.Now(),
 		}
+	}
+
+	if err := checkNonce(req.IncomingNonce, msg.From.Nonce); err != nil {
+		return err
+	}
+	req.IncomingNonce = msg.From.Nonce
 
-		//usr does have a key, encrypt messages
-		pk, err := parseRSAPublicKey(usr.Key)
+	text, err := c.decrypt(msg, func() *session {
+		return req.Session
+	}, func(s *session) error {
+		req.Session = s
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("decrypt: %w", err)
+	}
+
+	switch {
+	case bytes.HasPrefix(text, []byte("/key ")):
+		key := bytes.TrimPrefix(text, []byte("/key "))
+		if _, err := parseRSAPublicKey(key); err != nil {
+			return fmt.Errorf("parseRSAPublicKey: %w", err)
+		}
+		req.Key = key
+	case bytes.HasPrefix(text, []byte(nameCommand)):
+		u, err := parseNameUpdate(msg.From.ID, text)
 		if err != nil {
-			return nil, nil, fmt.Errorf("parseRSAPublicKey: %w", err)
+			return fmt.Errorf("parseNameUpdate: %w", err)
 		}
 
-		encryptedData, err := rsa.EncryptPKCS1v15(rand.Reader, pk, msg)
-		if err != nil {
-			return nil, nil, fmt.Errorf("encrypt messages: %w", err)
+		if u.Timestamp > req.NameUpdated {
+			req.Name = u.Name
+			req.NameUpdated = u.Timestamp
 		}
+	case bytes.HasPrefix(text, []byte("/")):
+		//other commands need an accepted contact.
+	default:
+		req.Messages = append(req.Messages, message{
+			Name:      msg.From.Name,
+			Text:      text,
+			Timestamp: time.Now().UTC(),
+		})
+	}
 
-		return encryptedData, msg, nil
+	if err := c.db.UpdateRequest(req); err != nil {
+		return err
 	}
 
-	//its a command
-	msg = bytes.ToLower(msg)
-	msg = bytes.TrimSpace(msg)
+	if !ok {
+		c.uiWriter("system", systemErrorMessage("new contact request from %s (%s), press ctrl+r to review", req.Name, req.ID))
+	}
+	c.updateRequests()
+
+	return nil
+}
 
-	parts := bytes.Split(msg, []byte(" "))
-	if len(parts) != 2 {
-		return nil, nil, fmt.Errorf("%s: invalid command formant: command must be in [/<cmd> <args>]", msg)
+func (c *Client) notifyKeyStatus(id common.Address, name string, status keyStatus) {
+	switch status {
+	case keyPinned:
+		c.uiWriter("system", systemErrorMessage("pinned the key of %s, fingerprint %s", name, c.fingerprint(id)))
+	case keyChanged:
+		c.uiWriter("system", systemErrorMessage("WARNING: the key of %s (%s) has CHANGED! Messages are still encrypted to the old key. "+
+			"If you did not expect this, someone may be intercepting your conversation. Run /verify to compare safety numbers, "+
+			"then /accept-key to trust the new key.", name, id))
+	case keyMismatch:
+		c.uiWriter("system", systemErrorMessage("WARNING: the key of %s (%s) does NOT match the fingerprint of their invite! "+
+			"Someone may be intercepting your conversation. Run /verify to compare safety numbers before trusting it.", name, id))
 	}
+}
 
-	switch {
-	case bytes.Equal(parts[0], []byte("/share")):
-		switch {
-		case bytes.Equal(parts[1], []byte("key")):
-			if c.id.RSAPublicKey == "" {
-				return nil, nil, errors.New("no key to share")
-			}
+func (c *Client) fingerprint(id common.Address) string {
+	usr, err := c.db.LookupContact(id)
+	if err != nil || len(usr.Key) == 0 {
+		return "none"
+	}
+	return keyFingerprint(usr.Key)
+}
 
-			msg := fmt.Appendf(nil, "/key %s", c.id.RSAPublicKey)
-			return msg, msg, nil
+// decrypt removes the scheme of msg, load and save give access to the
+// ratchet session of the sender.
+func (c *Client) decrypt(msg inMessage, load func() *session, save func(*session) error) ([]byte, error) {
+	switch msg.Scheme {
+	case schemeNone, "":
+		return msg.Text, nil
+
+	case schemeRSA:
+		decryptedData, err := rsa.DecryptPKCS1v15(rand.Reader, c.id.RSAKey, msg.Text)
+		if err != nil {
+			return nil, fmt.Errorf("message decryption: %w", err)
 		}
+		return decryptedData, nil
+
+	case schemeRatchet:
+		return c.openRatchet(msg.From.ID, msg.Text, load, save)
 	}
 
-	return nil, nil, fmt.Errorf("invalid command %s", msg)
+	return nil, fmt.Errorf("unknown scheme %q", msg.Scheme)
 }
 
+// processReceivedMessages handles a decrypted message.
 func (c *Client) processReceivedMessages(msg inMessage) ([]byte, error) {
 	text := msg.Text
 	//not a command, normal message
 	if !bytes.HasPrefix(text, []byte("/")) {
-		//not encrypted
-		if !msg.Encrypted {
-			return text, nil
+		return text, nil
+	}
+
+	name, arg, _ := bytes.Cut(text, []byte(" "))
+	handle, ok := wireCommands[string(name)]
+	if !ok {
+		return nil, fmt.Errorf("invalid command %s", name)
+	}
+
+	return handle(c, msg, arg)
+}
+
+// wireCommands handle the commands the client of a contact sends, they
+// return the text shown for them.
+var wireCommands = map[string]func(c *Client, msg inMessage, arg []byte) ([]byte, error){
+	"/key": func(c *Client, msg inMessage, key []byte) ([]byte, error) {
+		if _, err := parseRSAPublicKey(key); err != nil {
+			return nil, fmt.Errorf("parseRSAPublicKey: %w", err)
 		}
 
-		//decrypt
-		decryptedData, err := rsa.DecryptPKCS1v15(rand.Reader, c.id.RSAKey, []byte(msg.Text))
+		status, err := c.db.PinContactKey(msg.From.ID, key)
 		if err != nil {
-			return nil, fmt.Errorf("message decryption: %w", err)
+			return nil, fmt.Errorf("pinning contact key: %w", err)
 		}
+		c.notifyKeyStatus(msg.From.ID, msg.From.Name, status)
 
-		return decryptedData, nil
-	}
+		return []byte("*** Updated the contact's key ***"), nil
+	},
 
-	//command
-	parts := bytes.SplitN(text, []byte(" "), 2)
-	if len(parts) != 2 {
-		return nil, fmt.Errorf("%s: invalid command formant: command must be in [/key <RSA_Public>]", text)
-	}
+	strings.TrimSpace(nameCommand): func(c *Client, msg inMessage, arg []byte) ([]byte, error) {
+		if err := c.processNameUpdate(msg); err != nil {
+			return nil, fmt.Errorf("processNameUpdate: %w", err)
+		}
 
-	switch {
-	case bytes.Equal(parts[0], []byte("/key")):
-		key := parts[1]
-		if err := c.db.UpdateContactKey(msg.From.ID, key); err != nil {
-			return nil, fmt.Errorf("updating contact key: %w", err)
+		return []byte("*** Updated the contact's name ***"), nil
+	},
+
+	strings.TrimSpace(migrationCommand): func(c *Client, msg inMessage, arg []byte) ([]byte, error) {
+		//the contact is known by its new address already, the old one is
+		//still there when the move was interrupted.
+		var m Migration
+		if err := json.Unmarshal(arg, &m); err != nil {
+			return nil, fmt.Errorf("unmarshal migration: %w", err)
+		}
+
+		if _, err := c.db.LookupContact(m.From); err == nil {
+			if err := c.processMigration(msg); err != nil {
+				return nil, fmt.Errorf("processMigration: %w", err)
+			}
 		}
-		return []byte("*** Updated the contact's key ***"), nil
-	}
 
-	return nil, fmt.Errorf("invalid command %s", text)
+		return []byte("*** The contact moved to this address ***"), nil
+	},
 }
@@ -0,0 +1,440 @@
+package app_test
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/gorilla/websocket"
+	"github.com/hamidoujand/echo/cmd/client/app"
+)
+
+// server is a relay that greets the clients and then pushes what it is
+// given, the way the chat server forwards messages. It keeps the prekeys the
+// clients upload as they come.
+type server struct {
+	url     string
+	push    chan []byte
+	mu      sync.Mutex
+	preKeys map[common.Address]*preKeys
+}
+
+type preKeys struct {
+	Bundle         map[string]json.RawMessage `json:"bundle"`
+	OneTimePreKeys []json.RawMessage          `json:"oneTimePreKeys"`
+}
+
+func newServer(t *testing.T) *server {
+	s := server{
+		push:    make(chan []byte),
+		preKeys: make(map[common.Address]*preKeys),
+	}
+
+	var upgrader websocket.Upgrader
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ws", func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		if err := conn.WriteMessage(websocket.TextMessage, []byte("Hello")); err != nil {
+			return
+		}
+
+		if _, _, err := conn.ReadMessage(); err != nil {
+			return
+		}
+
+		if err := conn.WriteMessage(websocket.TextMessage, []byte("welcome")); err != nil {
+			return
+		}
+
+		for {
+			select {
+			case msg := <-s.push:
+				if err := conn.WriteMessage(websocket.TextMessage, msg); err != nil {
+					return
+				}
+			case <-r.Context().Done():
+				return
+			}
+		}
+	})
+
+	mux.HandleFunc("POST /v1/prekeys", func(w http.ResponseWriter, r *http.Request) {
+		var u preKeys
+		if err := json.NewDecoder(r.Body).Decode(&u); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		var id common.Address
+		if err := json.Unmarshal(u.Bundle["id"], &id); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		pk, ok := s.preKeys[id]
+		if !ok {
+			pk = &preKeys{}
+			s.preKeys[id] = pk
+		}
+		pk.Bundle = u.Bundle
+		pk.OneTimePreKeys = append(pk.OneTimePreKeys, u.OneTimePreKeys...)
+
+		json.NewEncoder(w).Encode(map[string]int{"oneTimePreKeys": len(pk.OneTimePreKeys)})
+	})
+
+	mux.HandleFunc("GET /v1/prekeys/{address}", func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		pk, ok := s.preKeys[common.HexToAddress(r.PathValue("address"))]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+
+		bundle := maps.Clone(pk.Bundle)
+		if len(pk.OneTimePreKeys) > 0 {
+			bundle["oneTimePreKey"] = pk.OneTimePreKeys[0]
+			pk.OneTimePreKeys = pk.OneTimePreKeys[1:]
+		}
+
+		json.NewEncoder(w).Encode(bundle)
+	})
+
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+
+	s.url = "ws" + strings.TrimPrefix(srv.URL, "http") + "/ws"
+	return &s
+}
+
+// send relays a plain text message from the contact from.
+func (s *server) send(t *testing.T, from common.Address, nonce uint64, text string) {
+	msg := struct {
+		Scheme string `json:"scheme"`
+		From   struct {
+			ID    common.Address `json:"id"`
+			Nonce uint64         `json:"nonce"`
+		} `json:"from"`
+		Text []byte `json:"text"`
+	}{
+		Text: []byte(text),
+	}
+	msg.From.ID = from
+	msg.From.Nonce = nonce
+
+	bs, err := json.Marshal(msg)
+	if err != nil {
+		t.Fatalf("Should be able to marshal a message: %s", err)
+	}
+
+	select {
+	case s.push <- bs:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Should be able to relay a message")
+	}
+}
+
+// connect starts a client of the account me on the server, every message it
+// delivers is sent on the returned channel.
+func connect(t *testing.T, s *server, db *app.Database) <-chan string {
+	id, err := app.NewID(t.TempDir(), []byte("correct horse"))
+	if err != nil {
+		t.Fatalf("Should be able to create an identity: %s", err)
+	}
+
+	_, delivered := connectID(t, s, id, db)
+	return delivered
+}
+
+// connectID starts a client of the identity id on the server.
+func connectID(t *testing.T, s *server, id app.ID, db *app.Database) (*app.Client, <-chan string) {
+	client := app.NewClient(id, db, app.ClientConfig{Servers: []string{s.url}})
+	t.Cleanup(func() { client.Close() })
+
+	delivered := make(chan string, 10)
+	notify := func(id string) {
+		delivered <- id
+	}
+
+	if err := client.Handshake("me", app.DiscardUI, func() {}, func(from, to string) {}, func(id string) {}, notify); err != nil {
+		t.Fatalf("Should be able to connect: %s", err)
+	}
+
+	return client, delivered
+}
+
+// texts returns the history of the contact id.
+func texts(t *testing.T, db *app.Database, id common.Address) []string {
+	msgs, _, err := db.History(id, -1, 100)
+	if err != nil {
+		t.Fatalf("Should be able to read the history: %s", err)
+	}
+
+	var texts []string
+	for _, msg := range msgs {
+		texts = append(texts, string(msg.Text))
+	}
+
+	return texts
+}
+
+func wait(t *testing.T, delivered <-chan string, n int) {
+	for range n {
+		select {
+		case <-delivered:
+		case <-time.After(5 * time.Second):
+			t.Fatal("Should deliver the message")
+		}
+	}
+}
+
+// waitNonce waits for the client to take in the message nonce of the
+// contact id, it shows nothing for a blocked contact.
+func waitNonce(t *testing.T, db *app.Database, id common.Address, nonce uint64) {
+	for range 100 {
+		usr, err := db.LookupContact(id)
+		if err != nil {
+			t.Fatalf("Should be able to look up the contact: %s", err)
+		}
+
+		if usr.IncomingNonce == nonce {
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	t.Fatalf("Should take in the nonce %d", nonce)
+}
+
+// waitRequest waits for a request from id with the nonce.
+func waitRequest(t *testing.T, db *app.Database, id common.Address, nonce uint64) app.Request {
+	for range 100 {
+		if req, ok := db.LookupRequest(id); ok && req.IncomingNonce == nonce {
+			return req
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	t.Fatalf("Should get a request with the nonce %d", nonce)
+	return app.Request{}
+}
+
+func Test_BlockedNonce(t *testing.T) {
+	db, err := app.NewDatabase(t.TempDir(), me, dataKey)
+	if err != nil {
+		t.Fatalf("Should be able to create a database: %s", err)
+	}
+
+	if _, err := db.AddContact(alice, "alice"); err != nil {
+		t.Fatalf("Should be able to add a contact: %s", err)
+	}
+
+	s := newServer(t)
+	delivered := connect(t, s, db)
+
+	s.send(t, alice, 1, "before")
+	wait(t, delivered, 1)
+
+	if err := db.Block(alice); err != nil {
+		t.Fatalf("Should be able to block a contact: %s", err)
+	}
+
+	//one slips through the server, the next is dropped by it.
+	s.send(t, alice, 2, "blocked")
+	waitNonce(t, db, alice, 2)
+
+	if err := db.Unblock(alice); err != nil {
+		t.Fatalf("Should be able to unblock a contact: %s", err)
+	}
+
+	s.send(t, alice, 4, "after")
+	wait(t, delivered, 1)
+
+	s.send(t, alice, 4, "replayed")
+	s.send(t, alice, 5, "still here")
+	wait(t, delivered, 1)
+
+	got := fmt.Sprint(texts(t, db, alice))
+	exp := fmt.Sprint([]string{"before", "after", "still here"})
+	if got != exp {
+		t.Logf("got: %s", got)
+		t.Logf("exp: %s", exp)
+		t.Fatalf("Should keep talking after an unblock.")
+	}
+}
+
+func Test_NonceGap(t *testing.T) {
+	db, err := app.NewDatabase(t.TempDir(), me, dataKey)
+	if err != nil {
+		t.Fatalf("Should be able to create a database: %s", err)
+	}
+
+	if _, err := db.AddContact(alice, "alice"); err != nil {
+		t.Fatalf("Should be able to add a contact: %s", err)
+	}
+
+	s := newServer(t)
+	delivered := connect(t, s, db)
+
+	//a hook of the server drops the messages 2 and 3.
+	s.send(t, alice, 1, "one")
+	s.send(t, alice, 4, "four")
+	wait(t, delivered, 2)
+
+	s.send(t, alice, 1, "replayed")
+	s.send(t, alice, 3, "late")
+	s.send(t, alice, 5, "five")
+	wait(t, delivered, 1)
+
+	got := fmt.Sprint(texts(t, db, alice))
+	exp := fmt.Sprint([]string{"one", "four", "five"})
+	if got != exp {
+		t.Logf("got: %s", got)
+		t.Logf("exp: %s", exp)
+		t.Fatalf("Should skip dropped nonces and refuse old ones.")
+	}
+}
+
+func Test_RequestNonce(t *testing.T) {
+	db, err := app.NewDatabase(t.TempDir(), me, dataKey)
+	if err != nil {
+		t.Fatalf("Should be able to create a database: %s", err)
+	}
+
+	s := newServer(t)
+	connect(t, s, db)
+
+	//bob wrote to someone else first, or to us before a restart.
+	s.send(t, bob, 7, "hi")
+	waitRequest(t, db, bob, 7)
+
+	s.send(t, bob, 7, "replayed")
+	s.send(t, bob, 8, "anyone?")
+	req := waitRequest(t, db, bob, 8)
+
+	if len(req.Messages) != 2 {
+		t.Fatalf("Should keep the messages of the request, got %d", len(req.Messages))
+	}
+
+	db.DeclineRequest(bob)
+
+	s.send(t, bob, 9, "again")
+	waitRequest(t, db, bob, 9)
+}
+
+func Test_BadCommand(t *testing.T) {
+	db, err := app.NewDatabase(t.TempDir(), me, dataKey)
+	if err != nil {
+		t.Fatalf("Should be able to create a database: %s", err)
+	}
+
+	if _, err := db.AddContact(alice, "alice"); err != nil {
+		t.Fatalf("Should be able to add a contact: %s", err)
+	}
+
+	s := newServer(t)
+	delivered := connect(t, s, db)
+
+	s.send(t, alice, 1, "/nope")
+	s.send(t, alice, 2, "/key not a key")
+	s.send(t, alice, 3, "/name {")
+	s.send(t, alice, 4, "still here")
+	wait(t, delivered, 1)
+
+	got := fmt.Sprint(texts(t, db, alice))
+	exp := fmt.Sprint([]string{"still here"})
+	if got != exp {
+		t.Logf("got: %s", got)
+		t.Logf("exp: %s", exp)
+		t.Fatalf("Should keep listening after a bad command.")
+	}
+}
+
+func Test_RequestKey(t *testing.T) {
+	db, err := app.NewDatabase(t.TempDir(), me, dataKey)
+	if err != nil {
+		t.Fatalf("Should be able to create a database: %s", err)
+	}
+
+	id, err := app.NewID(t.TempDir(), []byte("correct horse"))
+	if err != nil {
+		t.Fatalf("Should be able to create an identity: %s", err)
+	}
+
+	s := newServer(t)
+	connect(t, s, db)
+
+	s.send(t, bob, 1, "/key not a key")
+	s.send(t, bob, 2, "hi")
+	if req := waitRequest(t, db, bob, 2); len(req.Key) != 0 {
+		t.Fatalf("Should not keep a key that does not parse, got %q", req.Key)
+	}
+
+	s.send(t, bob, 3, "/key "+id.RSAPublicKey)
+	if req := waitRequest(t, db, bob, 3); string(req.Key) != id.RSAPublicKey {
+		t.Fatal("Should keep the key of the request")
+	}
+
+	//the caller pins the key, so a changed one is reported.
+	usr, err := db.AcceptRequest(bob)
+	if err != nil {
+		t.Fatalf("Should be able to accept the request: %s", err)
+	}
+
+	if len(usr.Key) != 0 {
+		t.Fatal("Should not trust the key of a request before it is pinned")
+	}
+}
+
+func Test_RequestLimits(t *testing.T) {
+	db, err := app.NewDatabase(t.TempDir(), me, dataKey)
+	if err != nil {
+		t.Fatalf("Should be able to create a database: %s", err)
+	}
+
+	req := app.Request{ID: bob}
+	for range 30 {
+		req = app.AddRequestMessage(req, "hi")
+	}
+
+	if err := db.UpdateRequest(req); err != nil {
+		t.Fatalf("Should be able to store a request: %s", err)
+	}
+
+	if got, _ := db.LookupRequest(bob); len(got.Messages) != 20 {
+		t.Fatalf("Should keep the first 20 messages, got %d", len(got.Messages))
+	}
+
+	for i := range 49 {
+		if err := db.UpdateRequest(app.Request{ID: common.BigToAddress(big.NewInt(int64(i + 100)))}); err != nil {
+			t.Fatalf("Should be able to store request %d: %s", i, err)
+		}
+	}
+
+	if err := db.UpdateRequest(app.Request{ID: alice}); !errors.Is(err, app.ErrTooManyRequests) {
+		t.Fatalf("Should not store more than 50 requests, got: %v", err)
+	}
+
+	if err := db.UpdateRequest(req); err != nil {
+		t.Fatalf("Should still update a pending request: %s", err)
+	}
+}
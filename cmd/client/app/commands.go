@@ -0,0 +1,580 @@
+package app
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"unicode"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// Commands are typed in the text area and start with a slash. They run in
+// the client, the ones that reach a contact or the server do it through the
+// Client, so a command line is never sent as a message.
+
+// command is a slash command, args is its usage and min and max bound the
+// number of arguments, max is -1 for any number.
+type command struct {
+	name    string
+	aliases []string
+	args    string
+	help    string
+	min     int
+	max     int
+	contact bool
+	run     func(a *App, inv invocation) error
+}
+
+// invocation is a parsed command line, contact is the selected contact of
+// the commands that need one.
+type invocation struct {
+	name    string
+	args    []string
+	contact common.Address
+}
+
+// usage returns the command line of c with its arguments.
+func (c *command) usage() string {
+	if c.args == "" {
+		return "/" + c.name
+	}
+	return "/" + c.name + " " + c.args
+}
+
+// commandSet is the registry of the commands by name and alias.
+type commandSet struct {
+	commands []*command
+	byName   map[string]*command
+}
+
+func newCommandSet(commands ...*command) *commandSet {
+	s := commandSet{
+		byName: make(map[string]*command),
+	}
+
+	for _, c := range commands {
+		s.add(c)
+	}
+
+	return &s
+}
+
+// add registers c, a name taken twice is a programming error.
+func (s *commandSet) add(c *command) {
+	for _, name := range append([]string{c.name}, c.aliases...) {
+		if _, ok := s.byName[name]; ok {
+			panic(fmt.Sprintf("command %s is registered twice", name))
+		}
+		s.byName[name] = c
+	}
+
+	s.commands = append(s.commands, c)
+}
+
+func (s *commandSet) lookup(name string) (*command, bool) {
+	c, ok := s.byName[strings.ToLower(strings.TrimPrefix(name, "/"))]
+	return c, ok
+}
+
+// complete returns the names and aliases starting with prefix, sorted.
+func (s *commandSet) complete(prefix string) []string {
+	prefix = strings.ToLower(strings.TrimPrefix(prefix, "/"))
+
+	var names []string
+	for name := range s.byName {
+		if strings.HasPrefix(name, prefix) {
+			names = append(names, name)
+		}
+	}
+	slices.Sort(names)
+
+	return names
+}
+
+// parseCommandLine splits a command line into its name and arguments.
+// Arguments are separated by spaces, quotes keep them together and a
+// backslash escapes the next character outside of single quotes.
+func parseCommandLine(line string) (string, []string, error) {
+	var args []string
+	var arg strings.Builder
+	var quote rune
+	var inArg, escaped bool
+
+	for _, r := range strings.TrimSpace(line) {
+		switch {
+		case escaped:
+			arg.WriteRune(r)
+			escaped = false
+		case r == '\\' && quote != '\'':
+			escaped = true
+			inArg = true
+		case quote != 0:
+			if r == quote {
+				quote = 0
+				continue
+			}
+			arg.WriteRune(r)
+		case r == '"' || r == '\'':
+			quote = r
+			inArg = true
+		case unicode.IsSpace(r):
+			if inArg {
+				args = append(args, arg.String())
+				arg.Reset()
+				inArg = false
+			}
+		default:
+			arg.WriteRune(r)
+			inArg = true
+		}
+	}
+
+	switch {
+	case quote != 0:
+		return "", nil, fmt.Errorf("missing closing %c", quote)
+	case escaped:
+		return "", nil, errors.New("nothing to escape at the end")
+	}
+
+	if inArg {
+		args = append(args, arg.String())
+	}
+
+	if len(args) == 0 || !strings.HasPrefix(args[0], "/") {
+		return "", nil, errors.New("a command starts with /")
+	}
+
+	return args[0], args[1:], nil
+}
+
+// =============================================================================
+
+// runCommand runs the command line, the errors are shown as system messages.
+func (a *App) runCommand(line string) {
+	name, args, err := parseCommandLine(line)
+	if err != nil {
+		a.WriteMessage("system", systemErrorMessage("invalid command: %s", err))
+		return
+	}
+
+	c, ok := a.commands.lookup(name)
+	if !ok {
+		a.WriteMessage("system", systemErrorMessage("unknown command %s, type /help to list the commands", name))
+		return
+	}
+
+	if len(args) < c.min || (c.max != -1 && len(args) > c.max) {
+		a.WriteMessage("system", systemErrorMessage("usage: %s", c.usage()))
+		return
+	}
+
+	inv := invocation{
+		name: c.name,
+		args: args,
+	}
+
+	if c.contact {
+		id, ok := a.selectedContact()
+		if !ok {
+			a.WriteMessage("system", systemErrorMessage("select a contact for /%s", c.name))
+			return
+		}
+		inv.contact = id
+	}
+
+	if err := c.run(a, inv); err != nil {
+		a.WriteMessage("system", systemErrorMessage("%s failed: %s", c.name, err))
+	}
+}
+
+// completeCommand completes the command name in the text area, the
+// candidates are listed when there are several.
+func (a *App) completeCommand() bool {
+	text := a.textArea.GetText()
+	if !strings.HasPrefix(text, "/") || strings.ContainsFunc(text, unicode.IsSpace) {
+		return false
+	}
+
+	names := a.commands.complete(text)
+	switch len(names) {
+	case 0:
+		return true
+	case 1:
+		a.textArea.SetText("/"+names[0]+" ", true)
+		return true
+	}
+
+	//complete up to where the candidates part ways.
+	prefix := names[0]
+	for _, name := range names[1:] {
+		for !strings.HasPrefix(name, prefix) {
+			prefix = prefix[:len(prefix)-1]
+		}
+	}
+
+	if len(prefix) > len(text)-1 {
+		a.textArea.SetText("/"+prefix, true)
+		return true
+	}
+
+	a.WriteMessage("system", systemErrorMessage("/%s", strings.Join(names, " /")))
+	return true
+}
+
+// =============================================================================
+
+// defaultCommands are the commands of the client.
+func defaultCommands() *commandSet {
+	return newCommandSet(
+		&command{
+			name:    "help",
+			aliases: []string{"?", "h"},
+			args:    "[command]",
+			help:    "list the commands or show the usage of one",
+			max:     1,
+			run:     (*App).help,
+		},
+		&command{
+			name: "clear",
+			help: "clear the screen, the history is kept",
+			run: func(a *App, inv invocation) error {
+				a.textView.Clear()
+				return nil
+			},
+		},
+		&command{
+			name:    "contacts",
+			aliases: []string{"ls"},
+			help:    "list the contacts with their address and trust state",
+			run:     (*App).listContacts,
+		},
+		&command{
+			name: "name",
+			args: "<name>",
+			help: "change your name and tell your contacts",
+			min:  1,
+			max:  -1,
+			run: func(a *App, inv invocation) error {
+				sent, err := a.client.SetName(strings.Join(inv.args, " "))
+				if err != nil {
+					return err
+				}
+				a.WriteMessage("system", systemErrorMessage("you are now known as %s, told %d contacts", a.db.MyAccount().Name, sent))
+				return nil
+			},
+		},
+		&command{
+			name: "find",
+			args: "<name>",
+			help: "search the directory",
+			min:  1,
+			max:  -1,
+			run: func(a *App, inv invocation) error {
+				name := strings.Join(inv.args, " ")
+				profiles, err := a.client.Find(name)
+				if err != nil {
+					return err
+				}
+				a.showFindResults(name, profiles)
+				return nil
+			},
+		},
+		&command{
+			name: "publish",
+			args: "[avatar]",
+			help: "publish your profile in the directory",
+			max:  -1,
+			run: func(a *App, inv invocation) error {
+				if err := a.client.PublishProfile(a.db.MyAccount().Name, strings.Join(inv.args, " ")); err != nil {
+					return err
+				}
+				a.WriteMessage("system", systemErrorMessage("your profile is published in the directory"))
+				return nil
+			},
+		},
+		&command{
+			name: "unpublish",
+			help: "remove your profile from the directory",
+			run: func(a *App, inv invocation) error {
+				if err := a.client.UnpublishProfile(); err != nil {
+					return err
+				}
+				a.WriteMessage("system", systemErrorMessage("your profile is removed from the directory"))
+				return nil
+			},
+		},
+		&command{
+			name: "add",
+			args: "[address name]",
+			help: "add a contact, a form opens without arguments",
+			max:  -1,
+			run: func(a *App, inv invocation) error {
+				switch len(inv.args) {
+				case 0:
+					a.showAddContact()
+					return nil
+				case 1:
+					return errors.New("usage: /add [address name]")
+				}
+
+				id, err := ParseAddress(inv.args[0])
+				if err != nil {
+					return err
+				}
+				a.addContact(id, strings.Join(inv.args[1:], " "), nil)
+				return nil
+			},
+		},
+		&command{
+			name: "invite",
+			help: "show your invite as a QR code and a URI",
+			run: func(a *App, inv invocation) error {
+				return a.showInvite()
+			},
+		},
+		&command{
+			name: "accept",
+			args: "<invite>",
+			help: "add the contact of an invite with its key pinned",
+			min:  1,
+			max:  1,
+			run: func(a *App, inv invocation) error {
+				return a.acceptInvite(inv.args[0])
+			},
+		},
+		&command{
+			name:    "rename",
+			args:    "[name]",
+			help:    "rename the contact, a form opens without a name",
+			max:     -1,
+			contact: true,
+			run: func(a *App, inv invocation) error {
+				if len(inv.args) == 0 {
+					a.showRenameContact(inv.contact)
+					return nil
+				}
+				return a.renameContact(inv.contact, strings.Join(inv.args, " "))
+			},
+		},
+		&command{
+			name:    "remove",
+			aliases: []string{"rm"},
+			args:    "[keep|delete]",
+			help:    "remove the contact and keep or delete its history, asks without an argument",
+			max:     1,
+			contact: true,
+			run: func(a *App, inv invocation) error {
+				if len(inv.args) == 0 {
+					a.showRemoveContact(inv.contact)
+					return nil
+				}
+
+				switch strings.ToLower(inv.args[0]) {
+				case "keep":
+					return a.removeContact(inv.contact, false)
+				case "delete":
+					return a.removeContact(inv.contact, true)
+				}
+				return fmt.Errorf("keep or delete the history, not %q", inv.args[0])
+			},
+		},
+		&command{
+			name:    "share",
+			args:    "key",
+			help:    "send your encryption key to the contact",
+			min:     1,
+			max:     1,
+			contact: true,
+			run: func(a *App, inv invocation) error {
+				if !strings.EqualFold(inv.args[0], "key") {
+					return fmt.Errorf("nothing to share as %q", inv.args[0])
+				}
+				return a.client.ShareKey(inv.contact)
+			},
+		},
+		&command{
+			name:    "verify",
+			help:    "compare the safety number with the contact",
+			contact: true,
+			run: func(a *App, inv invocation) error {
+				a.showVerify(inv.contact)
+				return nil
+			},
+		},
+		&command{
+			name:    "unverify",
+			help:    "mark the contact as not verified",
+			contact: true,
+			run: func(a *App, inv invocation) error {
+				if err := a.db.SetVerified(inv.contact, false); err != nil {
+					return err
+				}
+				a.refreshContact(inv.contact)
+				return nil
+			},
+		},
+		&command{
+			name:    "accept-key",
+			help:    "trust the new key of the contact",
+			contact: true,
+			run: func(a *App, inv invocation) error {
+				if err := a.db.AcceptPendingKey(inv.contact); err != nil {
+					return err
+				}
+				a.refreshContact(inv.contact)
+				a.WriteMessage("system", systemErrorMessage("accepted the new key, fingerprint %s, run /verify to verify it", a.client.fingerprint(inv.contact)))
+				return nil
+			},
+		},
+		&command{
+			name:    "pin",
+			help:    "keep the contact at the top of the list",
+			contact: true,
+			run: func(a *App, inv invocation) error {
+				return a.setPinned(inv.contact, true)
+			},
+		},
+		&command{
+			name:    "unpin",
+			help:    "sort the contact by its last message again",
+			contact: true,
+			run: func(a *App, inv invocation) error {
+				return a.setPinned(inv.contact, false)
+			},
+		},
+		&command{
+			name:    "mute",
+			help:    "stop the notifications for the contact",
+			contact: true,
+			run: func(a *App, inv invocation) error {
+				return a.setMuted(inv.contact, true)
+			},
+		},
+		&command{
+			name:    "unmute",
+			help:    "notify the messages of the contact again",
+			contact: true,
+			run: func(a *App, inv invocation) error {
+				return a.setMuted(inv.contact, false)
+			},
+		},
+		&command{
+			name: "notify",
+			args: "[bell|off|command]",
+			help: "show or change how new messages are notified until the client exits",
+			max:  -1,
+			run: func(a *App, inv invocation) error {
+				if len(inv.args) != 0 {
+					a.SetNotify(strings.Join(inv.args, " "))
+				}
+				a.WriteMessage("system", systemErrorMessage("new messages are notified with: %s", a.notifyWith()))
+				return nil
+			},
+		},
+		&command{
+			name: "block",
+			args: "[address]",
+			help: "block the contact or the address",
+			max:  1,
+			run: func(a *App, inv invocation) error {
+				return a.control(actionBlock, inv)
+			},
+		},
+		&command{
+			name: "unblock",
+			args: "[address]",
+			help: "unblock the contact or the address",
+			max:  1,
+			run: func(a *App, inv invocation) error {
+				return a.control(actionUnblock, inv)
+			},
+		},
+	)
+}
+
+// help lists the commands, or shows the usage of the one in the arguments.
+func (a *App) help(inv invocation) error {
+	if len(inv.args) == 1 {
+		c, ok := a.commands.lookup(inv.args[0])
+		if !ok {
+			return fmt.Errorf("unknown command %s", inv.args[0])
+		}
+
+		text := fmt.Sprintf("%s\n  %s", c.usage(), c.help)
+		if len(c.aliases) != 0 {
+			text += "\n  aliases: /" + strings.Join(c.aliases, ", /")
+		}
+		a.WriteMessage("system", systemErrorMessage("%s", text))
+		return nil
+	}
+
+	var b strings.Builder
+	b.WriteString("commands, tab completes them:")
+	for _, c := range a.commands.commands {
+		fmt.Fprintf(&b, "\n  %-24s %s", c.usage(), c.help)
+	}
+	b.WriteString("\nkeys: ctrl+r requests, ctrl+b blocked, ctrl+f search, ctrl+p profiles, esc quit")
+	a.WriteMessage("system", systemErrorMessage("%s", b.String()))
+
+	return nil
+}
+
+// listContacts writes the contacts of the profile on screen.
+func (a *App) listContacts(inv invocation) error {
+	contacts := a.db.Contacts()
+	if len(contacts) == 0 {
+		a.WriteMessage("system", systemErrorMessage("no contacts yet, use /find to look for one"))
+		return nil
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "%d contacts:", len(contacts))
+	for _, c := range contacts {
+		state := "not verified"
+		switch {
+		case a.db.IsBlocked(c.ID):
+			state = "blocked"
+		case len(c.PendingKey) != 0:
+			state = "key changed"
+		case c.Verified:
+			state = "verified"
+		}
+		if c.Pinned {
+			state += ", pinned"
+		}
+		if c.Muted {
+			state += ", muted"
+		}
+		if c.Unread > 0 {
+			state += fmt.Sprintf(", %d unread", c.Unread)
+		}
+		fmt.Fprintf(&b, "\n  %-20s %s %s", c.Name, c.ID.Hex(), state)
+	}
+	a.WriteMessage("system", systemErrorMessage("%s", b.String()))
+
+	return nil
+}
+
+// control blocks or unblocks the address in the arguments or the selected
+// contact.
+func (a *App) control(action string, inv invocation) error {
+	var target common.Address
+	switch {
+	case len(inv.args) == 1:
+		id, err := ParseAddress(inv.args[0])
+		if err != nil {
+			return err
+		}
+		target = id
+	default:
+		id, ok := a.selectedContact()
+		if !ok {
+			return errors.New("no contact selected")
+		}
+		target = id
+	}
+
+	return a.client.SendControl(action, target)
+}
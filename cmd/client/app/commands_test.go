@@ -0,0 +1,110 @@
+package app_test
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/hamidoujand/echo/cmd/client/app"
+)
+
+func Test_ParseCommandLine(t *testing.T) {
+	tt := []struct {
+		name    string
+		line    string
+		cmd     string
+		args    []string
+		wantErr bool
+	}{
+		{name: "no args", line: "/help", cmd: "/help"},
+		{name: "args", line: "  /add  0x2222 bob ", cmd: "/add", args: []string{"0x2222", "bob"}},
+		{name: "double quotes", line: `/rename "Bob Smith"`, cmd: "/rename", args: []string{"Bob Smith"}},
+		{name: "single quotes", line: `/name 'Alice  B'`, cmd: "/name", args: []string{"Alice  B"}},
+		{name: "quotes inside an arg", line: `/add 0x2222 Bob" "Smith`, cmd: "/add", args: []string{"0x2222", "Bob Smith"}},
+		{name: "empty quotes", line: `/notify ""`, cmd: "/notify", args: []string{""}},
+		{name: "escaped quote", line: `/name Bob\"s`, cmd: "/name", args: []string{`Bob"s`}},
+		{name: "escaped quote in quotes", line: `/name "say \"hi\""`, cmd: "/name", args: []string{`say "hi"`}},
+		{name: "escaped space", line: `/name Bob\ Smith`, cmd: "/name", args: []string{"Bob Smith"}},
+		{name: "backslash in single quotes", line: `/name 'a\b'`, cmd: "/name", args: []string{`a\b`}},
+		{name: "unterminated double quote", line: `/rename "Bob Smith`, wantErr: true},
+		{name: "unterminated single quote", line: `/rename 'Bob`, wantErr: true},
+		{name: "trailing backslash", line: `/name Bob\`, wantErr: true},
+		{name: "no slash", line: "help", wantErr: true},
+		{name: "empty", line: "   ", wantErr: true},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			cmd, args, err := app.ParseCommandLine(tc.line)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("Should not parse %q, got %s %q", tc.line, cmd, args)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("Should be able to parse %q: %s", tc.line, err)
+			}
+
+			got := fmt.Sprintf("%s %q", cmd, args)
+			exp := fmt.Sprintf("%s %q", tc.cmd, tc.args)
+
+			if got != exp {
+				t.Logf("got: %s", got)
+				t.Logf("exp: %s", exp)
+				t.Fatalf("Should split the command line.")
+			}
+		})
+	}
+}
+
+func Test_LookupCommand(t *testing.T) {
+	tt := []struct {
+		name string
+		cmd  string
+		ok   bool
+	}{
+		{name: "/help", cmd: "help", ok: true},
+		{name: "help", cmd: "help", ok: true},
+		{name: "/?", cmd: "help", ok: true},
+		{name: "/h", cmd: "help", ok: true},
+		{name: "/LS", cmd: "contacts", ok: true},
+		{name: "/rm", cmd: "remove", ok: true},
+		{name: "/hel"},
+		{name: "/send"},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			cmd, ok := app.LookupCommand(tc.name)
+			if ok != tc.ok || cmd != tc.cmd {
+				t.Fatalf("Should look up %s as %q %t, got %q %t", tc.name, tc.cmd, tc.ok, cmd, ok)
+			}
+		})
+	}
+}
+
+func Test_CompleteCommand(t *testing.T) {
+	tt := []struct {
+		prefix string
+		names  []string
+	}{
+		{prefix: "/un", names: []string{"unblock", "unmute", "unpin", "unpublish", "unverify"}},
+		{prefix: "/RE", names: []string{"remove", "rename"}},
+		{prefix: "h", names: []string{"h", "help"}},
+		{prefix: "/help", names: []string{"help"}},
+		{prefix: "/zz"},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.prefix, func(t *testing.T) {
+			got := fmt.Sprint(app.CompleteCommand(tc.prefix))
+			exp := fmt.Sprint(tc.names)
+			if got != exp {
+				t.Logf("got: %s", got)
+				t.Logf("exp: %s", exp)
+				t.Fatalf("Should complete %s.", tc.prefix)
+			}
+		})
+	}
+}
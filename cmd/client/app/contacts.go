@@ -0,0 +1,224 @@
+package app
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/rivo/tview"
+)
+
+// addContact adds the contact id, a pending request from id is accepted so
+// its nonce and messages are kept. The key, when known, is pinned.
+func (a *App) addContact(id common.Address, name string, key []byte) {
+	var usr User
+	var err error
+	switch req, ok := a.db.LookupRequest(id); {
+	case ok:
+		usr, err = a.acceptRequest(id)
+		if err == nil && strings.TrimSpace(name) != "" && name != req.Name {
+			usr, err = a.db.RenameContact(id, name)
+		}
+		a.UpdateRequests()
+	default:
+		usr, err = a.db.AddContact(id, name)
+	}
+
+	if err != nil {
+		a.WriteMessage("system", systemErrorMessage("adding contact failed: %s", err))
+		return
+	}
+
+	if len(key) != 0 {
+		status, err := a.db.PinContactKey(id, key)
+		if err != nil {
+			a.WriteMessage("system", systemErrorMessage("storing contact key failed: %s", err))
+		}
+		a.client.notifyKeyStatus(id, usr.Name, status)
+	}
+
+	a.UpdateContact(usr.ID.Hex(), usr.Name)
+	a.sortContacts()
+	a.WriteMessage("system", systemErrorMessage("added %s to your contacts", usr.Name))
+}
+
+// acceptRequest turns the request of id into a contact, the key it came with
+// is pinned the way a key sent by a contact is.
+func (a *App) acceptRequest(id common.Address) (User, error) {
+	req, _ := a.db.LookupRequest(id)
+
+	usr, err := a.db.AcceptRequest(id)
+	if err != nil {
+		return User{}, err
+	}
+
+	if len(req.Key) != 0 {
+		status, err := a.db.PinContactKey(req.ID, req.Key)
+		if err != nil {
+			return User{}, fmt.Errorf("pinning contact key: %w", err)
+		}
+		a.client.notifyKeyStatus(req.ID, usr.Name, status)
+	}
+
+	return usr, nil
+}
+
+// renameContact renames the contact id.
+func (a *App) renameContact(id common.Address, name string) error {
+	usr, err := a.db.RenameContact(id, name)
+	if err != nil {
+		return err
+	}
+
+	a.refreshContact(id)
+	a.WriteMessage("system", systemErrorMessage("renamed the contact %s to %s", id.Hex(), usr.Name))
+	return nil
+}
+
+// removeContact removes the contact id from the database and the list, its
+// history goes with it when history is set.
+func (a *App) removeContact(id common.Address, history bool) error {
+	usr, err := a.db.LookupContact(id)
+	if err != nil {
+		return err
+	}
+
+	if err := a.db.RemoveContact(id, history); err != nil {
+		return err
+	}
+
+	for i := range a.list.GetItemCount() {
+		if _, idStr := a.list.GetItemText(i); idStr == id.Hex() {
+			a.list.RemoveItem(i)
+			break
+		}
+	}
+
+	if a.shown == id {
+		a.shown = common.Address{}
+		a.messages = nil
+		a.textView.Clear()
+	}
+
+	what := "kept its history"
+	if history {
+		what = "deleted its history"
+	}
+	a.WriteMessage("system", systemErrorMessage("removed %s from your contacts and %s", usr.Name, what))
+
+	return nil
+}
+
+// =============================================================================
+
+// showAddContact opens the form to add a contact by its address.
+func (a *App) showAddContact() {
+	const page = "add"
+
+	const (
+		addressLabel = "Address"
+		nameLabel    = "Name"
+	)
+
+	form := tview.NewForm().
+		AddInputField(addressLabel, "", 44, nil, nil).
+		AddInputField(nameLabel, "", 44, nil, nil)
+
+	form.AddButton("Add", func() {
+		id, err := ParseAddress(form.GetFormItemByLabel(addressLabel).(*tview.InputField).GetText())
+		if err != nil {
+			a.WriteMessage("system", systemErrorMessage("%s", err))
+			return
+		}
+
+		a.closeModal(page)
+		a.addContact(id, form.GetFormItemByLabel(nameLabel).(*tview.InputField).GetText(), nil)
+	})
+
+	form.AddButton("Cancel", func() {
+		a.closeModal(page)
+	})
+
+	form.SetCancelFunc(func() {
+		a.closeModal(page)
+	})
+
+	form.SetBorder(true)
+	form.SetTitle("Add a contact (esc: close)")
+
+	a.showModal(page, form, 60, 9)
+}
+
+// showRenameContact opens the form to rename the contact id.
+func (a *App) showRenameContact(id common.Address) {
+	const page = "rename"
+
+	const nameLabel = "Name"
+
+	usr, err := a.db.LookupContact(id)
+	if err != nil {
+		a.WriteMessage("system", systemErrorMessage("rename failed: %s", err))
+		return
+	}
+
+	form := tview.NewForm().
+		AddInputField(nameLabel, usr.Name, 44, nil, nil)
+
+	form.AddButton("Rename", func() {
+		if err := a.renameContact(id, form.GetFormItemByLabel(nameLabel).(*tview.InputField).GetText()); err != nil {
+			a.WriteMessage("system", systemErrorMessage("rename failed: %s", err))
+			return
+		}
+		a.closeModal(page)
+	})
+
+	form.AddButton("Cancel", func() {
+		a.closeModal(page)
+	})
+
+	form.SetCancelFunc(func() {
+		a.closeModal(page)
+	})
+
+	form.SetBorder(true)
+	form.SetTitle(fmt.Sprintf("Rename %s (esc: close)", usr.Name))
+
+	a.showModal(page, form, 60, 7)
+}
+
+// showRemoveContact asks whether to remove the contact id and what happens
+// to its history.
+func (a *App) showRemoveContact(id common.Address) {
+	const page = "remove"
+
+	const (
+		keep        = "Remove, keep history"
+		withHistory = "Remove with history"
+		cancel      = "Cancel"
+	)
+
+	usr, err := a.db.LookupContact(id)
+	if err != nil {
+		a.WriteMessage("system", systemErrorMessage("remove failed: %s", err))
+		return
+	}
+
+	modal := tview.NewModal().
+		SetText(fmt.Sprintf("Remove %s (%s) from your contacts?\n\nA kept history comes back when the contact is added again.", usr.Name, usr.ID.Hex())).
+		AddButtons([]string{keep, withHistory, cancel}).
+		SetDoneFunc(func(buttonIndex int, buttonLabel string) {
+			a.pages.RemovePage(page)
+			a.app.SetFocus(a.textArea)
+
+			if buttonLabel != keep && buttonLabel != withHistory {
+				return
+			}
+
+			if err := a.removeContact(id, buttonLabel == withHistory); err != nil {
+				a.WriteMessage("system", systemErrorMessage("remove failed: %s", err))
+			}
+		})
+
+	a.pages.AddPage(page, modal, true, true)
+	a.app.SetFocus(modal)
+}
@@ -0,0 +1,156 @@
+package app_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/hamidoujand/echo/cmd/client/app"
+)
+
+func Test_ManageContacts(t *testing.T) {
+	db, err := app.NewDatabase(t.TempDir(), me, dataKey)
+	if err != nil {
+		t.Fatalf("Should be able to create a database: %s", err)
+	}
+
+	if n := len(db.Contacts()); n != 0 {
+		t.Fatalf("Should start without contacts, got %d", n)
+	}
+
+	archive := `{
+		"version": 1,
+		"account": "` + me.Hex() + `",
+		"conversations": [{
+			"contact": "` + alice.Hex() + `",
+			"name": "alice",
+			"messages": [
+				{"sender": "alice", "text": "hello", "timestamp": "2025-03-01T10:00:00Z"}
+			]
+		}]
+	}`
+
+	if _, err := db.Import(strings.NewReader(archive)); err != nil {
+		t.Fatalf("Should be able to import the history: %s", err)
+	}
+
+	if _, err := db.AddContact(alice, "alice again"); err == nil {
+		t.Fatal("Should not add alice twice")
+	}
+
+	if _, err := db.AddContact(me, "me"); err == nil {
+		t.Fatal("Should not add yourself")
+	}
+
+	usr, err := db.RenameContact(alice, " Alice ")
+	if err != nil || usr.Name != "Alice" {
+		t.Fatalf("Should rename alice, got %q: %v", usr.Name, err)
+	}
+
+	if err := db.RemoveContact(alice, false); err != nil {
+		t.Fatalf("Should be able to remove alice: %s", err)
+	}
+
+	if _, err := db.LookupContact(alice); err == nil {
+		t.Fatal("Should remove alice from the contacts")
+	}
+
+	if _, err := db.AddContact(alice, "alice"); err != nil {
+		t.Fatalf("Should be able to add alice again: %s", err)
+	}
+
+	msgs, _, err := db.History(alice, -1, 10)
+	if err != nil || len(msgs) != 1 {
+		t.Fatalf("Should keep the history, got %d messages: %v", len(msgs), err)
+	}
+
+	if err := db.RemoveContact(alice, true); err != nil {
+		t.Fatalf("Should be able to remove alice with the history: %s", err)
+	}
+
+	if _, err := db.AddContact(alice, "alice"); err != nil {
+		t.Fatalf("Should be able to add alice again: %s", err)
+	}
+
+	msgs, _, err = db.History(alice, -1, 10)
+	if err != nil || len(msgs) != 0 {
+		t.Fatalf("Should delete the history, got %d messages: %v", len(msgs), err)
+	}
+
+	results, err := db.Search(app.SearchQuery{Text: "hello"})
+	if err != nil || len(results) != 0 {
+		t.Fatalf("Should not find the deleted messages, got %d results: %v", len(results), err)
+	}
+}
+
+func Test_ContactOrder(t *testing.T) {
+	dir := t.TempDir()
+
+	db, err := app.NewDatabase(dir, me, dataKey)
+	if err != nil {
+		t.Fatalf("Should be able to create a database: %s", err)
+	}
+
+	archive := `{
+		"version": 1,
+		"account": "` + me.Hex() + `",
+		"conversations": [{
+			"contact": "` + alice.Hex() + `",
+			"name": "alice",
+			"messages": [
+				{"sender": "alice", "text": "hello", "timestamp": "2025-03-01T10:00:00Z"}
+			]
+		}, {
+			"contact": "` + bob.Hex() + `",
+			"name": "bob",
+			"messages": [
+				{"sender": "bob", "text": "hi", "timestamp": "2025-03-02T10:00:00Z"}
+			]
+		}]
+	}`
+
+	if _, err := db.Import(strings.NewReader(archive)); err != nil {
+		t.Fatalf("Should be able to import the history: %s", err)
+	}
+
+	order := func(db *app.Database) string {
+		var names []string
+		for _, c := range db.Contacts() {
+			names = append(names, c.Name)
+		}
+		return strings.Join(names, ",")
+	}
+
+	if got := order(db); got != "bob,alice" {
+		t.Fatalf("Should sort the latest conversation first, got %s", got)
+	}
+
+	if err := db.SetPinned(alice, true); err != nil {
+		t.Fatalf("Should be able to pin alice: %s", err)
+	}
+
+	if err := db.SetMuted(bob, true); err != nil {
+		t.Fatalf("Should be able to mute bob: %s", err)
+	}
+
+	if got := order(db); got != "alice,bob" {
+		t.Fatalf("Should sort the pinned contacts first, got %s", got)
+	}
+
+	db, err = app.NewDatabase(dir, me, dataKey)
+	if err != nil {
+		t.Fatalf("Should be able to open the database again: %s", err)
+	}
+
+	if got := order(db); got != "alice,bob" {
+		t.Fatalf("Should keep the order after a restart, got %s", got)
+	}
+
+	usr, err := db.LookupContact(bob)
+	if err != nil || !usr.Muted || usr.Pinned || usr.Unread != 0 {
+		t.Fatalf("Should keep bob muted and not pinned without unread messages: %+v %v", usr, err)
+	}
+
+	if err := db.MarkRead(bob); err != nil {
+		t.Fatalf("Should be able to mark the messages of bob read: %s", err)
+	}
+}
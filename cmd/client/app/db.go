@@ -1,10 +1,12 @@
 package app
 
 import (
-	"bufio"
+	"bytes"
+	"cmp"
+	"crypto/ecdh"
+	"crypto/rand"
 	"crypto/rsa"
 	"crypto/x509"
-	"encoding/json"
 	"encoding/pem"
 	"errors"
 	"fmt"
@@ -40,11 +42,52 @@ type contact struct {
 	// Nonce for messages THIS contact sends to YOU
 	IncomingNonce uint64 `json:"incomingNonce"`
 	Key           []byte `json:"key"`
+	// PendingKey is a new key received for THIS contact that is not trusted yet.
+	PendingKey []byte   `json:"pendingKey,omitempty"`
+	Verified   bool     `json:"verified"`
+	Session    *session `json:"session,omitempty"`
+	// FormerName is the name THIS contact had before its last signed name
+	// update, NameUpdated is the time of that update.
+	FormerName  string `json:"formerName,omitempty"`
+	NameUpdated int64  `json:"nameUpdated,omitempty"`
+	// InviteKey is the key fingerprint in the invite of THIS contact, the
+	// first key seen has to match it.
+	InviteKey string `json:"inviteKey,omitempty"`
+	// Unread is the number of messages from THIS contact since the
+	// conversation was last opened, LastActivity is the time of the last
+	// message either way.
+	Unread       int   `json:"unread,omitempty"`
+	LastActivity int64 `json:"lastActivity,omitempty"`
+	Pinned       bool  `json:"pinned,omitempty"`
+	Muted        bool  `json:"muted,omitempty"`
+}
+
+// preKeyPair is a X25519 key pair handed out through the prekey directory.
+type preKeyPair struct {
+	ID      uint32 `json:"id"`
+	Private []byte `json:"private"`
+	Created int64  `json:"created,omitempty"`
+}
+
+type preKeys struct {
+	SignedPreKey *preKeyPair `json:"signedPreKey,omitempty"`
+	// OldSignedPreKey is the signed prekey before the last rotation, contacts
+	// holding the old bundle can still start a session with it.
+	OldSignedPreKey *preKeyPair  `json:"oldSignedPreKey,omitempty"`
+	OneTimePreKeys  []preKeyPair `json:"oneTimePreKeys"`
+	NextID          uint32       `json:"nextID"`
 }
 
 type account struct {
-	MyAccount profile   `json:"myAccount"`
-	Contacts  []contact `json:"contacts"`
+	Version   int     `json:"version"`
+	MyAccount profile `json:"myAccount"`
+	// Contacts is only set by older clients, contacts live in their own files.
+	Contacts []contact        `json:"contacts,omitempty"`
+	Blocked  []common.Address `json:"blocked"`
+	PreKeys  preKeys          `json:"preKeys"`
+	// Migration is set after the identity key was rotated, until every
+	// contact got the statement.
+	Migration *migrationState `json:"migration,omitempty"`
 }
 
 type User struct {
@@ -53,7 +96,40 @@ type User struct {
 	OutgoingNonce uint64
 	IncomingNonce uint64
 	Key           []byte
+	PendingKey    []byte
+	Verified      bool
+	Session       *session
+	FormerName    string
+	NameUpdated   int64
+	InviteKey     string
+	Unread        int
+	LastActivity  int64
+	Pinned        bool
+	Muted         bool
+}
+
+// Anyone can send a request, only this many are kept with the first messages
+// of each.
+const (
+	maxRequests        = 50
+	maxRequestMessages = 20
+)
+
+// ErrTooManyRequests is returned when a new request does not fit.
+var ErrTooManyRequests = errors.New("too many pending contact requests")
+
+// Request is a pending contact request, it only lives in memory until it is
+// accepted. The sender is halfway through its nonces after a restart or a
+// decline, so the first nonce of a request is taken as it comes.
+type Request struct {
+	ID            common.Address
+	Name          string
+	IncomingNonce uint64
+	Key           []byte
+	Session       *session
 	Messages      []message
+	Received      time.Time
+	NameUpdated   int64
 }
 
 type Users struct {
@@ -63,93 +139,157 @@ type Users struct {
 
 type Database struct {
 	myAccount User
-	dir       string
+	store     storage
 	contacts  map[common.Address]User
-	mu        sync.RWMutex
+	blocked   map[common.Address]struct{}
+	requests  map[common.Address]Request
+	preKeys   preKeys
+	migration *migrationState
+	search    *searchIndex
+	// historyLen caches the number of messages in a history.
+	historyLen map[common.Address]int
+	mu         sync.RWMutex
 }
 
-func NewDatabase(confDir string, myAccountID common.Address) (*Database, error) {
+// NewDatabase opens the encrypted database in confDir, databases written by
+// older clients are migrated to the current schema first.
+func NewDatabase(confDir string, myAccountID common.Address, dataKey []byte) (*Database, error) {
 	chatHistoryPath := filepath.Join(confDir, chatHistoryDir)
-	if err := os.MkdirAll(chatHistoryPath, 0755); err != nil {
+	if err := os.MkdirAll(chatHistoryPath, 0700); err != nil {
 		return nil, fmt.Errorf("chatHistory mkdirAll: %w", err)
 	}
 
-	fullPath := filepath.Join(confDir, dbFilename)
+	v, err := newVault(dataKey)
+	if err != nil {
+		return nil, fmt.Errorf("newVault: %w", err)
+	}
 
-	//file not exists
-	if _, err := os.Stat(fullPath); err != nil {
-		if err := os.MkdirAll(confDir, 0755); err != nil {
-			return nil, fmt.Errorf("mkdirAll: %w", err)
-		}
+	if err := migrate(confDir, v); err != nil {
+		return nil, fmt.Errorf("migrate: %w", err)
+	}
 
-		f, err := os.Create(fullPath)
-		if err != nil {
-			return nil, fmt.Errorf("create file %s: %w", fullPath, err)
-		}
-		defer f.Close()
+	store, err := newFileStorage(confDir, v)
+	if err != nil {
+		return nil, fmt.Errorf("newFileStorage: %w", err)
+	}
 
-		doc := account{
-			MyAccount: profile{
-				ID:   myAccountID,
-				Name: "Anonymous",
-			},
-			Contacts: []contact{
-				{
-					ID:   common.Address{},
-					Name: "Sample Contact",
-				},
-			},
-		}
+	if err := store.Recover(); err != nil {
+		return nil, fmt.Errorf("recover: %w", err)
+	}
 
-		if err := json.NewEncoder(f).Encode(doc); err != nil {
-			return nil, fmt.Errorf("encoding cfg to file: %w", err)
-		}
+	if err := adoptMigration(confDir, store, myAccountID); err != nil {
+		return nil, fmt.Errorf("adoptMigration: %w", err)
+	}
 
-		db := Database{
-			myAccount: User{
-				ID:   doc.MyAccount.ID,
-				Name: doc.MyAccount.Name,
-			},
-			dir: confDir,
-		}
+	db, err := openDatabase(store, myAccountID)
+	if err != nil {
+		return nil, err
+	}
+
+	db.search, err = newSearchIndex(confDir, v, dataKey)
+	if err != nil {
+		return nil, fmt.Errorf("newSearchIndex: %w", err)
+	}
 
-		return &db, nil
+	if err := db.catchUpIndex(); err != nil {
+		return nil, fmt.Errorf("catchUpIndex: %w", err)
 	}
-	//file exists
-	f, err := os.Open(fullPath)
+
+	return db, nil
+}
+
+func openDatabase(store storage, myAccountID common.Address) (*Database, error) {
+	db := Database{
+		store:    store,
+		contacts: make(map[common.Address]User),
+		blocked:  make(map[common.Address]struct{}),
+		requests: make(map[common.Address]Request),
+
+		historyLen: make(map[common.Address]int),
+	}
+
+	acc, exists, err := store.LoadAccount()
 	if err != nil {
-		return nil, fmt.Errorf("open file %s: %w", fullPath, err)
+		return nil, fmt.Errorf("loadAccount: %w", err)
 	}
-	defer f.Close()
 
-	var acc account
-	if err := json.NewDecoder(f).Decode(&acc); err != nil {
-		return nil, fmt.Errorf("decode into account: %w", err)
+	if !exists {
+		acc = account{
+			Version: schemaVersion,
+			MyAccount: profile{
+				ID:   myAccountID,
+				Name: "Anonymous",
+			},
+		}
+
+		if err := store.SaveAccount(acc); err != nil {
+			return nil, fmt.Errorf("saveAccount: %w", err)
+		}
 	}
 
 	if acc.MyAccount.ID != myAccountID {
 		return nil, errors.New("id mismatch")
 	}
 
-	contacts := make(map[common.Address]User, len(acc.Contacts))
-	for _, c := range acc.Contacts {
-		contacts[c.ID] = User{
+	contacts, err := store.LoadContacts()
+	if err != nil {
+		return nil, fmt.Errorf("loadContacts: %w", err)
+	}
+
+	for _, c := range contacts {
+		//older versions seeded a sample contact with the zero address.
+		if c.ID == (common.Address{}) {
+			if err := store.RemoveContact(c.ID); err != nil {
+				return nil, fmt.Errorf("removeContact: %w", err)
+			}
+			continue
+		}
+
+		db.contacts[c.ID] = User{
 			ID:            c.ID,
 			Name:          c.Name,
 			OutgoingNonce: c.OutgoingNonce,
 			IncomingNonce: c.IncomingNonce,
 			Key:           c.Key,
+			PendingKey:    c.PendingKey,
+			Verified:      c.Verified,
+			Session:       c.Session,
+			FormerName:    c.FormerName,
+			NameUpdated:   c.NameUpdated,
+			InviteKey:     c.InviteKey,
+			Unread:        c.Unread,
+			LastActivity:  c.LastActivity,
+			Pinned:        c.Pinned,
+			Muted:         c.Muted,
+		}
+
+		//contacts stored before the activity was kept use their last
+		//message.
+		if c.LastActivity == 0 {
+			last, _, err := store.LoadHistoryPage(c.ID, -1, 1)
+			if err != nil {
+				return nil, fmt.Errorf("loadHistoryPage: %w", err)
+			}
+			if len(last) != 0 {
+				u := db.contacts[c.ID]
+				u.LastActivity = last[0].Timestamp.UnixNano()
+				db.contacts[c.ID] = u
+			}
 		}
 	}
 
-	c := Database{
-		myAccount: User{
-			ID:   acc.MyAccount.ID,
-			Name: acc.MyAccount.Name,
-		},
-		contacts: contacts,
+	for _, id := range acc.Blocked {
+		db.blocked[id] = struct{}{}
+	}
+
+	db.myAccount = User{
+		ID:   acc.MyAccount.ID,
+		Name: acc.MyAccount.Name,
 	}
-	return &c, nil
+	db.preKeys = acc.PreKeys
+	db.migration = acc.Migration
+
+	return &db, nil
 }
 
 func (db *Database) MyAccount() User {
@@ -158,26 +298,51 @@ func (db *Database) MyAccount() User {
 	return db.myAccount
 }
 
-func (db *Database) LookupContact(id common.Address) (User, error) {
+// SetName changes the name this account is shown with.
+func (db *Database) SetName(name string) error {
 	db.mu.Lock()
 	defer db.mu.Unlock()
 
+	old := db.myAccount.Name
+	db.myAccount.Name = name
+
+	if err := db.saveAccount(); err != nil {
+		db.myAccount.Name = old
+		return err
+	}
+
+	return nil
+}
+
+func (db *Database) LookupContact(id common.Address) (User, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
 	usr, ok := db.contacts[id]
 	if !ok {
 		return User{}, fmt.Errorf("contact with id %s not found", id.String())
 	}
 
-	if len(usr.Messages) == 0 {
-		//read messages from disk
-		msgs, err := readMessage(db.dir, usr.ID)
-		if err != nil {
-			return User{}, fmt.Errorf("readMessage: %w", err)
-		}
-		usr.Messages = msgs
-		db.contacts[id] = usr
+	return usr, nil
+}
+
+// History returns up to limit messages with the contact that come before
+// position before, the newest when before is negative. It also returns the
+// position of the first message, there are no older messages when it is 0.
+func (db *Database) History(id common.Address, before int, limit int) ([]message, int, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	if _, ok := db.contacts[id]; !ok {
+		return nil, 0, fmt.Errorf("contact with id %s not found", id.String())
 	}
 
-	return usr, nil
+	msgs, start, err := db.store.LoadHistoryPage(id, before, limit)
+	if err != nil {
+		return nil, 0, fmt.Errorf("loadHistoryPage: %w", err)
+	}
+
+	return msgs, start, nil
 }
 
 func (db *Database) Contacts() []User {
@@ -189,133 +354,267 @@ func (db *Database) Contacts() []User {
 		users = append(users, usr)
 	}
 
-	//sort
+	//pinned contacts first, then the latest conversations.
 	slices.SortFunc(users, func(a, b User) int {
+		switch {
+		case a.Pinned != b.Pinned:
+			if a.Pinned {
+				return -1
+			}
+			return 1
+		case a.LastActivity != b.LastActivity:
+			return cmp.Compare(b.LastActivity, a.LastActivity)
+		}
 		return strings.Compare(a.Name, b.Name)
 	})
 
 	return users
 }
 
+// AddMessage stores a message sent to the contact id.
 func (db *Database) AddMessage(id common.Address, msg message) error {
+	return db.addMessage(id, msg, false)
+}
+
+// AddReceivedMessage stores a message from the contact id, it is unread until
+// the conversation is opened.
+func (db *Database) AddReceivedMessage(id common.Address, msg message) error {
+	return db.addMessage(id, msg, true)
+}
+
+func (db *Database) addMessage(id common.Address, msg message, received bool) error {
 	db.mu.Lock()
 	defer db.mu.Unlock()
 
-	usr, ok := db.contacts[id]
+	u, ok := db.contacts[id]
 	if !ok {
 		return fmt.Errorf("contact with id %s not found", id.String())
 	}
 
-	usr.Messages = append(usr.Messages, msg)
-	db.contacts[id] = usr
+	if err := db.appendMessage(id, msg); err != nil {
+		return err
+	}
 
-	if err := db.writeMessage(id, msg); err != nil {
-		return fmt.Errorf("write message: %w", err)
+	u.LastActivity = max(u.LastActivity, msg.Timestamp.UnixNano())
+	if received {
+		u.Unread++
 	}
 
+	if err := db.saveContact(u); err != nil {
+		return err
+	}
+	db.contacts[id] = u
+
 	return nil
 }
 
-func (db *Database) AddContact(id common.Address, name string) (User, error) {
+// touchContact moves the last activity of the contact id up to t, callers
+// must hold the lock.
+func (db *Database) touchContact(id common.Address, t time.Time) error {
+	u, ok := db.contacts[id]
+	if !ok || t.UnixNano() <= u.LastActivity {
+		return nil
+	}
+	u.LastActivity = t.UnixNano()
+
+	if err := db.saveContact(u); err != nil {
+		return err
+	}
+	db.contacts[id] = u
+
+	return nil
+}
+
+// MarkRead clears the unread messages of the contact id.
+func (db *Database) MarkRead(id common.Address) error {
 	db.mu.Lock()
 	defer db.mu.Unlock()
 
-	fullPath := filepath.Join(db.dir, dbFilename)
+	u, ok := db.contacts[id]
+	if !ok {
+		return fmt.Errorf("contact with id %s not found", id.String())
+	}
+
+	if u.Unread == 0 {
+		return nil
+	}
+	u.Unread = 0
+
+	if err := db.saveContact(u); err != nil {
+		return err
+	}
+	db.contacts[id] = u
+
+	return nil
+}
+
+// SetPinned keeps the contact id at the top of the list.
+func (db *Database) SetPinned(id common.Address, pinned bool) error {
+	return db.updateContact(id, func(u *User) {
+		u.Pinned = pinned
+	})
+}
+
+// SetMuted stops the notifications for the messages of the contact id, they
+// are still counted as unread.
+func (db *Database) SetMuted(id common.Address, muted bool) error {
+	return db.updateContact(id, func(u *User) {
+		u.Muted = muted
+	})
+}
 
-	// Read the entire db file first
-	data, err := os.ReadFile(fullPath)
+// updateContact applies update to the contact id and stores it.
+func (db *Database) updateContact(id common.Address, update func(u *User)) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	u, ok := db.contacts[id]
+	if !ok {
+		return fmt.Errorf("contact with id %s not found", id.String())
+	}
+	update(&u)
+
+	if err := db.saveContact(u); err != nil {
+		return err
+	}
+	db.contacts[id] = u
+
+	return nil
+}
+
+// appendMessage stores msg in the history and the search index, the caller
+// must hold the lock.
+func (db *Database) appendMessage(id common.Address, msg message) error {
+	pos, err := db.historyLength(id)
 	if err != nil {
-		return User{}, fmt.Errorf("read file %s: %w", fullPath, err)
+		return err
 	}
 
-	var acc account
-	if err := json.Unmarshal(data, &acc); err != nil {
-		return User{}, fmt.Errorf("decode into account: %w", err)
+	if err := db.store.AppendHistory(id, msg); err != nil {
+		return fmt.Errorf("append history: %w", err)
 	}
+	db.historyLen[id] = pos + 1
 
-	acc.Contacts = append(acc.Contacts, contact{ID: id, Name: name})
-	db.contacts[id] = User{
-		ID:   id,
-		Name: name,
+	if db.search != nil {
+		if err := db.search.add(id, pos, msg); err != nil {
+			return fmt.Errorf("index message: %w", err)
+		}
+	}
+
+	return nil
+}
+
+func (db *Database) historyLength(id common.Address) (int, error) {
+	if n, ok := db.historyLen[id]; ok {
+		return n, nil
 	}
 
-	newData, err := json.Marshal(acc)
+	//an empty page starts at the end of the history.
+	_, n, err := db.store.LoadHistoryPage(id, -1, 0)
 	if err != nil {
-		return User{}, fmt.Errorf("encode updates: %w", err)
+		return 0, fmt.Errorf("loadHistoryPage: %w", err)
 	}
+	db.historyLen[id] = n
+
+	return n, nil
+}
 
-	if err := os.WriteFile(fullPath, newData, 0644); err != nil {
-		return User{}, fmt.Errorf("write file %s: %w", fullPath, err)
+// AddContact adds the contact id, it fails when id is a contact already.
+func (db *Database) AddContact(id common.Address, name string) (User, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	name, err := db.checkNewContact(id, name)
+	if err != nil {
+		return User{}, err
 	}
 
 	u := User{
 		ID:   id,
 		Name: name,
 	}
+
+	if err := db.saveContact(u); err != nil {
+		return User{}, err
+	}
+	db.contacts[id] = u
+
 	return u, nil
 }
 
-func readMessage(confDir string, id common.Address) ([]message, error) {
-	historyFile := filepath.Join(confDir, chatHistoryDir, id.Hex()+".msg")
+// checkNewContact returns the name the contact id is added with, it fails
+// when id can not be a contact. The caller holds the lock.
+func (db *Database) checkNewContact(id common.Address, name string) (string, error) {
+	name, err := validName(name)
+	if err != nil {
+		return "", err
+	}
+
+	switch {
+	case id == (common.Address{}):
+		return "", errors.New("the zero address can not be a contact")
+	case id == db.myAccount.ID:
+		return "", errors.New("you can not add yourself")
+	}
 
-	f, err := os.Open(historyFile)
+	if _, ok := db.contacts[id]; ok {
+		return "", fmt.Errorf("%s is already a contact", id.Hex())
+	}
+
+	return name, nil
+}
+
+// RenameContact changes the name of the contact id, until the contact
+// sends a newer name.
+func (db *Database) RenameContact(id common.Address, name string) (User, error) {
+	name, err := validName(name)
 	if err != nil {
-		return nil, nil
+		return User{}, err
 	}
-	defer f.Close()
 
-	var messages []message
-	scanner := bufio.NewScanner(f)
-	for scanner.Scan() {
-		jsn := scanner.Bytes()
+	db.mu.Lock()
+	defer db.mu.Unlock()
 
-		var msg message
-		if err := json.Unmarshal(jsn, &msg); err != nil {
-			return nil, fmt.Errorf("unmarshaling json data into message: %w", err)
-		}
-		msg.Timestamp = msg.Timestamp.Local()
-		messages = append(messages, msg)
+	u, ok := db.contacts[id]
+	if !ok {
+		return User{}, fmt.Errorf("contact with id %s not found", id.Hex())
 	}
 
-	if err := scanner.Err(); err != nil {
-		return nil, fmt.Errorf("while scanning file: %w", err)
+	u.Name = name
+	if err := db.saveContact(u); err != nil {
+		return User{}, err
 	}
+	db.contacts[id] = u
 
-	return messages, nil
+	return u, nil
 }
 
-func (db *Database) writeMessage(id common.Address, msg message) error {
-	filename := filepath.Join(db.dir, chatHistoryDir, id.String()+".msg")
-	_, err := os.Stat(filename)
-	var f *os.File
+// RemoveContact removes the contact id and its session, the history is
+// deleted with it when history is set.
+func (db *Database) RemoveContact(id common.Address, history bool) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
 
-	if err != nil {
-		var err error
-		f, err = os.Create(filename)
-		if err != nil {
-			return fmt.Errorf("create file %s: %w", filename, err)
-		}
-	} else {
-		var err error
-		f, err = os.OpenFile(filename, os.O_APPEND|os.O_WRONLY, 0644)
-		if err != nil {
-			return fmt.Errorf("openFile %s: %w", filename, err)
-		}
+	if _, ok := db.contacts[id]; !ok {
+		return fmt.Errorf("contact with id %s not found", id.Hex())
 	}
-	defer f.Close()
 
-	jsn, err := json.Marshal(msg)
-	if err != nil {
-		return fmt.Errorf("marshalling message: %w", err)
+	if err := db.store.RemoveContact(id); err != nil {
+		return fmt.Errorf("removeContact: %w", err)
 	}
+	delete(db.contacts, id)
 
-	jsn = append(jsn, '\n') //add new line manually.
+	if !history {
+		return nil
+	}
 
-	if _, err := f.Write(jsn); err != nil {
-		return fmt.Errorf("writeString: %w", err)
+	if err := db.store.RemoveHistory(id); err != nil {
+		return fmt.Errorf("removeHistory: %w", err)
 	}
+	delete(db.historyLen, id)
 
-	return nil
+	//the terms of a deleted history do not stay behind in the index.
+	return db.dropIndex(id)
 }
 
 func (db *Database) UpdateOutgoingNonce(id common.Address, appNonce uint64) error {
@@ -330,141 +629,513 @@ func (db *Database) UpdateOutgoingNonce(id common.Address, appNonce uint64) erro
 
 	u.OutgoingNonce = appNonce
 
+	//update the disk first, the cache only changes once it is stored
+	if err := db.saveContact(u); err != nil {
+		return err
+	}
+
 	db.contacts[id] = u
+	return nil
+}
 
-	//update the disk
+func (db *Database) UpdateIncomingNonce(id common.Address, contactNonce uint64) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
 
-	fullPath := filepath.Join(db.dir, dbFilename)
+	//update the in-memory cache
+	u, ok := db.contacts[id]
+	if !ok {
+		return fmt.Errorf("user with id %s, not found", id.Hex())
+	}
 
-	// Read the entire db file first
-	data, err := os.ReadFile(fullPath)
-	if err != nil {
-		return fmt.Errorf("read file %s: %w", fullPath, err)
+	u.IncomingNonce = contactNonce
+
+	//update the disk first, the cache only changes once it is stored
+	if err := db.saveContact(u); err != nil {
+		return err
 	}
 
-	var acc account
-	if err := json.Unmarshal(data, &acc); err != nil {
-		return fmt.Errorf("decode into account: %w", err)
+	db.contacts[id] = u
+	return nil
+}
+
+func (db *Database) LookupRequest(id common.Address) (Request, bool) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	req, ok := db.requests[id]
+	return req, ok
+}
+
+// UpdateRequest stores req, it fails with ErrTooManyRequests for a new one
+// when maxRequests are pending. Only the first maxRequestMessages messages
+// are kept.
+func (db *Database) UpdateRequest(req Request) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if _, ok := db.requests[req.ID]; !ok && len(db.requests) >= maxRequests {
+		return ErrTooManyRequests
 	}
 
-	//TODO: change to map[string]Account for performance.
-	for i := range acc.Contacts {
-		if acc.Contacts[i].ID == id {
-			acc.Contacts[i].OutgoingNonce = appNonce
-			break
-		}
+	if len(req.Messages) > maxRequestMessages {
+		req.Messages = req.Messages[:maxRequestMessages]
 	}
 
-	newData, err := json.Marshal(acc)
-	if err != nil {
-		return fmt.Errorf("encode updates: %w", err)
+	db.requests[req.ID] = req
+	return nil
+}
+
+func (db *Database) Requests() []Request {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	reqs := make([]Request, 0, len(db.requests))
+	for _, req := range db.requests {
+		reqs = append(reqs, req)
 	}
 
-	if err := os.WriteFile(fullPath, newData, 0644); err != nil {
-		return fmt.Errorf("write file %s: %w", fullPath, err)
+	slices.SortFunc(reqs, func(a, b Request) int {
+		return a.Received.Compare(b.Received)
+	})
+
+	return reqs
+}
+
+func (db *Database) DeclineRequest(id common.Address) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	delete(db.requests, id)
+}
+
+// AcceptRequest turns a pending request into a contact, keeping the nonce
+// and the messages received so far. The key of the request is not trusted
+// yet, it is left to PinContactKey.
+func (db *Database) AcceptRequest(id common.Address) (User, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	req, ok := db.requests[id]
+	if !ok {
+		return User{}, fmt.Errorf("request from %s not found", id.Hex())
 	}
 
-	return nil
+	usr := User{
+		ID:            req.ID,
+		Name:          req.Name,
+		IncomingNonce: req.IncomingNonce,
+		Session:       req.Session,
+		NameUpdated:   req.NameUpdated,
+		LastActivity:  req.Received.UnixNano(),
+	}
+
+	if err := db.saveContact(usr); err != nil {
+		return User{}, err
+	}
+
+	for _, msg := range req.Messages {
+		if err := db.appendMessage(id, msg); err != nil {
+			return User{}, err
+		}
+	}
+
+	db.contacts[id] = usr
+	delete(db.requests, id)
+
+	return usr, nil
 }
 
-func (db *Database) UpdateIncomingNonce(id common.Address, contactNonce uint64) error {
+func (db *Database) IsBlocked(id common.Address) bool {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	_, ok := db.blocked[id]
+	return ok
+}
+
+func (db *Database) Blocked() []common.Address {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	ids := make([]common.Address, 0, len(db.blocked))
+	for id := range db.blocked {
+		ids = append(ids, id)
+	}
+
+	slices.SortFunc(ids, func(a, b common.Address) int {
+		return a.Cmp(b)
+	})
+
+	return ids
+}
+
+func (db *Database) Block(id common.Address) error {
+	return db.updateBlocked(id, true)
+}
+
+func (db *Database) Unblock(id common.Address) error {
+	return db.updateBlocked(id, false)
+}
+
+func (db *Database) updateBlocked(id common.Address, blocked bool) error {
 	db.mu.Lock()
 	defer db.mu.Unlock()
 
 	//update the in-memory cache
+	if blocked {
+		db.blocked[id] = struct{}{}
+	} else {
+		delete(db.blocked, id)
+	}
+
+	//update the disk
+	return db.saveAccount()
+}
+
+// keyStatus is the result of pinning a contact's key.
+type keyStatus int
+
+const (
+	keyPinned keyStatus = iota + 1
+	keyUnchanged
+	keyChanged
+	keyMismatch
+)
+
+// PinContactKey trusts the first key seen for a contact, a different key
+// afterwards is kept as pending until the user accepts it. A contact added
+// from an invite only trusts the key of the invite.
+func (db *Database) PinContactKey(id common.Address, key []byte) (keyStatus, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	u, ok := db.contacts[id]
+	if !ok {
+		return 0, fmt.Errorf("user with id %s, not found", id.Hex())
+	}
+
+	var status keyStatus
+	switch {
+	case len(u.Key) == 0 && u.InviteKey != "" && keyFingerprint(key) != u.InviteKey:
+		status = keyMismatch
+		u.PendingKey = key
+	case len(u.Key) == 0:
+		status = keyPinned
+		u.Key = key
+		u.PendingKey = nil
+	case bytes.Equal(u.Key, key):
+		//the contact went back to the trusted key.
+		if len(u.PendingKey) == 0 {
+			return keyUnchanged, nil
+		}
+		status = keyUnchanged
+		u.PendingKey = nil
+	default:
+		status = keyChanged
+		u.PendingKey = key
+	}
+
+	if err := db.saveContact(u); err != nil {
+		return 0, err
+	}
+
+	db.contacts[id] = u
+	return status, nil
+}
+
+// ExpectContactKey stores the key fingerprint of the invite of the contact
+// id, a key already pinned is checked against it.
+func (db *Database) ExpectContactKey(id common.Address, fingerprint string) (keyStatus, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	u, ok := db.contacts[id]
+	if !ok {
+		return 0, fmt.Errorf("user with id %s, not found", id.Hex())
+	}
+
+	u.InviteKey = fingerprint
+
+	var status keyStatus
+	switch {
+	case len(u.Key) == 0:
+	case keyFingerprint(u.Key) == fingerprint:
+		status = keyUnchanged
+	default:
+		status = keyMismatch
+	}
+
+	if err := db.saveContact(u); err != nil {
+		return 0, err
+	}
+
+	db.contacts[id] = u
+	return status, nil
+}
+
+// AcceptPendingKey replaces the pinned key with the pending one, the contact
+// has to be verified again.
+func (db *Database) AcceptPendingKey(id common.Address) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
 	u, ok := db.contacts[id]
 	if !ok {
 		return fmt.Errorf("user with id %s, not found", id.Hex())
 	}
 
-	u.IncomingNonce = contactNonce
+	if len(u.PendingKey) == 0 {
+		return errors.New("no pending key")
+	}
+
+	u.Key = u.PendingKey
+	u.PendingKey = nil
+	u.Verified = false
+
+	if err := db.saveContact(u); err != nil {
+		return err
+	}
 
 	db.contacts[id] = u
+	return nil
+}
 
-	//update the disk
+func (db *Database) SetVerified(id common.Address, verified bool) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	u, ok := db.contacts[id]
+	if !ok {
+		return fmt.Errorf("user with id %s, not found", id.Hex())
+	}
 
-	fullPath := filepath.Join(db.dir, dbFilename)
+	u.Verified = verified
 
-	// Read the entire db file first
-	data, err := os.ReadFile(fullPath)
-	if err != nil {
-		return fmt.Errorf("read file %s: %w", fullPath, err)
+	if err := db.saveContact(u); err != nil {
+		return err
 	}
 
-	var acc account
-	if err := json.Unmarshal(data, &acc); err != nil {
-		return fmt.Errorf("decode into account: %w", err)
+	db.contacts[id] = u
+	return nil
+}
+
+// saveContact writes the contact part of u, callers must hold the lock.
+func (db *Database) saveContact(u User) error {
+	c := contact{
+		ID:            u.ID,
+		Name:          u.Name,
+		OutgoingNonce: u.OutgoingNonce,
+		IncomingNonce: u.IncomingNonce,
+		Key:           u.Key,
+		PendingKey:    u.PendingKey,
+		Verified:      u.Verified,
+		Session:       u.Session,
+		FormerName:    u.FormerName,
+		NameUpdated:   u.NameUpdated,
+		InviteKey:     u.InviteKey,
+		Unread:        u.Unread,
+		LastActivity:  u.LastActivity,
+		Pinned:        u.Pinned,
+		Muted:         u.Muted,
 	}
 
-	//TODO: change to map[string]Account for performance.
-	for i := range acc.Contacts {
-		if acc.Contacts[i].ID == id {
-			acc.Contacts[i].IncomingNonce = contactNonce
-			break
-		}
+	if err := db.store.SaveContact(c); err != nil {
+		return fmt.Errorf("saveContact: %w", err)
 	}
 
-	newData, err := json.Marshal(acc)
-	if err != nil {
-		return fmt.Errorf("encode updates: %w", err)
+	return nil
+}
+
+// saveAccount writes everything that is not a contact, callers must hold the
+// lock.
+func (db *Database) saveAccount() error {
+	blocked := make([]common.Address, 0, len(db.blocked))
+	for id := range db.blocked {
+		blocked = append(blocked, id)
+	}
+	slices.SortFunc(blocked, func(a, b common.Address) int {
+		return a.Cmp(b)
+	})
+
+	acc := account{
+		Version: schemaVersion,
+		MyAccount: profile{
+			ID:   db.myAccount.ID,
+			Name: db.myAccount.Name,
+		},
+		Blocked:   blocked,
+		PreKeys:   db.preKeys,
+		Migration: db.migration,
 	}
 
-	if err := os.WriteFile(fullPath, newData, 0644); err != nil {
-		return fmt.Errorf("write file %s: %w", fullPath, err)
+	if err := db.store.SaveAccount(acc); err != nil {
+		return fmt.Errorf("saveAccount: %w", err)
 	}
 
 	return nil
 }
 
-func (db *Database) UpdateContactKey(id common.Address, key []byte) error {
+// Session returns the ratchet session with a contact, nil when there is none.
+func (db *Database) Session(id common.Address) *session {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return db.contacts[id].Session
+}
+
+// SaveSession stores the ratchet session with a contact.
+func (db *Database) SaveSession(id common.Address, s *session) error {
 	db.mu.Lock()
 	defer db.mu.Unlock()
 
-	//update the in-memory cache
 	u, ok := db.contacts[id]
 	if !ok {
 		return fmt.Errorf("user with id %s, not found", id.Hex())
 	}
 
-	u.Key = key
+	u.Session = s
+
+	if err := db.saveContact(u); err != nil {
+		return err
+	}
 
 	db.contacts[id] = u
+	return nil
+}
 
-	//update the disk
+// SignedPreKey returns the signed prekey of this account, it is created the
+// first time it is needed.
+func (db *Database) SignedPreKey() (preKeyPair, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
 
-	fullPath := filepath.Join(db.dir, dbFilename)
+	if db.preKeys.SignedPreKey != nil {
+		return *db.preKeys.SignedPreKey, nil
+	}
 
-	// Read the entire db file first
-	data, err := os.ReadFile(fullPath)
-	if err != nil {
-		return fmt.Errorf("read file %s: %w", fullPath, err)
+	if err := db.newSignedPreKey(); err != nil {
+		return preKeyPair{}, err
 	}
 
-	var acc account
-	if err := json.Unmarshal(data, &acc); err != nil {
-		return fmt.Errorf("decode into account: %w", err)
+	return *db.preKeys.SignedPreKey, nil
+}
+
+// RotateSignedPreKey replaces the signed prekey once it is older than
+// maxAge, the one it replaces is kept until the next rotation.
+func (db *Database) RotateSignedPreKey(maxAge time.Duration) (bool, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	spk := db.preKeys.SignedPreKey
+	if spk != nil && time.Since(time.Unix(0, spk.Created)) < maxAge {
+		return false, nil
+	}
+
+	if err := db.newSignedPreKey(); err != nil {
+		return false, err
 	}
 
-	//TODO: change to map[string]Account for performance.
-	for i := range acc.Contacts {
-		if acc.Contacts[i].ID == id {
-			acc.Contacts[i].Key = key
-			break
+	return true, nil
+}
+
+// LookupSignedPreKey returns the signed prekey id, the current one or the
+// one before the last rotation.
+func (db *Database) LookupSignedPreKey(id uint32) (preKeyPair, bool) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	for _, spk := range []*preKeyPair{db.preKeys.SignedPreKey, db.preKeys.OldSignedPreKey} {
+		if spk != nil && spk.ID == id {
+			return *spk, true
 		}
 	}
 
-	newData, err := json.Marshal(acc)
+	return preKeyPair{}, false
+}
+
+// newSignedPreKey creates a new signed prekey, callers hold the lock.
+func (db *Database) newSignedPreKey() error {
+	pairs, err := db.newPreKeys(1)
 	if err != nil {
-		return fmt.Errorf("encode updates: %w", err)
+		return err
 	}
+	pairs[0].Created = time.Now().UnixNano()
+
+	old := db.preKeys
+	db.preKeys.OldSignedPreKey = db.preKeys.SignedPreKey
+	db.preKeys.SignedPreKey = &pairs[0]
 
-	if err := os.WriteFile(fullPath, newData, 0644); err != nil {
-		return fmt.Errorf("write file %s: %w", fullPath, err)
+	if err := db.saveAccount(); err != nil {
+		db.preKeys = old
+		return err
 	}
 
 	return nil
 }
 
+// AddOneTimePreKeys creates n new one-time prekeys, only the newest
+// maxOneTimePreKeys are kept since the server drops the older ones.
+func (db *Database) AddOneTimePreKeys(n int) ([]preKeyPair, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	pairs, err := db.newPreKeys(n)
+	if err != nil {
+		return nil, err
+	}
+
+	otks := append(db.preKeys.OneTimePreKeys, pairs...)
+	if len(otks) > maxOneTimePreKeys {
+		otks = otks[len(otks)-maxOneTimePreKeys:]
+	}
+	db.preKeys.OneTimePreKeys = otks
+
+	if err := db.saveAccount(); err != nil {
+		return nil, err
+	}
+
+	return pairs, nil
+}
+
+func (db *Database) OneTimePreKey(id uint32) (preKeyPair, bool) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	for _, k := range db.preKeys.OneTimePreKeys {
+		if k.ID == id {
+			return k, true
+		}
+	}
+
+	return preKeyPair{}, false
+}
+
+// RemoveOneTimePreKey deletes a used one-time prekey so no other session can
+// be started with it.
+func (db *Database) RemoveOneTimePreKey(id uint32) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	db.preKeys.OneTimePreKeys = slices.DeleteFunc(db.preKeys.OneTimePreKeys, func(k preKeyPair) bool {
+		return k.ID == id
+	})
+
+	return db.saveAccount()
+}
+
+// newPreKeys generates n key pairs with fresh ids, callers must hold the lock.
+func (db *Database) newPreKeys(n int) ([]preKeyPair, error) {
+	pairs := make([]preKeyPair, 0, n)
+	for range n {
+		private, err := ecdh.X25519().GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, fmt.Errorf("generating prekey: %w", err)
+		}
+
+		db.preKeys.NextID++
+		pairs = append(pairs, preKeyPair{ID: db.preKeys.NextID, Private: private.Bytes()})
+	}
+
+	return pairs, nil
+}
+
 func parseRSAPublicKey(key []byte) (*rsa.PublicKey, error) {
 	block, _ := pem.Decode(key)
 	if block == nil {
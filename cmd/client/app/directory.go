@@ -0,0 +1,202 @@
+package app
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/hamidoujand/echo/signature"
+)
+
+type directoryProfile struct {
+	ID        common.Address `json:"id"`
+	Name      string         `json:"name"`
+	Key       string         `json:"key"`
+	Avatar    string         `json:"avatar"`
+	Timestamp int64          `json:"timestamp"`
+	V         *big.Int       `json:"v"`
+	R         *big.Int       `json:"r"`
+	S         *big.Int       `json:"s"`
+}
+
+func (p directoryProfile) signedData() any {
+	return struct {
+		ID        common.Address
+		Name      string
+		Key       string
+		Avatar    string
+		Timestamp int64
+	}{
+		ID:        p.ID,
+		Name:      p.Name,
+		Key:       p.Key,
+		Avatar:    p.Avatar,
+		Timestamp: p.Timestamp,
+	}
+}
+
+// verify checks the profile is signed by its ID, the server is not trusted
+// to have done it.
+func (p directoryProfile) verify() error {
+	if p.V == nil || p.R == nil || p.S == nil {
+		return fmt.Errorf("profile %s is not signed", p.ID)
+	}
+
+	from, err := signature.FromAddress(p.signedData(), p.V, p.R, p.S)
+	if err != nil {
+		return fmt.Errorf("fromAddress: %w", err)
+	}
+
+	if from != p.ID.Hex() {
+		return fmt.Errorf("profile %s is signed by %s", p.ID, from)
+	}
+
+	return nil
+}
+
+// PublishProfile adds or replaces this user's profile in the server directory.
+func (c *Client) PublishProfile(name string, avatar string) error {
+	p := directoryProfile{
+		ID:        c.id.Address,
+		Name:      name,
+		Key:       c.id.RSAPublicKey,
+		Avatar:    avatar,
+		Timestamp: time.Now().UnixNano(),
+	}
+
+	v, r, s, err := signature.Sign(p.signedData(), c.id.ECDSAKey)
+	if err != nil {
+		return fmt.Errorf("sign: %w", err)
+	}
+	p.V, p.R, p.S = v, r, s
+
+	if err := c.doJSON(http.MethodPost, "/v1/directory", p, nil); err != nil {
+		return fmt.Errorf("publish: %w", err)
+	}
+
+	return nil
+}
+
+// UnpublishProfile removes this user's profile from the server directory.
+func (c *Client) UnpublishProfile() error {
+	rm := struct {
+		ID        common.Address `json:"id"`
+		Timestamp int64          `json:"timestamp"`
+		V         *big.Int       `json:"v"`
+		R         *big.Int       `json:"r"`
+		S         *big.Int       `json:"s"`
+	}{
+		ID:        c.id.Address,
+		Timestamp: time.Now().UnixNano(),
+	}
+
+	signedData := struct {
+		ID        common.Address
+		Timestamp int64
+		Action    string
+	}{
+		ID:        rm.ID,
+		Timestamp: rm.Timestamp,
+		Action:    "remove",
+	}
+
+	v, r, s, err := signature.Sign(signedData, c.id.ECDSAKey)
+	if err != nil {
+		return fmt.Errorf("sign: %w", err)
+	}
+	rm.V, rm.R, rm.S = v, r, s
+
+	if err := c.doJSON(http.MethodDelete, "/v1/directory/"+rm.ID.Hex(), rm, nil); err != nil {
+		return fmt.Errorf("unpublish: %w", err)
+	}
+
+	return nil
+}
+
+// Find searches the server directory, profiles with an invalid signature are
+// dropped.
+func (c *Client) Find(name string) ([]directoryProfile, error) {
+	var profiles []directoryProfile
+	path := "/v1/directory?name=" + url.QueryEscape(name)
+	if err := c.doJSON(http.MethodGet, path, nil, &profiles); err != nil {
+		return nil, fmt.Errorf("search: %w", err)
+	}
+
+	valid := make([]directoryProfile, 0, len(profiles))
+	for _, p := range profiles {
+		if err := p.verify(); err != nil {
+			continue
+		}
+		valid = append(valid, p)
+	}
+
+	return valid, nil
+}
+
+// doJSON calls the REST API of the server the client is connected to.
+func (c *Client) doJSON(method string, path string, body any, result any) error {
+	base, err := url.Parse(c.url)
+	if err != nil {
+		return fmt.Errorf("parse url: %w", err)
+	}
+
+	switch base.Scheme {
+	case "wss":
+		base.Scheme = "https"
+	default:
+		base.Scheme = "http"
+	}
+
+	ref, err := url.Parse(path)
+	if err != nil {
+		return fmt.Errorf("parse path: %w", err)
+	}
+	endpoint := base.ResolveReference(ref)
+
+	var reqBody io.Reader
+	if body != nil {
+		bs, err := json.Marshal(body)
+		if err != nil {
+			return fmt.Errorf("marshal body: %w", err)
+		}
+		reqBody = bytes.NewReader(bs)
+	}
+
+	req, err := http.NewRequest(method, endpoint.String(), reqBody)
+	if err != nil {
+		return fmt.Errorf("new request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return fmt.Errorf("do: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= http.StatusBadRequest {
+		var appErr struct {
+			Message string `json:"message"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&appErr); err != nil || appErr.Message == "" {
+			return fmt.Errorf("server responded with %s", resp.Status)
+		}
+		return fmt.Errorf("server responded with %s: %s", resp.Status, appErr.Message)
+	}
+
+	if result == nil {
+		return nil
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(result); err != nil {
+		return fmt.Errorf("decode response: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,286 @@
+package app
+
+import (
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// Export formats, only JSON can be imported again.
+const (
+	FormatJSON     = "json"
+	FormatMarkdown = "md"
+	FormatText     = "txt"
+)
+
+const exportVersion = 1
+
+type exportArchive struct {
+	Version       int                  `json:"version"`
+	Account       common.Address       `json:"account"`
+	Exported      time.Time            `json:"exported"`
+	Conversations []exportConversation `json:"conversations"`
+}
+
+type exportConversation struct {
+	Contact  common.Address  `json:"contact"`
+	Name     string          `json:"name"`
+	Messages []exportMessage `json:"messages"`
+}
+
+type exportMessage struct {
+	Sender    string    `json:"sender"`
+	Text      string    `json:"text"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// Export writes the conversations with ids to w in format, every
+// conversation when ids is empty.
+func (db *Database) Export(w io.Writer, format string, ids []common.Address) error {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	if len(ids) == 0 {
+		for id := range db.contacts {
+			ids = append(ids, id)
+		}
+	}
+
+	archive := exportArchive{
+		Version:  exportVersion,
+		Account:  db.myAccount.ID,
+		Exported: time.Now().UTC(),
+	}
+
+	for _, id := range ids {
+		usr, ok := db.contacts[id]
+		if !ok {
+			return fmt.Errorf("contact with id %s not found", id.Hex())
+		}
+
+		msgs, err := db.store.LoadHistory(id)
+		if err != nil {
+			return fmt.Errorf("loadHistory %s: %w", id.Hex(), err)
+		}
+
+		conv := exportConversation{
+			Contact:  usr.ID,
+			Name:     usr.Name,
+			Messages: make([]exportMessage, 0, len(msgs)),
+		}
+
+		for _, msg := range msgs {
+			conv.Messages = append(conv.Messages, exportMessage{
+				Sender:    msg.Name,
+				Text:      string(msg.Text),
+				Timestamp: msg.Timestamp.UTC(),
+			})
+		}
+
+		archive.Conversations = append(archive.Conversations, conv)
+	}
+
+	slices.SortFunc(archive.Conversations, func(a, b exportConversation) int {
+		return cmp.Or(strings.Compare(a.Name, b.Name), a.Contact.Cmp(b.Contact))
+	})
+
+	switch format {
+	case FormatJSON:
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(archive)
+	case FormatMarkdown:
+		return writeMarkdown(w, archive)
+	case FormatText:
+		return writeText(w, archive)
+	default:
+		return fmt.Errorf("unknown export format %q, use %s, %s or %s", format, FormatJSON, FormatMarkdown, FormatText)
+	}
+}
+
+// Import merges the conversations of a JSON export into the database, the
+// messages that are already stored are skipped. Contacts that do not exist
+// yet are added, so an export can be restored into a fresh install. It
+// returns the number of messages imported.
+func (db *Database) Import(r io.Reader) (int, error) {
+	var archive exportArchive
+	if err := json.NewDecoder(r).Decode(&archive); err != nil {
+		return 0, fmt.Errorf("decode archive: %w", err)
+	}
+
+	if archive.Version != exportVersion {
+		return 0, fmt.Errorf("unsupported archive version %d", archive.Version)
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	//the contacts are checked the way AddContact does before anything is
+	//written.
+	for i, conv := range archive.Conversations {
+		if _, ok := db.contacts[conv.Contact]; ok {
+			continue
+		}
+
+		name, err := db.checkNewContact(conv.Contact, conv.Name)
+		if err != nil {
+			return 0, fmt.Errorf("import %s: %w", conv.Contact.Hex(), err)
+		}
+		archive.Conversations[i].Name = name
+	}
+
+	var imported int
+	for _, conv := range archive.Conversations {
+		n, err := db.importConversation(conv)
+		if err != nil {
+			return imported, fmt.Errorf("import %s: %w", conv.Contact.Hex(), err)
+		}
+		imported += n
+	}
+
+	if err := db.saveIndex(); err != nil {
+		return imported, err
+	}
+
+	return imported, nil
+}
+
+func (db *Database) importConversation(conv exportConversation) (int, error) {
+	if _, ok := db.contacts[conv.Contact]; !ok {
+		u := User{
+			ID:   conv.Contact,
+			Name: conv.Name,
+		}
+
+		if err := db.saveContact(u); err != nil {
+			return 0, err
+		}
+		db.contacts[u.ID] = u
+	}
+
+	msgs, err := db.store.LoadHistory(conv.Contact)
+	if err != nil {
+		return 0, fmt.Errorf("loadHistory: %w", err)
+	}
+
+	type key struct {
+		sender string
+		text   string
+		nano   int64
+	}
+
+	seen := make(map[key]struct{}, len(msgs))
+	for _, msg := range msgs {
+		seen[key{msg.Name, string(msg.Text), msg.Timestamp.UnixNano()}] = struct{}{}
+	}
+
+	var added []message
+	for _, m := range conv.Messages {
+		k := key{m.Sender, m.Text, m.Timestamp.UnixNano()}
+		if _, ok := seen[k]; ok {
+			continue
+		}
+		seen[k] = struct{}{}
+
+		added = append(added, message{
+			Name:      m.Sender,
+			Text:      []byte(m.Text),
+			Timestamp: m.Timestamp.UTC(),
+		})
+	}
+
+	if len(added) == 0 {
+		return 0, nil
+	}
+
+	//newer messages only need to be appended, anything else is merged in
+	//order of time and the history is written again.
+	slices.SortStableFunc(added, func(a, b message) int {
+		return a.Timestamp.Compare(b.Timestamp)
+	})
+
+	if err := db.touchContact(conv.Contact, added[len(added)-1].Timestamp); err != nil {
+		return 0, err
+	}
+
+	if len(msgs) == 0 || !added[0].Timestamp.Before(msgs[len(msgs)-1].Timestamp) {
+		for _, msg := range added {
+			if err := db.appendMessage(conv.Contact, msg); err != nil {
+				return 0, err
+			}
+		}
+		return len(added), nil
+	}
+
+	merged := append(msgs, added...)
+	slices.SortStableFunc(merged, func(a, b message) int {
+		return a.Timestamp.Compare(b.Timestamp)
+	})
+
+	for i := range merged {
+		merged[i].Timestamp = merged[i].Timestamp.UTC()
+	}
+
+	if err := db.store.ReplaceHistory(conv.Contact, merged); err != nil {
+		return 0, fmt.Errorf("replaceHistory: %w", err)
+	}
+	db.historyLen[conv.Contact] = len(merged)
+
+	//the positions changed, the history is indexed again.
+	if err := db.dropIndex(conv.Contact); err != nil {
+		return 0, err
+	}
+
+	if _, err := db.indexHistory(conv.Contact); err != nil {
+		return 0, err
+	}
+
+	return len(added), nil
+}
+
+// =============================================================================
+
+func writeMarkdown(w io.Writer, archive exportArchive) error {
+	var b strings.Builder
+
+	for _, conv := range archive.Conversations {
+		fmt.Fprintf(&b, "# %s\n\n`%s`\n\n", conv.Name, conv.Contact.Hex())
+
+		for _, m := range conv.Messages {
+			fmt.Fprintf(&b, "**%s** _%s_\n\n", m.Sender, m.Timestamp.Local().Format(time.DateTime))
+
+			//quote every line, so the text can not break the layout.
+			for line := range strings.Lines(m.Text) {
+				fmt.Fprintf(&b, "> %s", line)
+			}
+			b.WriteString("\n\n")
+		}
+	}
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+func writeText(w io.Writer, archive exportArchive) error {
+	var b strings.Builder
+
+	for i, conv := range archive.Conversations {
+		if i > 0 {
+			b.WriteString("\n")
+		}
+		fmt.Fprintf(&b, "=== %s (%s) ===\n", conv.Name, conv.Contact.Hex())
+
+		for _, m := range conv.Messages {
+			fmt.Fprintf(&b, "[%s] %s: %s\n", m.Timestamp.Local().Format(time.DateTime), m.Sender, m.Text)
+		}
+	}
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
@@ -0,0 +1,180 @@
+package app_test
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/hamidoujand/echo/cmd/client/app"
+)
+
+func Test_ExportImport(t *testing.T) {
+	db, err := app.NewDatabase(copyFixture(t, "v2"), me, dataKey)
+	if err != nil {
+		t.Fatalf("Should be able to open the database: %s", err)
+	}
+
+	var archive bytes.Buffer
+	if err := db.Export(&archive, app.FormatJSON, nil); err != nil {
+		t.Fatalf("Should be able to export: %s", err)
+	}
+
+	fresh, err := app.NewDatabase(t.TempDir(), me, dataKey)
+	if err != nil {
+		t.Fatalf("Should be able to open a fresh database: %s", err)
+	}
+
+	n, err := fresh.Import(bytes.NewReader(archive.Bytes()))
+	if err != nil {
+		t.Fatalf("Should be able to import: %s", err)
+	}
+
+	if n != 2 {
+		t.Fatalf("Should import 2 messages, got %d", n)
+	}
+
+	checkHistory(t, fresh, "hello", "hi alice")
+
+	//importing twice must not duplicate anything.
+	n, err = fresh.Import(bytes.NewReader(archive.Bytes()))
+	if err != nil {
+		t.Fatalf("Should be able to import again: %s", err)
+	}
+
+	if n != 0 {
+		t.Fatalf("Should not import messages twice, got %d", n)
+	}
+
+	checkHistory(t, fresh, "hello", "hi alice")
+}
+
+func Test_ImportMerge(t *testing.T) {
+	db, err := app.NewDatabase(copyFixture(t, "v2"), me, dataKey)
+	if err != nil {
+		t.Fatalf("Should be able to open the database: %s", err)
+	}
+
+	archive := `{
+		"version": 1,
+		"account": "` + me.Hex() + `",
+		"conversations": [{
+			"contact": "` + alice.Hex() + `",
+			"name": "alice",
+			"messages": [
+				{"sender": "alice", "text": "first", "timestamp": "2025-02-01T10:00:00Z"},
+				{"sender": "alice", "text": "hello", "timestamp": "2025-03-01T10:00:00Z"},
+				{"sender": "alice", "text": "last", "timestamp": "2025-04-01T10:00:00Z"}
+			]
+		}]
+	}`
+
+	n, err := db.Import(strings.NewReader(archive))
+	if err != nil {
+		t.Fatalf("Should be able to import: %s", err)
+	}
+
+	if n != 2 {
+		t.Fatalf("Should import 2 new messages, got %d", n)
+	}
+
+	checkHistory(t, db, "first", "hello", "hi alice", "last")
+
+	results, err := db.Search(app.SearchQuery{Text: "first"})
+	if err != nil {
+		t.Fatalf("Should be able to search: %s", err)
+	}
+
+	if len(results) != 1 || results[0].Position != 0 {
+		t.Fatalf("Should find the merged message at its new position, got %d results", len(results))
+	}
+}
+
+func Test_ImportContacts(t *testing.T) {
+	tests := []struct {
+		name        string
+		contact     string
+		contactName string
+	}{
+		{name: "zero address", contact: "0x0000000000000000000000000000000000000000", contactName: "nobody"},
+		{name: "own address", contact: me.Hex(), contactName: "me"},
+		{name: "empty name", contact: bob.Hex(), contactName: " "},
+		{name: "control characters", contact: bob.Hex(), contactName: "bob\u0007"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, err := app.NewDatabase(t.TempDir(), me, dataKey)
+			if err != nil {
+				t.Fatalf("Should be able to create a database: %s", err)
+			}
+
+			//the good conversation comes first, nothing is written anyway.
+			archive := `{
+				"version": 1,
+				"account": "` + me.Hex() + `",
+				"conversations": [{
+					"contact": "` + alice.Hex() + `",
+					"name": "alice",
+					"messages": [{"sender": "alice", "text": "hello", "timestamp": "2025-03-01T10:00:00Z"}]
+				}, {
+					"contact": "` + tt.contact + `",
+					"name": "` + tt.contactName + `",
+					"messages": [{"sender": "x", "text": "orphan", "timestamp": "2025-03-01T10:00:00Z"}]
+				}]
+			}`
+
+			if _, err := db.Import(strings.NewReader(archive)); err == nil {
+				t.Fatal("Should not import a contact AddContact refuses")
+			}
+
+			if users := db.Contacts(); len(users) != 0 {
+				t.Fatalf("Should not add any contact, got %d", len(users))
+			}
+		})
+	}
+}
+
+func Test_ExportFormats(t *testing.T) {
+	db, err := app.NewDatabase(copyFixture(t, "v2"), me, dataKey)
+	if err != nil {
+		t.Fatalf("Should be able to open the database: %s", err)
+	}
+
+	for _, format := range []string{app.FormatMarkdown, app.FormatText} {
+		var out bytes.Buffer
+		if err := db.Export(&out, format, nil); err != nil {
+			t.Fatalf("Should be able to export %s: %s", format, err)
+		}
+
+		for _, want := range []string{"alice", "hi alice", alice.Hex()} {
+			if !strings.Contains(out.String(), want) {
+				t.Fatalf("Should find %q in the %s export:\n%s", want, format, out.String())
+			}
+		}
+	}
+
+	if err := db.Export(&bytes.Buffer{}, "pdf", nil); err == nil {
+		t.Fatal("Should not export an unknown format")
+	}
+}
+
+// =============================================================================
+
+func checkHistory(t *testing.T, db *app.Database, exp ...string) {
+	t.Helper()
+
+	msgs, _, err := db.History(alice, -1, 100)
+	if err != nil {
+		t.Fatalf("Should be able to read the history: %s", err)
+	}
+
+	if len(msgs) != len(exp) {
+		t.Fatalf("Should have %d messages, got %d", len(exp), len(msgs))
+	}
+
+	for i, msg := range msgs {
+		if string(msg.Text) != exp[i] {
+			t.Fatalf("Should have %q at %d, got %q", exp[i], i, msg.Text)
+		}
+	}
+}
@@ -0,0 +1,662 @@
+package app
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// A history is split into segments, the active <id>.msg new messages are
+// appended to and the archives <id>.<seq>.msg it is rotated into once it gets
+// large. Every segment starts with a header and has an index <id>.idx with
+// the offset of every message, so a page is read without decrypting the
+// whole file. The index is not sealed, it only tells the sizes of the records
+// the segment shows anyway, and it is rebuilt when it does not match.
+
+const (
+	historyIndexExt = ".idx"
+
+	// rotateSuffix marks an active history that is being archived.
+	rotateSuffix = ".rotate"
+
+	// replaceSuffix marks the complete new content of a history that
+	// replaces all of its segments.
+	replaceSuffix = ".replace"
+
+	// maxHistorySize is the size the active history is rotated at.
+	maxHistorySize = 1 << 20
+)
+
+type segment struct {
+	filename string
+	offsets  []int64
+	size     int64
+}
+
+func (s *fileStorage) LoadHistory(id common.Address) ([]message, error) {
+	segments, err := s.segments(id)
+	if err != nil {
+		return nil, err
+	}
+
+	var messages []message
+	for _, seg := range segments {
+		msgs, err := s.readSegment(seg, 0, len(seg.offsets))
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, msgs...)
+	}
+
+	return messages, nil
+}
+
+func (s *fileStorage) LoadHistoryPage(id common.Address, before int, limit int) ([]message, int, error) {
+	segments, err := s.segments(id)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var total int
+	for _, seg := range segments {
+		total += len(seg.offsets)
+	}
+
+	if before < 0 || before > total {
+		before = total
+	}
+	start := max(before-limit, 0)
+
+	var messages []message
+	var pos int
+	for _, seg := range segments {
+		n := len(seg.offsets)
+
+		from, to := max(start-pos, 0), min(before-pos, n)
+		if from < to {
+			msgs, err := s.readSegment(seg, from, to)
+			if err != nil {
+				return nil, 0, err
+			}
+			messages = append(messages, msgs...)
+		}
+
+		pos += n
+	}
+
+	return messages, start, nil
+}
+
+func (s *fileStorage) AppendHistory(id common.Address, msg message) error {
+	filename := s.historyFile(id)
+
+	jsn, err := json.Marshal(msg)
+	if err != nil {
+		return fmt.Errorf("marshalling message: %w", err)
+	}
+
+	record, err := s.vault.seal(recordName(filename), jsn)
+	if err != nil {
+		return fmt.Errorf("seal message: %w", err)
+	}
+
+	f, err := os.OpenFile(filename, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("openFile %s: %w", filename, err)
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return fmt.Errorf("stat: %w", err)
+	}
+
+	record = append(record, '\n')
+	offset := info.Size()
+
+	//a new history starts with its header.
+	if info.Size() == 0 {
+		header, err := historyHeaderRecord(s.vault, recordName(filename))
+		if err != nil {
+			return err
+		}
+		record = append(header, record...)
+		offset = int64(len(header))
+	}
+
+	//a single write, a crash can only leave a torn last line behind.
+	if _, err := f.Write(record); err != nil {
+		return fmt.Errorf("write: %w", err)
+	}
+
+	if err := f.Sync(); err != nil {
+		return fmt.Errorf("sync: %w", err)
+	}
+
+	//the index is not synced, Recover rebuilds it when it falls behind.
+	if err := appendIndex(filename, offset, info.Size() == 0); err != nil {
+		return fmt.Errorf("appendIndex: %w", err)
+	}
+
+	if info.Size()+int64(len(record)) >= maxHistorySize {
+		if err := s.rotateHistory(id); err != nil {
+			return fmt.Errorf("rotateHistory: %w", err)
+		}
+	}
+
+	return nil
+}
+
+func (s *fileStorage) ReplaceHistory(id common.Address, msgs []message) error {
+	active := s.historyFile(id)
+	name := recordName(active)
+
+	//an empty history gets its header with the next message.
+	var out bytes.Buffer
+	if len(msgs) != 0 {
+		header, err := historyHeaderRecord(s.vault, name)
+		if err != nil {
+			return err
+		}
+		out.Write(header)
+	}
+
+	for _, msg := range msgs {
+		jsn, err := json.Marshal(msg)
+		if err != nil {
+			return fmt.Errorf("marshalling message: %w", err)
+		}
+
+		record, err := s.vault.seal(name, jsn)
+		if err != nil {
+			return fmt.Errorf("seal message: %w", err)
+		}
+
+		out.Write(record)
+		out.WriteByte('\n')
+	}
+
+	//from here on Recover finishes the replace.
+	if err := writeFileAtomic(active+replaceSuffix, out.Bytes()); err != nil {
+		return fmt.Errorf("write: %w", err)
+	}
+
+	return s.finishReplace(active + replaceSuffix)
+}
+
+func (s *fileStorage) RemoveHistory(id common.Address) error {
+	//archives, indexes and the files of unfinished rotations and replaces.
+	files, err := filepath.Glob(filepath.Join(s.dir, chatHistoryDir, id.Hex()+".*"))
+	if err != nil {
+		return fmt.Errorf("glob: %w", err)
+	}
+
+	for _, filename := range files {
+		if err := os.Remove(filename); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("remove: %w", err)
+		}
+	}
+
+	return syncDir(filepath.Join(s.dir, chatHistoryDir))
+}
+
+// =============================================================================
+
+// segments returns the segments of the history with id, oldest first.
+func (s *fileStorage) segments(id common.Address) ([]segment, error) {
+	//the sequence is zero padded, so the archives sort by name.
+	filenames, err := filepath.Glob(filepath.Join(s.dir, chatHistoryDir, id.Hex()+".*.msg"))
+	if err != nil {
+		return nil, fmt.Errorf("glob: %w", err)
+	}
+
+	active := s.historyFile(id)
+	if _, err := os.Stat(active); err == nil {
+		filenames = append(filenames, active)
+	}
+
+	segments := make([]segment, 0, len(filenames))
+	for _, filename := range filenames {
+		seg, err := s.loadSegment(filename)
+		if err != nil {
+			return nil, err
+		}
+		segments = append(segments, seg)
+	}
+
+	return segments, nil
+}
+
+// loadSegment reads the index of filename and rebuilds it when it does not
+// match the segment.
+func (s *fileStorage) loadSegment(filename string) (segment, error) {
+	info, err := os.Stat(filename)
+	if err != nil {
+		return segment{}, fmt.Errorf("stat: %w", err)
+	}
+
+	seg := segment{
+		filename: filename,
+		size:     info.Size(),
+	}
+
+	data, err := os.ReadFile(indexFile(filename))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return segment{}, fmt.Errorf("read index: %w", err)
+	}
+
+	if offsets, ok := decodeIndex(data); ok && validIndex(filename, offsets, seg.size) {
+		seg.offsets = offsets
+		return seg, nil
+	}
+
+	seg.offsets, err = s.buildIndex(filename)
+	if err != nil {
+		return segment{}, fmt.Errorf("build index %s: %w", filename, err)
+	}
+
+	if err := writeFileAtomic(indexFile(filename), encodeIndex(seg.offsets)); err != nil {
+		return segment{}, fmt.Errorf("write index: %w", err)
+	}
+
+	return seg, nil
+}
+
+// buildIndex finds the offset of every message in filename.
+func (s *fileStorage) buildIndex(filename string) ([]int64, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("read: %w", err)
+	}
+
+	name := recordName(filename)
+
+	var offsets []int64
+	var offset int64
+	first := true
+	for line := range bytes.Lines(data) {
+		start := offset
+		offset += int64(len(line))
+
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 {
+			continue
+		}
+
+		if first {
+			first = false
+			h, ok, err := readHistoryHeader(s.vault, name, line)
+			if err != nil {
+				return nil, err
+			}
+			if ok {
+				if h.Schema > schemaVersion {
+					return nil, fmt.Errorf("history %s has schema version %d, this client only knows up to %d", name, h.Schema, schemaVersion)
+				}
+				continue
+			}
+		}
+
+		offsets = append(offsets, start)
+	}
+
+	return offsets, nil
+}
+
+// readSegment reads the messages from up to to of seg.
+func (s *fileStorage) readSegment(seg segment, from int, to int) ([]message, error) {
+	if from >= to {
+		return nil, nil
+	}
+
+	end := seg.size
+	if to < len(seg.offsets) {
+		end = seg.offsets[to]
+	}
+
+	f, err := os.Open(seg.filename)
+	if err != nil {
+		return nil, fmt.Errorf("open %s: %w", seg.filename, err)
+	}
+	defer f.Close()
+
+	data := make([]byte, end-seg.offsets[from])
+	if _, err := f.ReadAt(data, seg.offsets[from]); err != nil {
+		return nil, fmt.Errorf("read %s: %w", seg.filename, err)
+	}
+
+	name := recordName(seg.filename)
+
+	messages := make([]message, 0, to-from)
+	for line := range bytes.Lines(data) {
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 {
+			continue
+		}
+
+		jsn, err := s.vault.open(name, line)
+		if err != nil {
+			return nil, fmt.Errorf("open record: %w", err)
+		}
+
+		var msg message
+		if err := json.Unmarshal(jsn, &msg); err != nil {
+			return nil, fmt.Errorf("unmarshaling json data into message: %w", err)
+		}
+		msg.Timestamp = msg.Timestamp.Local()
+		messages = append(messages, msg)
+	}
+
+	return messages, nil
+}
+
+// rotateHistory moves the active history of id into a new archive, the
+// records are sealed again under the name of the archive.
+func (s *fileStorage) rotateHistory(id common.Address) error {
+	archives, err := filepath.Glob(filepath.Join(s.dir, chatHistoryDir, id.Hex()+".*.msg"))
+	if err != nil {
+		return fmt.Errorf("glob: %w", err)
+	}
+
+	active := s.historyFile(id)
+	archive := filepath.Join(s.dir, chatHistoryDir, fmt.Sprintf("%s.%06d.msg", id.Hex(), len(archives)+1))
+
+	//from here on Recover finishes the rotation.
+	if err := os.Rename(active, archive+rotateSuffix); err != nil {
+		return fmt.Errorf("rename: %w", err)
+	}
+
+	if err := os.Remove(indexFile(active)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("remove index: %w", err)
+	}
+
+	if err := syncDir(filepath.Dir(active)); err != nil {
+		return err
+	}
+
+	return s.finishRotation(archive + rotateSuffix)
+}
+
+func (s *fileStorage) finishRotation(pending string) error {
+	archive := strings.TrimSuffix(pending, rotateSuffix)
+
+	//the records were sealed under the name of the active history.
+	hex, _, _ := strings.Cut(filepath.Base(archive), ".")
+	from := hex + ".msg"
+	to := recordName(archive)
+
+	data, err := os.ReadFile(pending)
+	if err != nil {
+		return fmt.Errorf("read: %w", err)
+	}
+
+	var out bytes.Buffer
+	for line := range bytes.Lines(data) {
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 {
+			continue
+		}
+
+		plaintext, err := s.vault.open(from, line)
+		if err != nil {
+			return fmt.Errorf("open record: %w", err)
+		}
+
+		record, err := s.vault.seal(to, plaintext)
+		if err != nil {
+			return fmt.Errorf("seal record: %w", err)
+		}
+
+		out.Write(record)
+		out.WriteByte('\n')
+	}
+
+	if err := writeFileAtomic(archive, out.Bytes()); err != nil {
+		return fmt.Errorf("write archive: %w", err)
+	}
+
+	if _, err := s.loadSegment(archive); err != nil {
+		return err
+	}
+
+	if err := os.Remove(pending); err != nil {
+		return fmt.Errorf("remove: %w", err)
+	}
+
+	return nil
+}
+
+// finishReplace removes every segment of the history and puts pending in
+// place of the active one.
+func (s *fileStorage) finishReplace(pending string) error {
+	active := strings.TrimSuffix(pending, replaceSuffix)
+	hex := strings.TrimSuffix(filepath.Base(active), ".msg")
+
+	archives, err := filepath.Glob(filepath.Join(s.dir, chatHistoryDir, hex+".*.msg"))
+	if err != nil {
+		return fmt.Errorf("glob: %w", err)
+	}
+
+	files := []string{indexFile(active)}
+	for _, archive := range archives {
+		files = append(files, archive, indexFile(archive))
+	}
+
+	for _, filename := range files {
+		if err := os.Remove(filename); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("remove: %w", err)
+		}
+	}
+
+	if err := os.Rename(pending, active); err != nil {
+		return fmt.Errorf("rename: %w", err)
+	}
+
+	if err := syncDir(filepath.Dir(active)); err != nil {
+		return err
+	}
+
+	if _, err := s.loadSegment(active); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// recoverReplaces finishes the replaces that were interrupted, the new
+// content is complete since it is written atomically.
+func (s *fileStorage) recoverReplaces() error {
+	pending, err := filepath.Glob(filepath.Join(s.dir, chatHistoryDir, "*"+replaceSuffix))
+	if err != nil {
+		return fmt.Errorf("glob: %w", err)
+	}
+
+	for _, filename := range pending {
+		if err := s.finishReplace(filename); err != nil {
+			return fmt.Errorf("finish replace %s: %w", filename, err)
+		}
+	}
+
+	return nil
+}
+
+// recoverRotations finishes the rotations that were interrupted, an archive
+// that exists is complete since it is written atomically.
+func (s *fileStorage) recoverRotations() error {
+	pending, err := filepath.Glob(filepath.Join(s.dir, chatHistoryDir, "*"+rotateSuffix))
+	if err != nil {
+		return fmt.Errorf("glob: %w", err)
+	}
+
+	for _, filename := range pending {
+		if _, err := os.Stat(strings.TrimSuffix(filename, rotateSuffix)); err == nil {
+			if err := os.Remove(filename); err != nil {
+				return fmt.Errorf("remove: %w", err)
+			}
+			continue
+		}
+
+		if err := s.finishRotation(filename); err != nil {
+			return fmt.Errorf("finish rotation %s: %w", filename, err)
+		}
+	}
+
+	return nil
+}
+
+// =============================================================================
+
+// historyHeader is the first record of every history file.
+type historyHeader struct {
+	Schema int `json:"schema"`
+}
+
+// readHistoryHeader reports false when line is a message.
+func readHistoryHeader(v *vault, name string, line []byte) (historyHeader, bool, error) {
+	jsn, err := v.open(name, line)
+	if err != nil {
+		return historyHeader{}, false, fmt.Errorf("open record: %w", err)
+	}
+
+	var h historyHeader
+	if err := json.Unmarshal(jsn, &h); err != nil {
+		return historyHeader{}, false, nil
+	}
+
+	return h, h.Schema > 0, nil
+}
+
+func historyHeaderRecord(v *vault, name string) ([]byte, error) {
+	jsn, err := json.Marshal(historyHeader{Schema: schemaVersion})
+	if err != nil {
+		return nil, fmt.Errorf("marshal header: %w", err)
+	}
+
+	record, err := v.seal(name, jsn)
+	if err != nil {
+		return nil, fmt.Errorf("seal header: %w", err)
+	}
+
+	return append(record, '\n'), nil
+}
+
+// repairTail cuts off a last line that was not completely written.
+func repairTail(filename string) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		return fmt.Errorf("open: %w", err)
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return fmt.Errorf("stat: %w", err)
+	}
+
+	if info.Size() == 0 {
+		return nil
+	}
+
+	//most files are fine, only the last byte is read for them.
+	last := make([]byte, 1)
+	if _, err := f.ReadAt(last, info.Size()-1); err != nil {
+		return fmt.Errorf("read: %w", err)
+	}
+	if last[0] == '\n' {
+		return nil
+	}
+
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return fmt.Errorf("read: %w", err)
+	}
+
+	keep := bytes.LastIndexByte(data, '\n') + 1
+	if err := os.Truncate(filename, int64(keep)); err != nil {
+		return fmt.Errorf("truncate: %w", err)
+	}
+
+	return nil
+}
+
+// =============================================================================
+
+func indexFile(filename string) string {
+	return strings.TrimSuffix(filename, ".msg") + historyIndexExt
+}
+
+func appendIndex(filename string, offset int64, truncate bool) error {
+	flags := os.O_APPEND | os.O_CREATE | os.O_WRONLY
+	if truncate {
+		flags |= os.O_TRUNC
+	}
+
+	f, err := os.OpenFile(indexFile(filename), flags, 0600)
+	if err != nil {
+		return fmt.Errorf("open: %w", err)
+	}
+	defer f.Close()
+
+	if _, err := f.Write(binary.BigEndian.AppendUint64(nil, uint64(offset))); err != nil {
+		return fmt.Errorf("write: %w", err)
+	}
+
+	return nil
+}
+
+func encodeIndex(offsets []int64) []byte {
+	data := make([]byte, 0, len(offsets)*8)
+	for _, offset := range offsets {
+		data = binary.BigEndian.AppendUint64(data, uint64(offset))
+	}
+	return data
+}
+
+func decodeIndex(data []byte) ([]int64, bool) {
+	if len(data)%8 != 0 {
+		return nil, false
+	}
+
+	offsets := make([]int64, 0, len(data)/8)
+	for i := 0; i < len(data); i += 8 {
+		offsets = append(offsets, int64(binary.BigEndian.Uint64(data[i:])))
+	}
+
+	return offsets, true
+}
+
+// validIndex checks the offsets grow and the last one points at the last line
+// of the segment, an index that fell behind fails the second check.
+func validIndex(filename string, offsets []int64, size int64) bool {
+	if len(offsets) == 0 {
+		return size == 0
+	}
+
+	for i, offset := range offsets {
+		if offset < 0 || offset >= size || (i > 0 && offset <= offsets[i-1]) {
+			return false
+		}
+	}
+
+	f, err := os.Open(filename)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	last := offsets[len(offsets)-1]
+	tail := make([]byte, size-last)
+	if _, err := f.ReadAt(tail, last); err != nil {
+		return false
+	}
+
+	return bytes.IndexByte(tail, '\n') == len(tail)-1
+}
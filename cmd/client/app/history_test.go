@@ -0,0 +1,73 @@
+package app_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hamidoujand/echo/cmd/client/app"
+)
+
+func Test_HistoryPages(t *testing.T) {
+	dir := copyFixture(t, "v2")
+
+	db, err := app.NewDatabase(dir, me, dataKey)
+	if err != nil {
+		t.Fatalf("Should be able to open the database: %s", err)
+	}
+
+	msgs, start, err := db.History(alice, -1, 1)
+	if err != nil {
+		t.Fatalf("Should be able to read the last page: %s", err)
+	}
+
+	if len(msgs) != 1 || start != 1 || string(msgs[0].Text) != "hi alice" {
+		t.Fatalf("Should get the newest message: got %d messages from %d", len(msgs), start)
+	}
+
+	msgs, start, err = db.History(alice, start, 1)
+	if err != nil {
+		t.Fatalf("Should be able to read the older page: %s", err)
+	}
+
+	if len(msgs) != 1 || start != 0 || string(msgs[0].Text) != "hello" {
+		t.Fatalf("Should get the oldest message: got %d messages from %d", len(msgs), start)
+	}
+
+	msgs, _, err = db.History(bob, -1, 10)
+	if err != nil {
+		t.Fatalf("Should be able to read an empty history: %s", err)
+	}
+
+	if len(msgs) != 0 {
+		t.Fatalf("Should not have messages with bob, got %d", len(msgs))
+	}
+}
+
+func Test_HistoryIndexRebuild(t *testing.T) {
+	dir := copyFixture(t, "v2")
+
+	if _, err := app.NewDatabase(dir, me, dataKey); err != nil {
+		t.Fatalf("Should be able to open the database: %s", err)
+	}
+
+	//an index that does not match the history must not be trusted.
+	index := filepath.Join(dir, "messages", alice.Hex()+".idx")
+	if err := os.WriteFile(index, []byte{0, 0, 0, 0, 0, 0, 0, 1}, 0600); err != nil {
+		t.Fatalf("Should be able to damage the index: %s", err)
+	}
+
+	db, err := app.NewDatabase(dir, me, dataKey)
+	if err != nil {
+		t.Fatalf("Should be able to open the database: %s", err)
+	}
+
+	msgs, start, err := db.History(alice, -1, 10)
+	if err != nil {
+		t.Fatalf("Should be able to read the history: %s", err)
+	}
+
+	if len(msgs) != 2 || start != 0 {
+		t.Fatalf("Should have 2 messages, got %d from %d", len(msgs), start)
+	}
+}
@@ -1,12 +1,16 @@
 package app
 
 import (
+	"crypto/ecdh"
 	"crypto/ecdsa"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/x509"
+	"encoding/hex"
 	"encoding/pem"
+	"errors"
 	"fmt"
+	"io/fs"
 	"os"
 	"path/filepath"
 	"strings"
@@ -17,60 +21,135 @@ import (
 
 const idFilename = "private.ecdsa"
 const encryptionFilename = "private.rsa"
+const dhFilename = "private.x25519"
 
 type ID struct {
 	Address      common.Address
 	ECDSAKey     *ecdsa.PrivateKey
 	RSAKey       *rsa.PrivateKey
 	RSAPublicKey string
+	// DHKey is the identity key used to start forward-secret sessions.
+	DHKey *ecdh.PrivateKey
 }
 
-func NewID(confDir string) (ID, error) {
-	if err := os.MkdirAll(filepath.Join(confDir, "id"), 0755); err != nil {
-		return ID{}, fmt.Errorf("mkdirAll: %w", err)
+// ErrIDExists is returned when an identity is restored over an existing one.
+var ErrIDExists = errors.New("an identity already exists")
+
+// keyCreators create the encoded private keys missing in the id directory.
+type keyCreators struct {
+	id      func() ([]byte, error)
+	encrypt func() ([]byte, error)
+	dh      func() ([]byte, error)
+}
+
+var randomKeys = keyCreators{
+	id:      createKeyID,
+	encrypt: createEncryptKey,
+	dh:      createDHKey,
+}
+
+// NewID loads the keys in confDir, creating the missing ones. Every key is
+// sealed with passphrase, keys written by older clients are sealed on the way.
+func NewID(confDir string, passphrase []byte) (ID, error) {
+	return newID(confDir, passphrase, randomKeys)
+}
+
+// NewIDFromMnemonic creates the keys in confDir from a recovery phrase, the
+// same phrase always gives the same identity. It fails with ErrIDExists when
+// confDir already holds a key.
+func NewIDFromMnemonic(confDir string, mnemonic string, passphrase []byte) (ID, error) {
+	seed, err := mnemonicSeed(mnemonic)
+	if err != nil {
+		return ID{}, err
 	}
 
-	filename := filepath.Join(confDir, "id", idFilename)
-	var address common.Address
-	var privateECDSA *ecdsa.PrivateKey
-	_, err := os.Stat(filename)
-	switch {
-	case err != nil:
-		var err error
-		address, privateECDSA, err = createKeyID(filename)
-		if err != nil {
-			return ID{}, fmt.Errorf("createKeyID: %w", err)
+	for _, name := range []string{idFilename, encryptionFilename, dhFilename} {
+		_, err := os.Stat(filepath.Join(confDir, "id", name))
+		if err == nil {
+			return ID{}, fmt.Errorf("%w in %s", ErrIDExists, confDir)
 		}
-	default:
-		var err error
-		address, privateECDSA, err = readKeyID(filename)
-		if err != nil {
-			return ID{}, fmt.Errorf("readKeyID: %w", err)
+		if !errors.Is(err, fs.ErrNotExist) {
+			return ID{}, fmt.Errorf("stat: %w", err)
 		}
 	}
 
-	encryptKeyFile := filepath.Join(confDir, "id", encryptionFilename)
-	var privateRSA *rsa.PrivateKey
-	_, err = os.Stat(encryptKeyFile)
+	return newID(confDir, passphrase, seedKeys(seed))
+}
+
+// HasID reports whether confDir holds an identity, a new one is created on
+// the first run.
+func HasID(confDir string) (bool, error) {
+	_, err := os.Stat(filepath.Join(confDir, "id", idFilename))
 	switch {
-	case err != nil:
-		var err error
-		privateRSA, err = createEncryptKey(encryptKeyFile)
-		if err != nil {
-			return ID{}, fmt.Errorf("createEncryptKey: %w", err)
-		}
+	case err == nil:
+		return true, nil
+	case errors.Is(err, fs.ErrNotExist):
+		return false, nil
 	default:
-		var err error
-		privateRSA, err = readEncryptKey(encryptKeyFile)
-		if err != nil {
-			return ID{}, fmt.Errorf("readEncryptKey: %w", err)
-		}
+		return false, fmt.Errorf("stat: %w", err)
 	}
+}
 
-	//public key
-	bs, err := x509.MarshalPKIXPublicKey(&privateRSA.PublicKey)
+func newID(confDir string, passphrase []byte, create keyCreators) (ID, error) {
+	if len(passphrase) == 0 {
+		return ID{}, errors.New("passphrase can not be empty")
+	}
+
+	if err := os.MkdirAll(filepath.Join(confDir, "id"), 0700); err != nil {
+		return ID{}, fmt.Errorf("mkdirAll: %w", err)
+	}
+
+	if err := recoverKeys(confDir); err != nil {
+		return ID{}, fmt.Errorf("recoverKeys: %w", err)
+	}
+
+	filename := filepath.Join(confDir, "id", idFilename)
+	raw, err := loadKey(filename, passphrase, create.id)
+	if err != nil {
+		return ID{}, fmt.Errorf("loadKey %s: %w", idFilename, err)
+	}
+
+	address, privateECDSA, err := readKeyID(raw)
+	if err != nil {
+		return ID{}, fmt.Errorf("readKeyID: %w", err)
+	}
+
+	encryptKeyFile := filepath.Join(confDir, "id", encryptionFilename)
+	raw, err = loadKey(encryptKeyFile, passphrase, create.encrypt)
+	if err != nil {
+		return ID{}, fmt.Errorf("loadKey %s: %w", encryptionFilename, err)
+	}
+
+	privateRSA, err := readEncryptKey(raw)
 	if err != nil {
-		return ID{}, fmt.Errorf("marshalling Public Key: %w", err)
+		return ID{}, fmt.Errorf("readEncryptKey: %w", err)
+	}
+
+	dhKeyFile := filepath.Join(confDir, "id", dhFilename)
+	raw, err = loadKey(dhKeyFile, passphrase, create.dh)
+	if err != nil {
+		return ID{}, fmt.Errorf("loadKey %s: %w", dhFilename, err)
+	}
+
+	privateDH, err := readDHKey(raw)
+	if err != nil {
+		return ID{}, fmt.Errorf("readDHKey: %w", err)
+	}
+
+	publicRSA, err := encodePublicKey(&privateRSA.PublicKey)
+	if err != nil {
+		return ID{}, err
+	}
+
+	return ID{Address: address, ECDSAKey: privateECDSA, RSAKey: privateRSA, RSAPublicKey: publicRSA, DHKey: privateDH}, nil
+}
+
+// encodePublicKey returns the PEM the contacts get as the key of this
+// identity.
+func encodePublicKey(key *rsa.PublicKey) (string, error) {
+	bs, err := x509.MarshalPKIXPublicKey(key)
+	if err != nil {
+		return "", fmt.Errorf("marshalling Public Key: %w", err)
 	}
 
 	publicPEM := pem.Block{
@@ -80,66 +159,96 @@ func NewID(confDir string) (ID, error) {
 
 	var builder strings.Builder
 	if err := pem.Encode(&builder, &publicPEM); err != nil {
-		return ID{}, fmt.Errorf("encode public key: %w", err)
+		return "", fmt.Errorf("encode public key: %w", err)
 	}
 
-	return ID{Address: address, ECDSAKey: privateECDSA, RSAKey: privateRSA, RSAPublicKey: builder.String()}, nil
+	return builder.String(), nil
 }
 
-func createKeyID(filename string) (common.Address, *ecdsa.PrivateKey, error) {
-	private, err := crypto.GenerateKey()
+// loadKey returns the encoded key stored in filename, create is used when
+// the file does not exist yet.
+func loadKey(filename string, passphrase []byte, create func() ([]byte, error)) ([]byte, error) {
+	data, err := os.ReadFile(filename)
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		raw, err := create()
+		if err != nil {
+			return nil, err
+		}
+
+		sealed, err := sealKey(raw, passphrase)
+		if err != nil {
+			return nil, fmt.Errorf("sealKey: %w", err)
+		}
+
+		if err := writeFileAtomic(filename, sealed); err != nil {
+			return nil, fmt.Errorf("writeFileAtomic: %w", err)
+		}
+
+		return raw, nil
+
+	case err != nil:
+		return nil, fmt.Errorf("reading file: %w", err)
+	}
+
+	if err := checkKeyPermissions(filename); err != nil {
+		return nil, err
+	}
+
+	if isSealed(data) {
+		return openKey(data, passphrase)
+	}
+
+	//written by an older client, seal it now.
+	sealed, err := sealKey(data, passphrase)
 	if err != nil {
-		return common.Address{}, nil, fmt.Errorf("generateKey: %w", err)
+		return nil, fmt.Errorf("sealKey: %w", err)
 	}
 
-	if err := crypto.SaveECDSA(filename, private); err != nil {
-		return common.Address{}, nil, fmt.Errorf("saveECDSA: %w", err)
+	if err := writeFileAtomic(filename, sealed); err != nil {
+		return nil, fmt.Errorf("writeFileAtomic: %w", err)
 	}
 
-	addr := crypto.PubkeyToAddress(private.PublicKey)
-	return addr, private, nil
+	return data, nil
 }
 
-func readKeyID(filename string) (common.Address, *ecdsa.PrivateKey, error) {
-	private, err := crypto.LoadECDSA(filename)
+func createKeyID() ([]byte, error) {
+	private, err := crypto.GenerateKey()
 	if err != nil {
-		return common.Address{}, nil, fmt.Errorf("loadECDSA: %w", err)
+		return nil, fmt.Errorf("generateKey: %w", err)
 	}
-	addr := crypto.PubkeyToAddress(private.PublicKey)
-	return addr, private, nil
+
+	return []byte(hex.EncodeToString(crypto.FromECDSA(private))), nil
 }
 
-func createEncryptKey(filename string) (*rsa.PrivateKey, error) {
-	privateKey, err := rsa.GenerateKey(rand.Reader, 1024)
+func readKeyID(raw []byte) (common.Address, *ecdsa.PrivateKey, error) {
+	private, err := crypto.HexToECDSA(strings.TrimSpace(string(raw)))
 	if err != nil {
-		return nil, fmt.Errorf("generating private key: %w", err)
+		return common.Address{}, nil, fmt.Errorf("hexToECDSA: %w", err)
 	}
+	addr := crypto.PubkeyToAddress(private.PublicKey)
+	return addr, private, nil
+}
 
-	file, err := os.Create(filename)
+func createEncryptKey() ([]byte, error) {
+	privateKey, err := rsa.GenerateKey(rand.Reader, rsaBits)
 	if err != nil {
-		return nil, fmt.Errorf("creating private key file: %w", err)
+		return nil, fmt.Errorf("generating private key: %w", err)
 	}
 
-	defer file.Close()
+	return encodeEncryptKey(privateKey), nil
+}
 
+func encodeEncryptKey(privateKey *rsa.PrivateKey) []byte {
 	block := pem.Block{
 		Type:  "PRIVATE KEY",
 		Bytes: x509.MarshalPKCS1PrivateKey(privateKey),
 	}
 
-	if err := pem.Encode(file, &block); err != nil {
-		return nil, fmt.Errorf("encoding to pem: %w", err)
-	}
-
-	return privateKey, nil
+	return pem.EncodeToMemory(&block)
 }
 
-func readEncryptKey(filename string) (*rsa.PrivateKey, error) {
-	pemBytes, err := os.ReadFile(filename)
-	if err != nil {
-		return nil, fmt.Errorf("reading file: %w", err)
-	}
-
+func readEncryptKey(pemBytes []byte) (*rsa.PrivateKey, error) {
 	block, _ := pem.Decode(pemBytes)
 	if block == nil {
 		return nil, fmt.Errorf("failed to decode PEM block")
@@ -156,3 +265,26 @@ func readEncryptKey(filename string) (*rsa.PrivateKey, error) {
 
 	return private, nil
 }
+
+func createDHKey() ([]byte, error) {
+	privateKey, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("generating private key: %w", err)
+	}
+
+	return []byte(hex.EncodeToString(privateKey.Bytes())), nil
+}
+
+func readDHKey(bs []byte) (*ecdh.PrivateKey, error) {
+	raw, err := hex.DecodeString(strings.TrimSpace(string(bs)))
+	if err != nil {
+		return nil, fmt.Errorf("decoding private key: %w", err)
+	}
+
+	private, err := ecdh.X25519().NewPrivateKey(raw)
+	if err != nil {
+		return nil, fmt.Errorf("parsing private key: %w", err)
+	}
+
+	return private, nil
+}
@@ -0,0 +1,77 @@
+package app
+
+import "github.com/ethereum/go-ethereum/common"
+
+// The tests of package app_test reach the unexported parts of the package
+// through these.
+
+// the full PBKDF2 cost on every key file makes the tests take minutes.
+func init() {
+	keystoreIterations = keystoreMinIterations
+}
+
+// DiscardUI is a UIWriter that shows nothing.
+func DiscardUI(id string, msg message) {}
+
+// SealRatchet encrypts msg for the contact to with the double ratchet, a
+// session is started when there is none.
+func (c *Client) SealRatchet(to common.Address, msg []byte) ([]byte, error) {
+	return c.sealRatchet(User{ID: to}, msg)
+}
+
+// OpenRatchet decrypts a message sealed by the contact from.
+func (c *Client) OpenRatchet(from common.Address, text []byte) ([]byte, error) {
+	return c.openRatchet(from, text, func() *session {
+		return c.db.Session(from)
+	}, func(s *session) error {
+		return c.db.SaveSession(from, s)
+	})
+}
+
+// ParseCommandLine splits a command line into its name and arguments.
+var ParseCommandLine = parseCommandLine
+
+// LookupCommand returns the name of the command called or aliased name.
+func LookupCommand(name string) (string, bool) {
+	c, ok := defaultCommands().lookup(name)
+	if !ok {
+		return "", false
+	}
+	return c.name, true
+}
+
+// CompleteCommand returns the names and aliases of the commands starting with
+// prefix.
+func CompleteCommand(prefix string) []string {
+	return defaultCommands().complete(prefix)
+}
+
+// SealKey and OpenKey seal a private key with a passphrase and open it.
+var (
+	SealKey = sealKey
+	OpenKey = openKey
+)
+
+// SealRecord seals a record of the file name with the data key.
+func SealRecord(key []byte, name string, plaintext []byte) ([]byte, error) {
+	v, err := newVault(key)
+	if err != nil {
+		return nil, err
+	}
+	return v.seal(name, plaintext)
+}
+
+// OpenRecord opens a record of the file name sealed with the data key.
+func OpenRecord(key []byte, name string, record []byte) ([]byte, error) {
+	v, err := newVault(key)
+	if err != nil {
+		return nil, err
+	}
+	return v.open(name, record)
+}
+
+// AddRequestMessage adds a received message to req.
+func AddRequestMessage(req Request, text string) Request {
+	req.Messages = append(req.Messages, message{Text: []byte(text)})
+	return req
+}
@@ -0,0 +1,236 @@
+package app
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/url"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/gdamore/tcell/v2"
+	"github.com/hamidoujand/echo/qr"
+	"github.com/hamidoujand/echo/signature"
+	"github.com/rivo/tview"
+)
+
+// An invite hands out the address, the name and the fingerprint of the
+// encryption key of an account, signed by its identity key. It is shared as
+// an echo:// URI or its QR code, accepting it adds the contact and pins the
+// key before the first message.
+
+const (
+	inviteScheme = "echo"
+	inviteHost   = "invite"
+)
+
+// Invite is a signed invitation to talk to the account ID.
+type Invite struct {
+	ID          common.Address
+	Name        string
+	Fingerprint string
+	V           *big.Int
+	R           *big.Int
+	S           *big.Int
+}
+
+func (inv Invite) signedData() any {
+	return struct {
+		ID          common.Address
+		Name        string
+		Fingerprint string
+	}{
+		ID:          inv.ID,
+		Name:        inv.Name,
+		Fingerprint: inv.Fingerprint,
+	}
+}
+
+func (inv Invite) verify() error {
+	if _, err := validName(inv.Name); err != nil {
+		return err
+	}
+
+	if inv.V == nil || inv.R == nil || inv.S == nil {
+		return errors.New("invite is not signed")
+	}
+
+	from, err := signature.FromAddress(inv.signedData(), inv.V, inv.R, inv.S)
+	if err != nil {
+		return fmt.Errorf("fromAddress: %w", err)
+	}
+
+	if from != inv.ID.Hex() {
+		return fmt.Errorf("invite is signed by %s", from)
+	}
+
+	return nil
+}
+
+// NewInvite signs an invite to the identity id going by name.
+func NewInvite(id ID, name string) (Invite, error) {
+	name, err := validName(name)
+	if err != nil {
+		return Invite{}, err
+	}
+
+	inv := Invite{
+		ID:          id.Address,
+		Name:        name,
+		Fingerprint: keyFingerprint([]byte(id.RSAPublicKey)),
+	}
+
+	inv.V, inv.R, inv.S, err = signature.Sign(inv.signedData(), id.ECDSAKey)
+	if err != nil {
+		return Invite{}, fmt.Errorf("sign: %w", err)
+	}
+
+	return inv, nil
+}
+
+// String returns the invite as an echo:// URI, the fingerprint is written
+// without spaces and the signature in base64 to keep the QR code small.
+func (inv Invite) String() string {
+	sig := signature.ToSignatureBytesWithEthID(inv.V, inv.R, inv.S)
+
+	q := url.Values{}
+	q.Set("id", inv.ID.Hex())
+	q.Set("name", inv.Name)
+	q.Set("key", strings.ReplaceAll(inv.Fingerprint, " ", ""))
+	q.Set("sig", base64.RawURLEncoding.EncodeToString(sig))
+
+	u := url.URL{
+		Scheme:   inviteScheme,
+		Host:     inviteHost,
+		RawQuery: q.Encode(),
+	}
+
+	return u.String()
+}
+
+// ParseInvite reads the invite in the URI s and verifies its signature.
+func ParseInvite(s string) (Invite, error) {
+	u, err := url.Parse(strings.TrimSpace(s))
+	if err != nil {
+		return Invite{}, fmt.Errorf("parse: %w", err)
+	}
+
+	if u.Scheme != inviteScheme || u.Host != inviteHost {
+		return Invite{}, fmt.Errorf("not an invite, it has to start with %s://%s", inviteScheme, inviteHost)
+	}
+
+	q := u.Query()
+
+	id, err := ParseAddress(q.Get("id"))
+	if err != nil {
+		return Invite{}, err
+	}
+
+	key, err := hex.DecodeString(q.Get("key"))
+	if err != nil || len(key) != 16 {
+		return Invite{}, errors.New("invite has an invalid key fingerprint")
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(q.Get("sig"))
+	if err != nil || len(sig) != crypto.SignatureLength {
+		return Invite{}, errors.New("invite has an invalid signature")
+	}
+
+	inv := Invite{
+		ID:          id,
+		Name:        q.Get("name"),
+		Fingerprint: groupFingerprint(strings.ToUpper(hex.EncodeToString(key))),
+		R:           new(big.Int).SetBytes(sig[:32]),
+		S:           new(big.Int).SetBytes(sig[32:64]),
+		V:           new(big.Int).SetBytes(sig[64:]),
+	}
+
+	if err := inv.verify(); err != nil {
+		return Invite{}, fmt.Errorf("verify: %w", err)
+	}
+
+	return inv, nil
+}
+
+// =============================================================================
+
+// acceptInvite adds the contact of the invite in s with the key of the
+// invite pinned, the key itself is fetched from the key directory.
+func (a *App) acceptInvite(s string) error {
+	inv, err := ParseInvite(s)
+	if err != nil {
+		return err
+	}
+
+	usr, err := a.db.LookupContact(inv.ID)
+	if err != nil {
+		a.addContact(inv.ID, inv.Name, nil)
+
+		//addContact reports why the contact could not be added.
+		if usr, err = a.db.LookupContact(inv.ID); err != nil {
+			return nil
+		}
+	}
+
+	status, err := a.db.ExpectContactKey(inv.ID, inv.Fingerprint)
+	if err != nil {
+		return fmt.Errorf("expectContactKey: %w", err)
+	}
+
+	switch status {
+	case keyUnchanged:
+		a.WriteMessage("system", systemErrorMessage("the key of %s matches their invite, fingerprint %s", usr.Name, inv.Fingerprint))
+	case keyMismatch:
+		a.client.notifyKeyStatus(usr.ID, usr.Name, status)
+	default:
+		if _, err := a.client.resolveKey(usr); err != nil {
+			a.WriteMessage("system", systemErrorMessage("the key of %s, fingerprint %s, is pinned for when it arrives: %s", usr.Name, inv.Fingerprint, err))
+		}
+	}
+
+	a.refreshContact(usr.ID)
+	return nil
+}
+
+// showInvite shows the invite of the account as a QR code and writes its
+// URI on screen so it can be copied.
+func (a *App) showInvite() error {
+	const page = "invite"
+
+	inv, err := NewInvite(a.client.id, a.db.MyAccount().Name)
+	if err != nil {
+		return err
+	}
+	uri := inv.String()
+
+	code, err := qr.Encode([]byte(uri))
+	if err != nil {
+		return fmt.Errorf("encode: %w", err)
+	}
+
+	a.WriteMessage("system", systemErrorMessage("your invite, a contact adds you with /accept <invite>:\n%s", uri))
+
+	//the code is drawn dark on light whatever the theme, scanners expect it.
+	view := tview.NewTextView().
+		SetText(code.HalfBlocks(2)).
+		SetTextColor(tcell.ColorBlack)
+	view.SetBackgroundColor(tcell.ColorWhite)
+	view.SetBorder(true)
+	view.SetTitle("Invite (esc: close)")
+
+	view.SetInputCapture(func(event *tcell.EventKey) *tcell.EventKey {
+		if event.Key() == tcell.KeyEscape {
+			a.closeModal(page)
+			return nil
+		}
+		return event
+	})
+
+	side := code.Size() + 4
+	a.showModal(page, view, side+2, (side+1)/2+2)
+
+	return nil
+}
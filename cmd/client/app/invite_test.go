@@ -0,0 +1,82 @@
+package app_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/hamidoujand/echo/cmd/client/app"
+)
+
+func Test_Invite(t *testing.T) {
+	alice, err := app.NewID(t.TempDir(), []byte("correct horse"))
+	if err != nil {
+		t.Fatalf("Should be able to create an identity: %s", err)
+	}
+
+	mallory, err := app.NewID(t.TempDir(), []byte("battery staple"))
+	if err != nil {
+		t.Fatalf("Should be able to create an identity: %s", err)
+	}
+
+	inv, err := app.NewInvite(alice, "Alice Smith")
+	if err != nil {
+		t.Fatalf("Should be able to sign an invite: %s", err)
+	}
+
+	uri := inv.String()
+	if !strings.HasPrefix(uri, "echo://invite?") {
+		t.Fatalf("Should write an echo:// URI, got %s", uri)
+	}
+
+	got, err := app.ParseInvite(uri)
+	if err != nil {
+		t.Fatalf("Should be able to parse the invite: %s", err)
+	}
+
+	if got.ID != alice.Address || got.Name != "Alice Smith" || got.Fingerprint != inv.Fingerprint {
+		t.Logf("got: %s %q %s", got.ID, got.Name, got.Fingerprint)
+		t.Logf("exp: %s %q %s", alice.Address, "Alice Smith", inv.Fingerprint)
+		t.Fatalf("Should get back the invite.")
+	}
+
+	forged := strings.Replace(uri, "name=Alice+Smith", "name=Mallory", 1)
+	if _, err := app.ParseInvite(forged); err == nil {
+		t.Fatal("Should not accept an invite that was changed")
+	}
+
+	if _, err := app.ParseInvite("https://invite?id=" + alice.Address.Hex()); err == nil {
+		t.Fatal("Should not accept a URI that is not an invite")
+	}
+
+	//the key of the invite is the only one trusted.
+	db, err := app.NewDatabase(t.TempDir(), me, dataKey)
+	if err != nil {
+		t.Fatalf("Should be able to create a database: %s", err)
+	}
+
+	if _, err := db.AddContact(alice.Address, got.Name); err != nil {
+		t.Fatalf("Should be able to add a contact: %s", err)
+	}
+
+	if _, err := db.ExpectContactKey(alice.Address, got.Fingerprint); err != nil {
+		t.Fatalf("Should be able to pin the key of the invite: %s", err)
+	}
+
+	if _, err := db.PinContactKey(alice.Address, []byte(mallory.RSAPublicKey)); err != nil {
+		t.Fatalf("Should be able to offer a key: %s", err)
+	}
+
+	usr, err := db.LookupContact(alice.Address)
+	if err != nil || len(usr.Key) != 0 || len(usr.PendingKey) == 0 {
+		t.Fatalf("Should keep a key not matching the invite as pending, key %d bytes: %v", len(usr.Key), err)
+	}
+
+	if _, err := db.PinContactKey(alice.Address, []byte(alice.RSAPublicKey)); err != nil {
+		t.Fatalf("Should be able to offer a key: %s", err)
+	}
+
+	usr, err = db.LookupContact(alice.Address)
+	if err != nil || string(usr.Key) != alice.RSAPublicKey || len(usr.PendingKey) != 0 {
+		t.Fatalf("Should pin the key of the invite: %v", err)
+	}
+}
@@ -0,0 +1,113 @@
+package app
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/hamidoujand/echo/signature"
+)
+
+// keyRetryInterval is how long to wait before asking the key directory again
+// about a contact that has no key.
+const keyRetryInterval = time.Minute
+
+var errNoKey = errors.New("contact has not published a key")
+
+type keyBundle struct {
+	ID        common.Address `json:"id"`
+	Key       string         `json:"key"`
+	Timestamp int64          `json:"timestamp"`
+	V         *big.Int       `json:"v"`
+	R         *big.Int       `json:"r"`
+	S         *big.Int       `json:"s"`
+}
+
+func (b keyBundle) signedData() any {
+	return struct {
+		ID        common.Address
+		Key       string
+		Timestamp int64
+	}{
+		ID:        b.ID,
+		Key:       b.Key,
+		Timestamp: b.Timestamp,
+	}
+}
+
+func (b keyBundle) verify(id common.Address) error {
+	if b.ID != id {
+		return fmt.Errorf("bundle belongs to %s", b.ID)
+	}
+
+	if b.V == nil || b.R == nil || b.S == nil {
+		return errors.New("bundle is not signed")
+	}
+
+	from, err := signature.FromAddress(b.signedData(), b.V, b.R, b.S)
+	if err != nil {
+		return fmt.Errorf("fromAddress: %w", err)
+	}
+
+	if from != id.Hex() {
+		return fmt.Errorf("bundle is signed by %s", from)
+	}
+
+	if _, err := parseRSAPublicKey([]byte(b.Key)); err != nil {
+		return fmt.Errorf("parseRSAPublicKey: %w", err)
+	}
+
+	return nil
+}
+
+// keyBundle signs this client's encryption public key for the key directory.
+func (c *Client) keyBundle() (keyBundle, error) {
+	b := keyBundle{
+		ID:        c.id.Address,
+		Key:       c.id.RSAPublicKey,
+		Timestamp: time.Now().UnixNano(),
+	}
+
+	v, r, s, err := signature.Sign(b.signedData(), c.id.ECDSAKey)
+	if err != nil {
+		return keyBundle{}, fmt.Errorf("sign: %w", err)
+	}
+	b.V, b.R, b.S = v, r, s
+
+	return b, nil
+}
+
+// resolveKey fetches the contact's key from the key directory, verifies it is
+// signed by the contact and stores it.
+func (c *Client) resolveKey(usr User) (User, error) {
+	c.keyMu.Lock()
+	last, ok := c.keyMisses[usr.ID]
+	c.keyMu.Unlock()
+
+	if ok && time.Since(last) < keyRetryInterval {
+		return usr, errNoKey
+	}
+
+	var b keyBundle
+	if err := c.doJSON(http.MethodGet, "/v1/keys/"+usr.ID.Hex(), nil, &b); err != nil {
+		c.keyMu.Lock()
+		c.keyMisses[usr.ID] = time.Now()
+		c.keyMu.Unlock()
+		return usr, fmt.Errorf("%w: %w", errNoKey, err)
+	}
+
+	if err := b.verify(usr.ID); err != nil {
+		return usr, fmt.Errorf("verify: %w", err)
+	}
+
+	status, err := c.db.PinContactKey(usr.ID, []byte(b.Key))
+	if err != nil {
+		return usr, fmt.Errorf("pinContactKey: %w", err)
+	}
+	c.notifyKeyStatus(usr.ID, usr.Name, status)
+
+	return c.db.LookupContact(usr.ID)
+}
@@ -0,0 +1,287 @@
+package app
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+)
+
+// Private keys are stored as a small JSON document, the key is derived from
+// the passphrase with PBKDF2-SHA256 and the content is sealed with AES-256-GCM.
+
+const (
+	keystoreVersion = 1
+	keystoreKDF     = "pbkdf2-sha256"
+
+	//a key file asking for more would stall the client.
+	keystoreMinIterations = 1_000
+	keystoreMaxIterations = 10_000_000
+)
+
+// keystoreIterations is how many PBKDF2 iterations new key files are sealed
+// with, the tests lower it.
+var keystoreIterations = 600_000
+
+// Key files are replaced together, every sealed copy is written next to its
+// key file first, the marker is written once they are all in place and
+// removed after the renames.
+const (
+	keysSuffix = ".new"
+	keysMarker = "keys.commit"
+)
+
+// ErrWrongPassphrase is returned when a key file can not be opened with the
+// given passphrase.
+var ErrWrongPassphrase = errors.New("wrong passphrase")
+
+type keystoreFile struct {
+	Version    int    `json:"version"`
+	KDF        string `json:"kdf"`
+	Iterations int    `json:"iterations"`
+	Salt       []byte `json:"salt"`
+	Nonce      []byte `json:"nonce"`
+	Ciphertext []byte `json:"ciphertext"`
+}
+
+func sealKey(plaintext []byte, passphrase []byte) ([]byte, error) {
+	ks := keystoreFile{
+		Version:    keystoreVersion,
+		KDF:        keystoreKDF,
+		Iterations: keystoreIterations,
+		Salt:       make([]byte, 16),
+	}
+
+	if _, err := rand.Read(ks.Salt); err != nil {
+		return nil, fmt.Errorf("generating salt: %w", err)
+	}
+
+	aead, err := keystoreAEAD(passphrase, ks.Salt, ks.Iterations)
+	if err != nil {
+		return nil, err
+	}
+
+	ks.Nonce = make([]byte, aead.NonceSize())
+	if _, err := rand.Read(ks.Nonce); err != nil {
+		return nil, fmt.Errorf("generating nonce: %w", err)
+	}
+
+	ks.Ciphertext = aead.Seal(nil, ks.Nonce, plaintext, []byte(keystoreKDF))
+
+	bs, err := json.Marshal(ks)
+	if err != nil {
+		return nil, fmt.Errorf("marshal keystore: %w", err)
+	}
+
+	return bs, nil
+}
+
+func openKey(data []byte, passphrase []byte) ([]byte, error) {
+	var ks keystoreFile
+	if err := json.Unmarshal(data, &ks); err != nil {
+		return nil, fmt.Errorf("unmarshal keystore: %w", err)
+	}
+
+	if ks.Version != keystoreVersion || ks.KDF != keystoreKDF {
+		return nil, fmt.Errorf("unsupported keystore version %d with %q", ks.Version, ks.KDF)
+	}
+
+	if ks.Iterations < keystoreMinIterations || ks.Iterations > keystoreMaxIterations {
+		return nil, fmt.Errorf("unsupported keystore iterations %d", ks.Iterations)
+	}
+
+	aead, err := keystoreAEAD(passphrase, ks.Salt, ks.Iterations)
+	if err != nil {
+		return nil, err
+	}
+
+	plaintext, err := aead.Open(nil, ks.Nonce, ks.Ciphertext, []byte(keystoreKDF))
+	if err != nil {
+		return nil, ErrWrongPassphrase
+	}
+
+	return plaintext, nil
+}
+
+func keystoreAEAD(passphrase []byte, salt []byte, iterations int) (cipher.AEAD, error) {
+	key, err := pbkdf2.Key(sha256.New, string(passphrase), salt, iterations, 32)
+	if err != nil {
+		return nil, fmt.Errorf("pbkdf2: %w", err)
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("new cipher: %w", err)
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("new gcm: %w", err)
+	}
+
+	return aead, nil
+}
+
+// isSealed tells an encrypted key file apart from the plain files written by
+// older clients.
+func isSealed(data []byte) bool {
+	return bytes.HasPrefix(bytes.TrimSpace(data), []byte("{"))
+}
+
+// checkKeyPermissions refuses key files other users can access.
+func checkKeyPermissions(filename string) error {
+	if runtime.GOOS == "windows" {
+		return nil
+	}
+
+	info, err := os.Stat(filename)
+	if err != nil {
+		return fmt.Errorf("stat: %w", err)
+	}
+
+	if info.Mode().Perm()&0o007 != 0 {
+		return fmt.Errorf("key file %s is accessible by other users (%s), run: chmod 600 %s", filename, info.Mode().Perm(), filename)
+	}
+
+	return nil
+}
+
+// =============================================================================
+
+// HasSealedID reports whether the identity in confDir is already protected
+// by a passphrase, the client asks for a new passphrase when it is not.
+func HasSealedID(confDir string) (bool, error) {
+	data, err := os.ReadFile(filepath.Join(confDir, "id", idFilename))
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return false, nil
+		}
+		return false, fmt.Errorf("reading key file: %w", err)
+	}
+
+	return isSealed(data), nil
+}
+
+// ChangePassphrase seals every private key and the data key in confDir with
+// a new passphrase.
+func ChangePassphrase(confDir string, oldPassphrase []byte, newPassphrase []byte) error {
+	if len(newPassphrase) == 0 {
+		return errors.New("passphrase can not be empty")
+	}
+
+	if err := recoverKeys(confDir); err != nil {
+		return fmt.Errorf("recoverKeys: %w", err)
+	}
+
+	files := []string{idFilename, encryptionFilename, dhFilename}
+
+	//the data key only exists once the database was opened.
+	if _, err := os.Stat(filepath.Join(confDir, "id", dataKeyFilename)); err == nil {
+		files = append(files, dataKeyFilename)
+	}
+
+	//open everything first, so a wrong passphrase changes nothing.
+	plaintexts := make([][]byte, len(files))
+	for i, name := range files {
+		filename := filepath.Join(confDir, "id", name)
+
+		if err := checkKeyPermissions(filename); err != nil {
+			return err
+		}
+
+		data, err := os.ReadFile(filename)
+		if err != nil {
+			return fmt.Errorf("reading key file: %w", err)
+		}
+
+		if !isSealed(data) {
+			return fmt.Errorf("key file %s is not protected by a passphrase yet", filename)
+		}
+
+		plaintexts[i], err = openKey(data, oldPassphrase)
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+	}
+
+	sealed := make(map[string][]byte, len(files))
+	for i, name := range files {
+		bs, err := sealKey(plaintexts[i], newPassphrase)
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		sealed[name] = bs
+	}
+
+	return replaceKeys(confDir, sealed)
+}
+
+// replaceKeys replaces the key files in confDir with the sealed ones, a crash
+// before the marker keeps the old keys, after it the new ones, never a mix of
+// both.
+func replaceKeys(confDir string, sealed map[string][]byte) error {
+	dir := filepath.Join(confDir, "id")
+	for name, bs := range sealed {
+		if err := writeSynced(filepath.Join(dir, name+keysSuffix), bs); err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+	}
+
+	if err := writeSynced(filepath.Join(dir, keysMarker), nil); err != nil {
+		return fmt.Errorf("marker: %w", err)
+	}
+
+	if err := syncDir(dir); err != nil {
+		return err
+	}
+
+	return recoverKeys(confDir)
+}
+
+// recoverKeys finishes a replaceKeys that got as far as the marker and drops
+// the sealed copies of one that did not, it has to run before the keys are
+// read.
+func recoverKeys(confDir string) error {
+	dir := filepath.Join(confDir, "id")
+	marker := filepath.Join(dir, keysMarker)
+
+	_, err := os.Stat(marker)
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		for _, name := range backupKeys {
+			if err := os.Remove(filepath.Join(dir, name+keysSuffix)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+				return fmt.Errorf("remove: %w", err)
+			}
+		}
+		return nil
+
+	case err != nil:
+		return fmt.Errorf("stat: %w", err)
+	}
+
+	for _, name := range backupKeys {
+		filename := filepath.Join(dir, name)
+		if err := os.Rename(filename+keysSuffix, filename); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("rename: %w", err)
+		}
+	}
+
+	if err := syncDir(dir); err != nil {
+		return err
+	}
+
+	if err := os.Remove(marker); err != nil {
+		return fmt.Errorf("remove: %w", err)
+	}
+
+	return syncDir(dir)
+}
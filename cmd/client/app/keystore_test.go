@@ -0,0 +1,206 @@
+package app_test
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/hamidoujand/echo/cmd/client/app"
+)
+
+func Test_SealKey(t *testing.T) {
+	key := []byte("a private key")
+
+	sealed, err := app.SealKey(key, []byte("correct horse"))
+	if err != nil {
+		t.Fatalf("Should be able to seal a key: %s", err)
+	}
+
+	got, err := app.OpenKey(sealed, []byte("correct horse"))
+	if err != nil {
+		t.Fatalf("Should be able to open a sealed key: %s", err)
+	}
+
+	if string(got) != string(key) {
+		t.Fatalf("Should get back the key, got %q", got)
+	}
+
+	if _, err := app.OpenKey(sealed, []byte("battery staple")); !errors.Is(err, app.ErrWrongPassphrase) {
+		t.Fatalf("Should not open a key with a wrong passphrase, got: %v", err)
+	}
+
+	for _, iterations := range []int{0, 1_000_000_000} {
+		var ks map[string]any
+		if err := json.Unmarshal(sealed, &ks); err != nil {
+			t.Fatalf("Should be able to unmarshal the key file: %s", err)
+		}
+		ks["iterations"] = iterations
+
+		bs, err := json.Marshal(ks)
+		if err != nil {
+			t.Fatalf("Should be able to marshal the key file: %s", err)
+		}
+
+		if _, err := app.OpenKey(bs, []byte("correct horse")); err == nil {
+			t.Fatalf("Should not open a key file asking for %d iterations", iterations)
+		}
+	}
+}
+
+func Test_ChangePassphrase(t *testing.T) {
+	dir := t.TempDir()
+
+	id, err := app.NewID(dir, []byte("correct horse"))
+	if err != nil {
+		t.Fatalf("Should be able to create an identity: %s", err)
+	}
+
+	if sealed, err := app.HasSealedID(dir); err != nil || !sealed {
+		t.Fatalf("Should seal a new identity: %v", err)
+	}
+
+	if _, err := app.NewID(dir, []byte("battery staple")); !errors.Is(err, app.ErrWrongPassphrase) {
+		t.Fatalf("Should not open the identity with a wrong passphrase, got: %v", err)
+	}
+
+	if err := app.ChangePassphrase(dir, []byte("battery staple"), []byte("new")); !errors.Is(err, app.ErrWrongPassphrase) {
+		t.Fatalf("Should not change the passphrase without the old one, got: %v", err)
+	}
+
+	if err := app.ChangePassphrase(dir, []byte("correct horse"), []byte("battery staple")); err != nil {
+		t.Fatalf("Should be able to change the passphrase: %s", err)
+	}
+
+	got, err := app.NewID(dir, []byte("battery staple"))
+	if err != nil {
+		t.Fatalf("Should be able to open the identity with the new passphrase: %s", err)
+	}
+
+	if got.Address != id.Address || got.RSAPublicKey != id.RSAPublicKey {
+		t.Fatalf("Should keep the same identity, got %s", got.Address)
+	}
+
+	if _, err := app.NewID(dir, []byte("correct horse")); !errors.Is(err, app.ErrWrongPassphrase) {
+		t.Fatalf("Should not open the identity with the old passphrase, got: %v", err)
+	}
+}
+
+func Test_KeyPermissions(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("file modes are not checked on windows")
+	}
+
+	dir := t.TempDir()
+
+	if _, err := app.NewID(dir, []byte("correct horse")); err != nil {
+		t.Fatalf("Should be able to create an identity: %s", err)
+	}
+
+	filename := filepath.Join(dir, "id", "private.ecdsa")
+	if err := os.Chmod(filename, 0o644); err != nil {
+		t.Fatalf("Should be able to change the file mode: %s", err)
+	}
+
+	if _, err := app.NewID(dir, []byte("correct horse")); err == nil {
+		t.Fatal("Should refuse a key file anyone can read")
+	}
+
+	if err := app.ChangePassphrase(dir, []byte("correct horse"), []byte("battery staple")); err == nil {
+		t.Fatal("Should refuse to change the passphrase of a key file anyone can read")
+	}
+
+	if err := os.Chmod(filename, 0o600); err != nil {
+		t.Fatalf("Should be able to change the file mode: %s", err)
+	}
+
+	if _, err := app.NewID(dir, []byte("correct horse")); err != nil {
+		t.Fatalf("Should open the key file once it is private: %s", err)
+	}
+}
+
+func Test_RecoverPassphrase(t *testing.T) {
+	keys := []string{"private.ecdsa", "private.rsa", "private.x25519", "data.key"}
+
+	//interrupt leaves a passphrase change with the sealed copies written,
+	//after the marker the first n of them are renamed.
+	interrupt := func(t *testing.T, committed bool, n int) string {
+		dir := t.TempDir()
+
+		if _, err := app.NewID(dir, []byte("correct horse")); err != nil {
+			t.Fatalf("Should be able to create an identity: %s", err)
+		}
+
+		if _, err := app.LoadDataKey(dir, []byte("correct horse")); err != nil {
+			t.Fatalf("Should be able to create a data key: %s", err)
+		}
+
+		for i, name := range keys {
+			filename := filepath.Join(dir, "id", name)
+
+			data, err := os.ReadFile(filename)
+			if err != nil {
+				t.Fatalf("Should be able to read the key file: %s", err)
+			}
+
+			key, err := app.OpenKey(data, []byte("correct horse"))
+			if err != nil {
+				t.Fatalf("Should be able to open the key file: %s", err)
+			}
+
+			sealed, err := app.SealKey(key, []byte("battery staple"))
+			if err != nil {
+				t.Fatalf("Should be able to seal the key: %s", err)
+			}
+
+			if err := os.WriteFile(filename+".new", sealed, 0600); err != nil {
+				t.Fatalf("Should be able to write the sealed copy: %s", err)
+			}
+
+			if committed && i < n {
+				if err := os.Rename(filename+".new", filename); err != nil {
+					t.Fatalf("Should be able to rename the sealed copy: %s", err)
+				}
+			}
+		}
+
+		if committed {
+			if err := os.WriteFile(filepath.Join(dir, "id", "keys.commit"), nil, 0600); err != nil {
+				t.Fatalf("Should be able to write the marker: %s", err)
+			}
+		}
+
+		return dir
+	}
+
+	open := func(t *testing.T, dir string, passphrase string) {
+		if _, err := app.NewID(dir, []byte(passphrase)); err != nil {
+			t.Fatalf("Should open the identity with %q: %s", passphrase, err)
+		}
+
+		if _, err := app.LoadDataKey(dir, []byte(passphrase)); err != nil {
+			t.Fatalf("Should open the data key with %q: %s", passphrase, err)
+		}
+
+		leftovers, err := filepath.Glob(filepath.Join(dir, "id", "*.new"))
+		if err != nil || len(leftovers) != 0 {
+			t.Fatalf("Should not leave sealed copies behind, got %v", leftovers)
+		}
+
+		if _, err := os.Stat(filepath.Join(dir, "id", "keys.commit")); !errors.Is(err, os.ErrNotExist) {
+			t.Fatalf("Should remove the marker, got: %v", err)
+		}
+	}
+
+	t.Run("before the marker", func(t *testing.T) {
+		dir := interrupt(t, false, 0)
+		open(t, dir, "correct horse")
+	})
+
+	t.Run("during the renames", func(t *testing.T) {
+		dir := interrupt(t, true, 2)
+		open(t, dir, "battery staple")
+	})
+}
@@ -0,0 +1,369 @@
+package app
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// schemaVersion is the version of the database written by this client.
+//
+//	0: plaintext data.json with the contacts inside, plaintext histories.
+//	1: sealed data.json and histories.
+//	2: every contact in its own file.
+//	3: version in data.json and a header at the top of every history.
+const schemaVersion = 3
+
+const backupDir = "backups"
+
+type migration struct {
+	version int
+	name    string
+	run     func(dir string, v *vault) error
+}
+
+// migrations take the database from version-1 to version, a migration must
+// be safe to run again if the client stops half way.
+var migrations = []migration{
+	{version: 1, name: "seal plaintext files", run: sealPlaintext},
+	{version: 2, name: "move contacts into their own files", run: splitContacts},
+	{version: 3, name: "add schema headers to histories", run: addHistoryHeaders},
+}
+
+// migrate brings the database in dir to schemaVersion, the database is backed
+// up first and restored when a migration fails.
+func migrate(dir string, v *vault) error {
+	if err := recoverSealing(dir); err != nil {
+		return fmt.Errorf("recoverSealing: %w", err)
+	}
+
+	current, err := detectVersion(dir, v)
+	if err != nil {
+		return fmt.Errorf("detectVersion: %w", err)
+	}
+
+	switch {
+	case current < 0:
+		//a new database.
+		return nil
+	case current == schemaVersion:
+		return nil
+	case current > schemaVersion:
+		return fmt.Errorf("database has schema version %d, this client only knows up to %d, please upgrade", current, schemaVersion)
+	}
+
+	backup, err := backupDatabase(dir, v, current)
+	if err != nil {
+		return fmt.Errorf("backupDatabase: %w", err)
+	}
+
+	for _, m := range migrations {
+		if m.version <= current {
+			continue
+		}
+
+		if err := m.run(dir, v); err != nil {
+			if rErr := restoreDatabase(dir, v, backup); rErr != nil {
+				return fmt.Errorf("migration %d (%s): %w, restoring %s failed: %w", m.version, m.name, err, backup, rErr)
+			}
+			return fmt.Errorf("migration %d (%s): %w, the database was restored", m.version, m.name, err)
+		}
+
+		//plaintext files have no version field, it is recorded from v2 on.
+		if m.version >= 2 {
+			if err := setVersion(dir, v, m.version); err != nil {
+				return fmt.Errorf("setVersion %d: %w", m.version, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// detectVersion returns -1 when there is no database yet.
+func detectVersion(dir string, v *vault) (int, error) {
+	data, err := os.ReadFile(filepath.Join(dir, dbFilename))
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return -1, nil
+		}
+		return 0, fmt.Errorf("read %s: %w", dbFilename, err)
+	}
+
+	if isPlaintext(data) {
+		return 0, nil
+	}
+
+	//a history left in plaintext means sealing did not finish.
+	histories, err := filepath.Glob(filepath.Join(dir, chatHistoryDir, "*.msg"))
+	if err != nil {
+		return 0, fmt.Errorf("glob: %w", err)
+	}
+
+	for _, filename := range histories {
+		data, err := os.ReadFile(filename)
+		if err != nil {
+			return 0, fmt.Errorf("read %s: %w", filename, err)
+		}
+
+		if isPlaintext(data) {
+			return 0, nil
+		}
+	}
+
+	s := fileStorage{dir: dir, vault: v}
+	acc, _, err := s.LoadAccount()
+	if err != nil {
+		return 0, err
+	}
+
+	switch {
+	case acc.Version > 0:
+		return acc.Version, nil
+	case len(acc.Contacts) > 0:
+		return 1, nil
+	default:
+		return 2, nil
+	}
+}
+
+func setVersion(dir string, v *vault, version int) error {
+	s := fileStorage{dir: dir, vault: v}
+
+	acc, _, err := s.LoadAccount()
+	if err != nil {
+		return err
+	}
+
+	acc.Version = version
+	return s.SaveAccount(acc)
+}
+
+// =============================================================================
+
+// splitContacts moves the contacts out of data.json, the account is written
+// last so a crash half way just does it again.
+func splitContacts(dir string, v *vault) error {
+	s, err := newFileStorage(dir, v)
+	if err != nil {
+		return err
+	}
+
+	acc, _, err := s.LoadAccount()
+	if err != nil {
+		return err
+	}
+
+	for _, c := range acc.Contacts {
+		if err := s.SaveContact(c); err != nil {
+			return fmt.Errorf("saveContact: %w", err)
+		}
+	}
+
+	acc.Contacts = nil
+	return s.SaveAccount(acc)
+}
+
+// addHistoryHeaders puts a header record at the top of every history.
+func addHistoryHeaders(dir string, v *vault) error {
+	histories, err := filepath.Glob(filepath.Join(dir, chatHistoryDir, "*.msg"))
+	if err != nil {
+		return fmt.Errorf("glob: %w", err)
+	}
+
+	for _, filename := range histories {
+		data, err := os.ReadFile(filename)
+		if err != nil {
+			return fmt.Errorf("read %s: %w", filename, err)
+		}
+
+		name := recordName(filename)
+
+		first, _, _ := bytes.Cut(data, []byte("\n"))
+		if len(first) != 0 {
+			if _, ok, err := readHistoryHeader(v, name, first); err != nil || ok {
+				continue
+			}
+		}
+
+		header, err := historyHeaderRecord(v, name)
+		if err != nil {
+			return err
+		}
+
+		if err := writeFileAtomic(filename, append(header, data...)); err != nil {
+			return fmt.Errorf("write %s: %w", filename, err)
+		}
+	}
+
+	return nil
+}
+
+// =============================================================================
+
+// backupDatabase stores the database files in a single sealed archive, so a
+// backup of a plaintext database does not leave plaintext behind.
+func backupDatabase(dir string, v *vault, version int) (string, error) {
+	files, err := databaseFiles(dir)
+	if err != nil {
+		return "", err
+	}
+
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+
+	for _, rel := range files {
+		data, err := os.ReadFile(filepath.Join(dir, rel))
+		if err != nil {
+			return "", fmt.Errorf("read %s: %w", rel, err)
+		}
+
+		hdr := tar.Header{
+			Name:    filepath.ToSlash(rel),
+			Mode:    0600,
+			Size:    int64(len(data)),
+			ModTime: time.Now(),
+		}
+
+		if err := tw.WriteHeader(&hdr); err != nil {
+			return "", fmt.Errorf("tar header: %w", err)
+		}
+
+		if _, err := tw.Write(data); err != nil {
+			return "", fmt.Errorf("tar write: %w", err)
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		return "", fmt.Errorf("tar close: %w", err)
+	}
+
+	if err := gz.Close(); err != nil {
+		return "", fmt.Errorf("gzip close: %w", err)
+	}
+
+	if err := os.MkdirAll(filepath.Join(dir, backupDir), 0700); err != nil {
+		return "", fmt.Errorf("mkdirAll: %w", err)
+	}
+
+	filename := filepath.Join(dir, backupDir, fmt.Sprintf("schema-v%d-%d.bak", version, time.Now().UnixNano()))
+
+	record, err := v.seal(backupRecordName, buf.Bytes())
+	if err != nil {
+		return "", fmt.Errorf("seal backup: %w", err)
+	}
+
+	if err := writeFileAtomic(filename, record); err != nil {
+		return "", err
+	}
+
+	return filename, nil
+}
+
+const backupRecordName = "schema-backup"
+
+// restoreDatabase replaces the database files with the content of backup.
+func restoreDatabase(dir string, v *vault, backup string) error {
+	record, err := os.ReadFile(backup)
+	if err != nil {
+		return fmt.Errorf("read backup: %w", err)
+	}
+
+	data, err := v.open(backupRecordName, bytes.TrimSpace(record))
+	if err != nil {
+		return fmt.Errorf("open backup: %w", err)
+	}
+
+	gz, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("gzip: %w", err)
+	}
+
+	//read everything before touching the database.
+	restored := make(map[string][]byte)
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("tar: %w", err)
+		}
+
+		rel := filepath.FromSlash(hdr.Name)
+		if !filepath.IsLocal(rel) {
+			return fmt.Errorf("invalid file name %q in backup", hdr.Name)
+		}
+
+		content, err := io.ReadAll(tr)
+		if err != nil {
+			return fmt.Errorf("tar read: %w", err)
+		}
+		restored[rel] = content
+	}
+
+	current, err := databaseFiles(dir)
+	if err != nil {
+		return err
+	}
+
+	for _, rel := range current {
+		if _, ok := restored[rel]; ok {
+			continue
+		}
+		if err := os.Remove(filepath.Join(dir, rel)); err != nil {
+			return fmt.Errorf("remove %s: %w", rel, err)
+		}
+	}
+
+	for rel, content := range restored {
+		filename := filepath.Join(dir, rel)
+		if err := os.MkdirAll(filepath.Dir(filename), 0700); err != nil {
+			return fmt.Errorf("mkdirAll: %w", err)
+		}
+
+		if err := writeFileAtomic(filename, content); err != nil {
+			return fmt.Errorf("write %s: %w", rel, err)
+		}
+	}
+
+	return nil
+}
+
+// databaseFiles lists the files of the database relative to dir.
+func databaseFiles(dir string) ([]string, error) {
+	var files []string
+
+	if _, err := os.Stat(filepath.Join(dir, dbFilename)); err == nil {
+		files = append(files, dbFilename)
+	}
+
+	for _, sub := range []string{contactsDir, chatHistoryDir} {
+		entries, err := os.ReadDir(filepath.Join(dir, sub))
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				continue
+			}
+			return nil, fmt.Errorf("readDir %s: %w", sub, err)
+		}
+
+		for _, e := range entries {
+			if e.IsDir() || strings.HasSuffix(e.Name(), ".tmp") {
+				continue
+			}
+			files = append(files, filepath.Join(sub, e.Name()))
+		}
+	}
+
+	return files, nil
+}
@@ -0,0 +1,186 @@
+package app_test
+
+import (
+	"bytes"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/hamidoujand/echo/cmd/client/app"
+)
+
+// The fixtures in testdata were written by older clients and sealed with
+// dataKey where the schema did so.
+var (
+	dataKey = []byte("echo-test-data-key-0123456789abc")
+	me      = common.HexToAddress("0x1111111111111111111111111111111111111111")
+	alice   = common.HexToAddress("0x2222222222222222222222222222222222222222")
+	bob     = common.HexToAddress("0x3333333333333333333333333333333333333333")
+	blocked = common.HexToAddress("0x4444444444444444444444444444444444444444")
+)
+
+// =============================================================================
+
+func Test_Migrate(t *testing.T) {
+	tests := []struct {
+		fixture string
+		blocked bool
+	}{
+		{fixture: "v0"},
+		{fixture: "v1", blocked: true},
+		{fixture: "v2", blocked: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.fixture, func(t *testing.T) {
+			dir := copyFixture(t, tt.fixture)
+
+			db, err := app.NewDatabase(dir, me, dataKey)
+			if err != nil {
+				t.Fatalf("Should be able to migrate the database: %s", err)
+			}
+
+			checkDatabase(t, db, tt.blocked)
+
+			backups, err := filepath.Glob(filepath.Join(dir, "backups", "*.bak"))
+			if err != nil {
+				t.Fatalf("Should be able to list the backups: %s", err)
+			}
+
+			if len(backups) != 1 {
+				t.Fatalf("Should have a single backup, got %d", len(backups))
+			}
+
+			//the plaintext must be gone after the migration.
+			if tt.fixture == "v0" {
+				data, err := os.ReadFile(filepath.Join(dir, "data.json"))
+				if err != nil {
+					t.Fatalf("Should be able to read data.json: %s", err)
+				}
+
+				if bytes.Contains(data, []byte("alice")) {
+					t.Fatal("Should not keep data.json in plaintext")
+				}
+			}
+
+			//a migrated database must open again without migrating.
+			db, err = app.NewDatabase(dir, me, dataKey)
+			if err != nil {
+				t.Fatalf("Should be able to open the migrated database: %s", err)
+			}
+
+			checkDatabase(t, db, tt.blocked)
+
+			again, err := filepath.Glob(filepath.Join(dir, "backups", "*.bak"))
+			if err != nil {
+				t.Fatalf("Should be able to list the backups: %s", err)
+			}
+
+			if len(again) != 1 {
+				t.Fatalf("Should not migrate twice, got %d backups", len(again))
+			}
+		})
+	}
+}
+
+func Test_MigrateWrongKey(t *testing.T) {
+	dir := copyFixture(t, "v1")
+
+	wrongKey := bytes.Repeat([]byte{1}, 32)
+	if _, err := app.NewDatabase(dir, me, wrongKey); err == nil {
+		t.Fatal("Should not be able to open the database with the wrong key")
+	}
+
+	//nothing may change when the migration can not even start.
+	if _, err := os.Stat(filepath.Join(dir, "backups")); err == nil {
+		t.Fatal("Should not create a backup with the wrong key")
+	}
+
+	if _, err := app.NewDatabase(dir, me, dataKey); err != nil {
+		t.Fatalf("Should be able to migrate the database afterwards: %s", err)
+	}
+}
+
+// =============================================================================
+
+func checkDatabase(t *testing.T, db *app.Database, wantBlocked bool) {
+	t.Helper()
+
+	if got := db.MyAccount().ID; got != me {
+		t.Fatalf("Should keep the account: got %s, exp %s", got, me)
+	}
+
+	if got := len(db.Contacts()); got != 2 {
+		t.Fatalf("Should have 2 contacts, got %d", got)
+	}
+
+	usr, err := db.LookupContact(alice)
+	if err != nil {
+		t.Fatalf("Should be able to lookup alice: %s", err)
+	}
+
+	if usr.Name != "alice" || usr.OutgoingNonce != 3 || usr.IncomingNonce != 5 {
+		t.Fatalf("Should keep alice: got %s, %d, %d", usr.Name, usr.OutgoingNonce, usr.IncomingNonce)
+	}
+
+	if !bytes.Equal(usr.Key, []byte("alice-key")) {
+		t.Fatalf("Should keep the key of alice: got %q", usr.Key)
+	}
+
+	msgs, start, err := db.History(alice, -1, 10)
+	if err != nil {
+		t.Fatalf("Should be able to read the history of alice: %s", err)
+	}
+
+	if len(msgs) != 2 || start != 0 {
+		t.Fatalf("Should have 2 messages, got %d from %d", len(msgs), start)
+	}
+
+	if string(msgs[0].Text) != "hello" || string(msgs[1].Text) != "hi alice" {
+		t.Fatalf("Should keep the messages in order: got %q, %q", msgs[0].Text, msgs[1].Text)
+	}
+
+	if _, err := db.LookupContact(bob); err != nil {
+		t.Fatalf("Should be able to lookup bob: %s", err)
+	}
+
+	if got := db.IsBlocked(blocked); got != wantBlocked {
+		t.Fatalf("Should keep the blocked list: got %t, exp %t", got, wantBlocked)
+	}
+}
+
+func copyFixture(t *testing.T, name string) string {
+	t.Helper()
+
+	src := filepath.Join("testdata", name)
+	dst := t.TempDir()
+
+	err := filepath.WalkDir(src, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+
+		if d.IsDir() {
+			return os.MkdirAll(filepath.Join(dst, rel), 0700)
+		}
+
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+
+		return os.WriteFile(filepath.Join(dst, rel), data, 0600)
+	})
+	if err != nil {
+		t.Fatalf("Should be able to copy the fixture %s: %s", name, err)
+	}
+
+	return dst
+}
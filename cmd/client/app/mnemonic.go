@@ -0,0 +1,305 @@
+package app
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hkdf"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	_ "embed"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+// A mnemonic is a BIP-39 phrase of 12 words encoding 128 bits of entropy and
+// a 4 bit checksum. The 64 byte BIP-39 seed of the phrase is the root of
+// every private key of the identity, so writing the words down is enough to
+// create the same keys again on another machine. Each key is derived from
+// the seed with HKDF and its own info, the RSA primes are searched in a
+// stream keyed by the seed since crypto/rsa no longer accepts a reader.
+
+//go:embed wordlists/english.txt
+var englishWords string
+
+const (
+	mnemonicEntropy    = 16
+	mnemonicIterations = 2048
+	mnemonicSalt       = "mnemonic"
+
+	seedECDSAInfo = "echo-seed-ecdsa"
+	seedRSAInfo   = "echo-seed-rsa"
+	seedDHInfo    = "echo-seed-x25519"
+
+	rsaBits = 1024
+)
+
+// ErrInvalidMnemonic is returned for a phrase with unknown words or a wrong
+// checksum.
+var ErrInvalidMnemonic = errors.New("invalid recovery phrase")
+
+var wordlist = strings.Fields(englishWords)
+
+var wordIndex = func() map[string]int {
+	m := make(map[string]int, len(wordlist))
+	for i, w := range wordlist {
+		m[w] = i
+	}
+	return m
+}()
+
+// NewMnemonic returns a new random recovery phrase.
+func NewMnemonic() (string, error) {
+	entropy := make([]byte, mnemonicEntropy)
+	if _, err := rand.Read(entropy); err != nil {
+		return "", fmt.Errorf("generating entropy: %w", err)
+	}
+
+	return entropyToMnemonic(entropy), nil
+}
+
+// ValidateMnemonic checks the words and the checksum of a recovery phrase.
+func ValidateMnemonic(mnemonic string) error {
+	_, err := mnemonicToEntropy(mnemonic)
+	return err
+}
+
+func entropyToMnemonic(entropy []byte) string {
+	//the checksum is the first len/4 bits of the hash, at most a byte.
+	sum := sha256.Sum256(entropy)
+	bits := append(append([]byte{}, entropy...), sum[0])
+
+	count := (len(entropy)*8 + len(entropy)/4) / 11
+	words := make([]string, count)
+	for i := range words {
+		var idx int
+		for j := range 11 {
+			bit := i*11 + j
+			idx = idx<<1 | int(bits[bit/8]>>(7-bit%8)&1)
+		}
+		words[i] = wordlist[idx]
+	}
+
+	return strings.Join(words, " ")
+}
+
+func mnemonicToEntropy(mnemonic string) ([]byte, error) {
+	words := strings.Fields(strings.ToLower(mnemonic))
+
+	switch len(words) {
+	case 12, 15, 18, 21, 24:
+	default:
+		return nil, fmt.Errorf("%w: %d words, expected 12 to 24", ErrInvalidMnemonic, len(words))
+	}
+
+	bits := make([]byte, (len(words)*11+7)/8)
+	for i, w := range words {
+		idx, ok := wordIndex[w]
+		if !ok {
+			return nil, fmt.Errorf("%w: unknown word %q", ErrInvalidMnemonic, w)
+		}
+
+		for j := range 11 {
+			if idx>>(10-j)&1 == 1 {
+				bit := i*11 + j
+				bits[bit/8] |= 1 << (7 - bit%8)
+			}
+		}
+	}
+
+	size := len(words) * 11 * 32 / 33 / 8
+	entropy := bits[:size]
+
+	checksumBits := size / 4
+	sum := sha256.Sum256(entropy)
+	if bits[size]>>(8-checksumBits) != sum[0]>>(8-checksumBits) {
+		return nil, fmt.Errorf("%w: checksum mismatch", ErrInvalidMnemonic)
+	}
+
+	return entropy, nil
+}
+
+// mnemonicSeed returns the BIP-39 seed of the phrase, without the optional
+// BIP-39 passphrase.
+func mnemonicSeed(mnemonic string) ([]byte, error) {
+	if _, err := mnemonicToEntropy(mnemonic); err != nil {
+		return nil, err
+	}
+
+	normalized := strings.Join(strings.Fields(strings.ToLower(mnemonic)), " ")
+
+	seed, err := pbkdf2.Key(sha512.New, normalized, []byte(mnemonicSalt), mnemonicIterations, 64)
+	if err != nil {
+		return nil, fmt.Errorf("pbkdf2: %w", err)
+	}
+
+	return seed, nil
+}
+
+// seedKeys returns the key creators deriving every key from seed.
+func seedKeys(seed []byte) keyCreators {
+	return keyCreators{
+		id: func() ([]byte, error) {
+			return seedKeyID(seed)
+		},
+		encrypt: func() ([]byte, error) {
+			return seedEncryptKey(seed)
+		},
+		dh: func() ([]byte, error) {
+			return seedDHKey(seed)
+		},
+	}
+}
+
+func seedKeyID(seed []byte) ([]byte, error) {
+	//a scalar outside of the curve order is rejected, the next one is used.
+	for i := 0; ; i++ {
+		d, err := hkdf.Key(sha256.New, seed, nil, fmt.Sprintf("%s-%d", seedECDSAInfo, i), 32)
+		if err != nil {
+			return nil, fmt.Errorf("hkdf: %w", err)
+		}
+
+		if _, err := crypto.ToECDSA(d); err != nil {
+			continue
+		}
+
+		return []byte(hex.EncodeToString(d)), nil
+	}
+}
+
+func seedEncryptKey(seed []byte) ([]byte, error) {
+	key, err := hkdf.Key(sha256.New, seed, nil, seedRSAInfo, 32)
+	if err != nil {
+		return nil, fmt.Errorf("hkdf: %w", err)
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("new cipher: %w", err)
+	}
+
+	stream := cipher.StreamReader{
+		S: cipher.NewCTR(block, make([]byte, aes.BlockSize)),
+		R: zeroReader{},
+	}
+
+	private, err := generateRSAKey(stream, rsaBits)
+	if err != nil {
+		return nil, fmt.Errorf("generating private key: %w", err)
+	}
+
+	return encodeEncryptKey(private), nil
+}
+
+func seedDHKey(seed []byte) ([]byte, error) {
+	raw, err := hkdf.Key(sha256.New, seed, nil, seedDHInfo, 32)
+	if err != nil {
+		return nil, fmt.Errorf("hkdf: %w", err)
+	}
+
+	private, err := ecdh.X25519().NewPrivateKey(raw)
+	if err != nil {
+		return nil, fmt.Errorf("parsing private key: %w", err)
+	}
+
+	return []byte(hex.EncodeToString(private.Bytes())), nil
+}
+
+// =============================================================================
+
+// generateRSAKey builds a two prime key from the bytes of r, the same bytes
+// always give the same key.
+func generateRSAKey(r io.Reader, bits int) (*rsa.PrivateKey, error) {
+	e := big.NewInt(65537)
+	one := big.NewInt(1)
+
+	for {
+		p, err := generatePrime(r, bits/2, e)
+		if err != nil {
+			return nil, err
+		}
+
+		q, err := generatePrime(r, bits-bits/2, e)
+		if err != nil {
+			return nil, err
+		}
+
+		if p.Cmp(q) == 0 {
+			continue
+		}
+
+		n := new(big.Int).Mul(p, q)
+		if n.BitLen() != bits {
+			continue
+		}
+
+		pm := new(big.Int).Sub(p, one)
+		qm := new(big.Int).Sub(q, one)
+		gcd := new(big.Int).GCD(nil, nil, pm, qm)
+		lambda := new(big.Int).Div(new(big.Int).Mul(pm, qm), gcd)
+
+		d := new(big.Int).ModInverse(e, lambda)
+		if d == nil {
+			continue
+		}
+
+		private := &rsa.PrivateKey{
+			PublicKey: rsa.PublicKey{N: n, E: int(e.Int64())},
+			D:         d,
+			Primes:    []*big.Int{p, q},
+		}
+
+		if err := private.Validate(); err != nil {
+			return nil, fmt.Errorf("validate: %w", err)
+		}
+		private.Precompute()
+
+		return private, nil
+	}
+}
+
+// generatePrime returns a prime of exactly bits bits with p-1 coprime to e.
+func generatePrime(r io.Reader, bits int, e *big.Int) (*big.Int, error) {
+	buf := make([]byte, (bits+7)/8)
+	extra := uint(len(buf)*8 - bits)
+
+	for {
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, fmt.Errorf("reading candidate: %w", err)
+		}
+
+		//the two top bits are set, so the product of two primes has all
+		//of its bits.
+		buf[0] &= 0xff >> extra
+		buf[0] |= 0xc0 >> extra
+		buf[len(buf)-1] |= 1
+
+		p := new(big.Int).SetBytes(buf)
+		if !p.ProbablyPrime(20) {
+			continue
+		}
+
+		pm := new(big.Int).Sub(p, big.NewInt(1))
+		if new(big.Int).GCD(nil, nil, pm, e).Cmp(big.NewInt(1)) != 0 {
+			continue
+		}
+
+		return p, nil
+	}
+}
+
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}
@@ -0,0 +1,103 @@
+package app_test
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/hamidoujand/echo/cmd/client/app"
+)
+
+func Test_ValidateMnemonic(t *testing.T) {
+	tests := []struct {
+		name     string
+		mnemonic string
+		valid    bool
+	}{
+		//test vectors of BIP-39.
+		{name: "zero", mnemonic: "abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon about", valid: true},
+		{name: "7f", mnemonic: "legal winner thank year wave sausage worth useful legal winner thank yellow", valid: true},
+		{name: "24 words", mnemonic: "zoo zoo zoo zoo zoo zoo zoo zoo zoo zoo zoo zoo zoo zoo zoo zoo zoo zoo zoo zoo zoo zoo zoo vote", valid: true},
+		{name: "case and spaces", mnemonic: "  Legal winner thank year wave sausage\tworth useful legal winner thank YELLOW\n", valid: true},
+		{name: "checksum", mnemonic: "abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon"},
+		{name: "unknown word", mnemonic: "abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon echoes"},
+		{name: "length", mnemonic: "abandon abandon abandon about"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := app.ValidateMnemonic(tt.mnemonic)
+			if tt.valid && err != nil {
+				t.Fatalf("Should accept the phrase: %s", err)
+			}
+
+			if !tt.valid && !errors.Is(err, app.ErrInvalidMnemonic) {
+				t.Fatalf("Should reject the phrase, got %v", err)
+			}
+		})
+	}
+
+	mnemonic, err := app.NewMnemonic()
+	if err != nil {
+		t.Fatalf("Should be able to create a phrase: %s", err)
+	}
+
+	if n := len(strings.Fields(mnemonic)); n != 12 {
+		t.Fatalf("Should create 12 words, got %d", n)
+	}
+
+	if err := app.ValidateMnemonic(mnemonic); err != nil {
+		t.Fatalf("Should accept a new phrase: %s", err)
+	}
+}
+
+func Test_NewIDFromMnemonic(t *testing.T) {
+	const mnemonic = "legal winner thank year wave sausage worth useful legal winner thank yellow"
+	passphrase := []byte("correct horse")
+
+	dir := t.TempDir()
+
+	id, err := app.NewIDFromMnemonic(dir, mnemonic, passphrase)
+	if err != nil {
+		t.Fatalf("Should be able to create the identity: %s", err)
+	}
+
+	//the same words give the same keys, sealed with another passphrase.
+	again, err := app.NewIDFromMnemonic(t.TempDir(), mnemonic, []byte("battery staple"))
+	if err != nil {
+		t.Fatalf("Should be able to create the identity again: %s", err)
+	}
+
+	if id.Address != again.Address {
+		t.Fatalf("Should derive the same address: got %s, exp %s", again.Address, id.Address)
+	}
+
+	if id.RSAPublicKey != again.RSAPublicKey {
+		t.Fatal("Should derive the same encryption key")
+	}
+
+	if !id.DHKey.Equal(again.DHKey) {
+		t.Fatal("Should derive the same DH key")
+	}
+
+	if err := id.RSAKey.Validate(); err != nil {
+		t.Fatalf("Should derive a valid encryption key: %s", err)
+	}
+
+	if id.RSAKey.N.BitLen() != 1024 {
+		t.Fatalf("Should derive a 1024 bit key, got %d", id.RSAKey.N.BitLen())
+	}
+
+	loaded, err := app.NewID(dir, passphrase)
+	if err != nil {
+		t.Fatalf("Should be able to load the identity: %s", err)
+	}
+
+	if loaded.Address != id.Address {
+		t.Fatalf("Should load the same address: got %s, exp %s", loaded.Address, id.Address)
+	}
+
+	if _, err := app.NewIDFromMnemonic(dir, mnemonic, passphrase); !errors.Is(err, app.ErrIDExists) {
+		t.Fatalf("Should not restore over an identity, got %v", err)
+	}
+}
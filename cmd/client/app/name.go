@@ -0,0 +1,233 @@
+package app
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/hamidoujand/echo/signature"
+)
+
+// The name in the frames relayed by the server is not signed, so contacts
+// learn a name from a signed name update instead. The update is sent when
+// the name changes and before the first message to a contact, the newest
+// one wins.
+
+const (
+	nameCommand   = "/name "
+	maxNameLength = 64
+)
+
+// NameUpdate states that the account ID goes by Name since Timestamp.
+type NameUpdate struct {
+	ID        common.Address `json:"id"`
+	Name      string         `json:"name"`
+	Timestamp int64          `json:"timestamp"`
+	V         *big.Int       `json:"v"`
+	R         *big.Int       `json:"r"`
+	S         *big.Int       `json:"s"`
+}
+
+func (u NameUpdate) signedData() any {
+	return struct {
+		ID        common.Address
+		Name      string
+		Timestamp int64
+	}{
+		ID:        u.ID,
+		Name:      u.Name,
+		Timestamp: u.Timestamp,
+	}
+}
+
+func (u NameUpdate) verify() error {
+	if _, err := validName(u.Name); err != nil {
+		return err
+	}
+
+	if u.V == nil || u.R == nil || u.S == nil {
+		return errors.New("name update is not signed")
+	}
+
+	from, err := signature.FromAddress(u.signedData(), u.V, u.R, u.S)
+	if err != nil {
+		return fmt.Errorf("fromAddress: %w", err)
+	}
+
+	if from != u.ID.Hex() {
+		return fmt.Errorf("name update is signed by %s", from)
+	}
+
+	return nil
+}
+
+// NewNameUpdate signs the name of the identity id.
+func NewNameUpdate(id ID, name string) (NameUpdate, error) {
+	name, err := validName(name)
+	if err != nil {
+		return NameUpdate{}, err
+	}
+
+	u := NameUpdate{
+		ID:        id.Address,
+		Name:      name,
+		Timestamp: time.Now().UnixNano(),
+	}
+
+	u.V, u.R, u.S, err = signature.Sign(u.signedData(), id.ECDSAKey)
+	if err != nil {
+		return NameUpdate{}, fmt.Errorf("sign: %w", err)
+	}
+
+	return u, nil
+}
+
+// validName trims name and refuses names that are empty, too long or hold
+// control characters.
+func validName(name string) (string, error) {
+	name = strings.TrimSpace(name)
+
+	switch {
+	case name == "":
+		return "", errors.New("name can not be empty")
+	case utf8.RuneCountInString(name) > maxNameLength:
+		return "", fmt.Errorf("name can not be longer than %d characters", maxNameLength)
+	case strings.ContainsFunc(name, unicode.IsControl):
+		return "", errors.New("name can not hold control characters")
+	}
+
+	return name, nil
+}
+
+// =============================================================================
+
+// UpdateContactName applies a verified name update of a contact, the old
+// name is kept as its former name. It reports whether the name changed,
+// updates older than the last one are ignored.
+func (db *Database) UpdateContactName(u NameUpdate) (User, bool, error) {
+	if err := u.verify(); err != nil {
+		return User{}, false, err
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	usr, ok := db.contacts[u.ID]
+	if !ok {
+		return User{}, false, fmt.Errorf("contact with id %s not found", u.ID.Hex())
+	}
+
+	if u.Timestamp <= usr.NameUpdated {
+		return usr, false, nil
+	}
+
+	updated := usr
+	updated.NameUpdated = u.Timestamp
+	if u.Name != usr.Name {
+		updated.FormerName = usr.Name
+		updated.Name = u.Name
+	}
+
+	if err := db.saveContact(updated); err != nil {
+		return User{}, false, err
+	}
+	db.contacts[u.ID] = updated
+
+	return updated, updated.Name != usr.Name, nil
+}
+
+// =============================================================================
+
+// SetName changes the name of the account and sends the signed update to
+// every contact, it returns the number of contacts that got it.
+func (c *Client) SetName(name string) (int, error) {
+	name, err := validName(name)
+	if err != nil {
+		return 0, err
+	}
+
+	if err := c.db.SetName(name); err != nil {
+		return 0, fmt.Errorf("setName: %w", err)
+	}
+
+	var sent int
+	var errs []error
+	for _, usr := range c.db.Contacts() {
+		if c.db.IsBlocked(usr.ID) {
+			continue
+		}
+
+		if err := c.sendName(usr.ID); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", usr.Name, err))
+			continue
+		}
+		sent++
+	}
+
+	return sent, errors.Join(errs...)
+}
+
+// sendName sends the signed name of the account to the contact id.
+func (c *Client) sendName(id common.Address) error {
+	usr, err := c.db.LookupContact(id)
+	if err != nil {
+		return fmt.Errorf("lookup contact: %w", err)
+	}
+
+	u, err := NewNameUpdate(c.id, c.db.MyAccount().Name)
+	if err != nil {
+		return err
+	}
+
+	bs, err := json.Marshal(u)
+	if err != nil {
+		return fmt.Errorf("marshal name update: %w", err)
+	}
+
+	return c.write(id, schemeNone, append([]byte(nameCommand), bs...), usr.OutgoingNonce+1)
+}
+
+// parseNameUpdate reads the name update in text sent by from.
+func parseNameUpdate(from common.Address, text []byte) (NameUpdate, error) {
+	var u NameUpdate
+	if err := json.Unmarshal(bytes.TrimPrefix(text, []byte(nameCommand)), &u); err != nil {
+		return NameUpdate{}, fmt.Errorf("unmarshal name update: %w", err)
+	}
+
+	if u.ID != from {
+		return NameUpdate{}, fmt.Errorf("name update of %s sent by %s", u.ID.Hex(), from.Hex())
+	}
+
+	if err := u.verify(); err != nil {
+		return NameUpdate{}, fmt.Errorf("verify: %w", err)
+	}
+
+	return u, nil
+}
+
+// processNameUpdate renames the contact that sent a name update.
+func (c *Client) processNameUpdate(msg inMessage) error {
+	u, err := parseNameUpdate(msg.From.ID, msg.Text)
+	if err != nil {
+		return err
+	}
+
+	usr, changed, err := c.db.UpdateContactName(u)
+	if err != nil {
+		return fmt.Errorf("updateContactName: %w", err)
+	}
+
+	if changed {
+		c.refreshContact(usr.ID.Hex())
+		c.uiWriter("system", systemErrorMessage("%s is now known as %s", usr.FormerName, usr.Name))
+	}
+
+	return nil
+}
@@ -0,0 +1,61 @@
+package app_test
+
+import (
+	"testing"
+
+	"github.com/hamidoujand/echo/cmd/client/app"
+)
+
+func Test_UpdateContactName(t *testing.T) {
+	alice, err := app.NewID(t.TempDir(), []byte("correct horse"))
+	if err != nil {
+		t.Fatalf("Should be able to create an identity: %s", err)
+	}
+
+	db, err := app.NewDatabase(t.TempDir(), me, dataKey)
+	if err != nil {
+		t.Fatalf("Should be able to create a database: %s", err)
+	}
+
+	if _, err := db.AddContact(alice.Address, "alice"); err != nil {
+		t.Fatalf("Should be able to add a contact: %s", err)
+	}
+
+	older, err := app.NewNameUpdate(alice, "al")
+	if err != nil {
+		t.Fatalf("Should be able to sign a name: %s", err)
+	}
+
+	u, err := app.NewNameUpdate(alice, "  Alice Smith ")
+	if err != nil {
+		t.Fatalf("Should be able to sign a name: %s", err)
+	}
+
+	forged := u
+	forged.Name = "mallory"
+	if _, _, err := db.UpdateContactName(forged); err == nil {
+		t.Fatal("Should not accept a name update that was changed")
+	}
+
+	usr, changed, err := db.UpdateContactName(u)
+	if err != nil {
+		t.Fatalf("Should be able to update the name: %s", err)
+	}
+
+	if !changed || usr.Name != "Alice Smith" || usr.FormerName != "alice" {
+		t.Fatalf("Should rename alice to Alice Smith, got %q formerly %q", usr.Name, usr.FormerName)
+	}
+
+	if _, changed, err := db.UpdateContactName(older); err != nil || changed {
+		t.Fatalf("Should ignore an older name update, got changed %t: %v", changed, err)
+	}
+
+	usr, err = db.LookupContact(alice.Address)
+	if err != nil || usr.Name != "Alice Smith" {
+		t.Fatalf("Should keep the newest name, got %q", usr.Name)
+	}
+
+	if _, err := app.NewNameUpdate(alice, " "); err == nil {
+		t.Fatal("Should not sign an empty name")
+	}
+}
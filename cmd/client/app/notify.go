@@ -0,0 +1,103 @@
+package app
+
+import (
+	"fmt"
+	"os/exec"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// New messages from a contact that is not muted ring the terminal bell or
+// run a command, the command gets the text of the notification as its last
+// argument so notify-send and the like work as they are.
+
+// NotifyBell rings the terminal bell and NotifyOff turns the notifications
+// off, anything else is a command.
+const (
+	NotifyBell = "bell"
+	NotifyOff  = "off"
+)
+
+// SetNotify sets how new messages are notified, NotifyBell, NotifyOff or a
+// command with its arguments.
+func (a *App) SetNotify(notify string) {
+	notify = strings.TrimSpace(notify)
+	if notify == "" {
+		notify = NotifyOff
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.notifyCmd = notify
+}
+
+func (a *App) notifyWith() string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	return a.notifyCmd
+}
+
+// notify tells about a new message from the contact id of the session s.
+func (a *App) notify(s *Session, id string) {
+	usr, err := s.DB.LookupContact(common.HexToAddress(id))
+	if err != nil || usr.Muted {
+		return
+	}
+
+	switch how := a.notifyWith(); how {
+	case NotifyOff:
+	case NotifyBell:
+		//the bell is rung by the next draw, it owns the screen.
+		a.bell.Store(true)
+		a.app.Draw()
+	default:
+		text := fmt.Sprintf("new message from %s", usr.Name)
+		if !a.isActive(s) {
+			text += fmt.Sprintf(" (%s)", s.Name)
+		}
+
+		args := append(strings.Fields(how), text)
+		go func() {
+			if out, err := exec.Command(args[0], args[1:]...).CombinedOutput(); err != nil {
+				a.WriteMessage("system", systemErrorMessage("notify command failed: %s: %s", err, strings.TrimSpace(string(out))))
+			}
+		}()
+	}
+}
+
+// =============================================================================
+
+// setPinned pins or unpins the contact id and sorts the list again.
+func (a *App) setPinned(id common.Address, pinned bool) error {
+	if err := a.db.SetPinned(id, pinned); err != nil {
+		return err
+	}
+
+	a.sortContacts()
+	return nil
+}
+
+// setMuted mutes or unmutes the notifications of the contact id.
+func (a *App) setMuted(id common.Address, muted bool) error {
+	if err := a.db.SetMuted(id, muted); err != nil {
+		return err
+	}
+
+	a.refreshContact(id)
+
+	usr, err := a.db.LookupContact(id)
+	if err != nil {
+		return err
+	}
+
+	what := "notified again"
+	if muted {
+		what = "muted, they still count as unread"
+	}
+	a.WriteMessage("system", systemErrorMessage("the messages of %s are %s", usr.Name, what))
+
+	return nil
+}
@@ -0,0 +1,325 @@
+package app
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/gdamore/tcell/v2"
+	"github.com/rivo/tview"
+)
+
+// Profiles are identities of their own under one data root, each with its
+// keys and database. The default profile is the root itself so a data
+// directory of a single identity keeps working, the others live in
+// profiles/<name>.
+
+// DefaultProfile is the profile stored in the data root.
+const DefaultProfile = "default"
+
+var profileName = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,31}$`)
+
+// ProfileDir returns the directory of the profile name under root.
+func ProfileDir(root string, name string) (string, error) {
+	if name == DefaultProfile {
+		return root, nil
+	}
+
+	if !profileName.MatchString(name) {
+		return "", fmt.Errorf("invalid profile name %q, use up to 32 lowercase letters, digits, - and _", name)
+	}
+
+	return filepath.Join(root, "profiles", name), nil
+}
+
+// Profiles returns the names of the profiles under root that hold an
+// identity, the default profile first.
+func Profiles(root string) ([]string, error) {
+	var names []string
+
+	exists, err := HasID(root)
+	if err != nil {
+		return nil, fmt.Errorf("hasID: %w", err)
+	}
+
+	if exists {
+		names = append(names, DefaultProfile)
+	}
+
+	entries, err := os.ReadDir(filepath.Join(root, "profiles"))
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		return names, nil
+	case err != nil:
+		return nil, fmt.Errorf("readDir: %w", err)
+	}
+
+	for _, e := range entries {
+		if !e.IsDir() || e.Name() == DefaultProfile || !profileName.MatchString(e.Name()) {
+			continue
+		}
+
+		exists, err := HasID(filepath.Join(root, "profiles", e.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("hasID: %w", err)
+		}
+
+		if exists {
+			names = append(names, e.Name())
+		}
+	}
+
+	return names, nil
+}
+
+// =============================================================================
+
+// Session is an unlocked profile, its client stays connected while another
+// profile is on screen.
+type Session struct {
+	Name   string
+	Client *Client
+	DB     *Database
+
+	// unread is the number of messages received while the profile was not
+	// on screen, it is guarded by the mutex of the App.
+	unread int
+}
+
+// OpenProfile unlocks the profile name with passphrase, the client of the
+// session is not connected yet.
+type OpenProfile func(name string, passphrase []byte) (*Session, error)
+
+// Connect runs the handshake of the session, its messages are counted as
+// unread while another profile is on screen.
+func (a *App) Connect(s *Session) error {
+	writer := func(id string, msg message) {
+		a.mu.Lock()
+		active := a.active == s
+		if !active && id != "system" {
+			s.unread++
+		}
+		a.mu.Unlock()
+
+		switch {
+		case active:
+			a.WriteMessage(id, msg)
+		case id == "system":
+			msg.Name = fmt.Sprintf("%s (%s)", msg.Name, s.Name)
+			a.WriteMessage(id, msg)
+		default:
+			a.updateTitle()
+			a.app.Draw()
+		}
+	}
+
+	//the requests and the contacts are loaded again on switching.
+	updateRequests := func() {
+		if a.isActive(s) {
+			a.UpdateRequests()
+		}
+	}
+
+	moveContact := func(from string, to string) {
+		if a.isActive(s) {
+			a.MoveContact(from, to)
+		}
+	}
+
+	refreshContact := func(id string) {
+		if a.isActive(s) {
+			a.RefreshContact(id)
+		}
+	}
+
+	notify := func(id string) {
+		a.notify(s, id)
+	}
+
+	return s.Client.Handshake(s.DB.MyAccount().Name, writer, updateRequests, moveContact, refreshContact, notify)
+}
+
+// Close disconnects every session.
+func (a *App) Close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	var errs []error
+	for _, s := range a.sessions {
+		if err := s.Client.Close(); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", s.Name, err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+func (a *App) isActive(s *Session) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	return a.active == s
+}
+
+// session returns the unlocked session of the profile name.
+func (a *App) session(name string) (*Session, bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	i := slices.IndexFunc(a.sessions, func(s *Session) bool {
+		return s.Name == name
+	})
+	if i == -1 {
+		return nil, false
+	}
+
+	return a.sessions[i], true
+}
+
+// updateTitle shows the profile on screen and the unread messages of the
+// others.
+func (a *App) updateTitle() {
+	a.mu.Lock()
+	title := fmt.Sprintf("*** %s ***", a.db.MyAccount().ID)
+	if len(a.sessions) > 1 || a.active.Name != DefaultProfile {
+		title = fmt.Sprintf("*** %s: %s ***", a.active.Name, a.db.MyAccount().ID)
+	}
+
+	var unread []string
+	for _, s := range a.sessions {
+		if s != a.active && s.unread > 0 {
+			unread = append(unread, fmt.Sprintf("%s %d", s.Name, s.unread))
+		}
+	}
+	a.mu.Unlock()
+
+	if len(unread) > 0 {
+		title += fmt.Sprintf(" unread: %s (ctrl+p) ", strings.Join(unread, ", "))
+	}
+
+	a.textView.SetTitle(title)
+}
+
+// switchTo puts the profile of s on screen.
+func (a *App) switchTo(s *Session) {
+	a.mu.Lock()
+	a.active = s
+	a.client = s.Client
+	a.db = s.DB
+	s.unread = 0
+	a.mu.Unlock()
+
+	a.shown = common.Address{}
+	a.messages = nil
+	a.textView.Clear()
+
+	a.loadContacts()
+	a.updateTitle()
+	a.UpdateRequests()
+}
+
+// showProfiles opens the profile picker, selecting a locked profile asks for
+// its passphrase.
+func (a *App) showProfiles() {
+	const page = "profiles"
+
+	names, err := Profiles(a.root)
+	if err != nil {
+		a.WriteMessage("system", systemErrorMessage("listing profiles failed: %s", err))
+		return
+	}
+
+	list := tview.NewList()
+	list.SetBorder(true)
+	list.SetTitle("Profiles (enter: switch, esc: close)")
+
+	for _, name := range names {
+		secondary := "locked"
+		if s, ok := a.session(name); ok {
+			a.mu.Lock()
+			switch {
+			case s == a.active:
+				secondary = "on screen"
+			case s.unread > 0:
+				secondary = fmt.Sprintf("%d unread", s.unread)
+			default:
+				secondary = "no unread messages"
+			}
+			a.mu.Unlock()
+		}
+		list.AddItem(name, secondary, 0, nil)
+	}
+
+	list.SetSelectedFunc(func(index int, name, secondary string, shortcut rune) {
+		a.closeModal(page)
+
+		if s, ok := a.session(name); ok {
+			a.switchTo(s)
+			return
+		}
+		a.unlockProfile(name)
+	})
+
+	list.SetInputCapture(func(event *tcell.EventKey) *tcell.EventKey {
+		if event.Key() == tcell.KeyEscape {
+			a.closeModal(page)
+			return nil
+		}
+		return event
+	})
+
+	a.showModal(page, list, 60, 20)
+}
+
+// unlockProfile asks for the passphrase of the profile name, connects it and
+// puts it on screen.
+func (a *App) unlockProfile(name string) {
+	const page = "unlock"
+
+	const passphraseLabel = "Passphrase"
+
+	form := tview.NewForm().
+		AddPasswordField(passphraseLabel, "", 40, '*', nil)
+
+	form.AddButton("Unlock", func() {
+		passphrase := []byte(form.GetFormItemByLabel(passphraseLabel).(*tview.InputField).GetText())
+
+		s, err := a.open(name, passphrase)
+		if err != nil {
+			a.WriteMessage("system", systemErrorMessage("unlocking %s failed: %s", name, err))
+			return
+		}
+
+		if err := a.Connect(s); err != nil {
+			s.Client.Close()
+			a.WriteMessage("system", systemErrorMessage("connecting %s failed: %s", name, err))
+			return
+		}
+
+		a.mu.Lock()
+		a.sessions = append(a.sessions, s)
+		a.mu.Unlock()
+
+		a.closeModal(page)
+		a.switchTo(s)
+	})
+
+	form.AddButton("Cancel", func() {
+		a.closeModal(page)
+	})
+
+	form.SetCancelFunc(func() {
+		a.closeModal(page)
+	})
+
+	form.SetBorder(true)
+	form.SetTitle(fmt.Sprintf("Unlock %s (esc: close)", name))
+
+	a.showModal(page, form, 60, 7)
+}
@@ -0,0 +1,54 @@
+package app_test
+
+import (
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/hamidoujand/echo/cmd/client/app"
+)
+
+func Test_Profiles(t *testing.T) {
+	passphrase := []byte("correct horse")
+	root := t.TempDir()
+
+	names, err := app.Profiles(root)
+	if err != nil {
+		t.Fatalf("Should be able to list the profiles of an empty root: %s", err)
+	}
+
+	if len(names) != 0 {
+		t.Fatalf("Should not find any profile, got %v", names)
+	}
+
+	for _, name := range []string{app.DefaultProfile, "work"} {
+		dir, err := app.ProfileDir(root, name)
+		if err != nil {
+			t.Fatalf("Should be able to get the directory of %s: %s", name, err)
+		}
+
+		if _, err := app.NewID(dir, passphrase); err != nil {
+			t.Fatalf("Should be able to create the identity of %s: %s", name, err)
+		}
+	}
+
+	dir, err := app.ProfileDir(root, app.DefaultProfile)
+	if err != nil || dir != root {
+		t.Fatalf("Should keep the default profile in the root, got %s", dir)
+	}
+
+	names, err = app.Profiles(root)
+	if err != nil {
+		t.Fatalf("Should be able to list the profiles: %s", err)
+	}
+
+	if !slices.Equal(names, []string{app.DefaultProfile, "work"}) {
+		t.Fatalf("Should find the default and the work profiles, got %v", names)
+	}
+
+	for _, name := range []string{"", "../personal", "Work", filepath.Join("a", "b")} {
+		if _, err := app.ProfileDir(root, name); err == nil {
+			t.Fatalf("Should not accept the profile name %q", name)
+		}
+	}
+}
@@ -0,0 +1,354 @@
+package app
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hkdf"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"maps"
+	"strconv"
+)
+
+// The double ratchet follows https://signal.org/docs/specifications/doubleratchet
+// with X25519, HKDF-SHA256, HMAC-SHA256 and AES-256-GCM.
+
+const (
+	// maxSkip is how many message keys a single chain can skip.
+	maxSkip = 1000
+
+	// maxSkipped is how many skipped message keys a session keeps in total.
+	maxSkipped = 2000
+
+	ratchetInfo = "echo-ratchet"
+	messageInfo = "echo-message-keys"
+)
+
+var errRatchetDecrypt = errors.New("ratchet: message can not be decrypted")
+
+type ratchetHeader struct {
+	DH []byte `json:"dh"`
+	PN uint32 `json:"pn"`
+	N  uint32 `json:"n"`
+}
+
+func (h ratchetHeader) bytes() []byte {
+	b := make([]byte, 0, len(h.DH)+8)
+	b = append(b, h.DH...)
+	b = binary.BigEndian.AppendUint32(b, h.PN)
+	b = binary.BigEndian.AppendUint32(b, h.N)
+	return b
+}
+
+// ratchetState is the state of one side of a conversation, it is stored in
+// the client database after every change.
+type ratchetState struct {
+	DHs     []byte            `json:"dhs"`
+	DHr     []byte            `json:"dhr"`
+	RK      []byte            `json:"rk"`
+	CKs     []byte            `json:"cks"`
+	CKr     []byte            `json:"ckr"`
+	Ns      uint32            `json:"ns"`
+	Nr      uint32            `json:"nr"`
+	PN      uint32            `json:"pn"`
+	Skipped map[string][]byte `json:"skipped"`
+	// Order keeps the insertion order of Skipped so the oldest keys are dropped first.
+	Order []string `json:"order"`
+	AD    []byte   `json:"ad"`
+}
+
+// newInitiatorRatchet is used by the side that ran X3DH, theirs is the
+// contact's signed prekey.
+func newInitiatorRatchet(sk []byte, theirs []byte, ad []byte) (ratchetState, error) {
+	dhs, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return ratchetState{}, fmt.Errorf("generating ratchet key: %w", err)
+	}
+
+	s := ratchetState{
+		DHs:     dhs.Bytes(),
+		DHr:     theirs,
+		Skipped: make(map[string][]byte),
+		AD:      ad,
+	}
+
+	dhOut, err := dh(s.DHs, s.DHr)
+	if err != nil {
+		return ratchetState{}, err
+	}
+
+	s.RK, s.CKs, err = kdfRK(sk, dhOut)
+	if err != nil {
+		return ratchetState{}, err
+	}
+
+	return s, nil
+}
+
+// newResponderRatchet is used by the side that received the X3DH message,
+// spk is the private signed prekey the initiator used.
+func newResponderRatchet(sk []byte, spk []byte, ad []byte) ratchetState {
+	return ratchetState{
+		DHs:     spk,
+		RK:      sk,
+		Skipped: make(map[string][]byte),
+		AD:      ad,
+	}
+}
+
+func (s *ratchetState) encrypt(plaintext []byte) (ratchetHeader, []byte, error) {
+	if len(s.CKs) == 0 {
+		return ratchetHeader{}, nil, errors.New("ratchet: no sending chain yet")
+	}
+
+	pub, err := publicKey(s.DHs)
+	if err != nil {
+		return ratchetHeader{}, nil, err
+	}
+
+	var mk []byte
+	s.CKs, mk = kdfCK(s.CKs)
+
+	h := ratchetHeader{DH: pub, PN: s.PN, N: s.Ns}
+	s.Ns++
+
+	ct, err := seal(mk, plaintext, append(bytes.Clone(s.AD), h.bytes()...))
+	if err != nil {
+		return ratchetHeader{}, nil, err
+	}
+
+	return h, ct, nil
+}
+
+// decrypt only changes the state when the message is authentic.
+func (s *ratchetState) decrypt(h ratchetHeader, ciphertext []byte) ([]byte, error) {
+	next := s.clone()
+
+	plaintext, err := next.decryptInPlace(h, ciphertext)
+	if err != nil {
+		return nil, err
+	}
+
+	*s = next
+	return plaintext, nil
+}
+
+func (s *ratchetState) decryptInPlace(h ratchetHeader, ciphertext []byte) ([]byte, error) {
+	ad := append(bytes.Clone(s.AD), h.bytes()...)
+
+	key := skippedKey(h.DH, h.N)
+	if mk, ok := s.Skipped[key]; ok {
+		plaintext, err := open(mk, ciphertext, ad)
+		if err != nil {
+			return nil, errRatchetDecrypt
+		}
+		s.dropSkipped(key)
+		return plaintext, nil
+	}
+
+	if !bytes.Equal(h.DH, s.DHr) {
+		if err := s.skip(h.PN); err != nil {
+			return nil, err
+		}
+		if err := s.step(h.DH); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := s.skip(h.N); err != nil {
+		return nil, err
+	}
+
+	var mk []byte
+	s.CKr, mk = kdfCK(s.CKr)
+	s.Nr++
+
+	plaintext, err := open(mk, ciphertext, ad)
+	if err != nil {
+		return nil, errRatchetDecrypt
+	}
+
+	return plaintext, nil
+}
+
+// skip stores the message keys of the receiving chain up to until.
+func (s *ratchetState) skip(until uint32) error {
+	if len(s.CKr) == 0 {
+		return nil
+	}
+
+	if until < s.Nr {
+		return nil
+	}
+
+	if until-s.Nr > maxSkip {
+		return fmt.Errorf("ratchet: too many skipped messages: %d", until-s.Nr)
+	}
+
+	for s.Nr < until {
+		var mk []byte
+		s.CKr, mk = kdfCK(s.CKr)
+
+		key := skippedKey(s.DHr, s.Nr)
+		s.Skipped[key] = mk
+		s.Order = append(s.Order, key)
+		s.Nr++
+	}
+
+	for len(s.Order) > maxSkipped {
+		s.dropSkipped(s.Order[0])
+	}
+
+	return nil
+}
+
+// step performs a DH ratchet step with the new key of the contact.
+func (s *ratchetState) step(theirs []byte) error {
+	s.PN = s.Ns
+	s.Ns = 0
+	s.Nr = 0
+	s.DHr = theirs
+
+	dhOut, err := dh(s.DHs, s.DHr)
+	if err != nil {
+		return err
+	}
+
+	s.RK, s.CKr, err = kdfRK(s.RK, dhOut)
+	if err != nil {
+		return err
+	}
+
+	dhs, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return fmt.Errorf("generating ratchet key: %w", err)
+	}
+	s.DHs = dhs.Bytes()
+
+	dhOut, err = dh(s.DHs, s.DHr)
+	if err != nil {
+		return err
+	}
+
+	s.RK, s.CKs, err = kdfRK(s.RK, dhOut)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (s *ratchetState) dropSkipped(key string) {
+	delete(s.Skipped, key)
+	for i, k := range s.Order {
+		if k == key {
+			s.Order = append(s.Order[:i:i], s.Order[i+1:]...)
+			break
+		}
+	}
+}
+
+func (s ratchetState) clone() ratchetState {
+	c := s
+	c.Skipped = maps.Clone(s.Skipped)
+	if c.Skipped == nil {
+		c.Skipped = make(map[string][]byte)
+	}
+	c.Order = append([]string(nil), s.Order...)
+	return c
+}
+
+// =============================================================================
+
+func skippedKey(dh []byte, n uint32) string {
+	return hex.EncodeToString(dh) + ":" + strconv.FormatUint(uint64(n), 10)
+}
+
+func dh(private []byte, public []byte) ([]byte, error) {
+	priv, err := ecdh.X25519().NewPrivateKey(private)
+	if err != nil {
+		return nil, fmt.Errorf("parsing private key: %w", err)
+	}
+
+	pub, err := ecdh.X25519().NewPublicKey(public)
+	if err != nil {
+		return nil, fmt.Errorf("parsing public key: %w", err)
+	}
+
+	out, err := priv.ECDH(pub)
+	if err != nil {
+		return nil, fmt.Errorf("ecdh: %w", err)
+	}
+
+	return out, nil
+}
+
+func publicKey(private []byte) ([]byte, error) {
+	priv, err := ecdh.X25519().NewPrivateKey(private)
+	if err != nil {
+		return nil, fmt.Errorf("parsing private key: %w", err)
+	}
+	return priv.PublicKey().Bytes(), nil
+}
+
+func kdfRK(rk []byte, dhOut []byte) (newRK []byte, ck []byte, err error) {
+	out, err := hkdf.Key(sha256.New, dhOut, rk, ratchetInfo, 64)
+	if err != nil {
+		return nil, nil, fmt.Errorf("hkdf: %w", err)
+	}
+	return out[:32], out[32:], nil
+}
+
+func kdfCK(ck []byte) (next []byte, mk []byte) {
+	m := hmac.New(sha256.New, ck)
+	m.Write([]byte{0x01})
+	mk = m.Sum(nil)
+
+	m = hmac.New(sha256.New, ck)
+	m.Write([]byte{0x02})
+	next = m.Sum(nil)
+
+	return next, mk
+}
+
+func messageKeys(mk []byte) (cipher.AEAD, []byte, error) {
+	out, err := hkdf.Key(sha256.New, mk, make([]byte, 32), messageInfo, 44)
+	if err != nil {
+		return nil, nil, fmt.Errorf("hkdf: %w", err)
+	}
+
+	block, err := aes.NewCipher(out[:32])
+	if err != nil {
+		return nil, nil, fmt.Errorf("new cipher: %w", err)
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, nil, fmt.Errorf("new gcm: %w", err)
+	}
+
+	return aead, out[32:], nil
+}
+
+func seal(mk []byte, plaintext []byte, ad []byte) ([]byte, error) {
+	aead, nonce, err := messageKeys(mk)
+	if err != nil {
+		return nil, err
+	}
+	return aead.Seal(nil, nonce, plaintext, ad), nil
+}
+
+func open(mk []byte, ciphertext []byte, ad []byte) ([]byte, error) {
+	aead, nonce, err := messageKeys(mk)
+	if err != nil {
+		return nil, err
+	}
+	return aead.Open(nil, nonce, ciphertext, ad)
+}
@@ -0,0 +1,233 @@
+package app_test
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/hamidoujand/echo/cmd/client/app"
+)
+
+// peer is a client talking to the other peer through the ratchet.
+type peer struct {
+	id     app.ID
+	db     *app.Database
+	client *app.Client
+}
+
+// newPeers connects two clients that have each other as contacts, the first
+// one has the lower address.
+func newPeers(t *testing.T) (*peer, *peer) {
+	s := newServer(t)
+
+	var peers [2]*peer
+	for i := range peers {
+		id, err := app.NewID(t.TempDir(), []byte("correct horse"))
+		if err != nil {
+			t.Fatalf("Should be able to create an identity: %s", err)
+		}
+
+		db, err := app.NewDatabase(t.TempDir(), id.Address, dataKey)
+		if err != nil {
+			t.Fatalf("Should be able to create a database: %s", err)
+		}
+
+		peers[i] = &peer{id: id, db: db}
+	}
+
+	a, b := peers[0], peers[1]
+	if a.id.Address.Cmp(b.id.Address) > 0 {
+		a, b = b, a
+	}
+
+	if _, err := a.db.AddContact(b.id.Address, "b"); err != nil {
+		t.Fatalf("Should be able to add a contact: %s", err)
+	}
+
+	if _, err := b.db.AddContact(a.id.Address, "a"); err != nil {
+		t.Fatalf("Should be able to add a contact: %s", err)
+	}
+
+	a.client, _ = connectID(t, s, a.id, a.db)
+	b.client, _ = connectID(t, s, b.id, b.db)
+
+	return a, b
+}
+
+func (p *peer) seal(t *testing.T, to *peer, text string) []byte {
+	msg, err := p.client.SealRatchet(to.id.Address, []byte(text))
+	if err != nil {
+		t.Fatalf("Should be able to seal %q: %s", text, err)
+	}
+
+	return msg
+}
+
+func (p *peer) open(t *testing.T, from *peer, msg []byte, exp string) {
+	text, err := p.client.OpenRatchet(from.id.Address, msg)
+	if err != nil {
+		t.Fatalf("Should be able to open %q: %s", exp, err)
+	}
+
+	if string(text) != exp {
+		t.Logf("got: %s", text)
+		t.Logf("exp: %s", exp)
+		t.Fatalf("Should open the message that was sealed.")
+	}
+}
+
+func (p *peer) refuse(t *testing.T, from *peer, msg []byte, why string) {
+	if _, err := p.client.OpenRatchet(from.id.Address, msg); err == nil {
+		t.Fatalf("Should not open %s", why)
+	}
+}
+
+// envelope is the wire format of a ratchet message.
+type envelope struct {
+	Init   json.RawMessage `json:"init,omitempty"`
+	Header struct {
+		DH []byte `json:"dh"`
+		PN uint32 `json:"pn"`
+		N  uint32 `json:"n"`
+	} `json:"header"`
+	Ciphertext []byte `json:"ciphertext"`
+}
+
+func parseEnvelope(t *testing.T, msg []byte) envelope {
+	var env envelope
+	if err := json.Unmarshal(msg, &env); err != nil {
+		t.Fatalf("Should be able to unmarshal the envelope: %s", err)
+	}
+
+	return env
+}
+
+func tamper(t *testing.T, msg []byte, fn func(env *envelope)) []byte {
+	env := parseEnvelope(t, msg)
+	fn(&env)
+
+	bs, err := json.Marshal(env)
+	if err != nil {
+		t.Fatalf("Should be able to marshal the envelope: %s", err)
+	}
+
+	return bs
+}
+
+// =============================================================================
+
+func Test_X3DH(t *testing.T) {
+	a, b := newPeers(t)
+
+	//every message carries the init until the contact replies.
+	m1 := a.seal(t, b, "hello")
+	m2 := a.seal(t, b, "are you there?")
+	if len(parseEnvelope(t, m2).Init) == 0 {
+		t.Fatal("Should send the init until the contact replies")
+	}
+
+	b.open(t, a, m1, "hello")
+	b.open(t, a, m2, "are you there?")
+
+	a.open(t, b, b.seal(t, a, "hi"), "hi")
+
+	m3 := a.seal(t, b, "good")
+	if len(parseEnvelope(t, m3).Init) != 0 {
+		t.Fatal("Should not send the init once the contact replied")
+	}
+	b.open(t, a, m3, "good")
+}
+
+func Test_SignedPreKeyRotation(t *testing.T) {
+	a, b := newPeers(t)
+
+	if rotated, err := b.db.RotateSignedPreKey(time.Hour); err != nil || rotated {
+		t.Fatalf("Should not rotate a new signed prekey: %v", err)
+	}
+
+	//a fetched the bundle before the rotation.
+	m1 := a.seal(t, b, "hello")
+
+	if rotated, err := b.db.RotateSignedPreKey(0); err != nil || !rotated {
+		t.Fatalf("Should rotate an old signed prekey: %v", err)
+	}
+
+	b.open(t, a, m1, "hello")
+	a.open(t, b, b.seal(t, a, "hi"), "hi")
+}
+
+func Test_RatchetOutOfOrder(t *testing.T) {
+	a, b := newPeers(t)
+
+	b.open(t, a, a.seal(t, b, "hello"), "hello")
+	a.open(t, b, b.seal(t, a, "hi"), "hi")
+
+	var msgs [][]byte
+	for _, text := range []string{"one", "two", "three", "four"} {
+		msgs = append(msgs, a.seal(t, b, text))
+	}
+
+	b.open(t, a, msgs[3], "four")
+	b.open(t, a, msgs[1], "two")
+	b.open(t, a, msgs[0], "one")
+	b.refuse(t, a, msgs[1], "a replayed skipped message")
+	b.refuse(t, a, msgs[3], "a replayed message")
+
+	//the last one of a chain arrives after the next chain started.
+	late := a.seal(t, b, "late")
+	a.open(t, b, b.seal(t, a, "ok"), "ok")
+	next := a.seal(t, b, "next chain")
+
+	b.open(t, a, next, "next chain")
+	b.open(t, a, late, "late")
+	b.open(t, a, msgs[2], "three")
+	b.refuse(t, a, late, "a replayed message of an old chain")
+}
+
+func Test_RatchetTampered(t *testing.T) {
+	a, b := newPeers(t)
+
+	first := a.seal(t, b, "hello")
+	b.open(t, a, first, "hello")
+	b.refuse(t, a, first, "a replayed first message")
+
+	msg := a.seal(t, b, "pay bob 10")
+
+	b.refuse(t, a, tamper(t, msg, func(env *envelope) {
+		env.Ciphertext[0] ^= 0x01
+	}), "a changed ciphertext")
+
+	b.refuse(t, a, tamper(t, msg, func(env *envelope) {
+		env.Header.N++
+	}), "a changed message number")
+
+	b.refuse(t, a, tamper(t, msg, func(env *envelope) {
+		env.Header.PN++
+	}), "a changed previous chain length")
+
+	b.refuse(t, a, tamper(t, msg, func(env *envelope) {
+		env.Header.DH[0] ^= 0x01
+	}), "a changed ratchet key")
+
+	//the failed attempts left the session as it was.
+	b.open(t, a, msg, "pay bob 10")
+}
+
+func Test_SimultaneousStart(t *testing.T) {
+	a, b := newPeers(t)
+
+	//both start a session before seeing the other one, a has the lower
+	//address so its session wins.
+	ma := a.seal(t, b, "from a")
+	mb1 := b.seal(t, a, "from b")
+	mb2 := b.seal(t, a, "from b again")
+
+	a.open(t, b, mb1, "from b")
+	b.open(t, a, ma, "from a")
+	a.open(t, b, mb2, "from b again")
+	a.refuse(t, b, mb2, "a replayed message of the lost session")
+
+	b.open(t, a, a.seal(t, b, "a again"), "a again")
+	a.open(t, b, b.seal(t, a, "b again"), "b again")
+	b.open(t, a, a.seal(t, b, "and on"), "and on")
+}
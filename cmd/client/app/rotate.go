@@ -0,0 +1,438 @@
+package app
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"math/big"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/hamidoujand/echo/signature"
+)
+
+// Rotating the identity key moves the account to a new address. The new keys
+// come from a new recovery phrase, the old key signs a migration statement
+// that is written next to the keys before the new keys replace the old ones.
+// The database adopts the new address the next time it is opened and keeps
+// the statement until every contact got it. Contacts trust the statement and
+// the encryption key it carries because only the old key can sign it.
+
+const migrationFilename = "migration.json"
+
+// Migration states that the identity From moved to the address To.
+type Migration struct {
+	From      common.Address `json:"from"`
+	To        common.Address `json:"to"`
+	Key       string         `json:"key"`
+	Timestamp int64          `json:"timestamp"`
+	V         *big.Int       `json:"v"`
+	R         *big.Int       `json:"r"`
+	S         *big.Int       `json:"s"`
+}
+
+func (m Migration) signedData() any {
+	return struct {
+		From      common.Address
+		To        common.Address
+		Key       string
+		Timestamp int64
+	}{
+		From:      m.From,
+		To:        m.To,
+		Key:       m.Key,
+		Timestamp: m.Timestamp,
+	}
+}
+
+func (m Migration) verify() error {
+	if m.From == m.To {
+		return errors.New("migration to the same address")
+	}
+
+	if m.V == nil || m.R == nil || m.S == nil {
+		return errors.New("migration is not signed")
+	}
+
+	if _, err := parseRSAPublicKey([]byte(m.Key)); err != nil {
+		return fmt.Errorf("parseRSAPublicKey: %w", err)
+	}
+
+	from, err := signature.FromAddress(m.signedData(), m.V, m.R, m.S)
+	if err != nil {
+		return fmt.Errorf("fromAddress: %w", err)
+	}
+
+	if from != m.From.Hex() {
+		return fmt.Errorf("migration is signed by %s", from)
+	}
+
+	return nil
+}
+
+// migrationState is a migration that was not sent to every contact yet.
+type migrationState struct {
+	Statement Migration        `json:"statement"`
+	Pending   []common.Address `json:"pending"`
+}
+
+// RotateID replaces the keys in confDir with the ones of mnemonic and returns
+// the migration statement signed by the old key, mnemonic restores the new
+// identity from then on.
+func RotateID(confDir string, passphrase []byte, mnemonic string) (Migration, error) {
+	old, err := NewID(confDir, passphrase)
+	if err != nil {
+		return Migration{}, fmt.Errorf("newID: %w", err)
+	}
+
+	seed, err := mnemonicSeed(mnemonic)
+	if err != nil {
+		return Migration{}, err
+	}
+	create := seedKeys(seed)
+
+	rawID, err := create.id()
+	if err != nil {
+		return Migration{}, err
+	}
+
+	address, _, err := readKeyID(rawID)
+	if err != nil {
+		return Migration{}, fmt.Errorf("readKeyID: %w", err)
+	}
+
+	rawEncrypt, err := create.encrypt()
+	if err != nil {
+		return Migration{}, err
+	}
+
+	privateRSA, err := readEncryptKey(rawEncrypt)
+	if err != nil {
+		return Migration{}, fmt.Errorf("readEncryptKey: %w", err)
+	}
+
+	rawDH, err := create.dh()
+	if err != nil {
+		return Migration{}, err
+	}
+
+	m := Migration{
+		From:      old.Address,
+		To:        address,
+		Timestamp: time.Now().UnixNano(),
+	}
+
+	m.Key, err = encodePublicKey(&privateRSA.PublicKey)
+	if err != nil {
+		return Migration{}, err
+	}
+
+	m.V, m.R, m.S, err = signature.Sign(m.signedData(), old.ECDSAKey)
+	if err != nil {
+		return Migration{}, fmt.Errorf("sign: %w", err)
+	}
+
+	bs, err := json.Marshal(m)
+	if err != nil {
+		return Migration{}, fmt.Errorf("marshal migration: %w", err)
+	}
+
+	raws := map[string][]byte{
+		idFilename:         rawID,
+		encryptionFilename: rawEncrypt,
+		dhFilename:         rawDH,
+	}
+
+	sealed := make(map[string][]byte, len(raws))
+	for name, raw := range raws {
+		sealed[name], err = sealKey(raw, passphrase)
+		if err != nil {
+			return Migration{}, fmt.Errorf("sealKey: %w", err)
+		}
+	}
+
+	//the statement goes first, the database needs it once the new keys are
+	//in place.
+	if err := writeFileAtomic(filepath.Join(confDir, "id", migrationFilename), bs); err != nil {
+		return Migration{}, fmt.Errorf("writeFileAtomic: %w", err)
+	}
+
+	if err := replaceKeys(confDir, sealed); err != nil {
+		return Migration{}, fmt.Errorf("replaceKeys: %w", err)
+	}
+
+	return m, nil
+}
+
+// adoptMigration moves the account to myAccountID when the identity key was
+// rotated since the database was last opened.
+func adoptMigration(confDir string, store storage, myAccountID common.Address) error {
+	acc, exists, err := store.LoadAccount()
+	if err != nil {
+		return fmt.Errorf("loadAccount: %w", err)
+	}
+
+	if !exists || acc.MyAccount.ID == myAccountID {
+		return nil
+	}
+
+	filename := filepath.Join(confDir, "id", migrationFilename)
+	bs, err := os.ReadFile(filename)
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		//openDatabase reports the mismatch.
+		return nil
+	case err != nil:
+		return fmt.Errorf("reading migration: %w", err)
+	}
+
+	var m Migration
+	if err := json.Unmarshal(bs, &m); err != nil {
+		return fmt.Errorf("unmarshal migration: %w", err)
+	}
+
+	if m.From != acc.MyAccount.ID || m.To != myAccountID {
+		return nil
+	}
+
+	if err := m.verify(); err != nil {
+		return fmt.Errorf("verify migration: %w", err)
+	}
+
+	contacts, err := store.LoadContacts()
+	if err != nil {
+		return fmt.Errorf("loadContacts: %w", err)
+	}
+
+	state := migrationState{Statement: m}
+	for _, c := range contacts {
+		if c.ID != (common.Address{}) {
+			state.Pending = append(state.Pending, c.ID)
+		}
+	}
+
+	acc.MyAccount.ID = myAccountID
+	acc.Migration = &state
+
+	if err := store.SaveAccount(acc); err != nil {
+		return fmt.Errorf("saveAccount: %w", err)
+	}
+
+	if err := os.Remove(filename); err != nil {
+		return fmt.Errorf("remove migration: %w", err)
+	}
+
+	return nil
+}
+
+// =============================================================================
+
+// PendingMigration returns the migration statement of this account and the
+// contacts that did not get it yet.
+func (db *Database) PendingMigration() (Migration, []common.Address, bool) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	if db.migration == nil {
+		return Migration{}, nil, false
+	}
+
+	return db.migration.Statement, slices.Clone(db.migration.Pending), true
+}
+
+// MigrationSent marks the migration as sent to id, the statement is dropped
+// once every contact got it.
+func (db *Database) MigrationSent(id common.Address) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if db.migration == nil {
+		return nil
+	}
+
+	db.migration.Pending = slices.DeleteFunc(db.migration.Pending, func(p common.Address) bool {
+		return p == id
+	})
+
+	if len(db.migration.Pending) == 0 {
+		db.migration = nil
+	}
+
+	return db.saveAccount()
+}
+
+// MigrateContact moves the contact, its history and its session to the new
+// address of a verified migration, nonce is the nonce of the message that
+// carried the statement. The contact has to be verified again since the
+// safety number depends on the address.
+func (db *Database) MigrateContact(m Migration, nonce uint64) (User, error) {
+	if err := m.verify(); err != nil {
+		return User{}, err
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	old, ok := db.contacts[m.From]
+	if !ok {
+		return User{}, fmt.Errorf("contact with id %s not found", m.From.Hex())
+	}
+
+	//the history is in place before the new contact is saved, a crash after
+	//that leaves both contacts behind and the next statement finishes the
+	//move.
+	usr, resumed := db.contacts[m.To]
+	switch {
+	case resumed && (usr.Name != old.Name || !bytes.Equal(usr.Key, []byte(m.Key))):
+		return User{}, fmt.Errorf("%s is already a contact", m.To.Hex())
+
+	case !resumed:
+		msgs, err := db.store.LoadHistory(m.From)
+		if err != nil {
+			return User{}, fmt.Errorf("loadHistory: %w", err)
+		}
+
+		if len(msgs) != 0 {
+			if err := db.store.ReplaceHistory(m.To, msgs); err != nil {
+				return User{}, fmt.Errorf("replaceHistory: %w", err)
+			}
+		}
+
+		//the old key vouches for the new encryption key.
+		usr = old
+		usr.ID = m.To
+		usr.Key = []byte(m.Key)
+		usr.PendingKey = nil
+		usr.IncomingNonce = nonce
+		usr.Verified = false
+
+		if err := db.saveContact(usr); err != nil {
+			return User{}, err
+		}
+
+		db.historyLen[m.To] = len(msgs)
+	}
+
+	if err := db.store.RemoveContact(m.From); err != nil {
+		return User{}, fmt.Errorf("removeContact: %w", err)
+	}
+
+	if err := db.store.RemoveHistory(m.From); err != nil {
+		return User{}, fmt.Errorf("removeHistory: %w", err)
+	}
+
+	delete(db.contacts, m.From)
+	delete(db.historyLen, m.From)
+	delete(db.requests, m.To)
+	db.contacts[m.To] = usr
+
+	if err := db.dropIndex(m.From); err != nil {
+		return User{}, err
+	}
+
+	if _, err := db.indexHistory(m.To); err != nil {
+		return User{}, err
+	}
+
+	if err := db.saveIndex(); err != nil {
+		return User{}, err
+	}
+
+	return usr, nil
+}
+
+// =============================================================================
+
+const migrationCommand = "/migrate "
+
+// sendMigration sends the migration statement to the contacts that did not
+// get it yet, from the new address.
+func (c *Client) sendMigration() error {
+	m, pending, ok := c.db.PendingMigration()
+	if !ok {
+		return nil
+	}
+
+	bs, err := json.Marshal(m)
+	if err != nil {
+		return fmt.Errorf("marshal migration: %w", err)
+	}
+	text := append([]byte(migrationCommand), bs...)
+
+	var sent int
+	for _, id := range pending {
+		usr, err := c.db.LookupContact(id)
+		if err != nil {
+			//the contact was removed in the meantime.
+			if err := c.db.MigrationSent(id); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if err := c.write(id, schemeNone, text, usr.OutgoingNonce+1); err != nil {
+			return fmt.Errorf("write %s: %w", id.Hex(), err)
+		}
+
+		if err := c.db.MigrationSent(id); err != nil {
+			return err
+		}
+		sent++
+	}
+
+	c.uiWriter("system", systemErrorMessage("told %d contacts that %s moved to %s", sent, m.From.Hex(), m.To.Hex()))
+	return nil
+}
+
+// isMigration reports whether msg carries a migration statement, it is
+// never encrypted since the sender is not known by its new address yet.
+func isMigration(msg inMessage) bool {
+	return (msg.Scheme == schemeNone || msg.Scheme == "") && bytes.HasPrefix(msg.Text, []byte(migrationCommand))
+}
+
+// processMigration moves a contact to the address that sent its migration
+// statement.
+func (c *Client) processMigration(msg inMessage) error {
+	var m Migration
+	if err := json.Unmarshal(bytes.TrimPrefix(msg.Text, []byte(migrationCommand)), &m); err != nil {
+		return fmt.Errorf("unmarshal migration: %w", err)
+	}
+
+	if m.To != msg.From.ID {
+		return fmt.Errorf("migration to %s sent by %s", m.To.Hex(), msg.From.ID.Hex())
+	}
+
+	if err := m.verify(); err != nil {
+		return fmt.Errorf("verify: %w", err)
+	}
+
+	//a blocked contact stays blocked, its new address is not trusted.
+	if c.db.IsBlocked(m.From) {
+		return nil
+	}
+
+	old, err := c.db.LookupContact(m.From)
+	if err != nil {
+		return fmt.Errorf("migration of unknown contact %s", m.From.Hex())
+	}
+
+	if err := checkNonce(old.IncomingNonce, msg.From.Nonce); err != nil {
+		return err
+	}
+
+	usr, err := c.db.MigrateContact(m, msg.From.Nonce)
+	if err != nil {
+		return fmt.Errorf("migrateContact: %w", err)
+	}
+
+	c.moveContact(m.From.Hex(), m.To.Hex())
+	c.uiWriter("system", systemErrorMessage("%s moved from %s to %s on %s, the change is signed by the old key. Run /verify to verify the contact again.",
+		usr.Name, m.From.Hex(), m.To.Hex(), time.Unix(0, m.Timestamp).Local().Format(time.DateTime)))
+
+	return nil
+}
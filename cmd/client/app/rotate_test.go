@@ -0,0 +1,240 @@
+package app_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/hamidoujand/echo/cmd/client/app"
+)
+
+func Test_RotateID(t *testing.T) {
+	passphrase := []byte("correct horse")
+	dir := t.TempDir()
+
+	id, err := app.NewID(dir, passphrase)
+	if err != nil {
+		t.Fatalf("Should be able to create an identity: %s", err)
+	}
+
+	key, err := app.LoadDataKey(dir, passphrase)
+	if err != nil {
+		t.Fatalf("Should be able to create a data key: %s", err)
+	}
+
+	db, err := app.NewDatabase(dir, id.Address, key)
+	if err != nil {
+		t.Fatalf("Should be able to create a database: %s", err)
+	}
+
+	if _, err := db.AddContact(alice, "alice"); err != nil {
+		t.Fatalf("Should be able to add a contact: %s", err)
+	}
+
+	mnemonic, err := app.NewMnemonic()
+	if err != nil {
+		t.Fatalf("Should be able to create a recovery phrase: %s", err)
+	}
+
+	m, err := app.RotateID(dir, passphrase, mnemonic)
+	if err != nil {
+		t.Fatalf("Should be able to rotate the identity: %s", err)
+	}
+
+	if m.From != id.Address || m.To == id.Address {
+		t.Fatalf("Should move from %s to a new address, got %s to %s", id.Address, m.From, m.To)
+	}
+
+	rotated, err := app.NewID(dir, passphrase)
+	if err != nil {
+		t.Fatalf("Should be able to load the new identity: %s", err)
+	}
+
+	if rotated.Address != m.To || rotated.RSAPublicKey != m.Key {
+		t.Fatalf("Should load the new keys: got %s, exp %s", rotated.Address, m.To)
+	}
+
+	restored, err := app.NewIDFromMnemonic(t.TempDir(), mnemonic, passphrase)
+	if err != nil {
+		t.Fatalf("Should be able to restore the new identity: %s", err)
+	}
+
+	if restored.Address != m.To || restored.RSAPublicKey != rotated.RSAPublicKey || !restored.DHKey.Equal(rotated.DHKey) {
+		t.Fatalf("Should restore the new identity from its recovery phrase, got %s", restored.Address)
+	}
+
+	//the database follows the key.
+	db, err = app.NewDatabase(dir, m.To, key)
+	if err != nil {
+		t.Fatalf("Should be able to open the database with the new key: %s", err)
+	}
+
+	if db.MyAccount().ID != m.To {
+		t.Fatalf("Should move the account: got %s, exp %s", db.MyAccount().ID, m.To)
+	}
+
+	_, pending, ok := db.PendingMigration()
+	if !ok || len(pending) != 1 || pending[0] != alice {
+		t.Fatalf("Should send the statement to alice, got %v", pending)
+	}
+
+	if err := db.MigrationSent(alice); err != nil {
+		t.Fatalf("Should be able to mark the statement as sent: %s", err)
+	}
+
+	db, err = app.NewDatabase(dir, m.To, key)
+	if err != nil {
+		t.Fatalf("Should be able to open the database again: %s", err)
+	}
+
+	if _, _, ok := db.PendingMigration(); ok {
+		t.Fatal("Should not send the statement again")
+	}
+}
+
+func Test_MigrateContact(t *testing.T) {
+	passphrase := []byte("correct horse")
+	dir := t.TempDir()
+
+	old, err := app.NewID(dir, passphrase)
+	if err != nil {
+		t.Fatalf("Should be able to create an identity: %s", err)
+	}
+
+	mnemonic, err := app.NewMnemonic()
+	if err != nil {
+		t.Fatalf("Should be able to create a recovery phrase: %s", err)
+	}
+
+	m, err := app.RotateID(dir, passphrase, mnemonic)
+	if err != nil {
+		t.Fatalf("Should be able to rotate the identity: %s", err)
+	}
+
+	//the contact that rotated its key is alice for this database.
+	db, err := app.NewDatabase(t.TempDir(), me, dataKey)
+	if err != nil {
+		t.Fatalf("Should be able to create a database: %s", err)
+	}
+
+	archive := `{
+		"version": 1,
+		"account": "` + me.Hex() + `",
+		"conversations": [{
+			"contact": "` + m.From.Hex() + `",
+			"name": "alice",
+			"messages": [
+				{"sender": "alice", "text": "hello", "timestamp": "2025-03-01T10:00:00Z"}
+			]
+		}]
+	}`
+
+	if _, err := db.Import(strings.NewReader(archive)); err != nil {
+		t.Fatalf("Should be able to import the history: %s", err)
+	}
+
+	forged := m
+	forged.To = bob
+	if _, err := db.MigrateContact(forged, 1); err == nil {
+		t.Fatal("Should not accept a statement that was changed")
+	}
+
+	forged = m
+	forged.Key = old.RSAPublicKey
+	if _, err := db.MigrateContact(forged, 1); err == nil {
+		t.Fatal("Should not accept a statement with another key")
+	}
+
+	usr, err := db.MigrateContact(m, 1)
+	if err != nil {
+		t.Fatalf("Should be able to migrate the contact: %s", err)
+	}
+
+	if usr.ID != m.To || usr.Name != "alice" || usr.IncomingNonce != 1 || string(usr.Key) != m.Key {
+		t.Fatalf("Should move alice to %s, got %+v", m.To, usr)
+	}
+
+	if _, err := db.LookupContact(m.From); err == nil {
+		t.Fatal("Should remove the old address")
+	}
+
+	msgs, _, err := db.History(m.To, -1, 10)
+	if err != nil {
+		t.Fatalf("Should be able to read the history: %s", err)
+	}
+
+	if len(msgs) != 1 || string(msgs[0].Text) != "hello" {
+		t.Fatalf("Should move the history, got %d messages", len(msgs))
+	}
+
+	results, err := db.Search(app.SearchQuery{Text: "hello"})
+	if err != nil {
+		t.Fatalf("Should be able to search: %s", err)
+	}
+
+	if len(results) != 1 || results[0].Contact != m.To {
+		t.Fatalf("Should find the message at the new address, got %d results", len(results))
+	}
+}
+
+func Test_MigrateContactResume(t *testing.T) {
+	passphrase := []byte("correct horse")
+	dir := t.TempDir()
+
+	if _, err := app.NewID(dir, passphrase); err != nil {
+		t.Fatalf("Should be able to create an identity: %s", err)
+	}
+
+	mnemonic, err := app.NewMnemonic()
+	if err != nil {
+		t.Fatalf("Should be able to create a recovery phrase: %s", err)
+	}
+
+	m, err := app.RotateID(dir, passphrase, mnemonic)
+	if err != nil {
+		t.Fatalf("Should be able to rotate the identity: %s", err)
+	}
+
+	db, err := app.NewDatabase(t.TempDir(), me, dataKey)
+	if err != nil {
+		t.Fatalf("Should be able to create a database: %s", err)
+	}
+
+	if _, err := db.AddContact(m.From, "alice"); err != nil {
+		t.Fatalf("Should be able to add a contact: %s", err)
+	}
+
+	//another contact already has the new address.
+	if _, err := db.AddContact(m.To, "mallory"); err != nil {
+		t.Fatalf("Should be able to add a contact: %s", err)
+	}
+
+	if _, err := db.MigrateContact(m, 1); err == nil {
+		t.Fatal("Should not move a contact over another one")
+	}
+
+	if err := db.RemoveContact(m.To, true); err != nil {
+		t.Fatalf("Should be able to remove a contact: %s", err)
+	}
+
+	//a crash left the new contact saved and the old one behind.
+	if _, err := db.AddContact(m.To, "alice"); err != nil {
+		t.Fatalf("Should be able to add a contact: %s", err)
+	}
+
+	if _, err := db.PinContactKey(m.To, []byte(m.Key)); err != nil {
+		t.Fatalf("Should be able to pin the key: %s", err)
+	}
+
+	usr, err := db.MigrateContact(m, 2)
+	if err != nil {
+		t.Fatalf("Should finish an interrupted move: %s", err)
+	}
+
+	if usr.ID != m.To || usr.Name != "alice" {
+		t.Fatalf("Should keep alice at %s, got %+v", m.To, usr)
+	}
+
+	if _, err := db.LookupContact(m.From); err == nil {
+		t.Fatal("Should remove the old address")
+	}
+}
@@ -0,0 +1,86 @@
+package app
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+const (
+	safetyVersion    = 0
+	safetyIterations = 5200
+)
+
+// safetyNumber returns the 60 digit number both sides of a conversation can
+// compare, it is the same no matter which side computes it.
+func safetyNumber(myID common.Address, myKey []byte, theirID common.Address, theirKey []byte) string {
+	mine := fingerprintDigits(myID, myKey)
+	theirs := fingerprintDigits(theirID, theirKey)
+
+	if bytes.Compare(myID.Bytes(), theirID.Bytes()) > 0 {
+		mine, theirs = theirs, mine
+	}
+
+	groups := append(mine, theirs...)
+
+	var b strings.Builder
+	for i, g := range groups {
+		switch {
+		case i == 0:
+		case i%4 == 0:
+			b.WriteString("\n")
+		default:
+			b.WriteString(" ")
+		}
+		b.WriteString(g)
+	}
+
+	return b.String()
+}
+
+// fingerprintDigits turns an identity into six groups of five digits.
+func fingerprintDigits(id common.Address, key []byte) []string {
+	hash := make([]byte, 0, sha512.Size)
+	hash = binary.BigEndian.AppendUint16(hash, safetyVersion)
+	hash = append(hash, key...)
+	hash = append(hash, id.Bytes()...)
+
+	for range safetyIterations {
+		sum := sha512.Sum512(append(hash, key...))
+		hash = sum[:]
+	}
+
+	groups := make([]string, 6)
+	for i := range groups {
+		chunk := hash[i*5 : i*5+5]
+		var n uint64
+		for _, b := range chunk {
+			n = n<<8 | uint64(b)
+		}
+		groups[i] = fmt.Sprintf("%05d", n%100000)
+	}
+
+	return groups
+}
+
+// keyFingerprint is a short human-readable digest of an encryption key.
+func keyFingerprint(key []byte) string {
+	sum := sha256.Sum256(key)
+	return groupFingerprint(strings.ToUpper(hex.EncodeToString(sum[:16])))
+}
+
+// groupFingerprint splits the hex digits of a fingerprint in groups of four.
+func groupFingerprint(h string) string {
+	parts := make([]string, 0, len(h)/4)
+	for i := 0; i < len(h); i += 4 {
+		parts = append(parts, h[i:i+4])
+	}
+
+	return strings.Join(parts, " ")
+}
@@ -0,0 +1,561 @@
+package app
+
+import (
+	"bytes"
+	"cmp"
+	"crypto/hkdf"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// The search index is an inverted index split into buckets, a term goes into
+// the bucket named by the first byte of its HMAC under a key derived from the
+// data key. A bucket is an append-only file of sealed postings, so the index
+// does not reveal more about the messages than the histories do. It is
+// derived data, a crash may lose the last postings and they are indexed again
+// from the histories when the database is opened.
+
+const (
+	searchDir   = "index"
+	searchState = "state"
+	searchInfo  = "echo-search-index"
+
+	minTermLength = 2
+	maxTermLength = 64
+
+	// stateInterval is the number of messages indexed between writes of the
+	// state, at most that many are indexed again after a crash.
+	stateInterval = 100
+
+	defaultSearchLimit = 100
+)
+
+// SearchQuery finds the messages containing every word of Text.
+type SearchQuery struct {
+	Text string
+	// Contacts limits the search to these contacts, all when empty.
+	Contacts []common.Address
+	// From and To limit the time of the messages, a zero time is open.
+	From  time.Time
+	To    time.Time
+	Limit int
+}
+
+// SearchResult is a message found by Search, Position is the position of the
+// message in the history of Contact.
+type SearchResult struct {
+	Contact  common.Address
+	Position int
+	Message  message
+}
+
+type posting struct {
+	ID        common.Address `json:"id"`
+	Position  int            `json:"pos"`
+	Timestamp int64          `json:"ts"`
+	Terms     []string       `json:"terms"`
+}
+
+type searchIndex struct {
+	dir     string
+	vault   *vault
+	key     []byte
+	indexed map[common.Address]int
+	pending int
+}
+
+func newSearchIndex(dir string, v *vault, dataKey []byte) (*searchIndex, error) {
+	dir = filepath.Join(dir, searchDir)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("mkdirAll: %w", err)
+	}
+
+	key, err := hkdf.Key(sha256.New, dataKey, nil, searchInfo, 32)
+	if err != nil {
+		return nil, fmt.Errorf("hkdf: %w", err)
+	}
+
+	idx := searchIndex{
+		dir:     dir,
+		vault:   v,
+		key:     key,
+		indexed: make(map[common.Address]int),
+	}
+
+	buckets, err := filepath.Glob(filepath.Join(dir, "*.idx"))
+	if err != nil {
+		return nil, fmt.Errorf("glob: %w", err)
+	}
+
+	for _, filename := range buckets {
+		if err := repairTail(filename); err != nil {
+			return nil, fmt.Errorf("repair %s: %w", filename, err)
+		}
+	}
+
+	if err := idx.loadState(); err != nil {
+		return nil, err
+	}
+
+	return &idx, nil
+}
+
+// add indexes the message at pos of the history with id.
+func (s *searchIndex) add(id common.Address, pos int, msg message) error {
+	buckets := make(map[string][]string)
+	for _, term := range tokenize(string(msg.Text)) {
+		bucket := s.bucket(term)
+		buckets[bucket] = append(buckets[bucket], term)
+	}
+
+	for bucket, terms := range buckets {
+		p := posting{
+			ID:        id,
+			Position:  pos,
+			Timestamp: msg.Timestamp.Unix(),
+			Terms:     terms,
+		}
+
+		if err := s.appendPosting(bucket, p); err != nil {
+			return err
+		}
+	}
+
+	s.indexed[id] = max(s.indexed[id], pos+1)
+
+	s.pending++
+	if s.pending >= stateInterval {
+		return s.saveState()
+	}
+
+	return nil
+}
+
+// remove drops the postings of the history with id from every bucket, so a
+// deleted history leaves no terms behind.
+func (s *searchIndex) remove(id common.Address) error {
+	buckets, err := filepath.Glob(filepath.Join(s.dir, "*.idx"))
+	if err != nil {
+		return fmt.Errorf("glob: %w", err)
+	}
+
+	for _, filename := range buckets {
+		if err := s.removeFromBucket(filename, id); err != nil {
+			return fmt.Errorf("remove from %s: %w", filepath.Base(filename), err)
+		}
+	}
+
+	delete(s.indexed, id)
+	return s.saveState()
+}
+
+func (s *searchIndex) removeFromBucket(filename string, id common.Address) error {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return fmt.Errorf("read bucket: %w", err)
+	}
+
+	bucket := filepath.Base(filename)
+
+	var kept bytes.Buffer
+	var removed bool
+	for line := range bytes.Lines(data) {
+		record := bytes.TrimSpace(line)
+		if len(record) == 0 {
+			continue
+		}
+
+		jsn, err := s.vault.open(bucket, record)
+		if err != nil {
+			return fmt.Errorf("open posting: %w", err)
+		}
+
+		var p posting
+		if err := json.Unmarshal(jsn, &p); err != nil {
+			return fmt.Errorf("unmarshal posting: %w", err)
+		}
+
+		if p.ID == id {
+			removed = true
+			continue
+		}
+
+		kept.Write(record)
+		kept.WriteByte('\n')
+	}
+
+	switch {
+	case !removed:
+		return nil
+	case kept.Len() == 0:
+		if err := os.Remove(filename); err != nil {
+			return fmt.Errorf("remove bucket: %w", err)
+		}
+		return nil
+	}
+
+	return writeFileAtomic(filename, kept.Bytes())
+}
+
+// search returns the postings of the messages containing every term, newest
+// first.
+func (s *searchIndex) search(terms []string, q SearchQuery) ([]posting, error) {
+	type key struct {
+		id  common.Address
+		pos int
+	}
+
+	var found map[key]posting
+	loaded := make(map[string][]posting)
+
+	for _, term := range terms {
+		bucket := s.bucket(term)
+
+		postings, ok := loaded[bucket]
+		if !ok {
+			var err error
+			postings, err = s.readBucket(bucket)
+			if err != nil {
+				return nil, err
+			}
+			loaded[bucket] = postings
+		}
+
+		matches := make(map[key]posting)
+		for _, p := range postings {
+			if !slices.Contains(p.Terms, term) || !q.matches(p) {
+				continue
+			}
+
+			k := key{id: p.ID, pos: p.Position}
+			if _, ok := found[k]; found == nil || ok {
+				matches[k] = p
+			}
+		}
+
+		found = matches
+		if len(found) == 0 {
+			return nil, nil
+		}
+	}
+
+	results := make([]posting, 0, len(found))
+	for _, p := range found {
+		results = append(results, p)
+	}
+
+	slices.SortFunc(results, func(a, b posting) int {
+		if c := cmp.Compare(b.Timestamp, a.Timestamp); c != 0 {
+			return c
+		}
+		return cmp.Compare(b.Position, a.Position)
+	})
+
+	return results, nil
+}
+
+func (q SearchQuery) matches(p posting) bool {
+	if len(q.Contacts) != 0 && !slices.Contains(q.Contacts, p.ID) {
+		return false
+	}
+
+	if !q.From.IsZero() && p.Timestamp < q.From.Unix() {
+		return false
+	}
+
+	if !q.To.IsZero() && p.Timestamp > q.To.Unix() {
+		return false
+	}
+
+	return true
+}
+
+// =============================================================================
+
+// Search finds the messages containing every word of q.Text, newest first.
+func (db *Database) Search(q SearchQuery) ([]SearchResult, error) {
+	terms := tokenize(q.Text)
+	if len(terms) == 0 {
+		return nil, errors.New("nothing to search for")
+	}
+
+	if q.Limit <= 0 {
+		q.Limit = defaultSearchLimit
+	}
+
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	if db.search == nil {
+		return nil, errors.New("no search index")
+	}
+
+	postings, err := db.search.search(terms, q)
+	if err != nil {
+		return nil, fmt.Errorf("search: %w", err)
+	}
+
+	results := make([]SearchResult, 0, min(len(postings), q.Limit))
+	for _, p := range postings {
+		if len(results) == q.Limit {
+			break
+		}
+
+		if _, ok := db.contacts[p.ID]; !ok {
+			continue
+		}
+
+		msgs, start, err := db.store.LoadHistoryPage(p.ID, p.Position+1, 1)
+		if err != nil {
+			return nil, fmt.Errorf("loadHistoryPage: %w", err)
+		}
+
+		//postings of messages lost in a crash may point past the history or
+		//at a newer message stored in their place.
+		if len(msgs) != 1 || start != p.Position {
+			continue
+		}
+
+		words := tokenize(string(msgs[0].Text))
+		missing := slices.ContainsFunc(terms, func(term string) bool {
+			return !slices.Contains(words, term)
+		})
+		if missing {
+			continue
+		}
+
+		results = append(results, SearchResult{
+			Contact:  p.ID,
+			Position: p.Position,
+			Message:  msgs[0],
+		})
+	}
+
+	return results, nil
+}
+
+// catchUpIndex indexes the messages that were stored after the index state
+// was last written.
+func (db *Database) catchUpIndex() error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if db.search == nil {
+		return nil
+	}
+
+	var changed bool
+	for id := range db.contacts {
+		indexed, err := db.indexHistory(id)
+		if err != nil {
+			return err
+		}
+		changed = changed || indexed
+	}
+
+	if !changed {
+		return nil
+	}
+
+	return db.search.saveState()
+}
+
+// indexHistory indexes the messages of the history with id that are not
+// indexed yet, the caller must hold the lock.
+func (db *Database) indexHistory(id common.Address) (bool, error) {
+	const batch = 500
+
+	if db.search == nil {
+		return false, nil
+	}
+
+	total, err := db.historyLength(id)
+	if err != nil {
+		return false, err
+	}
+
+	from := db.search.indexed[id]
+	if from == total {
+		return false, nil
+	}
+
+	//a history that lost messages in a crash is indexed from its end.
+	if from > total {
+		db.search.indexed[id] = total
+		return true, nil
+	}
+
+	for from < total {
+		msgs, start, err := db.store.LoadHistoryPage(id, min(from+batch, total), batch)
+		if err != nil {
+			return false, fmt.Errorf("loadHistoryPage: %w", err)
+		}
+
+		for i, msg := range msgs {
+			if err := db.search.add(id, start+i, msg); err != nil {
+				return false, fmt.Errorf("index message: %w", err)
+			}
+		}
+		from = start + len(msgs)
+	}
+
+	return true, nil
+}
+
+// dropIndex removes the postings of the history with id, the caller must
+// hold the lock.
+func (db *Database) dropIndex(id common.Address) error {
+	if db.search == nil {
+		return nil
+	}
+
+	if err := db.search.remove(id); err != nil {
+		return fmt.Errorf("remove postings: %w", err)
+	}
+
+	return nil
+}
+
+// saveIndex writes how far every history is indexed, the caller must hold
+// the lock.
+func (db *Database) saveIndex() error {
+	if db.search == nil {
+		return nil
+	}
+
+	return db.search.saveState()
+}
+
+func (s *searchIndex) bucket(term string) string {
+	m := hmac.New(sha256.New, s.key)
+	m.Write([]byte(term))
+	return hex.EncodeToString(m.Sum(nil)[:1]) + ".idx"
+}
+
+func (s *searchIndex) appendPosting(bucket string, p posting) error {
+	jsn, err := json.Marshal(p)
+	if err != nil {
+		return fmt.Errorf("marshal posting: %w", err)
+	}
+
+	record, err := s.vault.seal(bucket, jsn)
+	if err != nil {
+		return fmt.Errorf("seal posting: %w", err)
+	}
+
+	f, err := os.OpenFile(filepath.Join(s.dir, bucket), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("open bucket: %w", err)
+	}
+	defer f.Close()
+
+	if _, err := f.Write(append(record, '\n')); err != nil {
+		return fmt.Errorf("write bucket: %w", err)
+	}
+
+	return nil
+}
+
+func (s *searchIndex) readBucket(bucket string) ([]posting, error) {
+	data, err := os.ReadFile(filepath.Join(s.dir, bucket))
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("read bucket: %w", err)
+	}
+
+	var postings []posting
+	for line := range bytes.Lines(data) {
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 {
+			continue
+		}
+
+		jsn, err := s.vault.open(bucket, line)
+		if err != nil {
+			return nil, fmt.Errorf("open posting: %w", err)
+		}
+
+		var p posting
+		if err := json.Unmarshal(jsn, &p); err != nil {
+			return nil, fmt.Errorf("unmarshal posting: %w", err)
+		}
+		postings = append(postings, p)
+	}
+
+	return postings, nil
+}
+
+// loadState reads how far every history is indexed.
+func (s *searchIndex) loadState() error {
+	data, err := os.ReadFile(filepath.Join(s.dir, searchState))
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		return fmt.Errorf("read state: %w", err)
+	}
+
+	jsn, err := s.vault.open(searchState, bytes.TrimSpace(data))
+	if err != nil {
+		return fmt.Errorf("open state: %w", err)
+	}
+
+	if err := json.Unmarshal(jsn, &s.indexed); err != nil {
+		return fmt.Errorf("unmarshal state: %w", err)
+	}
+
+	return nil
+}
+
+func (s *searchIndex) saveState() error {
+	jsn, err := json.Marshal(s.indexed)
+	if err != nil {
+		return fmt.Errorf("marshal state: %w", err)
+	}
+
+	record, err := s.vault.seal(searchState, jsn)
+	if err != nil {
+		return fmt.Errorf("seal state: %w", err)
+	}
+
+	if err := writeFileAtomic(filepath.Join(s.dir, searchState), append(record, '\n')); err != nil {
+		return fmt.Errorf("write state: %w", err)
+	}
+
+	s.pending = 0
+	return nil
+}
+
+// tokenize returns the distinct lower case words of text.
+func tokenize(text string) []string {
+	fields := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+
+	terms := make([]string, 0, len(fields))
+	for _, f := range fields {
+		n := utf8.RuneCountInString(f)
+		if n < minTermLength || n > maxTermLength || slices.Contains(terms, f) {
+			continue
+		}
+		terms = append(terms, f)
+	}
+
+	return terms
+}
@@ -0,0 +1,102 @@
+package app_test
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/hamidoujand/echo/cmd/client/app"
+)
+
+func Test_Search(t *testing.T) {
+	dir := copyFixture(t, "v2")
+
+	//the fixture was written without an index, it is built when opened.
+	db, err := app.NewDatabase(dir, me, dataKey)
+	if err != nil {
+		t.Fatalf("Should be able to open the database: %s", err)
+	}
+
+	day := time.Date(2025, 3, 1, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name  string
+		query app.SearchQuery
+		exp   []int
+	}{
+		{name: "word", query: app.SearchQuery{Text: "hello"}, exp: []int{0}},
+		{name: "case", query: app.SearchQuery{Text: "HELLO"}, exp: []int{0}},
+		{name: "all words", query: app.SearchQuery{Text: "hi alice"}, exp: []int{1}},
+		{name: "missing word", query: app.SearchQuery{Text: "hello bob"}},
+		{name: "contact", query: app.SearchQuery{Text: "hello", Contacts: []common.Address{alice}}, exp: []int{0}},
+		{name: "other contact", query: app.SearchQuery{Text: "hello", Contacts: []common.Address{bob}}},
+		{name: "date", query: app.SearchQuery{Text: "hello", From: day, To: day.AddDate(0, 0, 1)}, exp: []int{0}},
+		{name: "after date", query: app.SearchQuery{Text: "hello", From: day.AddDate(0, 0, 1)}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			results, err := db.Search(tt.query)
+			if err != nil {
+				t.Fatalf("Should be able to search: %s", err)
+			}
+
+			if len(results) != len(tt.exp) {
+				t.Fatalf("Should find %d messages, got %d", len(tt.exp), len(results))
+			}
+
+			for i, r := range results {
+				if r.Contact != alice || r.Position != tt.exp[i] {
+					t.Fatalf("Should find message %d of alice, got %d of %s", tt.exp[i], r.Position, r.Contact)
+				}
+			}
+		})
+	}
+
+	//the index is kept on disk and not built again.
+	db, err = app.NewDatabase(dir, me, dataKey)
+	if err != nil {
+		t.Fatalf("Should be able to open the database again: %s", err)
+	}
+
+	results, err := db.Search(app.SearchQuery{Text: "hello"})
+	if err != nil {
+		t.Fatalf("Should be able to search: %s", err)
+	}
+
+	if len(results) != 1 {
+		t.Fatalf("Should find the message once, got %d", len(results))
+	}
+}
+
+func Test_SearchRemoveHistory(t *testing.T) {
+	dir := copyFixture(t, "v2")
+
+	db, err := app.NewDatabase(dir, me, dataKey)
+	if err != nil {
+		t.Fatalf("Should be able to open the database: %s", err)
+	}
+
+	if buckets, _ := filepath.Glob(filepath.Join(dir, "index", "*.idx")); len(buckets) == 0 {
+		t.Fatal("Should index the history of alice")
+	}
+
+	if err := db.RemoveContact(alice, true); err != nil {
+		t.Fatalf("Should be able to remove alice with her history: %s", err)
+	}
+
+	//alice is the only contact with messages.
+	if buckets, _ := filepath.Glob(filepath.Join(dir, "index", "*.idx")); len(buckets) != 0 {
+		t.Fatalf("Should not leave the postings of a deleted history, got %d buckets", len(buckets))
+	}
+
+	if _, err := db.AddContact(alice, "alice"); err != nil {
+		t.Fatalf("Should be able to add alice again: %s", err)
+	}
+
+	results, err := db.Search(app.SearchQuery{Text: "hello"})
+	if err != nil || len(results) != 0 {
+		t.Fatalf("Should not find deleted messages, got %d: %v", len(results), err)
+	}
+}
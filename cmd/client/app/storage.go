@@ -0,0 +1,266 @@
+package app
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+const contactsDir = "contacts"
+
+// storage is where the database keeps its state. Every write must be atomic
+// and durable once it returns, the database keeps its own in-memory copy.
+type storage interface {
+	// LoadAccount returns false when there is no account yet.
+	LoadAccount() (account, bool, error)
+	SaveAccount(acc account) error
+	LoadContacts() ([]contact, error)
+	SaveContact(c contact) error
+	RemoveContact(id common.Address) error
+	LoadHistory(id common.Address) ([]message, error)
+	// LoadHistoryPage returns up to limit messages that come before position
+	// before, the newest when before is negative, and the position of the
+	// first message returned.
+	LoadHistoryPage(id common.Address, before int, limit int) ([]message, int, error)
+	AppendHistory(id common.Address, msg message) error
+	// ReplaceHistory replaces the whole history with id by msgs.
+	ReplaceHistory(id common.Address, msgs []message) error
+	// RemoveHistory deletes the whole history with id.
+	RemoveHistory(id common.Address) error
+	// Recover cleans up after a crash, it runs before anything is loaded.
+	Recover() error
+}
+
+// fileStorage keeps the account in data.json, one file per contact and an
+// append-only history per contact, every record is sealed by the vault.
+// Files are replaced with a rename after an fsync, so a crash leaves either
+// the old or the new version behind.
+type fileStorage struct {
+	dir   string
+	vault *vault
+}
+
+func newFileStorage(dir string, v *vault) (*fileStorage, error) {
+	for _, sub := range []string{contactsDir, chatHistoryDir} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0700); err != nil {
+			return nil, fmt.Errorf("mkdirAll %s: %w", sub, err)
+		}
+	}
+
+	return &fileStorage{dir: dir, vault: v}, nil
+}
+
+func (s *fileStorage) LoadAccount() (account, bool, error) {
+	var acc account
+	err := s.readRecord(filepath.Join(s.dir, dbFilename), &acc)
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		return account{}, false, nil
+	case err != nil:
+		return account{}, false, err
+	}
+
+	return acc, true, nil
+}
+
+func (s *fileStorage) SaveAccount(acc account) error {
+	return s.writeRecord(filepath.Join(s.dir, dbFilename), acc)
+}
+
+func (s *fileStorage) LoadContacts() ([]contact, error) {
+	files, err := filepath.Glob(filepath.Join(s.dir, contactsDir, "*.json"))
+	if err != nil {
+		return nil, fmt.Errorf("glob: %w", err)
+	}
+
+	contacts := make([]contact, 0, len(files))
+	for _, filename := range files {
+		var c contact
+		if err := s.readRecord(filename, &c); err != nil {
+			return nil, err
+		}
+		contacts = append(contacts, c)
+	}
+
+	return contacts, nil
+}
+
+func (s *fileStorage) SaveContact(c contact) error {
+	return s.writeRecord(s.contactFile(c.ID), c)
+}
+
+func (s *fileStorage) RemoveContact(id common.Address) error {
+	if err := os.Remove(s.contactFile(id)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("remove: %w", err)
+	}
+
+	return syncDir(filepath.Join(s.dir, contactsDir))
+}
+
+// Recover removes the temporary files of writes that never finished, cuts
+// torn lines off the histories, fixes their indexes and makes sure every file
+// can be read.
+func (s *fileStorage) Recover() error {
+	for _, sub := range []string{"", contactsDir, chatHistoryDir} {
+		temps, err := filepath.Glob(filepath.Join(s.dir, sub, "*.tmp"))
+		if err != nil {
+			return fmt.Errorf("glob: %w", err)
+		}
+
+		for _, tmp := range temps {
+			if err := os.Remove(tmp); err != nil {
+				return fmt.Errorf("remove %s: %w", tmp, err)
+			}
+		}
+	}
+
+	if err := s.recoverRotations(); err != nil {
+		return fmt.Errorf("recoverRotations: %w", err)
+	}
+
+	if err := s.recoverReplaces(); err != nil {
+		return fmt.Errorf("recoverReplaces: %w", err)
+	}
+
+	histories, err := filepath.Glob(filepath.Join(s.dir, chatHistoryDir, "*.msg"))
+	if err != nil {
+		return fmt.Errorf("glob: %w", err)
+	}
+
+	for _, filename := range histories {
+		if err := repairTail(filename); err != nil {
+			return fmt.Errorf("repair %s: %w", filename, err)
+		}
+
+		//an index that fell behind the history is rebuilt here.
+		if _, err := s.loadSegment(filename); err != nil {
+			return fmt.Errorf("index %s: %w", filename, err)
+		}
+	}
+
+	var corrupted []string
+
+	if _, _, err := s.LoadAccount(); err != nil {
+		corrupted = append(corrupted, fmt.Sprintf("%s: %s", dbFilename, err))
+	}
+
+	contacts, err := filepath.Glob(filepath.Join(s.dir, contactsDir, "*.json"))
+	if err != nil {
+		return fmt.Errorf("glob: %w", err)
+	}
+
+	for _, filename := range contacts {
+		var c contact
+		if err := s.readRecord(filename, &c); err != nil {
+			corrupted = append(corrupted, fmt.Sprintf("%s: %s", filepath.Base(filename), err))
+		}
+	}
+
+	if len(corrupted) != 0 {
+		return fmt.Errorf("database is corrupted, restore it from a backup:\n%s", strings.Join(corrupted, "\n"))
+	}
+
+	return nil
+}
+
+// =============================================================================
+
+func (s *fileStorage) contactFile(id common.Address) string {
+	return filepath.Join(s.dir, contactsDir, id.Hex()+".json")
+}
+
+func (s *fileStorage) historyFile(id common.Address) string {
+	return filepath.Join(s.dir, chatHistoryDir, id.Hex()+".msg")
+}
+
+func (s *fileStorage) readRecord(filename string, v any) error {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return fmt.Errorf("read file %s: %w", filename, err)
+	}
+
+	jsn, err := s.vault.open(recordName(filename), bytes.TrimSpace(data))
+	if err != nil {
+		return fmt.Errorf("open %s: %w", filename, err)
+	}
+
+	if err := json.Unmarshal(jsn, v); err != nil {
+		return fmt.Errorf("decode %s: %w", filename, err)
+	}
+
+	return nil
+}
+
+func (s *fileStorage) writeRecord(filename string, v any) error {
+	jsn, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("encode %s: %w", filename, err)
+	}
+
+	record, err := s.vault.seal(recordName(filename), jsn)
+	if err != nil {
+		return fmt.Errorf("seal %s: %w", filename, err)
+	}
+
+	return writeFileAtomic(filename, append(record, '\n'))
+}
+
+// writeFileAtomic replaces filename with data, the file is synced before the
+// rename and the directory after it.
+func writeFileAtomic(filename string, data []byte) error {
+	dir := filepath.Dir(filename)
+
+	tmp, err := os.CreateTemp(dir, filepath.Base(filename)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("create temp file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if err := tmp.Chmod(0600); err != nil {
+		tmp.Close()
+		return fmt.Errorf("chmod: %w", err)
+	}
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("write: %w", err)
+	}
+
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("sync: %w", err)
+	}
+
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("close: %w", err)
+	}
+
+	if err := os.Rename(tmp.Name(), filename); err != nil {
+		return fmt.Errorf("rename: %w", err)
+	}
+
+	return syncDir(dir)
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return fmt.Errorf("open dir: %w", err)
+	}
+	defer d.Close()
+
+	//windows can not sync a directory, the rename is durable there anyway.
+	if err := d.Sync(); err != nil && runtime.GOOS != "windows" {
+		return fmt.Errorf("sync dir: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,76 @@
+package app_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hamidoujand/echo/cmd/client/app"
+)
+
+func Test_RecoverPartialWrite(t *testing.T) {
+	dir := copyFixture(t, "v2")
+
+	db, err := app.NewDatabase(dir, me, dataKey)
+	if err != nil {
+		t.Fatalf("Should be able to open the database: %s", err)
+	}
+
+	if err := db.UpdateIncomingNonce(alice, 6); err != nil {
+		t.Fatalf("Should be able to update a contact: %s", err)
+	}
+
+	//the client stopped half way through writing the next versions.
+	for _, name := range []string{"data.json", filepath.Join("contacts", alice.Hex()+".json")} {
+		filename := filepath.Join(dir, name)
+
+		data, err := os.ReadFile(filename)
+		if err != nil {
+			t.Fatalf("Should be able to read %s: %s", name, err)
+		}
+
+		if err := os.WriteFile(filename+".1234.tmp", data[:len(data)/2], 0600); err != nil {
+			t.Fatalf("Should be able to write a temp file: %s", err)
+		}
+	}
+
+	history := filepath.Join(dir, "messages", alice.Hex()+".msg")
+	f, err := os.OpenFile(history, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatalf("Should be able to open the history: %s", err)
+	}
+
+	if _, err := f.WriteString("dG9ybiBsaW5"); err != nil {
+		t.Fatalf("Should be able to write a torn line: %s", err)
+	}
+	f.Close()
+
+	db, err = app.NewDatabase(dir, me, dataKey)
+	if err != nil {
+		t.Fatalf("Should be able to open the database after a crash: %s", err)
+	}
+
+	usr, err := db.LookupContact(alice)
+	if err != nil || usr.IncomingNonce != 6 {
+		t.Fatalf("Should keep the last write that finished, got nonce %d: %v", usr.IncomingNonce, err)
+	}
+
+	msgs, _, err := db.History(alice, -1, 10)
+	if err != nil || len(msgs) != 2 {
+		t.Fatalf("Should keep the messages before the torn line, got %d: %v", len(msgs), err)
+	}
+
+	temps, err := filepath.Glob(filepath.Join(dir, "*", "*.tmp"))
+	if err != nil {
+		t.Fatalf("Should be able to list the temp files: %s", err)
+	}
+
+	more, err := filepath.Glob(filepath.Join(dir, "*.tmp"))
+	if err != nil {
+		t.Fatalf("Should be able to list the temp files: %s", err)
+	}
+
+	if left := append(temps, more...); len(left) != 0 {
+		t.Fatalf("Should remove the temp files, got %v", left)
+	}
+}
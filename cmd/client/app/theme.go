@@ -0,0 +1,40 @@
+package app
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+
+	"github.com/gdamore/tcell/v2"
+	"github.com/rivo/tview"
+)
+
+// themes are the color themes of the UI, dark is the default of tview.
+var themes = map[string]tview.Theme{
+	"dark": tview.Styles,
+	"light": {
+		PrimitiveBackgroundColor:    tcell.ColorWhite,
+		ContrastBackgroundColor:     tcell.ColorLightGray,
+		MoreContrastBackgroundColor: tcell.ColorSilver,
+		BorderColor:                 tcell.ColorBlack,
+		TitleColor:                  tcell.ColorBlack,
+		GraphicsColor:               tcell.ColorBlack,
+		PrimaryTextColor:            tcell.ColorBlack,
+		SecondaryTextColor:          tcell.ColorNavy,
+		TertiaryTextColor:           tcell.ColorDarkGreen,
+		InverseTextColor:            tcell.ColorWhite,
+		ContrastSecondaryTextColor:  tcell.ColorDarkSlateGray,
+	},
+}
+
+// SetTheme selects the color theme, it must be called before New.
+func SetTheme(name string) error {
+	theme, ok := themes[strings.ToLower(name)]
+	if !ok {
+		return fmt.Errorf("unknown theme %q, use one of %s", name, strings.Join(slices.Sorted(maps.Keys(themes)), ", "))
+	}
+
+	tview.Styles = theme
+	return nil
+}
@@ -0,0 +1,280 @@
+package app
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// The database is stored as lines of base64, every line is a record sealed
+// with AES-256-GCM under the data key. The data key is random and sealed with
+// the passphrase like the private keys, so changing the passphrase does not
+// rewrite the database.
+
+const dataKeyFilename = "data.key"
+
+// wipeSuffix marks plaintext files that were replaced and still need to be
+// wiped, they are picked up again if the client stops half way.
+const wipeSuffix = ".wipe"
+
+type vault struct {
+	aead cipher.AEAD
+}
+
+func newVault(key []byte) (*vault, error) {
+	if len(key) != 32 {
+		return nil, fmt.Errorf("data key must be 32 bytes, got %d", len(key))
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("new cipher: %w", err)
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("new gcm: %w", err)
+	}
+
+	return &vault{aead: aead}, nil
+}
+
+// seal encrypts a record of the file called name, the name is authenticated
+// so records can not be moved between files.
+func (v *vault) seal(name string, plaintext []byte) ([]byte, error) {
+	nonce := make([]byte, v.aead.NonceSize(), v.aead.NonceSize()+len(plaintext)+v.aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("generating nonce: %w", err)
+	}
+
+	sealed := v.aead.Seal(nonce, nonce, plaintext, []byte(name))
+
+	out := make([]byte, base64.StdEncoding.EncodedLen(len(sealed)))
+	base64.StdEncoding.Encode(out, sealed)
+	return out, nil
+}
+
+func (v *vault) open(name string, record []byte) ([]byte, error) {
+	sealed := make([]byte, base64.StdEncoding.DecodedLen(len(record)))
+	n, err := base64.StdEncoding.Decode(sealed, record)
+	if err != nil {
+		return nil, fmt.Errorf("decoding record: %w", err)
+	}
+	sealed = sealed[:n]
+
+	if len(sealed) < v.aead.NonceSize() {
+		return nil, errors.New("record is too short")
+	}
+
+	nonce, ciphertext := sealed[:v.aead.NonceSize()], sealed[v.aead.NonceSize():]
+	plaintext, err := v.aead.Open(nil, nonce, ciphertext, []byte(name))
+	if err != nil {
+		return nil, errors.New("record can not be decrypted, wrong key or corrupted file")
+	}
+
+	return plaintext, nil
+}
+
+// LoadDataKey returns the key the database is encrypted with, it is created
+// on first use and sealed with passphrase.
+func LoadDataKey(confDir string, passphrase []byte) ([]byte, error) {
+	if err := os.MkdirAll(filepath.Join(confDir, "id"), 0700); err != nil {
+		return nil, fmt.Errorf("mkdirAll: %w", err)
+	}
+
+	if err := recoverKeys(confDir); err != nil {
+		return nil, fmt.Errorf("recoverKeys: %w", err)
+	}
+
+	filename := filepath.Join(confDir, "id", dataKeyFilename)
+	key, err := loadKey(filename, passphrase, func() ([]byte, error) {
+		key := make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			return nil, fmt.Errorf("generating data key: %w", err)
+		}
+		return key, nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("loadKey %s: %w", dataKeyFilename, err)
+	}
+
+	return key, nil
+}
+
+// =============================================================================
+
+// isPlaintext tells the JSON written by older clients apart from sealed
+// records, base64 never starts with a brace.
+func isPlaintext(data []byte) bool {
+	return bytes.HasPrefix(bytes.TrimSpace(data), []byte("{"))
+}
+
+// recoverSealing finishes a sealPlaintext that was interrupted, it has to run
+// before the schema version is detected.
+func recoverSealing(dir string) error {
+	var leftovers []string
+	for _, pattern := range []string{filepath.Join(dir, "*"+wipeSuffix), filepath.Join(dir, chatHistoryDir, "*"+wipeSuffix)} {
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return fmt.Errorf("glob: %w", err)
+		}
+		leftovers = append(leftovers, matches...)
+	}
+
+	for _, filename := range leftovers {
+		original := strings.TrimSuffix(filename, wipeSuffix)
+
+		//the sealed copy never made it, migrate the plaintext again.
+		if _, err := os.Stat(original); errors.Is(err, fs.ErrNotExist) {
+			if err := os.Rename(filename, original); err != nil {
+				return fmt.Errorf("rename: %w", err)
+			}
+			continue
+		}
+
+		if err := wipeFile(filename); err != nil {
+			return fmt.Errorf("wipe %s: %w", filename, err)
+		}
+	}
+
+	return nil
+}
+
+// sealPlaintext seals the files written by older clients and wipes the
+// plaintext copies.
+func sealPlaintext(dir string, v *vault) error {
+	var files []string
+
+	if _, err := os.Stat(filepath.Join(dir, dbFilename)); err == nil {
+		files = append(files, filepath.Join(dir, dbFilename))
+	}
+
+	histories, err := filepath.Glob(filepath.Join(dir, chatHistoryDir, "*.msg"))
+	if err != nil {
+		return fmt.Errorf("glob: %w", err)
+	}
+	files = append(files, histories...)
+
+	for _, filename := range files {
+		if err := migrateFile(filename, v); err != nil {
+			return fmt.Errorf("migrate %s: %w", filename, err)
+		}
+	}
+
+	return nil
+}
+
+func migrateFile(filename string, v *vault) error {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return fmt.Errorf("read: %w", err)
+	}
+
+	if !isPlaintext(data) {
+		return nil
+	}
+
+	name := recordName(filename)
+
+	//the account is a single document, the history is one message per line.
+	records := [][]byte{bytes.TrimSpace(data)}
+	if name != dbFilename {
+		records = bytes.Split(data, []byte("\n"))
+	}
+
+	var out bytes.Buffer
+	for _, record := range records {
+		record = bytes.TrimSpace(record)
+		if len(record) == 0 {
+			continue
+		}
+
+		sealed, err := v.seal(name, record)
+		if err != nil {
+			return err
+		}
+		out.Write(sealed)
+		out.WriteByte('\n')
+	}
+
+	//keep the plaintext around until the sealed copy is in place.
+	tmp := filename + ".tmp"
+	if err := writeSynced(tmp, out.Bytes()); err != nil {
+		return err
+	}
+
+	if err := os.Rename(filename, filename+wipeSuffix); err != nil {
+		return fmt.Errorf("rename: %w", err)
+	}
+
+	if err := os.Rename(tmp, filename); err != nil {
+		return fmt.Errorf("rename: %w", err)
+	}
+
+	return wipeFile(filename + wipeSuffix)
+}
+
+// wipeFile overwrites filename with random bytes before removing it. This is
+// best effort, journaling and copy-on-write file systems or SSDs may keep
+// old blocks around.
+func wipeFile(filename string) error {
+	f, err := os.OpenFile(filename, os.O_WRONLY, 0)
+	if err != nil {
+		return fmt.Errorf("open: %w", err)
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("stat: %w", err)
+	}
+
+	if _, err := io.CopyN(f, rand.Reader, info.Size()); err != nil {
+		f.Close()
+		return fmt.Errorf("overwrite: %w", err)
+	}
+
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return fmt.Errorf("sync: %w", err)
+	}
+
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("close: %w", err)
+	}
+
+	return os.Remove(filename)
+}
+
+func writeSynced(filename string, data []byte) error {
+	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return fmt.Errorf("open: %w", err)
+	}
+
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return fmt.Errorf("write: %w", err)
+	}
+
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return fmt.Errorf("sync: %w", err)
+	}
+
+	return f.Close()
+}
+
+// recordName is the name records of filename are sealed with.
+func recordName(filename string) string {
+	return filepath.Base(filename)
+}
@@ -0,0 +1,102 @@
+package app_test
+
+import (
+	"bytes"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hamidoujand/echo/cmd/client/app"
+)
+
+func Test_Vault(t *testing.T) {
+	record := []byte(`{"name":"alice","text":"hello"}`)
+
+	sealed, err := app.SealRecord(dataKey, "alice.msg", record)
+	if err != nil {
+		t.Fatalf("Should be able to seal a record: %s", err)
+	}
+
+	if bytes.Contains(sealed, []byte("alice")) || bytes.ContainsAny(sealed, "\n{") {
+		t.Fatalf("Should write the record as a single line of base64, got %q", sealed)
+	}
+
+	got, err := app.OpenRecord(dataKey, "alice.msg", sealed)
+	if err != nil {
+		t.Fatalf("Should be able to open a record: %s", err)
+	}
+
+	if !bytes.Equal(got, record) {
+		t.Fatalf("Should get back the record, got %q", got)
+	}
+
+	//the file name is authenticated with the record.
+	if _, err := app.OpenRecord(dataKey, "bob.msg", sealed); err == nil {
+		t.Fatal("Should not open a record moved to another file")
+	}
+
+	wrongKey := bytes.Repeat([]byte{1}, 32)
+	if _, err := app.OpenRecord(wrongKey, "alice.msg", sealed); err == nil {
+		t.Fatal("Should not open a record with the wrong key")
+	}
+
+	sealed[len(sealed)/2] ^= 0x01
+	if _, err := app.OpenRecord(dataKey, "alice.msg", sealed); err == nil {
+		t.Fatal("Should not open a changed record")
+	}
+}
+
+func Test_RecoverSealing(t *testing.T) {
+	t.Run("before the sealed copy", func(t *testing.T) {
+		dir := copyFixture(t, "v0")
+
+		//the client stopped once the plaintext was moved away.
+		filename := filepath.Join(dir, "data.json")
+		if err := os.Rename(filename, filename+".wipe"); err != nil {
+			t.Fatalf("Should be able to move data.json: %s", err)
+		}
+
+		db, err := app.NewDatabase(dir, me, dataKey)
+		if err != nil {
+			t.Fatalf("Should be able to open the database: %s", err)
+		}
+
+		checkDatabase(t, db, false)
+
+		if _, err := os.Stat(filename + ".wipe"); !errors.Is(err, fs.ErrNotExist) {
+			t.Fatalf("Should not leave the plaintext behind: %v", err)
+		}
+	})
+
+	t.Run("after the sealed copy", func(t *testing.T) {
+		dir := copyFixture(t, "v0")
+
+		history := filepath.Join(dir, "messages", alice.Hex()+".msg")
+		plaintext, err := os.ReadFile(history)
+		if err != nil {
+			t.Fatalf("Should be able to read the history: %s", err)
+		}
+
+		if _, err := app.NewDatabase(dir, me, dataKey); err != nil {
+			t.Fatalf("Should be able to migrate the database: %s", err)
+		}
+
+		//the client stopped before the plaintext was wiped.
+		if err := os.WriteFile(history+".wipe", plaintext, 0600); err != nil {
+			t.Fatalf("Should be able to write the plaintext: %s", err)
+		}
+
+		db, err := app.NewDatabase(dir, me, dataKey)
+		if err != nil {
+			t.Fatalf("Should be able to open the database: %s", err)
+		}
+
+		checkDatabase(t, db, false)
+
+		if _, err := os.Stat(history + ".wipe"); !errors.Is(err, fs.ErrNotExist) {
+			t.Fatalf("Should wipe the plaintext: %v", err)
+		}
+	})
+}
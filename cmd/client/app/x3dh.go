@@ -0,0 +1,517 @@
+package app
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/hamidoujand/echo/signature"
+)
+
+// Sessions are started with X3DH, see https://signal.org/docs/specifications/x3dh
+// and then carried on with the double ratchet.
+
+// Schemes tell the receiver how the text of a message is protected.
+const (
+	schemeNone    = "none"
+	schemeRSA     = "rsa"
+	schemeRatchet = "ratchet"
+)
+
+const (
+	// minOneTimePreKeys is when this client uploads a new batch of one-time prekeys.
+	minOneTimePreKeys = 20
+
+	// oneTimePreKeyBatch is how many one-time prekeys are uploaded at once.
+	oneTimePreKeyBatch = 50
+
+	// maxOneTimePreKeys mirrors the server limit.
+	maxOneTimePreKeys = 200
+
+	// signedPreKeyLifetime is how long a signed prekey is published before it
+	// is replaced.
+	signedPreKeyLifetime = 7 * 24 * time.Hour
+
+	x3dhInfo = "echo-x3dh"
+)
+
+var errNoPreKeys = errors.New("contact has not published prekeys")
+
+type preKey struct {
+	KeyID  uint32 `json:"keyID"`
+	Public []byte `json:"public"`
+}
+
+type preKeyBundle struct {
+	ID            common.Address `json:"id"`
+	IdentityKey   []byte         `json:"identityKey"`
+	SignedPreKey  preKey         `json:"signedPreKey"`
+	Timestamp     int64          `json:"timestamp"`
+	V             *big.Int       `json:"v"`
+	R             *big.Int       `json:"r"`
+	S             *big.Int       `json:"s"`
+	OneTimePreKey *preKey        `json:"oneTimePreKey,omitempty"`
+}
+
+func (b preKeyBundle) signedData() any {
+	return struct {
+		ID           common.Address
+		IdentityKey  []byte
+		SignedPreKey preKey
+		Timestamp    int64
+	}{
+		ID:           b.ID,
+		IdentityKey:  b.IdentityKey,
+		SignedPreKey: b.SignedPreKey,
+		Timestamp:    b.Timestamp,
+	}
+}
+
+func (b preKeyBundle) verify(id common.Address) error {
+	if b.ID != id {
+		return fmt.Errorf("bundle belongs to %s", b.ID)
+	}
+
+	if len(b.IdentityKey) != 32 || len(b.SignedPreKey.Public) != 32 {
+		return errors.New("invalid key size")
+	}
+
+	if b.OneTimePreKey != nil && len(b.OneTimePreKey.Public) != 32 {
+		return errors.New("invalid one-time prekey size")
+	}
+
+	if b.V == nil || b.R == nil || b.S == nil {
+		return errors.New("bundle is not signed")
+	}
+
+	from, err := signature.FromAddress(b.signedData(), b.V, b.R, b.S)
+	if err != nil {
+		return fmt.Errorf("fromAddress: %w", err)
+	}
+
+	if from != id.Hex() {
+		return fmt.Errorf("bundle is signed by %s", from)
+	}
+
+	return nil
+}
+
+type preKeyUpload struct {
+	Bundle         preKeyBundle `json:"bundle"`
+	OneTimePreKeys []preKey     `json:"oneTimePreKeys"`
+	Timestamp      int64        `json:"timestamp"`
+	V              *big.Int     `json:"v"`
+	R              *big.Int     `json:"r"`
+	S              *big.Int     `json:"s"`
+}
+
+// sessionInit is attached to every message of a new session until the
+// contact replies, so the contact can run X3DH on any of them.
+type sessionInit struct {
+	Bundle          preKeyBundle `json:"bundle"`
+	EphemeralKey    []byte       `json:"ephemeralKey"`
+	SignedPreKeyID  uint32       `json:"signedPreKeyID"`
+	OneTimePreKeyID *uint32      `json:"oneTimePreKeyID,omitempty"`
+}
+
+type ratchetEnvelope struct {
+	Init       *sessionInit  `json:"init,omitempty"`
+	Header     ratchetHeader `json:"header"`
+	Ciphertext []byte        `json:"ciphertext"`
+}
+
+type session struct {
+	Ratchet ratchetState `json:"ratchet"`
+	// Init is set while the contact has not replied to a session we started.
+	Init *sessionInit `json:"init,omitempty"`
+	// BaseKey is the ephemeral key of the X3DH run that created the session.
+	BaseKey []byte `json:"baseKey"`
+	// Lost is the session the contact started at the same time as this one,
+	// it only reads the messages the contact sent with it.
+	Lost *session `json:"lost,omitempty"`
+}
+
+func (s *session) clone() *session {
+	c := *s
+	c.Ratchet = s.Ratchet.clone()
+	if s.Lost != nil {
+		c.Lost = s.Lost.clone()
+	}
+	return &c
+}
+
+// =============================================================================
+
+// preKeyBundle signs the identity and signed prekey of this client.
+func (c *Client) preKeyBundle() (preKeyBundle, error) {
+	spk, err := c.db.SignedPreKey()
+	if err != nil {
+		return preKeyBundle{}, fmt.Errorf("signedPreKey: %w", err)
+	}
+
+	spkPublic, err := publicKey(spk.Private)
+	if err != nil {
+		return preKeyBundle{}, err
+	}
+
+	b := preKeyBundle{
+		ID:           c.id.Address,
+		IdentityKey:  c.id.DHKey.PublicKey().Bytes(),
+		SignedPreKey: preKey{KeyID: spk.ID, Public: spkPublic},
+		Timestamp:    time.Now().UnixNano(),
+	}
+
+	v, r, s, err := signature.Sign(b.signedData(), c.id.ECDSAKey)
+	if err != nil {
+		return preKeyBundle{}, fmt.Errorf("sign: %w", err)
+	}
+	b.V, b.R, b.S = v, r, s
+
+	return b, nil
+}
+
+// UploadPreKeys publishes the prekey bundle and tops up the one-time prekeys
+// when the server is running low, the signed prekey is rotated first when it
+// is due.
+func (c *Client) UploadPreKeys() error {
+	if _, err := c.db.RotateSignedPreKey(signedPreKeyLifetime); err != nil {
+		return fmt.Errorf("rotateSignedPreKey: %w", err)
+	}
+
+	available, err := c.uploadPreKeys(nil)
+	if err != nil {
+		return err
+	}
+
+	if available >= minOneTimePreKeys {
+		return nil
+	}
+
+	pairs, err := c.db.AddOneTimePreKeys(oneTimePreKeyBatch)
+	if err != nil {
+		return fmt.Errorf("addOneTimePreKeys: %w", err)
+	}
+
+	if _, err := c.uploadPreKeys(pairs); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (c *Client) uploadPreKeys(pairs []preKeyPair) (int, error) {
+	bundle, err := c.preKeyBundle()
+	if err != nil {
+		return 0, err
+	}
+
+	otks := make([]preKey, 0, len(pairs))
+	for _, p := range pairs {
+		pub, err := publicKey(p.Private)
+		if err != nil {
+			return 0, err
+		}
+		otks = append(otks, preKey{KeyID: p.ID, Public: pub})
+	}
+
+	u := preKeyUpload{
+		Bundle:         bundle,
+		OneTimePreKeys: otks,
+		Timestamp:      time.Now().UnixNano(),
+	}
+
+	dataToSign := struct {
+		ID             common.Address
+		OneTimePreKeys []preKey
+		Timestamp      int64
+	}{
+		ID:             c.id.Address,
+		OneTimePreKeys: u.OneTimePreKeys,
+		Timestamp:      u.Timestamp,
+	}
+
+	v, r, s, err := signature.Sign(dataToSign, c.id.ECDSAKey)
+	if err != nil {
+		return 0, fmt.Errorf("sign: %w", err)
+	}
+	u.V, u.R, u.S = v, r, s
+
+	var resp struct {
+		OneTimePreKeys int `json:"oneTimePreKeys"`
+	}
+
+	if err := c.doJSON(http.MethodPost, "/v1/prekeys", u, &resp); err != nil {
+		return 0, fmt.Errorf("upload prekeys: %w", err)
+	}
+
+	return resp.OneTimePreKeys, nil
+}
+
+// fetchPreKeyBundle asks the server for the bundle of id, misses are cached
+// the same way as the key directory.
+func (c *Client) fetchPreKeyBundle(id common.Address) (preKeyBundle, error) {
+	c.keyMu.Lock()
+	last, ok := c.preKeyMisses[id]
+	c.keyMu.Unlock()
+
+	if ok && time.Since(last) < keyRetryInterval {
+		return preKeyBundle{}, errNoPreKeys
+	}
+
+	var b preKeyBundle
+	if err := c.doJSON(http.MethodGet, "/v1/prekeys/"+id.Hex(), nil, &b); err != nil {
+		c.keyMu.Lock()
+		c.preKeyMisses[id] = time.Now()
+		c.keyMu.Unlock()
+		return preKeyBundle{}, fmt.Errorf("%w: %w", errNoPreKeys, err)
+	}
+
+	if err := b.verify(id); err != nil {
+		return preKeyBundle{}, fmt.Errorf("verify: %w", err)
+	}
+
+	return b, nil
+}
+
+// startSession runs X3DH as the initiator against the bundle of id.
+func (c *Client) startSession(id common.Address) (*session, error) {
+	theirs, err := c.fetchPreKeyBundle(id)
+	if err != nil {
+		return nil, err
+	}
+
+	ours, err := c.preKeyBundle()
+	if err != nil {
+		return nil, err
+	}
+
+	ek, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("generating ephemeral key: %w", err)
+	}
+
+	dhs := [][2][]byte{
+		{c.id.DHKey.Bytes(), theirs.SignedPreKey.Public},
+		{ek.Bytes(), theirs.IdentityKey},
+		{ek.Bytes(), theirs.SignedPreKey.Public},
+	}
+
+	init := sessionInit{
+		Bundle:         ours,
+		EphemeralKey:   ek.PublicKey().Bytes(),
+		SignedPreKeyID: theirs.SignedPreKey.KeyID,
+	}
+
+	if theirs.OneTimePreKey != nil {
+		dhs = append(dhs, [2][]byte{ek.Bytes(), theirs.OneTimePreKey.Public})
+		keyID := theirs.OneTimePreKey.KeyID
+		init.OneTimePreKeyID = &keyID
+	}
+
+	sk, err := x3dh(dhs)
+	if err != nil {
+		return nil, err
+	}
+
+	ad := associatedData(ours.IdentityKey, theirs.IdentityKey)
+	rs, err := newInitiatorRatchet(sk, theirs.SignedPreKey.Public, ad)
+	if err != nil {
+		return nil, err
+	}
+
+	s := session{
+		Ratchet: rs,
+		Init:    &init,
+		BaseKey: init.EphemeralKey,
+	}
+
+	return &s, nil
+}
+
+// acceptSession runs X3DH as the responder for an init sent by from.
+func (c *Client) acceptSession(from common.Address, init sessionInit) (*session, error) {
+	if err := init.Bundle.verify(from); err != nil {
+		return nil, fmt.Errorf("verify init bundle: %w", err)
+	}
+
+	spk, ok := c.db.LookupSignedPreKey(init.SignedPreKeyID)
+	if !ok {
+		return nil, fmt.Errorf("unknown signed prekey %d", init.SignedPreKeyID)
+	}
+
+	dhs := [][2][]byte{
+		{spk.Private, init.Bundle.IdentityKey},
+		{c.id.DHKey.Bytes(), init.EphemeralKey},
+		{spk.Private, init.EphemeralKey},
+	}
+
+	if init.OneTimePreKeyID != nil {
+		otk, ok := c.db.OneTimePreKey(*init.OneTimePreKeyID)
+		if !ok {
+			return nil, fmt.Errorf("unknown one-time prekey %d", *init.OneTimePreKeyID)
+		}
+		dhs = append(dhs, [2][]byte{otk.Private, init.EphemeralKey})
+	}
+
+	sk, err := x3dh(dhs)
+	if err != nil {
+		return nil, err
+	}
+
+	ad := associatedData(init.Bundle.IdentityKey, c.id.DHKey.PublicKey().Bytes())
+	s := session{
+		Ratchet: newResponderRatchet(sk, spk.Private, ad),
+		BaseKey: init.EphemeralKey,
+	}
+
+	return &s, nil
+}
+
+// sealRatchet encrypts msg for usr, it returns errNoPreKeys when there is no
+// session and one can not be started.
+func (c *Client) sealRatchet(usr User, msg []byte) ([]byte, error) {
+	c.sessionMu.Lock()
+	defer c.sessionMu.Unlock()
+
+	s := c.db.Session(usr.ID)
+	switch {
+	case s != nil && len(s.Ratchet.CKs) != 0:
+		s = s.clone()
+	default:
+		var err error
+		s, err = c.startSession(usr.ID)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	h, ct, err := s.Ratchet.encrypt(msg)
+	if err != nil {
+		return nil, fmt.Errorf("encrypt: %w", err)
+	}
+
+	env := ratchetEnvelope{
+		Init:       s.Init,
+		Header:     h,
+		Ciphertext: ct,
+	}
+
+	bs, err := json.Marshal(env)
+	if err != nil {
+		return nil, fmt.Errorf("marshal envelope: %w", err)
+	}
+
+	if err := c.db.SaveSession(usr.ID, s); err != nil {
+		return nil, fmt.Errorf("saveSession: %w", err)
+	}
+
+	return bs, nil
+}
+
+// openRatchet decrypts a ratchet message from a contact or a pending request,
+// load returns the session stored for from, nil if there is none, and save
+// stores the session after a successful decryption.
+func (c *Client) openRatchet(from common.Address, text []byte, load func() *session, save func(*session) error) ([]byte, error) {
+	c.sessionMu.Lock()
+	defer c.sessionMu.Unlock()
+
+	current := load()
+
+	var env ratchetEnvelope
+	if err := json.Unmarshal(text, &env); err != nil {
+		return nil, fmt.Errorf("unmarshal envelope: %w", err)
+	}
+
+	var s *session
+	var created bool
+	ratchet := func() *ratchetState { return &s.Ratchet }
+	switch {
+	case env.Init != nil && current != nil && bytes.Equal(current.BaseKey, env.Init.EphemeralKey):
+		//the contact has not seen our reply yet.
+		s = current.clone()
+
+	case env.Init != nil && current != nil && current.Lost != nil && bytes.Equal(current.Lost.BaseKey, env.Init.EphemeralKey):
+		s = current.clone()
+		ratchet = func() *ratchetState { return &s.Lost.Ratchet }
+
+	case env.Init != nil:
+		next, err := c.acceptSession(from, *env.Init)
+		if err != nil {
+			return nil, fmt.Errorf("acceptSession: %w", err)
+		}
+		s = next
+		created = true
+
+		//both sides started a session at the same time, the one started by
+		//the lower address wins and the other one is kept as lost, it only
+		//reads the messages sent with it.
+		if current != nil && current.Init != nil && c.id.Address.Cmp(from) < 0 {
+			s = current.clone()
+			s.Lost = next
+			ratchet = func() *ratchetState { return &s.Lost.Ratchet }
+		}
+
+	case current == nil:
+		return nil, errors.New("no session with contact")
+
+	default:
+		s = current.clone()
+		//the contact replied, so it has our session.
+		s.Init = nil
+	}
+
+	plaintext, err := ratchet().decrypt(env.Header, env.Ciphertext)
+	if err != nil {
+		return nil, fmt.Errorf("decrypt: %w", err)
+	}
+
+	//the one-time prekey is only deleted once a session was created with it.
+	if created && env.Init.OneTimePreKeyID != nil {
+		if err := c.db.RemoveOneTimePreKey(*env.Init.OneTimePreKeyID); err != nil {
+			return nil, fmt.Errorf("removeOneTimePreKey: %w", err)
+		}
+	}
+
+	if err := save(s); err != nil {
+		return nil, fmt.Errorf("save session: %w", err)
+	}
+
+	return plaintext, nil
+}
+
+// =============================================================================
+
+func x3dh(pairs [][2][]byte) ([]byte, error) {
+	//32 0xFF bytes for X25519 as the spec says.
+	ikm := bytes.Repeat([]byte{0xff}, 32)
+	for _, p := range pairs {
+		out, err := dh(p[0], p[1])
+		if err != nil {
+			return nil, err
+		}
+		ikm = append(ikm, out...)
+	}
+
+	sk, err := hkdf.Key(sha256.New, ikm, make([]byte, 32), x3dhInfo, 32)
+	if err != nil {
+		return nil, fmt.Errorf("hkdf: %w", err)
+	}
+
+	return sk, nil
+}
+
+func associatedData(initiator []byte, responder []byte) []byte {
+	ad := make([]byte, 0, len(initiator)+len(responder))
+	ad = append(ad, initiator...)
+	ad = append(ad, responder...)
+	return ad
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/hamidoujand/echo/cmd/client/app"
+)
+
+// backup implements the backup subcommand.
+func backup(confDir string, args []string) error {
+	fs := flag.NewFlagSet("backup", flag.ContinueOnError)
+	history := fs.Bool("history", false, "include the chat history")
+	out := fs.String("o", "", "file to write the backup to")
+
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if *out == "" {
+		return errors.New("usage: backup [-history] -o <file>")
+	}
+
+	passphrase, err := readPassphrase("Passphrase: ")
+	if err != nil {
+		return err
+	}
+
+	fmt.Println("Choose a passphrase for the backup.")
+	backupPassphrase, err := newPassphrase()
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(*out, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return fmt.Errorf("create %s: %w", *out, err)
+	}
+
+	manifest, err := app.WriteBackup(f, confDir, passphrase, backupPassphrase, *history)
+	if err != nil {
+		f.Close()
+		os.Remove(*out)
+		return fmt.Errorf("writeBackup: %w", err)
+	}
+
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return fmt.Errorf("sync: %w", err)
+	}
+
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("close: %w", err)
+	}
+
+	fmt.Printf("backup of %s with %d files written to %s\n", manifest.Address.Hex(), len(manifest.Files), *out)
+	return nil
+}
+
+// restore implements the restore subcommand.
+func restore(confDir string, args []string) error {
+	fs := flag.NewFlagSet("restore", flag.ContinueOnError)
+	dryRun := fs.Bool("dry-run", false, "only verify the backup and report what would change")
+	force := fs.Bool("force", false, "replace the identity that is there already")
+
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if fs.NArg() != 1 {
+		return errors.New("usage: restore [-dry-run] [-force] <file>")
+	}
+
+	f, err := os.Open(fs.Arg(0))
+	if err != nil {
+		return fmt.Errorf("open: %w", err)
+	}
+	defer f.Close()
+
+	passphrase, err := readPassphrase("Backup passphrase: ")
+	if err != nil {
+		return err
+	}
+
+	report, err := app.RestoreBackup(confDir, f, passphrase, *dryRun, *force)
+	if err != nil && report.Manifest.Version == 0 {
+		return fmt.Errorf("restoreBackup: %w", err)
+	}
+
+	m := report.Manifest
+	fmt.Printf("backup of %s from %s, history included: %t\n", m.Address.Hex(), m.Created.Local().Format("2006-01-02 15:04"), m.History)
+	for _, c := range report.Changes {
+		fmt.Printf("  %-9s %s\n", c.Action, c.Name)
+	}
+
+	if report.ReplacesIdentity {
+		fmt.Println("WARNING: the identity in this directory is replaced, its address is lost unless it has a backup.")
+	}
+
+	if err != nil {
+		return fmt.Errorf("restoreBackup: %w", err)
+	}
+
+	switch {
+	case *dryRun:
+		fmt.Println("the backup is intact, nothing was changed")
+	default:
+		fmt.Println("restored, the keys are protected with the backup passphrase, use passwd to change it")
+	}
+
+	return nil
+}
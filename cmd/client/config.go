@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/ardanlabs/conf/v3"
+)
+
+// prefix of the environment variables, ECHO_CLIENT_DATA_DIR sets DataDir.
+const prefix = "ECHO_CLIENT"
+
+// config is read from the defaults, the config file, the environment and the
+// flags, each one overriding the one before.
+type config struct {
+	conf.Version `json:"-"`
+	Config       string    `json:"-" conf:"help:JSON config file (default $XDG_CONFIG_HOME/echo/client.json)"`
+	Servers      []string  `json:"servers" conf:"default:ws://localhost:8000/v1/connect,help:servers to connect to tried in order"`
+	DataDir      string    `json:"dataDir" conf:"default:infra,help:data root holding the profiles"`
+	Profile      string    `json:"profile" conf:"help:profile to open (asked when there are several)"`
+	Name         string    `json:"name" conf:"help:name shown to your contacts"`
+	Theme        string    `json:"theme" conf:"default:dark,help:color theme: dark or light"`
+	Notify       string    `json:"notify" conf:"default:bell,help:how new messages are notified: bell or off or a command run with the text as its last argument"`
+	LogFile      string    `json:"logFile" conf:"help:file to append the logs to"`
+	Proxy        string    `json:"proxy" conf:"help:HTTP or SOCKS5 proxy like socks5://127.0.0.1:9050"`
+	RestoreSeed  bool      `json:"-" conf:"help:create the identity again from its recovery phrase"`
+	Args         conf.Args `json:"-"`
+
+	// Profiles holds the servers of each profile, only the config file sets
+	// it.
+	Profiles map[string]profileConfig `json:"profiles" conf:"-"`
+}
+
+// profileConfig overrides the settings of a profile.
+type profileConfig struct {
+	Servers []string `json:"servers"`
+}
+
+// servers returns the servers of the profile name.
+func (cfg config) servers(name string) []string {
+	if p, ok := cfg.Profiles[name]; ok && len(p.Servers) != 0 {
+		return p.Servers
+	}
+	return cfg.Servers
+}
+
+const commands = `COMMANDS
+  passwd                                      change the passphrase of the keys
+  export [-format f] [-contact id] [-o file]  export conversations
+  import <file>                               import conversations from a JSON export
+  backup [-history] -o <file>                 write an encrypted backup
+  restore [-dry-run] [-force] <file>          restore an encrypted backup
+  rotate                                      move the identity to a new key`
+
+// parseConfig returns the configuration, help is set when it was asked for.
+func parseConfig() (cfg config, help string, err error) {
+	cfg.Version = conf.Version{
+		Desc: "echo, an end-to-end encrypted chat client",
+	}
+
+	filename, required := configFile()
+
+	help, err = conf.Parse(prefix, &cfg, jsonFile{filename: filename, required: required})
+	if err != nil {
+		if errors.Is(err, conf.ErrHelpWanted) {
+			if strings.HasPrefix(help, "Usage:") {
+				help += "\n" + commands + "\n"
+			}
+			return config{}, help, nil
+		}
+		return config{}, "", fmt.Errorf("parsing config: %w", err)
+	}
+
+	cfg.Config = filename
+	return cfg, "", nil
+}
+
+// configFile finds the config file before the flags are parsed, it is
+// required when it was named explicitly.
+func configFile() (string, bool) {
+	args := os.Args[1:]
+	for i, arg := range args {
+		//the flags end at the first command.
+		if !strings.HasPrefix(arg, "-") || arg == "--" {
+			break
+		}
+
+		name, value, found := strings.Cut(strings.TrimLeft(arg, "-"), "=")
+		if name != "config" {
+			continue
+		}
+
+		if found {
+			return value, true
+		}
+
+		if i+1 < len(args) {
+			return args[i+1], true
+		}
+	}
+
+	if filename := os.Getenv(prefix + "_CONFIG"); filename != "" {
+		return filename, true
+	}
+
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", false
+	}
+
+	return filepath.Join(dir, "echo", "client.json"), false
+}
+
+// jsonFile is a conf parser reading the settings from a JSON file, a missing
+// file is fine unless it is required.
+type jsonFile struct {
+	filename string
+	required bool
+}
+
+func (f jsonFile) Process(prefix string, cfg any) error {
+	if f.filename == "" {
+		return nil
+	}
+
+	data, err := os.ReadFile(f.filename)
+	switch {
+	case errors.Is(err, fs.ErrNotExist) && !f.required:
+		return nil
+	case err != nil:
+		return fmt.Errorf("reading config file: %w", err)
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+
+	if err := dec.Decode(cfg); err != nil {
+		return fmt.Errorf("decoding config file %s: %w", f.filename, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+const configJSON = `{
+	"name": "file",
+	"theme": "light",
+	"dataDir": "file-data",
+	"profiles": {
+		"work": {"servers": ["ws://work:8000/v1/connect"]}
+	}
+}`
+
+// writeConfig writes the config file to the default place of the user.
+func writeConfig(t *testing.T, data string) {
+	filename := filepath.Join(os.Getenv("XDG_CONFIG_HOME"), "echo", "client.json")
+	if err := os.MkdirAll(filepath.Dir(filename), 0700); err != nil {
+		t.Fatalf("Should be able to create the config dir: %s", err)
+	}
+
+	if err := os.WriteFile(filename, []byte(data), 0600); err != nil {
+		t.Fatalf("Should be able to write the config file: %s", err)
+	}
+}
+
+func Test_ParseConfig(t *testing.T) {
+	tests := []struct {
+		name  string
+		file  bool
+		env   map[string]string
+		args  []string
+		exp   config
+		check func(t *testing.T, cfg config)
+	}{
+		{
+			name: "defaults",
+			exp:  config{Theme: "dark", DataDir: "infra", Notify: "bell"},
+		},
+		{
+			name: "file over defaults",
+			file: true,
+			exp:  config{Name: "file", Theme: "light", DataDir: "file-data", Notify: "bell"},
+		},
+		{
+			name: "env over file",
+			file: true,
+			env:  map[string]string{"ECHO_CLIENT_NAME": "env", "ECHO_CLIENT_NOTIFY": "off"},
+			exp:  config{Name: "env", Theme: "light", DataDir: "file-data", Notify: "off"},
+		},
+		{
+			name: "flag over env",
+			file: true,
+			env:  map[string]string{"ECHO_CLIENT_NAME": "env", "ECHO_CLIENT_NOTIFY": "off"},
+			args: []string{"--name=flag", "--theme", "dark", "passwd"},
+			exp:  config{Name: "flag", Theme: "dark", DataDir: "file-data", Notify: "off"},
+			check: func(t *testing.T, cfg config) {
+				if !slices.Equal(cfg.Args, []string{"passwd"}) {
+					t.Fatalf("Should keep the command, got %v", cfg.Args)
+				}
+			},
+		},
+		{
+			name: "profile servers from file",
+			file: true,
+			args: []string{"--servers", "ws://flag:8000/v1/connect"},
+			exp:  config{Name: "file", Theme: "light", DataDir: "file-data", Notify: "bell"},
+			check: func(t *testing.T, cfg config) {
+				if got := cfg.servers("work"); !slices.Equal(got, []string{"ws://work:8000/v1/connect"}) {
+					t.Fatalf("Should use the servers of the profile, got %v", got)
+				}
+
+				if got := cfg.servers("home"); !slices.Equal(got, []string{"ws://flag:8000/v1/connect"}) {
+					t.Fatalf("Should use the servers of the flag for other profiles, got %v", got)
+				}
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+
+			if tt.file {
+				writeConfig(t, configJSON)
+			}
+
+			args := os.Args
+			os.Args = append([]string{"client"}, tt.args...)
+			t.Cleanup(func() { os.Args = args })
+
+			cfg, help, err := parseConfig()
+			if err != nil || help != "" {
+				t.Fatalf("Should be able to parse the config: %v", err)
+			}
+
+			if cfg.Name != tt.exp.Name || cfg.Theme != tt.exp.Theme || cfg.DataDir != tt.exp.DataDir || cfg.Notify != tt.exp.Notify {
+				t.Logf("got: name %q theme %q dataDir %q notify %q", cfg.Name, cfg.Theme, cfg.DataDir, cfg.Notify)
+				t.Logf("exp: name %q theme %q dataDir %q notify %q", tt.exp.Name, tt.exp.Theme, tt.exp.DataDir, tt.exp.Notify)
+				t.Fatalf("Should take each setting from the last place that sets it.")
+			}
+
+			if tt.check != nil {
+				tt.check(t, cfg)
+			}
+		})
+	}
+}
+
+func Test_ConfigFile(t *testing.T) {
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+
+	args := os.Args
+	t.Cleanup(func() { os.Args = args })
+
+	//a missing default file is fine.
+	os.Args = []string{"client"}
+	if _, _, err := parseConfig(); err != nil {
+		t.Fatalf("Should parse the config without a file: %s", err)
+	}
+
+	named := filepath.Join(t.TempDir(), "named.json")
+	if err := os.WriteFile(named, []byte(`{"name": "named"}`), 0600); err != nil {
+		t.Fatalf("Should be able to write the config file: %s", err)
+	}
+
+	//the flag names the file before the environment does.
+	t.Setenv("ECHO_CLIENT_CONFIG", filepath.Join(t.TempDir(), "missing.json"))
+	os.Args = []string{"client", "--config", named}
+	cfg, _, err := parseConfig()
+	if err != nil {
+		t.Fatalf("Should be able to parse the named config: %s", err)
+	}
+
+	if cfg.Name != "named" || cfg.Config != named {
+		t.Fatalf("Should read the file named by the flag, got %q from %q", cfg.Name, cfg.Config)
+	}
+
+	//a named file must be there.
+	os.Args = []string{"client"}
+	if _, _, err := parseConfig(); err == nil {
+		t.Fatal("Should not parse the config without the named file")
+	}
+
+	//an unknown setting is likely a typo.
+	writeConfig(t, `{"nmae": "typo"}`)
+	t.Setenv("ECHO_CLIENT_CONFIG", "")
+	if _, _, err := parseConfig(); err == nil {
+		t.Fatal("Should not parse a config file with an unknown setting")
+	}
+}
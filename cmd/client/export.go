@@ -0,0 +1,90 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/hamidoujand/echo/cmd/client/app"
+)
+
+// exportConversations implements the export subcommand.
+func exportConversations(confDir string, args []string) error {
+	fs := flag.NewFlagSet("export", flag.ContinueOnError)
+	format := fs.String("format", app.FormatJSON, "json, md or txt, only json can be imported")
+	contact := fs.String("contact", "", "address of the contact to export, every contact when empty")
+	out := fs.String("o", "", "file to write to, stdout when empty")
+
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	var ids []common.Address
+	if *contact != "" {
+		if !common.IsHexAddress(*contact) {
+			return fmt.Errorf("invalid contact address %q", *contact)
+		}
+		ids = append(ids, common.HexToAddress(*contact))
+	}
+
+	_, db, err := openDatabase(confDir)
+	if err != nil {
+		return err
+	}
+
+	var w io.Writer = os.Stdout
+	if *out != "" {
+		//the export is not encrypted, keep it private.
+		f, err := os.OpenFile(*out, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err != nil {
+			return fmt.Errorf("create %s: %w", *out, err)
+		}
+		defer f.Close()
+		w = f
+	}
+
+	if err := db.Export(w, strings.ToLower(*format), ids); err != nil {
+		return fmt.Errorf("export: %w", err)
+	}
+
+	if *out != "" {
+		fmt.Printf("exported to %s, the file is not encrypted\n", *out)
+	}
+
+	return nil
+}
+
+// importConversations implements the import subcommand.
+func importConversations(confDir string, args []string) error {
+	fs := flag.NewFlagSet("import", flag.ContinueOnError)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if fs.NArg() != 1 {
+		return errors.New("usage: import <export.json>")
+	}
+
+	f, err := os.Open(fs.Arg(0))
+	if err != nil {
+		return fmt.Errorf("open: %w", err)
+	}
+	defer f.Close()
+
+	_, db, err := openDatabase(confDir)
+	if err != nil {
+		return err
+	}
+
+	n, err := db.Import(f)
+	if err != nil {
+		return fmt.Errorf("import: %w", err)
+	}
+
+	fmt.Printf("imported %d messages\n", n)
+	return nil
+}
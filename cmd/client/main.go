@@ -1,17 +1,15 @@
 package main
 
 import (
+	"cmp"
 	"fmt"
+	"log/slog"
+	"net/url"
 	"os"
 
 	"github.com/hamidoujand/echo/cmd/client/app"
 )
 
-const (
-	url       = "ws://localhost:8000/v1/connect"
-	configDir = "infra"
-)
-
 func main() {
 	if err := run(); err != nil {
 		fmt.Println(err)
@@ -20,27 +18,172 @@ func main() {
 }
 
 func run() error {
-	id, err := app.NewID(configDir)
+	cfg, help, err := parseConfig()
+	if err != nil {
+		return err
+	}
+
+	if help != "" {
+		fmt.Print(help)
+		return nil
+	}
+
+	if cfg.RestoreSeed {
+		dir, err := app.ProfileDir(cfg.DataDir, cmp.Or(cfg.Profile, app.DefaultProfile))
+		if err != nil {
+			return err
+		}
+		return restoreSeed(dir)
+	}
+
+	profile, err := selectProfile(cfg.DataDir, cfg.Profile)
+	if err != nil {
+		return err
+	}
+
+	dir, err := app.ProfileDir(cfg.DataDir, profile)
 	if err != nil {
-		return fmt.Errorf("newID: %w", err)
+		return err
 	}
 
-	db, err := app.NewDatabase(configDir, id.Address)
+	if cfg.Args.Num(0) != "" {
+		args := cfg.Args[1:]
+		switch cfg.Args.Num(0) {
+		case "passwd":
+			return changePassphrase(dir)
+		case "export":
+			return exportConversations(dir, args)
+		case "import":
+			return importConversations(dir, args)
+		case "backup":
+			return backup(dir, args)
+		case "restore":
+			return restore(dir, args)
+		case "rotate":
+			return rotateIdentity(dir)
+		default:
+			return fmt.Errorf("unknown command %q, see --help", cfg.Args.Num(0))
+		}
+	}
+
+	//the theme is set before any primitive is created.
+	if err := app.SetTheme(cfg.Theme); err != nil {
+		return err
+	}
+
+	var proxy *url.URL
+	if cfg.Proxy != "" {
+		proxy, err = url.Parse(cfg.Proxy)
+		if err != nil {
+			return fmt.Errorf("parsing proxy: %w", err)
+		}
+	}
+
+	log := slog.New(slog.DiscardHandler)
+	if cfg.LogFile != "" {
+		f, err := os.OpenFile(cfg.LogFile, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+		if err != nil {
+			return fmt.Errorf("opening log file: %w", err)
+		}
+		defer f.Close()
+
+		log = slog.New(slog.NewTextHandler(f, nil))
+	}
+
+	id, db, err := openDatabase(dir)
 	if err != nil {
-		return fmt.Errorf("newDatabase: %w", err)
+		return err
 	}
 
-	client := app.NewClient(id, url, db)
-	defer client.Close()
+	//the contacts are told about a new name once connected.
+	renamed := cfg.Name != "" && cfg.Name != db.MyAccount().Name
+	if renamed {
+		if err := db.SetName(cfg.Name); err != nil {
+			return fmt.Errorf("setName: %w", err)
+		}
+	}
+
+	newSession := func(name string, id app.ID, db *app.Database) *app.Session {
+		log := log.With("profile", name)
+		log.Info("client starting", "account", id.Address.Hex(), "servers", cfg.servers(name))
 
-	a := app.New(client, db)
+		client := app.NewClient(id, db, app.ClientConfig{
+			Servers: cfg.servers(name),
+			Proxy:   proxy,
+			Log:     log,
+		})
 
-	if err := client.Handshake(db.MyAccount().Name, a.WriteMessage, a.UpdateContact); err != nil {
+		return &app.Session{Name: name, Client: client, DB: db}
+	}
+
+	open := func(name string, passphrase []byte) (*app.Session, error) {
+		id, db, err := unlockProfile(cfg.DataDir, name, passphrase)
+		if err != nil {
+			return nil, err
+		}
+		return newSession(name, id, db), nil
+	}
+
+	s := newSession(profile, id, db)
+
+	a := app.New(s, cfg.DataDir, open)
+	defer a.Close()
+
+	a.SetNotify(cfg.Notify)
+
+	if err := a.Connect(s); err != nil {
 		return fmt.Errorf("client handshake failed: %w", err)
 	}
 
+	if renamed {
+		if _, err := s.Client.SetName(cfg.Name); err != nil {
+			log.Warn("sending the name failed", "err", err)
+		}
+	}
+
 	if err := a.Run(); err != nil {
 		return fmt.Errorf("application run failed: %w", err)
 	}
 	return nil
 }
+
+// openDatabase asks for the passphrase and opens the identity and the
+// database in confDir, the identity is created on the first run.
+func openDatabase(confDir string) (app.ID, *app.Database, error) {
+	exists, err := app.HasID(confDir)
+	if err != nil {
+		return app.ID{}, nil, fmt.Errorf("hasID: %w", err)
+	}
+
+	var id app.ID
+	var passphrase []byte
+
+	if exists {
+		passphrase, err = promptPassphrase(confDir)
+		if err != nil {
+			return app.ID{}, nil, fmt.Errorf("passphrase: %w", err)
+		}
+
+		id, err = app.NewID(confDir, passphrase)
+		if err != nil {
+			return app.ID{}, nil, fmt.Errorf("newID: %w", err)
+		}
+	} else {
+		id, passphrase, err = createIdentity(confDir)
+		if err != nil {
+			return app.ID{}, nil, fmt.Errorf("createIdentity: %w", err)
+		}
+	}
+
+	dataKey, err := app.LoadDataKey(confDir, passphrase)
+	if err != nil {
+		return app.ID{}, nil, fmt.Errorf("loadDataKey: %w", err)
+	}
+
+	db, err := app.NewDatabase(confDir, id.Address, dataKey)
+	if err != nil {
+		return app.ID{}, nil, fmt.Errorf("newDatabase: %w", err)
+	}
+
+	return id, db, nil
+}
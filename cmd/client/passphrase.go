@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/hamidoujand/echo/cmd/client/app"
+	"golang.org/x/term"
+)
+
+// promptPassphrase reads the passphrase of the identity in confDir, a new one
+// is asked twice when the keys are not protected yet.
+func promptPassphrase(confDir string) ([]byte, error) {
+	sealed, err := app.HasSealedID(confDir)
+	if err != nil {
+		return nil, fmt.Errorf("hasSealedID: %w", err)
+	}
+
+	if sealed {
+		return readPassphrase("Passphrase: ")
+	}
+
+	fmt.Println("Your keys are not protected yet, choose a passphrase.")
+	return newPassphrase()
+}
+
+// changePassphrase implements the passwd subcommand.
+func changePassphrase(confDir string) error {
+	old, err := readPassphrase("Current passphrase: ")
+	if err != nil {
+		return err
+	}
+
+	pass, err := newPassphrase()
+	if err != nil {
+		return err
+	}
+
+	if err := app.ChangePassphrase(confDir, old, pass); err != nil {
+		return fmt.Errorf("changePassphrase: %w", err)
+	}
+
+	fmt.Println("passphrase changed")
+	return nil
+}
+
+func newPassphrase() ([]byte, error) {
+	pass, err := readPassphrase("New passphrase: ")
+	if err != nil {
+		return nil, err
+	}
+
+	if len(pass) == 0 {
+		return nil, errors.New("passphrase can not be empty")
+	}
+
+	confirm, err := readPassphrase("Confirm passphrase: ")
+	if err != nil {
+		return nil, err
+	}
+
+	if !bytes.Equal(pass, confirm) {
+		return nil, errors.New("passphrases do not match")
+	}
+
+	return pass, nil
+}
+
+func readPassphrase(prompt string) ([]byte, error) {
+	fmt.Print(prompt)
+	defer fmt.Println()
+
+	pass, err := term.ReadPassword(int(os.Stdin.Fd()))
+	if err != nil {
+		return nil, fmt.Errorf("read passphrase: %w", err)
+	}
+
+	return pass, nil
+}
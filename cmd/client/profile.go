@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/hamidoujand/echo/cmd/client/app"
+)
+
+// selectProfile returns the profile to open, the user picks one when there
+// are several and none was given.
+func selectProfile(root string, name string) (string, error) {
+	if name != "" {
+		return name, nil
+	}
+
+	names, err := app.Profiles(root)
+	if err != nil {
+		return "", fmt.Errorf("profiles: %w", err)
+	}
+
+	switch len(names) {
+	case 0:
+		return app.DefaultProfile, nil
+	case 1:
+		return names[0], nil
+	}
+
+	fmt.Println("Profiles:")
+	for i, n := range names {
+		fmt.Printf("  %d. %s\n", i+1, n)
+	}
+	fmt.Print("Profile to open: ")
+
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil {
+		return "", fmt.Errorf("read: %w", err)
+	}
+
+	line = strings.TrimSpace(line)
+	if i, err := strconv.Atoi(line); err == nil && i >= 1 && i <= len(names) {
+		return names[i-1], nil
+	}
+
+	return line, nil
+}
+
+// unlockProfile opens a profile from the UI, the keys of a profile that was
+// never opened have no passphrase yet and it is chosen on the command line.
+func unlockProfile(root string, name string, passphrase []byte) (app.ID, *app.Database, error) {
+	dir, err := app.ProfileDir(root, name)
+	if err != nil {
+		return app.ID{}, nil, err
+	}
+
+	sealed, err := app.HasSealedID(dir)
+	if err != nil {
+		return app.ID{}, nil, fmt.Errorf("hasSealedID: %w", err)
+	}
+
+	if !sealed {
+		return app.ID{}, nil, fmt.Errorf("open %s once with --profile %s to choose its passphrase", name, name)
+	}
+
+	id, err := app.NewID(dir, passphrase)
+	if err != nil {
+		return app.ID{}, nil, fmt.Errorf("newID: %w", err)
+	}
+
+	dataKey, err := app.LoadDataKey(dir, passphrase)
+	if err != nil {
+		return app.ID{}, nil, fmt.Errorf("loadDataKey: %w", err)
+	}
+
+	db, err := app.NewDatabase(dir, id.Address, dataKey)
+	if err != nil {
+		return app.ID{}, nil, fmt.Errorf("newDatabase: %w", err)
+	}
+
+	return id, db, nil
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/hamidoujand/echo/cmd/client/app"
+)
+
+// rotateIdentity implements the rotate subcommand, it moves the identity to
+// a new address signed off by the old key and shows its recovery phrase.
+func rotateIdentity(confDir string) error {
+	fmt.Println("This replaces your identity key, your contacts are moved to the new address")
+	fmt.Println("the next time the client connects. Do not run it while the client is open.")
+	fmt.Print("Continue? [y/N] ")
+
+	answer, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil {
+		return fmt.Errorf("read: %w", err)
+	}
+
+	if !strings.EqualFold(strings.TrimSpace(answer), "y") {
+		return errors.New("rotation cancelled")
+	}
+
+	passphrase, err := readPassphrase("Passphrase: ")
+	if err != nil {
+		return err
+	}
+
+	mnemonic, err := app.NewMnemonic()
+	if err != nil {
+		return fmt.Errorf("newMnemonic: %w", err)
+	}
+
+	m, err := app.RotateID(confDir, passphrase, mnemonic)
+	if err != nil {
+		return fmt.Errorf("rotateID: %w", err)
+	}
+
+	//the old phrase restores the old identity only.
+	if err := showMnemonic(mnemonic); err != nil {
+		return err
+	}
+
+	//the database moves to the new address when it is opened.
+	dataKey, err := app.LoadDataKey(confDir, passphrase)
+	if err != nil {
+		return fmt.Errorf("loadDataKey: %w", err)
+	}
+
+	db, err := app.NewDatabase(confDir, m.To, dataKey)
+	if err != nil {
+		return fmt.Errorf("newDatabase: %w", err)
+	}
+
+	_, pending, _ := db.PendingMigration()
+
+	fmt.Printf("identity moved from %s to %s\n", m.From.Hex(), m.To.Hex())
+	fmt.Printf("%d contacts are told the next time the client connects\n", len(pending))
+	fmt.Println("your old recovery phrase no longer restores this identity, make a new backup")
+
+	return nil
+}
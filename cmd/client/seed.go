@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/hamidoujand/echo/cmd/client/app"
+)
+
+// createIdentity creates the identity on the first run from a new recovery
+// phrase, the phrase is shown once and never stored.
+func createIdentity(confDir string) (app.ID, []byte, error) {
+	fmt.Println("Creating a new identity, choose a passphrase.")
+	passphrase, err := newPassphrase()
+	if err != nil {
+		return app.ID{}, nil, err
+	}
+
+	mnemonic, err := app.NewMnemonic()
+	if err != nil {
+		return app.ID{}, nil, fmt.Errorf("newMnemonic: %w", err)
+	}
+
+	id, err := app.NewIDFromMnemonic(confDir, mnemonic, passphrase)
+	if err != nil {
+		return app.ID{}, nil, fmt.Errorf("newIDFromMnemonic: %w", err)
+	}
+
+	if err := showMnemonic(mnemonic); err != nil {
+		return app.ID{}, nil, err
+	}
+
+	return id, passphrase, nil
+}
+
+// showMnemonic shows the recovery phrase until it was written down.
+func showMnemonic(mnemonic string) error {
+	fmt.Println()
+	fmt.Println("Write down your recovery phrase, it is the only way to get your")
+	fmt.Println("identity back and it will not be shown again:")
+	fmt.Println()
+	for i, w := range strings.Fields(mnemonic) {
+		fmt.Printf("  %2d. %s\n", i+1, w)
+	}
+	fmt.Println()
+	fmt.Print("Press Enter once you wrote it down.")
+
+	if _, err := bufio.NewReader(os.Stdin).ReadString('\n'); err != nil {
+		return fmt.Errorf("read: %w", err)
+	}
+
+	//clear the screen, so the words do not stay in the terminal.
+	fmt.Print("\033[H\033[2J")
+
+	return nil
+}
+
+// restoreSeed implements the --restore-seed flow, it creates the identity
+// again from its recovery phrase.
+func restoreSeed(confDir string) error {
+	exists, err := app.HasID(confDir)
+	if err != nil {
+		return fmt.Errorf("hasID: %w", err)
+	}
+
+	if exists {
+		return fmt.Errorf("%w in %s, move it away before restoring", app.ErrIDExists, confDir)
+	}
+
+	fmt.Print("Recovery phrase: ")
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil {
+		return fmt.Errorf("read: %w", err)
+	}
+
+	if err := app.ValidateMnemonic(line); err != nil {
+		return err
+	}
+
+	passphrase, err := newPassphrase()
+	if err != nil {
+		return err
+	}
+
+	id, err := app.NewIDFromMnemonic(confDir, line, passphrase)
+	if err != nil {
+		return fmt.Errorf("newIDFromMnemonic: %w", err)
+	}
+
+	fmt.Printf("identity %s restored, a backup of the chat history can be brought back with restore -force\n", id.Address.Hex())
+	return nil
+}
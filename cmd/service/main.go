@@ -16,8 +16,13 @@ import (
 
 	"github.com/ardanlabs/conf/v3"
 	"github.com/google/uuid"
+	"github.com/hamidoujand/echo/blocks"
 	"github.com/hamidoujand/echo/chat"
+	"github.com/hamidoujand/echo/directory"
 	"github.com/hamidoujand/echo/handler"
+	"github.com/hamidoujand/echo/hooks"
+	"github.com/hamidoujand/echo/keys"
+	"github.com/hamidoujand/echo/limiter"
 	"github.com/hamidoujand/echo/users"
 	"github.com/nats-io/nats.go"
 )
@@ -55,6 +60,31 @@ func run(log *slog.Logger) error {
 			Subject string `conf:"default:cap"`
 			CapID   string `conf:"default:infra"`
 		}
+		Limits struct {
+			Rate           float64 `conf:"default:5,help:messages per second a sender can send"`
+			Burst          int     `conf:"default:20"`
+			PairRate       float64 `conf:"default:2,help:messages per second a sender can send to a single recipient"`
+			PairBurst      int     `conf:"default:10"`
+			DailyQuota     int     `conf:"default:10000"`
+			PairDailyQuota int     `conf:"default:2000"`
+			Shared         bool    `conf:"default:true,help:share the limits across CAPs using the BUS"`
+			Bucket         string  `conf:"default:ratelimits"`
+		}
+		Blocks struct {
+			Bucket string `conf:"default:blocks"`
+		}
+		Directory struct {
+			Bucket string `conf:"default:directory"`
+		}
+		Keys struct {
+			Bucket       string `conf:"default:keys"`
+			PreKeyBucket string `conf:"default:prekeys"`
+		}
+		Hooks struct {
+			BlockedAddresses []string `conf:"help:addresses that can not send or receive messages"`
+			MaxMessageSize   int      `conf:"default:65536,help:maximum size of a message text in bytes"`
+			Audit            bool     `conf:"default:false,help:log the verdict of every message"`
+		}
 	}{}
 
 	const prefix = "ECHO"
@@ -124,7 +154,79 @@ func run(log *slog.Logger) error {
 
 	users := users.New(log)
 
-	chat, err := chat.New(log, users, nc, cfg.NATS.Subject, capID)
+	//---------------------------------------------------------------------------
+	//Limiter
+	var store limiter.Store = limiter.NewMemoryStore()
+	if cfg.Limits.Shared {
+		kvStore, err := limiter.NewKVStore(nc, cfg.Limits.Bucket)
+		if err != nil {
+			return fmt.Errorf("creating limiter store: %w", err)
+		}
+		store = kvStore
+	}
+
+	limits := limiter.New(log, limiter.Config{
+		Rate:           cfg.Limits.Rate,
+		Burst:          cfg.Limits.Burst,
+		PairRate:       cfg.Limits.PairRate,
+		PairBurst:      cfg.Limits.PairBurst,
+		DailyQuota:     cfg.Limits.DailyQuota,
+		PairDailyQuota: cfg.Limits.PairDailyQuota,
+	}, store)
+
+	//---------------------------------------------------------------------------
+	//Blocks
+	blockLists, err := blocks.New(log, nc, cfg.Blocks.Bucket)
+	if err != nil {
+		return fmt.Errorf("creating blocks store: %w", err)
+	}
+
+	//---------------------------------------------------------------------------
+	//Directory
+	dir, err := directory.New(log, nc, cfg.Directory.Bucket)
+	if err != nil {
+		return fmt.Errorf("creating directory store: %w", err)
+	}
+
+	//---------------------------------------------------------------------------
+	//Keys
+	keyDir, err := keys.New(nc, cfg.Keys.Bucket)
+	if err != nil {
+		return fmt.Errorf("creating keys store: %w", err)
+	}
+
+	preKeys, err := keys.NewPreKeyStore(nc, cfg.Keys.PreKeyBucket)
+	if err != nil {
+		return fmt.Errorf("creating prekeys store: %w", err)
+	}
+
+	//---------------------------------------------------------------------------
+	//Hooks
+	blocklist, err := hooks.NewBlocklist(cfg.Hooks.BlockedAddresses)
+	if err != nil {
+		return fmt.Errorf("creating blocklist hook: %w", err)
+	}
+
+	pipeline := []chat.Hook{
+		blocklist,
+		hooks.NewSizeLimit(cfg.Hooks.MaxMessageSize),
+	}
+
+	if cfg.Hooks.Audit {
+		pipeline = append(pipeline, hooks.NewAudit(log))
+	}
+
+	chat, err := chat.New(chat.Config{
+		Log:     log,
+		Users:   users,
+		Limiter: limits,
+		Blocks:  blockLists,
+		Keys:    keyDir,
+		Hooks:   pipeline,
+		Conn:    nc,
+		Subject: cfg.NATS.Subject,
+		CapID:   capID,
+	})
 	if err != nil {
 		return fmt.Errorf("creating chat obj: %w", err)
 	}
@@ -132,9 +234,12 @@ func run(log *slog.Logger) error {
 	//---------------------------------------------------------------------------
 	//Mux
 	mux := handler.Register(handler.Config{
-		Logger:  log,
-		Chat:    chat,
-		Subject: cfg.NATS.Subject,
+		Logger:    log,
+		Chat:      chat,
+		Directory: dir,
+		Keys:      keyDir,
+		PreKeys:   preKeys,
+		Subject:   cfg.NATS.Subject,
 	})
 
 	errCh := make(chan error)
@@ -0,0 +1,322 @@
+// Package directory stores the profiles users publish so others can find them
+// by name, the profiles are kept in a JetStream key-value bucket and cached in
+// memory on every CAP.
+package directory
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/hamidoujand/echo/kvstore"
+	"github.com/hamidoujand/echo/signature"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+var (
+	ErrInvalidSignature = errors.New("invalid signature")
+	ErrStaleProfile     = errors.New("stale profile")
+	ErrNotFound         = errors.New("profile not found")
+)
+
+const (
+	// maxClockSkew is how far in the future a signed timestamp can be, a
+	// timestamp too far ahead would lock the user out of further updates.
+	maxClockSkew = 5 * time.Minute
+
+	maxNameLength   = 64
+	maxAvatarLength = 256
+	maxKeyLength    = 4096
+)
+
+// Profile is what a user publishes, it is signed by the user's identity key.
+type Profile struct {
+	ID        common.Address `json:"id"`
+	Name      string         `json:"name"`
+	Key       string         `json:"key"`
+	Avatar    string         `json:"avatar"`
+	Timestamp int64          `json:"timestamp"`
+	V         *big.Int       `json:"v"`
+	R         *big.Int       `json:"r"`
+	S         *big.Int       `json:"s"`
+}
+
+// Verify checks the profile is well-formed and signed by its ID.
+func (p Profile) Verify() error {
+	switch {
+	case strings.TrimSpace(p.Name) == "":
+		return errors.New("name is required")
+	case len(p.Name) > maxNameLength:
+		return fmt.Errorf("name is longer than %d bytes", maxNameLength)
+	case len(p.Avatar) > maxAvatarLength:
+		return fmt.Errorf("avatar is longer than %d bytes", maxAvatarLength)
+	case len(p.Key) > maxKeyLength:
+		return fmt.Errorf("key is longer than %d bytes", maxKeyLength)
+	case time.Until(time.Unix(0, p.Timestamp)) > maxClockSkew:
+		return errors.New("timestamp is in the future")
+	case p.V == nil || p.R == nil || p.S == nil:
+		return ErrInvalidSignature
+	}
+
+	signedData := struct {
+		ID        common.Address
+		Name      string
+		Key       string
+		Avatar    string
+		Timestamp int64
+	}{
+		ID:        p.ID,
+		Name:      p.Name,
+		Key:       p.Key,
+		Avatar:    p.Avatar,
+		Timestamp: p.Timestamp,
+	}
+
+	from, err := signature.FromAddress(signedData, p.V, p.R, p.S)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrInvalidSignature, err)
+	}
+
+	if from != p.ID.Hex() {
+		return ErrInvalidSignature
+	}
+
+	return nil
+}
+
+// Removal is a signed request to remove a profile from the directory.
+type Removal struct {
+	ID        common.Address `json:"id"`
+	Timestamp int64          `json:"timestamp"`
+	V         *big.Int       `json:"v"`
+	R         *big.Int       `json:"r"`
+	S         *big.Int       `json:"s"`
+}
+
+func (r Removal) Verify() error {
+	switch {
+	case time.Until(time.Unix(0, r.Timestamp)) > maxClockSkew:
+		return errors.New("timestamp is in the future")
+	case r.V == nil || r.R == nil || r.S == nil:
+		return ErrInvalidSignature
+	}
+
+	signedData := struct {
+		ID        common.Address
+		Timestamp int64
+		Action    string
+	}{
+		ID:        r.ID,
+		Timestamp: r.Timestamp,
+		Action:    "remove",
+	}
+
+	from, err := signature.FromAddress(signedData, r.V, r.R, r.S)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrInvalidSignature, err)
+	}
+
+	if from != r.ID.Hex() {
+		return ErrInvalidSignature
+	}
+
+	return nil
+}
+
+// record is what the bucket holds for a user, the profile or the removal
+// that replaced it. The removal is kept so an older profile, signed before
+// it, cannot be published again.
+type record struct {
+	Profile
+	Removed *Removal `json:"removed,omitempty"`
+}
+
+// timestamp is when the record was signed.
+func (r record) timestamp() int64 {
+	if r.Removed != nil {
+		return r.Removed.Timestamp
+	}
+	return r.Timestamp
+}
+
+// =============================================================================
+
+type Store struct {
+	log      *slog.Logger
+	kv       jetstream.KeyValue
+	profiles map[common.Address]Profile
+	mu       sync.RWMutex
+}
+
+func New(log *slog.Logger, conn *nats.Conn, bucket string) (*Store, error) {
+	ctx := context.Background()
+
+	js, err := jetstream.New(conn)
+	if err != nil {
+		return nil, fmt.Errorf("create jetStream: %w", err)
+	}
+
+	kv, err := js.CreateOrUpdateKeyValue(ctx, jetstream.KeyValueConfig{
+		Bucket: bucket,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("creating key-value bucket: %w", err)
+	}
+
+	return NewWithKV(log, kv)
+}
+
+// NewWithKV keeps the profiles in the key-value bucket kv.
+func NewWithKV(log *slog.Logger, kv jetstream.KeyValue) (*Store, error) {
+	watcher, err := kv.WatchAll(context.Background())
+	if err != nil {
+		return nil, fmt.Errorf("watching key-value bucket: %w", err)
+	}
+
+	s := Store{
+		log:      log,
+		kv:       kv,
+		profiles: make(map[common.Address]Profile),
+	}
+
+	//keep the cache in sync with changes made by other CAPs.
+	go s.watch(watcher)
+
+	return &s, nil
+}
+
+// Publish stores a verified profile, replacing any older one.
+func (s *Store) Publish(ctx context.Context, p Profile) error {
+	if err := p.Verify(); err != nil {
+		return err
+	}
+
+	err := kvstore.Update(ctx, s.kv, p.ID.Hex(), func(old record, exists bool) (record, error) {
+		if exists && p.Timestamp <= old.timestamp() {
+			return record{}, ErrStaleProfile
+		}
+		return record{Profile: p}, nil
+	})
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	s.profiles[p.ID] = p
+	s.mu.Unlock()
+
+	return nil
+}
+
+// Remove deletes the profile of a user that no longer wants to be found.
+func (s *Store) Remove(ctx context.Context, r Removal) error {
+	if err := r.Verify(); err != nil {
+		return err
+	}
+
+	err := kvstore.Update(ctx, s.kv, r.ID.Hex(), func(old record, exists bool) (record, error) {
+		if !exists || old.Removed != nil {
+			return record{}, ErrNotFound
+		}
+
+		if r.Timestamp <= old.timestamp() {
+			return record{}, ErrStaleProfile
+		}
+		return record{Removed: &r}, nil
+	})
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	delete(s.profiles, r.ID)
+	s.mu.Unlock()
+
+	return nil
+}
+
+func (s *Store) Retrieve(id common.Address) (Profile, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	p, ok := s.profiles[id]
+	if !ok {
+		return Profile{}, ErrNotFound
+	}
+
+	return p, nil
+}
+
+// Search returns up to limit profiles whose name contains the query, the
+// match is case-insensitive.
+func (s *Store) Search(query string, limit int) []Profile {
+	query = strings.ToLower(strings.TrimSpace(query))
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var result []Profile
+	for _, p := range s.profiles {
+		if strings.Contains(strings.ToLower(p.Name), query) {
+			result = append(result, p)
+		}
+	}
+
+	slices.SortFunc(result, func(a, b Profile) int {
+		if c := strings.Compare(strings.ToLower(a.Name), strings.ToLower(b.Name)); c != 0 {
+			return c
+		}
+		return a.ID.Cmp(b.ID)
+	})
+
+	if len(result) > limit {
+		result = result[:limit]
+	}
+
+	return result
+}
+
+func (s *Store) watch(watcher jetstream.KeyWatcher) {
+	for entry := range watcher.Updates() {
+		//nil marks the end of the initial values.
+		if entry == nil {
+			continue
+		}
+
+		if !common.IsHexAddress(entry.Key()) {
+			s.log.Error("directory: invalid key in bucket", "key", entry.Key())
+			continue
+		}
+		id := common.HexToAddress(entry.Key())
+
+		if entry.Operation() != jetstream.KeyValuePut {
+			s.mu.Lock()
+			delete(s.profiles, id)
+			s.mu.Unlock()
+			continue
+		}
+
+		var r record
+		if err := json.Unmarshal(entry.Value(), &r); err != nil {
+			s.log.Error("directory: unmarshal profile failed", "id", id, "err", err)
+			continue
+		}
+
+		s.mu.Lock()
+		if r.Removed != nil {
+			delete(s.profiles, id)
+		} else {
+			s.profiles[id] = r.Profile
+		}
+		s.mu.Unlock()
+	}
+}
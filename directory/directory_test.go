@@ -0,0 +1,283 @@
+package directory_test
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"errors"
+	"io"
+	"log/slog"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/hamidoujand/echo/directory"
+	"github.com/hamidoujand/echo/signature"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+const pkHexKey = "fae85851bdf5c9f49923722ce38f3c1defcfd3619ef5453230a58ad805499959"
+
+// entry is a value of memoryKV.
+type entry struct {
+	key      string
+	value    []byte
+	revision uint64
+}
+
+func (e entry) Bucket() string                  { return "directory" }
+func (e entry) Key() string                     { return e.key }
+func (e entry) Value() []byte                   { return e.value }
+func (e entry) Revision() uint64                { return e.revision }
+func (e entry) Created() time.Time              { return time.Time{} }
+func (e entry) Delta() uint64                   { return 0 }
+func (e entry) Operation() jetstream.KeyValueOp { return jetstream.KeyValuePut }
+
+type watcher struct {
+	updates chan jetstream.KeyValueEntry
+}
+
+func (w watcher) Updates() <-chan jetstream.KeyValueEntry { return w.updates }
+func (w watcher) Stop() error                             { return nil }
+
+// memoryKV is the part of a key-value bucket the store uses, before is run
+// once ahead of the next write, the way another CAP would race it.
+type memoryKV struct {
+	jetstream.KeyValue
+	mu       sync.Mutex
+	entries  map[string]entry
+	revision uint64
+	before   func()
+}
+
+func (kv *memoryKV) Get(ctx context.Context, key string) (jetstream.KeyValueEntry, error) {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+
+	e, ok := kv.entries[key]
+	if !ok {
+		return nil, jetstream.ErrKeyNotFound
+	}
+
+	return e, nil
+}
+
+func (kv *memoryKV) Create(ctx context.Context, key string, value []byte, opts ...jetstream.KVCreateOpt) (uint64, error) {
+	kv.race()
+
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+
+	if _, ok := kv.entries[key]; ok {
+		return 0, jetstream.ErrKeyExists
+	}
+
+	return kv.put(key, value), nil
+}
+
+func (kv *memoryKV) Update(ctx context.Context, key string, value []byte, revision uint64) (uint64, error) {
+	kv.race()
+
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+
+	if kv.entries[key].revision != revision {
+		return 0, &jetstream.APIError{ErrorCode: jetstream.JSErrCodeStreamWrongLastSequence}
+	}
+
+	return kv.put(key, value), nil
+}
+
+func (kv *memoryKV) WatchAll(ctx context.Context, opts ...jetstream.WatchOpt) (jetstream.KeyWatcher, error) {
+	return watcher{updates: make(chan jetstream.KeyValueEntry)}, nil
+}
+
+func (kv *memoryKV) race() {
+	kv.mu.Lock()
+	before := kv.before
+	kv.before = nil
+	kv.mu.Unlock()
+
+	if before != nil {
+		before()
+	}
+}
+
+func (kv *memoryKV) put(key string, value []byte) uint64 {
+	kv.revision++
+	kv.entries[key] = entry{key: key, value: value, revision: kv.revision}
+	return kv.revision
+}
+
+// =============================================================================
+
+func newStore(t *testing.T) (*directory.Store, *memoryKV) {
+	kv := memoryKV{
+		entries: make(map[string]entry),
+	}
+
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+	s, err := directory.NewWithKV(log, &kv)
+	if err != nil {
+		t.Fatalf("Should be able to create a store: %s", err)
+	}
+
+	return s, &kv
+}
+
+func newKey(t *testing.T) (*ecdsa.PrivateKey, common.Address) {
+	pk, err := crypto.HexToECDSA(pkHexKey)
+	if err != nil {
+		t.Fatalf("Should be able to generate a private key: %s", err)
+	}
+
+	return pk, crypto.PubkeyToAddress(pk.PublicKey)
+}
+
+func newProfile(t *testing.T, pk *ecdsa.PrivateKey, name string, timestamp int64) directory.Profile {
+	p := directory.Profile{
+		ID:        crypto.PubkeyToAddress(pk.PublicKey),
+		Name:      name,
+		Timestamp: timestamp,
+	}
+
+	signedData := struct {
+		ID        common.Address
+		Name      string
+		Key       string
+		Avatar    string
+		Timestamp int64
+	}{
+		ID:        p.ID,
+		Name:      p.Name,
+		Key:       p.Key,
+		Avatar:    p.Avatar,
+		Timestamp: p.Timestamp,
+	}
+
+	var err error
+	p.V, p.R, p.S, err = signature.Sign(signedData, pk)
+	if err != nil {
+		t.Fatalf("Should be able to sign a profile: %s", err)
+	}
+
+	return p
+}
+
+func newRemoval(t *testing.T, pk *ecdsa.PrivateKey, timestamp int64) directory.Removal {
+	r := directory.Removal{
+		ID:        crypto.PubkeyToAddress(pk.PublicKey),
+		Timestamp: timestamp,
+	}
+
+	signedData := struct {
+		ID        common.Address
+		Timestamp int64
+		Action    string
+	}{
+		ID:        r.ID,
+		Timestamp: r.Timestamp,
+		Action:    "remove",
+	}
+
+	var err error
+	r.V, r.R, r.S, err = signature.Sign(signedData, pk)
+	if err != nil {
+		t.Fatalf("Should be able to sign a removal: %s", err)
+	}
+
+	return r
+}
+
+// =============================================================================
+
+func Test_Publish(t *testing.T) {
+	s, _ := newStore(t)
+	pk, id := newKey(t)
+	ctx := context.Background()
+
+	if err := s.Publish(ctx, newProfile(t, pk, "bill", 2)); err != nil {
+		t.Fatalf("Should be able to publish a profile: %s", err)
+	}
+
+	if err := s.Publish(ctx, newProfile(t, pk, "old bill", 1)); !errors.Is(err, directory.ErrStaleProfile) {
+		t.Fatalf("Should not replace a profile with an older one, got: %v", err)
+	}
+
+	forged := newProfile(t, pk, "bill", 3)
+	forged.Name = "mallory"
+	if err := s.Publish(ctx, forged); !errors.Is(err, directory.ErrInvalidSignature) {
+		t.Fatalf("Should not publish a profile that was changed, got: %v", err)
+	}
+
+	p, err := s.Retrieve(id)
+	if err != nil || p.Name != "bill" {
+		t.Fatalf("Should keep the newest profile, got %q: %v", p.Name, err)
+	}
+
+	if got := s.Search("BIL", 10); len(got) != 1 || got[0].ID != id {
+		t.Fatalf("Should find the profile by name, got %d", len(got))
+	}
+}
+
+func Test_Remove(t *testing.T) {
+	s, _ := newStore(t)
+	pk, id := newKey(t)
+	ctx := context.Background()
+
+	old := newProfile(t, pk, "bill", 1)
+	if err := s.Publish(ctx, old); err != nil {
+		t.Fatalf("Should be able to publish a profile: %s", err)
+	}
+
+	if err := s.Remove(ctx, newRemoval(t, pk, 1)); !errors.Is(err, directory.ErrStaleProfile) {
+		t.Fatalf("Should not remove a profile with an older removal, got: %v", err)
+	}
+
+	if err := s.Remove(ctx, newRemoval(t, pk, 2)); err != nil {
+		t.Fatalf("Should be able to remove the profile: %s", err)
+	}
+
+	if _, err := s.Retrieve(id); !errors.Is(err, directory.ErrNotFound) {
+		t.Fatalf("Should not find a removed profile, got: %v", err)
+	}
+
+	if err := s.Remove(ctx, newRemoval(t, pk, 3)); !errors.Is(err, directory.ErrNotFound) {
+		t.Fatalf("Should not remove a profile twice, got: %v", err)
+	}
+
+	//anyone holding the old signed profile could publish it again.
+	if err := s.Publish(ctx, old); !errors.Is(err, directory.ErrStaleProfile) {
+		t.Fatalf("Should not publish a profile signed before the removal, got: %v", err)
+	}
+
+	if err := s.Publish(ctx, newProfile(t, pk, "bill", 4)); err != nil {
+		t.Fatalf("Should be able to publish a new profile after a removal: %s", err)
+	}
+
+	if _, err := s.Retrieve(id); err != nil {
+		t.Fatalf("Should find the new profile: %s", err)
+	}
+}
+
+func Test_PublishConflict(t *testing.T) {
+	s, kv := newStore(t)
+	pk, _ := newKey(t)
+	ctx := context.Background()
+
+	if err := s.Publish(ctx, newProfile(t, pk, "bill", 1)); err != nil {
+		t.Fatalf("Should be able to publish a profile: %s", err)
+	}
+
+	//another CAP removes the profile between the read and the write.
+	kv.before = func() {
+		if err := s.Remove(ctx, newRemoval(t, pk, 3)); err != nil {
+			t.Errorf("Should be able to remove the profile: %s", err)
+		}
+	}
+
+	if err := s.Publish(ctx, newProfile(t, pk, "bill", 2)); !errors.Is(err, directory.ErrStaleProfile) {
+		t.Fatalf("Should read the record again after a conflict, got: %v", err)
+	}
+}
@@ -0,0 +1,103 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/hamidoujand/echo/directory"
+	"github.com/hamidoujand/echo/errs"
+	"github.com/hamidoujand/echo/web"
+)
+
+func (h Handler) publishProfile(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	var p directory.Profile
+	if err := web.Decode(r, &p); err != nil {
+		return errs.New(http.StatusBadRequest, err)
+	}
+
+	if err := h.directory.Publish(ctx, p); err != nil {
+		switch {
+		case errors.Is(err, directory.ErrInvalidSignature):
+			return errs.New(http.StatusUnauthorized, err)
+		case errors.Is(err, directory.ErrStaleProfile):
+			return errs.New(http.StatusConflict, err)
+		default:
+			return errs.New(http.StatusBadRequest, fmt.Errorf("publish: %w", err))
+		}
+	}
+
+	return web.Respond(ctx, w, http.StatusOK, p)
+}
+
+func (h Handler) removeProfile(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	var rm directory.Removal
+	if err := web.Decode(r, &rm); err != nil {
+		return errs.New(http.StatusBadRequest, err)
+	}
+
+	addr := r.PathValue("address")
+	if !common.IsHexAddress(addr) || common.HexToAddress(addr) != rm.ID {
+		return errs.New(http.StatusBadRequest, errors.New("address does not match the removal request"))
+	}
+
+	if err := h.directory.Remove(ctx, rm); err != nil {
+		switch {
+		case errors.Is(err, directory.ErrInvalidSignature):
+			return errs.New(http.StatusUnauthorized, err)
+		case errors.Is(err, directory.ErrNotFound):
+			return errs.New(http.StatusNotFound, err)
+		case errors.Is(err, directory.ErrStaleProfile):
+			return errs.New(http.StatusConflict, err)
+		default:
+			return fmt.Errorf("remove: %w", err)
+		}
+	}
+
+	return web.Respond(ctx, w, http.StatusNoContent, nil)
+}
+
+func (h Handler) searchProfiles(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	const (
+		defaultLimit = 20
+		maxLimit     = 100
+	)
+
+	name := r.URL.Query().Get("name")
+	if len(name) < 2 {
+		return errs.New(http.StatusBadRequest, errors.New("name must be at least 2 characters"))
+	}
+
+	limit := defaultLimit
+	if l := r.URL.Query().Get("limit"); l != "" {
+		v, err := strconv.Atoi(l)
+		if err != nil || v < 1 {
+			return errs.New(http.StatusBadRequest, fmt.Errorf("invalid limit %q", l))
+		}
+		limit = min(v, maxLimit)
+	}
+
+	profiles := h.directory.Search(name, limit)
+	if profiles == nil {
+		profiles = []directory.Profile{}
+	}
+
+	return web.Respond(ctx, w, http.StatusOK, profiles)
+}
+
+func (h Handler) retrieveProfile(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	addr := r.PathValue("address")
+	if !common.IsHexAddress(addr) {
+		return errs.New(http.StatusBadRequest, fmt.Errorf("invalid address %q", addr))
+	}
+
+	p, err := h.directory.Retrieve(common.HexToAddress(addr))
+	if err != nil {
+		return errs.New(http.StatusNotFound, err)
+	}
+
+	return web.Respond(ctx, w, http.StatusOK, p)
+}
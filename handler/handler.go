@@ -7,15 +7,20 @@ import (
 	"net/http"
 
 	"github.com/hamidoujand/echo/chat"
+	"github.com/hamidoujand/echo/directory"
 	"github.com/hamidoujand/echo/errs"
+	"github.com/hamidoujand/echo/keys"
 	"github.com/hamidoujand/echo/mid"
 	"github.com/hamidoujand/echo/web"
 )
 
 type Config struct {
-	Logger  *slog.Logger
-	Chat    *chat.Chat
-	Subject string
+	Logger    *slog.Logger
+	Chat      *chat.Chat
+	Directory *directory.Store
+	Keys      *keys.Store
+	PreKeys   *keys.PreKeyStore
+	Subject   string
 }
 
 func Register(cfg Config) *web.App {
@@ -28,18 +33,34 @@ func Register(cfg Config) *web.App {
 	const version = "v1"
 
 	h := Handler{
-		Logger: cfg.Logger,
-		chat:   cfg.Chat,
+		Logger:    cfg.Logger,
+		chat:      cfg.Chat,
+		directory: cfg.Directory,
+		keys:      cfg.Keys,
+		preKeys:   cfg.PreKeys,
 	}
 
 	app.HandleFunc(http.MethodGet, version, "/connect", h.connect)
 
+	app.HandleFunc(http.MethodGet, version, "/directory", h.searchProfiles)
+	app.HandleFunc(http.MethodPost, version, "/directory", h.publishProfile)
+	app.HandleFunc(http.MethodGet, version, "/directory/{address}", h.retrieveProfile)
+	app.HandleFunc(http.MethodDelete, version, "/directory/{address}", h.removeProfile)
+
+	app.HandleFunc(http.MethodGet, version, "/keys/{address}", h.retrieveKey)
+
+	app.HandleFunc(http.MethodPost, version, "/prekeys", h.uploadPreKeys)
+	app.HandleFunc(http.MethodGet, version, "/prekeys/{address}", h.fetchPreKeys)
+
 	return app
 }
 
 type Handler struct {
-	Logger *slog.Logger
-	chat   *chat.Chat
+	Logger    *slog.Logger
+	chat      *chat.Chat
+	directory *directory.Store
+	keys      *keys.Store
+	preKeys   *keys.PreKeyStore
 }
 
 func (h Handler) connect(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
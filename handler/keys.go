@@ -0,0 +1,74 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/hamidoujand/echo/errs"
+	"github.com/hamidoujand/echo/keys"
+	"github.com/hamidoujand/echo/web"
+)
+
+func (h Handler) retrieveKey(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	addr := r.PathValue("address")
+	if !common.IsHexAddress(addr) {
+		return errs.New(http.StatusBadRequest, fmt.Errorf("invalid address %q", addr))
+	}
+
+	b, err := h.keys.Retrieve(ctx, common.HexToAddress(addr))
+	if err != nil {
+		if errors.Is(err, keys.ErrNotFound) {
+			return errs.New(http.StatusNotFound, err)
+		}
+		return fmt.Errorf("retrieve: %w", err)
+	}
+
+	return web.Respond(ctx, w, http.StatusOK, b)
+}
+
+func (h Handler) uploadPreKeys(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	var u keys.PreKeyUpload
+	if err := web.Decode(r, &u); err != nil {
+		return errs.New(http.StatusBadRequest, err)
+	}
+
+	available, err := h.preKeys.Upload(ctx, u)
+	if err != nil {
+		switch {
+		case errors.Is(err, keys.ErrInvalidSignature):
+			return errs.New(http.StatusUnauthorized, err)
+		case errors.Is(err, keys.ErrStaleBundle):
+			return errs.New(http.StatusConflict, err)
+		default:
+			return errs.New(http.StatusBadRequest, fmt.Errorf("upload: %w", err))
+		}
+	}
+
+	resp := struct {
+		OneTimePreKeys int `json:"oneTimePreKeys"`
+	}{
+		OneTimePreKeys: available,
+	}
+
+	return web.Respond(ctx, w, http.StatusOK, resp)
+}
+
+func (h Handler) fetchPreKeys(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	addr := r.PathValue("address")
+	if !common.IsHexAddress(addr) {
+		return errs.New(http.StatusBadRequest, fmt.Errorf("invalid address %q", addr))
+	}
+
+	b, err := h.preKeys.Fetch(ctx, common.HexToAddress(addr))
+	if err != nil {
+		if errors.Is(err, keys.ErrNotFound) {
+			return errs.New(http.StatusNotFound, err)
+		}
+		return fmt.Errorf("fetch: %w", err)
+	}
+
+	return web.Respond(ctx, w, http.StatusOK, b)
+}
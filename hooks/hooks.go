@@ -0,0 +1,103 @@
+// Package hooks provides example plugins for the chat message pipeline.
+package hooks
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strconv"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/hamidoujand/echo/chat"
+)
+
+// =============================================================================
+
+// Blocklist rejects any message sent from or to one of the blocked addresses.
+type Blocklist struct {
+	blocked map[common.Address]struct{}
+}
+
+func NewBlocklist(addresses []string) (*Blocklist, error) {
+	blocked := make(map[common.Address]struct{}, len(addresses))
+	for _, addr := range addresses {
+		if !common.IsHexAddress(addr) {
+			return nil, fmt.Errorf("invalid address %q", addr)
+		}
+		blocked[common.HexToAddress(addr)] = struct{}{}
+	}
+
+	return &Blocklist{blocked: blocked}, nil
+}
+
+func (b *Blocklist) Name() string {
+	return "blocklist"
+}
+
+func (b *Blocklist) Filter(ctx context.Context, msg chat.Message) error {
+	if _, ok := b.blocked[msg.FromID]; ok {
+		return chat.Reject(b.Name(), "sender %s is blocked", msg.FromID)
+	}
+
+	//do not reveal to the sender that the recipient is blocked, clients take
+	//the skipped nonce as a drop.
+	if _, ok := b.blocked[msg.ToID]; ok {
+		return chat.ErrDrop
+	}
+
+	return nil
+}
+
+// =============================================================================
+
+// SizeLimit rejects messages with a text bigger than max bytes.
+type SizeLimit struct {
+	max int
+}
+
+func NewSizeLimit(max int) *SizeLimit {
+	return &SizeLimit{max: max}
+}
+
+func (s *SizeLimit) Name() string {
+	return "sizelimit"
+}
+
+func (s *SizeLimit) Filter(ctx context.Context, msg chat.Message) error {
+	if len(msg.Text) > s.max {
+		return chat.Reject(s.Name(), "message is %d bytes, the limit is %d bytes", len(msg.Text), s.max)
+	}
+
+	return nil
+}
+
+// Enrich records the size so the recipient's CAP does not have to trust the
+// client.
+func (s *SizeLimit) Enrich(ctx context.Context, msg *chat.Message) error {
+	msg.Metadata["size"] = strconv.Itoa(len(msg.Text))
+	return nil
+}
+
+// =============================================================================
+
+// Audit logs the verdict of every message passing through the pipeline.
+type Audit struct {
+	log *slog.Logger
+}
+
+func NewAudit(log *slog.Logger) *Audit {
+	return &Audit{log: log}
+}
+
+func (a *Audit) Name() string {
+	return "audit"
+}
+
+func (a *Audit) Audit(ctx context.Context, msg chat.Message, verdict error) {
+	status := "routed"
+	if verdict != nil {
+		status = "stopped"
+	}
+
+	a.log.Info("audit", "status", status, "from", msg.FromID, "to", msg.ToID, "nonce", msg.FromNonce, "size", len(msg.Text), "scheme", msg.Scheme, "verdict", verdict)
+}
@@ -0,0 +1,381 @@
+// Package keys implements the server-side directory of encryption public
+// keys, every key is signed by the identity key of its owner so clients can
+// verify it without trusting the server.
+package keys
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"slices"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/hamidoujand/echo/kvstore"
+	"github.com/hamidoujand/echo/signature"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+var (
+	ErrInvalidSignature = errors.New("invalid signature")
+	ErrStaleBundle      = errors.New("stale key bundle")
+	ErrNotFound         = errors.New("key not found")
+
+	// errUnchanged stops a publish of the key already stored.
+	errUnchanged = errors.New("unchanged")
+)
+
+const (
+	// maxClockSkew is how far in the future a signed timestamp can be.
+	maxClockSkew = 5 * time.Minute
+
+	maxKeyLength = 4096
+)
+
+// Bundle is an encryption public key signed by the identity key of ID.
+type Bundle struct {
+	ID        common.Address `json:"id"`
+	Key       string         `json:"key"`
+	Timestamp int64          `json:"timestamp"`
+	V         *big.Int       `json:"v"`
+	R         *big.Int       `json:"r"`
+	S         *big.Int       `json:"s"`
+}
+
+func (b Bundle) Verify() error {
+	switch {
+	case b.Key == "":
+		return errors.New("key is required")
+	case len(b.Key) > maxKeyLength:
+		return fmt.Errorf("key is longer than %d bytes", maxKeyLength)
+	case time.Until(time.Unix(0, b.Timestamp)) > maxClockSkew:
+		return errors.New("timestamp is in the future")
+	case b.V == nil || b.R == nil || b.S == nil:
+		return ErrInvalidSignature
+	}
+
+	signedData := struct {
+		ID        common.Address
+		Key       string
+		Timestamp int64
+	}{
+		ID:        b.ID,
+		Key:       b.Key,
+		Timestamp: b.Timestamp,
+	}
+
+	from, err := signature.FromAddress(signedData, b.V, b.R, b.S)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrInvalidSignature, err)
+	}
+
+	if from != b.ID.Hex() {
+		return ErrInvalidSignature
+	}
+
+	return nil
+}
+
+// =============================================================================
+
+type Store struct {
+	kv jetstream.KeyValue
+}
+
+func New(conn *nats.Conn, bucket string) (*Store, error) {
+	ctx := context.Background()
+
+	js, err := jetstream.New(conn)
+	if err != nil {
+		return nil, fmt.Errorf("create jetStream: %w", err)
+	}
+
+	kv, err := js.CreateOrUpdateKeyValue(ctx, jetstream.KeyValueConfig{
+		Bucket: bucket,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("creating key-value bucket: %w", err)
+	}
+
+	return &Store{kv: kv}, nil
+}
+
+// Publish stores a verified bundle, a bundle for the same key as the stored
+// one is a no-op.
+func (s *Store) Publish(ctx context.Context, b Bundle) error {
+	if err := b.Verify(); err != nil {
+		return err
+	}
+
+	//another CAP can publish a bundle of the same id at the same time, the
+	//timestamps are compared against what is written.
+	err := kvstore.Update(ctx, s.kv, b.ID.Hex(), func(old Bundle, exists bool) (Bundle, error) {
+		switch {
+		case !exists:
+			return b, nil
+		case old.Key == b.Key:
+			return old, errUnchanged
+		case b.Timestamp <= old.Timestamp:
+			return old, ErrStaleBundle
+		}
+		return b, nil
+	})
+	if err != nil && !errors.Is(err, errUnchanged) {
+		return err
+	}
+
+	return nil
+}
+
+func (s *Store) Retrieve(ctx context.Context, id common.Address) (Bundle, error) {
+	entry, err := s.kv.Get(ctx, id.Hex())
+	if err != nil {
+		if errors.Is(err, jetstream.ErrKeyNotFound) {
+			return Bundle{}, ErrNotFound
+		}
+		return Bundle{}, fmt.Errorf("get: %w", err)
+	}
+
+	var b Bundle
+	if err := json.Unmarshal(entry.Value(), &b); err != nil {
+		return Bundle{}, fmt.Errorf("unmarshal bundle: %w", err)
+	}
+
+	return b, nil
+}
+
+// =============================================================================
+
+// PreKey is a X25519 public key used to start a session.
+type PreKey struct {
+	KeyID  uint32 `json:"keyID"`
+	Public []byte `json:"public"`
+}
+
+// PreKeyBundle is what a client fetches to start a session with ID, the
+// identity and signed prekey are signed by the identity key of ID, the
+// one-time prekey is handed out to a single client only.
+type PreKeyBundle struct {
+	ID            common.Address `json:"id"`
+	IdentityKey   []byte         `json:"identityKey"`
+	SignedPreKey  PreKey         `json:"signedPreKey"`
+	Timestamp     int64          `json:"timestamp"`
+	V             *big.Int       `json:"v"`
+	R             *big.Int       `json:"r"`
+	S             *big.Int       `json:"s"`
+	OneTimePreKey *PreKey        `json:"oneTimePreKey,omitempty"`
+}
+
+func (b PreKeyBundle) Verify() error {
+	switch {
+	case len(b.IdentityKey) != 32:
+		return errors.New("identity key must be 32 bytes")
+	case len(b.SignedPreKey.Public) != 32:
+		return errors.New("signed prekey must be 32 bytes")
+	case time.Until(time.Unix(0, b.Timestamp)) > maxClockSkew:
+		return errors.New("timestamp is in the future")
+	case b.V == nil || b.R == nil || b.S == nil:
+		return ErrInvalidSignature
+	}
+
+	signedData := struct {
+		ID           common.Address
+		IdentityKey  []byte
+		SignedPreKey PreKey
+		Timestamp    int64
+	}{
+		ID:           b.ID,
+		IdentityKey:  b.IdentityKey,
+		SignedPreKey: b.SignedPreKey,
+		Timestamp:    b.Timestamp,
+	}
+
+	from, err := signature.FromAddress(signedData, b.V, b.R, b.S)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrInvalidSignature, err)
+	}
+
+	if from != b.ID.Hex() {
+		return ErrInvalidSignature
+	}
+
+	return nil
+}
+
+// PreKeyUpload replaces the signed part of the bundle and adds one-time
+// prekeys, the whole upload is signed so no one else can add prekeys.
+type PreKeyUpload struct {
+	Bundle         PreKeyBundle `json:"bundle"`
+	OneTimePreKeys []PreKey     `json:"oneTimePreKeys"`
+	Timestamp      int64        `json:"timestamp"`
+	V              *big.Int     `json:"v"`
+	R              *big.Int     `json:"r"`
+	S              *big.Int     `json:"s"`
+}
+
+func (u PreKeyUpload) Verify() error {
+	if err := u.Bundle.Verify(); err != nil {
+		return fmt.Errorf("bundle: %w", err)
+	}
+
+	switch {
+	case len(u.OneTimePreKeys) > maxOneTimePreKeys:
+		return fmt.Errorf("more than %d one-time prekeys", maxOneTimePreKeys)
+	case time.Until(time.Unix(0, u.Timestamp)) > maxClockSkew:
+		return errors.New("timestamp is in the future")
+	case u.V == nil || u.R == nil || u.S == nil:
+		return ErrInvalidSignature
+	}
+
+	for _, k := range u.OneTimePreKeys {
+		if len(k.Public) != 32 {
+			return fmt.Errorf("one-time prekey %d must be 32 bytes", k.KeyID)
+		}
+	}
+
+	signedData := struct {
+		ID             common.Address
+		OneTimePreKeys []PreKey
+		Timestamp      int64
+	}{
+		ID:             u.Bundle.ID,
+		OneTimePreKeys: u.OneTimePreKeys,
+		Timestamp:      u.Timestamp,
+	}
+
+	from, err := signature.FromAddress(signedData, u.V, u.R, u.S)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrInvalidSignature, err)
+	}
+
+	if from != u.Bundle.ID.Hex() {
+		return ErrInvalidSignature
+	}
+
+	return nil
+}
+
+const (
+	// maxOneTimePreKeys is the most one-time prekeys kept for a single user.
+	maxOneTimePreKeys = 200
+
+	// oneTimePreKeyRate is how many one-time prekeys of a user are handed out
+	// per hour, up to oneTimePreKeyBurst at once. Anyone can fetch a bundle,
+	// past the rate it comes without a one-time prekey so a stranger fetching
+	// in a loop cannot drain them, the session still starts without one.
+	oneTimePreKeyRate  = 30.0
+	oneTimePreKeyBurst = 30
+)
+
+type preKeyRecord struct {
+	Bundle         PreKeyBundle `json:"bundle"`
+	OneTimePreKeys []PreKey     `json:"oneTimePreKeys"`
+	Uploaded       int64        `json:"uploaded"`
+	Tokens         float64      `json:"tokens"`
+	Refilled       int64        `json:"refilled"`
+}
+
+type PreKeyStore struct {
+	kv jetstream.KeyValue
+}
+
+func NewPreKeyStore(conn *nats.Conn, bucket string) (*PreKeyStore, error) {
+	ctx := context.Background()
+
+	js, err := jetstream.New(conn)
+	if err != nil {
+		return nil, fmt.Errorf("create jetStream: %w", err)
+	}
+
+	kv, err := js.CreateOrUpdateKeyValue(ctx, jetstream.KeyValueConfig{
+		Bucket: bucket,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("creating key-value bucket: %w", err)
+	}
+
+	return &PreKeyStore{kv: kv}, nil
+}
+
+// Upload stores a verified upload, it returns the number of one-time prekeys
+// available after the upload.
+func (s *PreKeyStore) Upload(ctx context.Context, u PreKeyUpload) (int, error) {
+	if err := u.Verify(); err != nil {
+		return 0, err
+	}
+
+	var available int
+	err := kvstore.Update(ctx, s.kv, u.Bundle.ID.Hex(), func(rec preKeyRecord, exists bool) (preKeyRecord, error) {
+		if exists && u.Timestamp <= rec.Uploaded {
+			return rec, ErrStaleBundle
+		}
+
+		bundle := u.Bundle
+		bundle.OneTimePreKey = nil
+		if !exists || bundle.Timestamp > rec.Bundle.Timestamp {
+			rec.Bundle = bundle
+		}
+		rec.Uploaded = u.Timestamp
+
+		for _, k := range u.OneTimePreKeys {
+			if !slices.ContainsFunc(rec.OneTimePreKeys, func(o PreKey) bool { return o.KeyID == k.KeyID }) {
+				rec.OneTimePreKeys = append(rec.OneTimePreKeys, k)
+			}
+		}
+
+		//keep the newest ones.
+		if n := len(rec.OneTimePreKeys); n > maxOneTimePreKeys {
+			rec.OneTimePreKeys = rec.OneTimePreKeys[n-maxOneTimePreKeys:]
+		}
+
+		available = len(rec.OneTimePreKeys)
+		return rec, nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return available, nil
+}
+
+// Fetch returns the bundle of id with one of its one-time prekeys, the
+// one-time prekey is removed so it is never handed out twice. The one-time
+// prekeys are handed out at oneTimePreKeyRate.
+func (s *PreKeyStore) Fetch(ctx context.Context, id common.Address) (PreKeyBundle, error) {
+	now := time.Now()
+
+	var bundle PreKeyBundle
+	err := kvstore.Update(ctx, s.kv, id.Hex(), func(rec preKeyRecord, exists bool) (preKeyRecord, error) {
+		if !exists {
+			return rec, ErrNotFound
+		}
+
+		bundle = rec.Bundle
+		bundle.OneTimePreKey = nil
+
+		//refill
+		elapsed := now.Sub(time.Unix(0, rec.Refilled)).Hours()
+		if elapsed > 0 {
+			rec.Tokens = math.Min(oneTimePreKeyBurst, rec.Tokens+elapsed*oneTimePreKeyRate)
+		}
+		rec.Refilled = now.UnixNano()
+
+		if len(rec.OneTimePreKeys) > 0 && rec.Tokens >= 1 {
+			k := rec.OneTimePreKeys[0]
+			bundle.OneTimePreKey = &k
+			rec.OneTimePreKeys = rec.OneTimePreKeys[1:]
+			rec.Tokens--
+		}
+
+		return rec, nil
+	})
+	if err != nil {
+		return PreKeyBundle{}, err
+	}
+
+	return bundle, nil
+}
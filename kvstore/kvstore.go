@@ -0,0 +1,84 @@
+// Package kvstore provides the read-modify-write the stores share to keep
+// their records in a JetStream key-value bucket shared by all the CAPs.
+package kvstore
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// maxAttempts is how many times a write is tried again after another CAP
+// changed the same key.
+const maxAttempts = 5
+
+// Update replaces the value of key with the one fn returns, the value is read
+// from the bucket and only written if no other CAP changed it since. fn gets
+// the zero value when the key does not exist yet and it can be called again
+// after a conflict, an error it returns is returned as it is.
+func Update[T any](ctx context.Context, kv jetstream.KeyValue, key string, fn func(v T, exists bool) (T, error)) error {
+	for range maxAttempts {
+		var v T
+		var revision uint64
+		exists := true
+
+		entry, err := kv.Get(ctx, key)
+		switch {
+		case errors.Is(err, jetstream.ErrKeyNotFound):
+			exists = false
+		case err != nil:
+			return fmt.Errorf("get: %w", err)
+		default:
+			revision = entry.Revision()
+			if err := json.Unmarshal(entry.Value(), &v); err != nil {
+				return fmt.Errorf("unmarshal %s: %w", key, err)
+			}
+		}
+
+		v, err = fn(v, exists)
+		if err != nil {
+			return err
+		}
+
+		bs, err := json.Marshal(v)
+		if err != nil {
+			return fmt.Errorf("marshal %s: %w", key, err)
+		}
+
+		if exists {
+			_, err = kv.Update(ctx, key, bs, revision)
+		} else {
+			_, err = kv.Create(ctx, key, bs)
+		}
+
+		if err != nil {
+			//another CAP wrote the same key, read it again.
+			if IsConflict(err) {
+				continue
+			}
+			return fmt.Errorf("write %s: %w", key, err)
+		}
+
+		return nil
+	}
+
+	return fmt.Errorf("too many concurrent updates on key %s", key)
+}
+
+// IsConflict reports whether a write failed because the key changed since it
+// was read.
+func IsConflict(err error) bool {
+	if errors.Is(err, jetstream.ErrKeyExists) {
+		return true
+	}
+
+	var apiErr *jetstream.APIError
+	if errors.As(err, &apiErr) {
+		return apiErr.ErrorCode == jetstream.JSErrCodeStreamWrongLastSequence
+	}
+
+	return false
+}
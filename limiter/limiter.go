@@ -0,0 +1,193 @@
+package limiter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/hamidoujand/echo/chat"
+)
+
+// Config holds the token-bucket and quota settings, a zero rate or quota
+// disables that particular check.
+type Config struct {
+	Rate           float64
+	Burst          int
+	PairRate       float64
+	PairBurst      int
+	DailyQuota     int
+	PairDailyQuota int
+}
+
+// Bucket is the persisted state for a single key.
+type Bucket struct {
+	Tokens  float64   `json:"tokens"`
+	Updated time.Time `json:"updated"`
+	Day     string    `json:"day"`
+	Count   int       `json:"count"`
+}
+
+// Store persists buckets, fn must be applied atomically for the given key.
+type Store interface {
+	Update(ctx context.Context, key string, fn func(b Bucket, exists bool) (Bucket, error)) error
+}
+
+type Limiter struct {
+	log   *slog.Logger
+	cfg   Config
+	store Store
+	now   func() time.Time
+}
+
+func New(log *slog.Logger, cfg Config, store Store) *Limiter {
+	return &Limiter{
+		log:   log,
+		cfg:   cfg,
+		store: store,
+		now:   time.Now,
+	}
+}
+
+// errChecked stops a store update once the bucket is checked, nothing is
+// written.
+var errChecked = errors.New("bucket checked")
+
+// limit is a bucket and its settings.
+type limit struct {
+	key   string
+	rate  float64
+	burst int
+	quota int
+}
+
+// Allow takes a token from both the sender's and the sender→recipient
+// buckets, when throttled it returns how long the sender has to wait.
+func (l *Limiter) Allow(ctx context.Context, from common.Address, to common.Address) (time.Duration, error) {
+	sender := limit{key: "sender." + from.Hex(), rate: l.cfg.Rate, burst: l.cfg.Burst, quota: l.cfg.DailyQuota}
+	pair := limit{key: "pair." + from.Hex() + "." + to.Hex(), rate: l.cfg.PairRate, burst: l.cfg.PairBurst, quota: l.cfg.PairDailyQuota}
+
+	//both are checked before any token is taken, a message refused for the
+	//pair does not cost the sender.
+	for _, lim := range []limit{sender, pair} {
+		if wait, err := l.take(ctx, lim, false); err != nil {
+			return wait, err
+		}
+	}
+
+	if wait, err := l.take(ctx, sender, true); err != nil {
+		return wait, err
+	}
+
+	//the pair might have been emptied since the check, by another server.
+	if wait, err := l.take(ctx, pair, true); err != nil {
+		l.refund(ctx, sender)
+		return wait, err
+	}
+
+	return 0, nil
+}
+
+// AllowControl takes a token from the sender's bucket for a control message,
+// when throttled it returns how long the sender has to wait.
+func (l *Limiter) AllowControl(ctx context.Context, from common.Address) (time.Duration, error) {
+	sender := limit{key: "sender." + from.Hex(), rate: l.cfg.Rate, burst: l.cfg.Burst, quota: l.cfg.DailyQuota}
+	return l.take(ctx, sender, true)
+}
+
+// take takes a token from the bucket of lim, or only checks there is one
+// when commit is false.
+func (l *Limiter) take(ctx context.Context, lim limit, commit bool) (time.Duration, error) {
+	if lim.rate <= 0 && lim.quota <= 0 {
+		return 0, nil
+	}
+
+	now := l.now().UTC()
+	day := now.Format(time.DateOnly)
+	var wait time.Duration
+
+	fn := func(b Bucket, exists bool) (Bucket, error) {
+		wait = 0
+
+		if !exists {
+			b = Bucket{Tokens: float64(lim.burst), Updated: now, Day: day}
+		}
+
+		//new day, reset the quota
+		if b.Day != day {
+			b.Day = day
+			b.Count = 0
+		}
+
+		if lim.quota > 0 && b.Count >= lim.quota {
+			midnight := now.Truncate(24 * time.Hour).Add(24 * time.Hour)
+			wait = midnight.Sub(now)
+			return b, chat.ErrQuotaExceeded
+		}
+
+		if lim.rate > 0 {
+			//refill
+			elapsed := now.Sub(b.Updated).Seconds()
+			if elapsed > 0 {
+				b.Tokens = math.Min(float64(lim.burst), b.Tokens+elapsed*lim.rate)
+			}
+			b.Updated = now
+
+			if b.Tokens < 1 {
+				missing := 1 - b.Tokens
+				wait = time.Duration(missing / lim.rate * float64(time.Second))
+				return b, chat.ErrRateLimited
+			}
+
+			b.Tokens--
+		}
+
+		if !commit {
+			return b, errChecked
+		}
+
+		b.Count++
+		return b, nil
+	}
+
+	if err := l.store.Update(ctx, lim.key, fn); err != nil {
+		if errors.Is(err, errChecked) {
+			return 0, nil
+		}
+		if wait > 0 {
+			l.log.Info("throttled", "key", lim.key, "retryAfter", wait, "err", err)
+			return wait, err
+		}
+		return 0, fmt.Errorf("update bucket %s: %w", lim.key, err)
+	}
+
+	return 0, nil
+}
+
+// refund gives back the token taken from the bucket of lim.
+func (l *Limiter) refund(ctx context.Context, lim limit) {
+	if lim.rate <= 0 && lim.quota <= 0 {
+		return
+	}
+
+	fn := func(b Bucket, exists bool) (Bucket, error) {
+		if !exists {
+			return b, errChecked
+		}
+
+		if lim.rate > 0 {
+			b.Tokens = math.Min(float64(lim.burst), b.Tokens+1)
+		}
+		if b.Count > 0 {
+			b.Count--
+		}
+		return b, nil
+	}
+
+	if err := l.store.Update(ctx, lim.key, fn); err != nil && !errors.Is(err, errChecked) {
+		l.log.Error("refund token", "key", lim.key, "err", err)
+	}
+}
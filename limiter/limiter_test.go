@@ -0,0 +1,112 @@
+package limiter_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/hamidoujand/echo/chat"
+	"github.com/hamidoujand/echo/limiter"
+)
+
+var (
+	alice = common.HexToAddress("0xdd6B972ffcc631a62CAE1BB9d80b7ff429c8ebA4")
+	bob   = common.HexToAddress("0x8b5C2Bd29B4ab8c6e5a7E2f8A4a7a02AE7b3F1c0")
+	carol = common.HexToAddress("0x2a4e0C8d9a5b7e0b5F46cE2E2a1C2f1f3d1E5B11")
+)
+
+func newLimiter(cfg limiter.Config) *limiter.Limiter {
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+	return limiter.New(log, cfg, limiter.NewMemoryStore())
+}
+
+func Test_Burst(t *testing.T) {
+	l := newLimiter(limiter.Config{Rate: 0.001, Burst: 2})
+	ctx := context.Background()
+
+	for i := range 2 {
+		if _, err := l.Allow(ctx, alice, bob); err != nil {
+			t.Fatalf("Should be able to send message %d within the burst: %s", i, err)
+		}
+	}
+
+	wait, err := l.Allow(ctx, alice, bob)
+	if !errors.Is(err, chat.ErrRateLimited) {
+		t.Fatalf("Should be rate limited after the burst, got: %v", err)
+	}
+
+	if wait <= 0 {
+		t.Fatalf("Should get a positive retry after duration, got: %s", wait)
+	}
+}
+
+func Test_PairLimit(t *testing.T) {
+	l := newLimiter(limiter.Config{Rate: 100, Burst: 100, PairRate: 0.001, PairBurst: 1})
+	ctx := context.Background()
+
+	if _, err := l.Allow(ctx, alice, bob); err != nil {
+		t.Fatalf("Should be able to send the first message: %s", err)
+	}
+
+	if _, err := l.Allow(ctx, alice, bob); !errors.Is(err, chat.ErrRateLimited) {
+		t.Fatalf("Should be rate limited for the same recipient, got: %v", err)
+	}
+
+	if _, err := l.Allow(ctx, alice, carol); err != nil {
+		t.Fatalf("Should be able to send to another recipient: %s", err)
+	}
+}
+
+func Test_DailyQuota(t *testing.T) {
+	l := newLimiter(limiter.Config{DailyQuota: 3})
+	ctx := context.Background()
+
+	for i := range 3 {
+		if _, err := l.Allow(ctx, alice, bob); err != nil {
+			t.Fatalf("Should be able to send message %d within the quota: %s", i, err)
+		}
+	}
+
+	if _, err := l.Allow(ctx, alice, carol); !errors.Is(err, chat.ErrQuotaExceeded) {
+		t.Fatalf("Should exceed the daily quota, got: %v", err)
+	}
+}
+
+func Test_PairLimitKeepsSenderTokens(t *testing.T) {
+	l := newLimiter(limiter.Config{Rate: 0.001, Burst: 2, PairRate: 0.001, PairBurst: 1})
+	ctx := context.Background()
+
+	if _, err := l.Allow(ctx, alice, bob); err != nil {
+		t.Fatalf("Should be able to send the first message: %s", err)
+	}
+
+	for range 3 {
+		if _, err := l.Allow(ctx, alice, bob); !errors.Is(err, chat.ErrRateLimited) {
+			t.Fatalf("Should be rate limited for the same recipient, got: %v", err)
+		}
+	}
+
+	if _, err := l.Allow(ctx, alice, carol); err != nil {
+		t.Fatalf("Should not spend the sender tokens on refused messages: %s", err)
+	}
+}
+
+func Test_AllowControl(t *testing.T) {
+	l := newLimiter(limiter.Config{Rate: 0.001, Burst: 2, PairRate: 0.001, PairBurst: 2})
+	ctx := context.Background()
+
+	if _, err := l.AllowControl(ctx, alice); err != nil {
+		t.Fatalf("Should be able to send a control message: %s", err)
+	}
+
+	if _, err := l.Allow(ctx, alice, bob); err != nil {
+		t.Fatalf("Should be able to send a message: %s", err)
+	}
+
+	if _, err := l.AllowControl(ctx, alice); !errors.Is(err, chat.ErrRateLimited) {
+		t.Fatalf("Should charge control messages to the sender, got: %v", err)
+	}
+}
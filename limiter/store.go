@@ -0,0 +1,68 @@
+package limiter
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/hamidoujand/echo/kvstore"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// MemoryStore keeps the buckets inside this CAP only.
+type MemoryStore struct {
+	buckets map[string]Bucket
+	mu      sync.Mutex
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		buckets: make(map[string]Bucket),
+	}
+}
+
+func (m *MemoryStore) Update(ctx context.Context, key string, fn func(b Bucket, exists bool) (Bucket, error)) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	b, exists := m.buckets[key]
+	b, err := fn(b, exists)
+	if err != nil {
+		return err
+	}
+
+	m.buckets[key] = b
+	return nil
+}
+
+// KVStore keeps the buckets inside a JetStream key-value bucket so all the
+// CAPs connected to the BUS share the same limits.
+type KVStore struct {
+	kv jetstream.KeyValue
+}
+
+func NewKVStore(conn *nats.Conn, bucket string) (*KVStore, error) {
+	ctx := context.Background()
+
+	js, err := jetstream.New(conn)
+	if err != nil {
+		return nil, fmt.Errorf("create jetStream: %w", err)
+	}
+
+	//quotas are daily, so there is no point in keeping the keys any longer.
+	kv, err := js.CreateOrUpdateKeyValue(ctx, jetstream.KeyValueConfig{
+		Bucket: bucket,
+		TTL:    48 * time.Hour,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("creating key-value bucket: %w", err)
+	}
+
+	return &KVStore{kv: kv}, nil
+}
+
+func (s *KVStore) Update(ctx context.Context, key string, fn func(b Bucket, exists bool) (Bucket, error)) error {
+	return kvstore.Update(ctx, s.kv, key, fn)
+}
@@ -0,0 +1,601 @@
+// Package qr encodes data as a QR code, it only supports what the terminal
+// needs: byte mode at error correction level M.
+package qr
+
+import (
+	"errors"
+	"strings"
+)
+
+// ErrTooLong is returned when the data does not fit in the largest version.
+var ErrTooLong = errors.New("data is too long for a QR code")
+
+// blocks describes the error correction of a version at level M, the data is
+// split into blocks1 blocks of data1 codewords followed by blocks2 blocks of
+// data1+1 codewords, each with ec error correction codewords.
+type blocks struct {
+	ec      int
+	blocks1 int
+	data1   int
+	blocks2 int
+}
+
+// levelM holds the block structure of versions 1 to 40.
+var levelM = [...]blocks{
+	{10, 1, 16, 0},
+	{16, 1, 28, 0},
+	{26, 1, 44, 0},
+	{18, 2, 32, 0},
+	{24, 2, 43, 0},
+	{16, 4, 27, 0},
+	{18, 4, 31, 0},
+	{22, 2, 38, 2},
+	{22, 3, 36, 2},
+	{26, 4, 43, 1},
+	{30, 1, 50, 4},
+	{22, 6, 36, 2},
+	{22, 8, 37, 1},
+	{24, 4, 40, 5},
+	{24, 5, 41, 5},
+	{28, 7, 45, 3},
+	{28, 10, 46, 1},
+	{26, 9, 43, 4},
+	{26, 3, 44, 11},
+	{26, 3, 41, 13},
+	{26, 17, 42, 0},
+	{28, 17, 46, 0},
+	{28, 4, 47, 14},
+	{28, 6, 45, 14},
+	{28, 8, 47, 13},
+	{28, 19, 46, 4},
+	{28, 22, 45, 3},
+	{28, 3, 45, 23},
+	{28, 21, 45, 7},
+	{28, 19, 47, 10},
+	{28, 2, 46, 29},
+	{28, 10, 46, 23},
+	{28, 14, 46, 21},
+	{28, 14, 46, 23},
+	{28, 12, 47, 26},
+	{28, 6, 47, 34},
+	{28, 29, 46, 14},
+	{28, 13, 46, 32},
+	{28, 40, 47, 7},
+	{28, 18, 47, 31},
+}
+
+func (b blocks) dataCodewords() int {
+	return b.blocks1*b.data1 + b.blocks2*(b.data1+1)
+}
+
+// Code is an encoded QR code.
+type Code struct {
+	version  int
+	size     int
+	modules  [][]bool
+	function [][]bool
+}
+
+// Encode returns the smallest QR code holding data.
+func Encode(data []byte) (*Code, error) {
+	version := 0
+	for v := 1; v <= len(levelM); v++ {
+		if dataBits(v, len(data)) <= levelM[v-1].dataCodewords()*8 {
+			version = v
+			break
+		}
+	}
+
+	if version == 0 {
+		return nil, ErrTooLong
+	}
+
+	c := newCode(version)
+	c.drawFunctionPatterns()
+	c.drawCodewords(c.codewords(data))
+
+	//the mask with the lowest penalty is kept.
+	best, bestPenalty := 0, -1
+	for mask := range 8 {
+		c.applyMask(mask)
+		c.drawFormat(mask)
+		if p := c.penalty(); bestPenalty == -1 || p < bestPenalty {
+			best, bestPenalty = mask, p
+		}
+		c.applyMask(mask)
+	}
+
+	c.applyMask(best)
+	c.drawFormat(best)
+
+	return c, nil
+}
+
+// Size returns the number of modules on a side.
+func (c *Code) Size() int {
+	return c.size
+}
+
+// Dark reports whether the module at x, y is dark.
+func (c *Code) Dark(x int, y int) bool {
+	return c.modules[y][x]
+}
+
+// HalfBlocks draws the code with a quiet zone of quiet modules, every line of
+// text holds two rows of modules. Dark modules are drawn, so the text needs
+// a dark color on a light background to be scanned.
+func (c *Code) HalfBlocks(quiet int) string {
+	dark := func(x, y int) bool {
+		x, y = x-quiet, y-quiet
+		if x < 0 || y < 0 || x >= c.size || y >= c.size {
+			return false
+		}
+		return c.modules[y][x]
+	}
+
+	side := c.size + 2*quiet
+
+	var b strings.Builder
+	for y := 0; y < side; y += 2 {
+		for x := range side {
+			switch top, bottom := dark(x, y), dark(x, y+1); {
+			case top && bottom:
+				b.WriteRune('█')
+			case top:
+				b.WriteRune('▀')
+			case bottom:
+				b.WriteRune('▄')
+			default:
+				b.WriteRune(' ')
+			}
+		}
+		b.WriteByte('\n')
+	}
+
+	return b.String()
+}
+
+// =============================================================================
+
+func newCode(version int) *Code {
+	size := 17 + 4*version
+
+	c := Code{
+		version:  version,
+		size:     size,
+		modules:  make([][]bool, size),
+		function: make([][]bool, size),
+	}
+
+	for i := range size {
+		c.modules[i] = make([]bool, size)
+		c.function[i] = make([]bool, size)
+	}
+
+	return &c
+}
+
+// dataBits returns the number of bits n bytes take in byte mode.
+func dataBits(version int, n int) int {
+	count := 8
+	if version >= 10 {
+		count = 16
+	}
+	return 4 + count + 8*n
+}
+
+func (c *Code) set(x int, y int, dark bool) {
+	c.modules[y][x] = dark
+	c.function[y][x] = true
+}
+
+func (c *Code) drawFunctionPatterns() {
+	for i := range c.size {
+		c.set(6, i, i%2 == 0)
+		c.set(i, 6, i%2 == 0)
+	}
+
+	c.drawFinder(3, 3)
+	c.drawFinder(c.size-4, 3)
+	c.drawFinder(3, c.size-4)
+
+	pos := alignmentPositions(c.version, c.size)
+	last := len(pos) - 1
+	for i := range pos {
+		for j := range pos {
+			//the corners are taken by the finders.
+			if (i == 0 && j == 0) || (i == 0 && j == last) || (i == last && j == 0) {
+				continue
+			}
+			c.drawAlignment(pos[i], pos[j])
+		}
+	}
+
+	//reserve the format area, it is drawn with the mask.
+	c.drawFormat(0)
+	c.drawVersion()
+}
+
+// drawFinder draws a finder pattern with its separator around x, y.
+func (c *Code) drawFinder(x int, y int) {
+	for dy := -4; dy <= 4; dy++ {
+		for dx := -4; dx <= 4; dx++ {
+			xx, yy := x+dx, y+dy
+			if xx < 0 || yy < 0 || xx >= c.size || yy >= c.size {
+				continue
+			}
+
+			dist := max(abs(dx), abs(dy))
+			c.set(xx, yy, dist != 2 && dist != 4)
+		}
+	}
+}
+
+func (c *Code) drawAlignment(x int, y int) {
+	for dy := -2; dy <= 2; dy++ {
+		for dx := -2; dx <= 2; dx++ {
+			c.set(x+dx, y+dy, max(abs(dx), abs(dy)) != 1)
+		}
+	}
+}
+
+// alignmentPositions returns the centers of the alignment patterns on each
+// axis.
+func alignmentPositions(version int, size int) []int {
+	if version == 1 {
+		return nil
+	}
+
+	n := version/7 + 2
+	step := (version*4 + n*2 + 1) / (n*2 - 2) * 2
+	if version == 32 {
+		step = 26
+	}
+
+	pos := make([]int, n)
+	pos[0] = 6
+	for i, p := n-1, size-7; i >= 1; i, p = i-1, p-step {
+		pos[i] = p
+	}
+
+	return pos
+}
+
+// drawFormat draws both copies of the level and the mask.
+func (c *Code) drawFormat(mask int) {
+	//level M is 00.
+	data := mask
+	rem := data
+	for range 10 {
+		rem = (rem << 1) ^ ((rem >> 9) * 0x537)
+	}
+	bits := (data<<10 | rem) ^ 0x5412
+
+	for i := 0; i <= 5; i++ {
+		c.set(8, i, bit(bits, i))
+	}
+	c.set(8, 7, bit(bits, 6))
+	c.set(8, 8, bit(bits, 7))
+	c.set(7, 8, bit(bits, 8))
+	for i := 9; i < 15; i++ {
+		c.set(14-i, 8, bit(bits, i))
+	}
+
+	for i := range 8 {
+		c.set(c.size-1-i, 8, bit(bits, i))
+	}
+	for i := 8; i < 15; i++ {
+		c.set(8, c.size-15+i, bit(bits, i))
+	}
+
+	//the dark module.
+	c.set(8, c.size-8, true)
+}
+
+// drawVersion draws both copies of the version from version 7 on.
+func (c *Code) drawVersion() {
+	if c.version < 7 {
+		return
+	}
+
+	rem := c.version
+	for range 12 {
+		rem = (rem << 1) ^ ((rem >> 11) * 0x1f25)
+	}
+	bits := c.version<<12 | rem
+
+	for i := range 18 {
+		a, b := c.size-11+i%3, i/3
+		c.set(a, b, bit(bits, i))
+		c.set(b, a, bit(bits, i))
+	}
+}
+
+// codewords returns the data and error correction codewords of data,
+// interleaved across the blocks.
+func (c *Code) codewords(data []byte) []byte {
+	b := levelM[c.version-1]
+	capacity := b.dataCodewords() * 8
+
+	var w bitWriter
+	w.write(0b0100, 4)
+	if c.version >= 10 {
+		w.write(len(data), 16)
+	} else {
+		w.write(len(data), 8)
+	}
+	for _, d := range data {
+		w.write(int(d), 8)
+	}
+
+	w.write(0, min(4, capacity-w.n))
+	w.write(0, (8-w.n%8)%8)
+	for pad := 0xec; w.n < capacity; pad ^= 0xec ^ 0x11 {
+		w.write(pad, 8)
+	}
+
+	divisor := rsDivisor(b.ec)
+
+	var dataBlocks, ecBlocks [][]byte
+	rest := w.bytes
+	for i := range b.blocks1 + b.blocks2 {
+		n := b.data1
+		if i >= b.blocks1 {
+			n++
+		}
+
+		dataBlocks = append(dataBlocks, rest[:n])
+		ecBlocks = append(ecBlocks, rsRemainder(rest[:n], divisor))
+		rest = rest[n:]
+	}
+
+	var out []byte
+	for i := range b.data1 + 1 {
+		for _, blk := range dataBlocks {
+			if i < len(blk) {
+				out = append(out, blk[i])
+			}
+		}
+	}
+	for i := range b.ec {
+		for _, blk := range ecBlocks {
+			out = append(out, blk[i])
+		}
+	}
+
+	return out
+}
+
+// drawCodewords places the codewords in the zigzag order, two columns at a
+// time from the bottom right corner.
+func (c *Code) drawCodewords(data []byte) {
+	i := 0
+	for right := c.size - 1; right >= 1; right -= 2 {
+		//the vertical timing pattern is skipped.
+		if right == 6 {
+			right = 5
+		}
+
+		for vert := range c.size {
+			for j := range 2 {
+				x := right - j
+				y := vert
+				if (right+1)&2 == 0 {
+					y = c.size - 1 - vert
+				}
+
+				if c.function[y][x] || i >= len(data)*8 {
+					continue
+				}
+
+				c.modules[y][x] = bit(int(data[i>>3]), 7-i&7)
+				i++
+			}
+		}
+	}
+}
+
+// applyMask flips the data modules selected by mask, applying it twice
+// undoes it.
+func (c *Code) applyMask(mask int) {
+	for y := range c.size {
+		for x := range c.size {
+			if c.function[y][x] {
+				continue
+			}
+
+			var flip bool
+			switch mask {
+			case 0:
+				flip = (x+y)%2 == 0
+			case 1:
+				flip = y%2 == 0
+			case 2:
+				flip = x%3 == 0
+			case 3:
+				flip = (x+y)%3 == 0
+			case 4:
+				flip = (x/3+y/2)%2 == 0
+			case 5:
+				flip = x*y%2+x*y%3 == 0
+			case 6:
+				flip = (x*y%2+x*y%3)%2 == 0
+			case 7:
+				flip = ((x+y)%2+x*y%3)%2 == 0
+			}
+
+			c.modules[y][x] = c.modules[y][x] != flip
+		}
+	}
+}
+
+// penalty scores how hard the code is to scan, following the four rules of
+// the standard.
+func (c *Code) penalty() int {
+	var p int
+
+	line := make([]bool, c.size)
+	for _, horizontal := range []bool{true, false} {
+		for i := range c.size {
+			for j := range c.size {
+				if horizontal {
+					line[j] = c.modules[i][j]
+				} else {
+					line[j] = c.modules[j][i]
+				}
+			}
+			p += linePenalty(line)
+		}
+	}
+
+	var dark int
+	for y := range c.size {
+		for x := range c.size {
+			if c.modules[y][x] {
+				dark++
+			}
+
+			if x+1 < c.size && y+1 < c.size {
+				m := c.modules[y][x]
+				if m == c.modules[y][x+1] && m == c.modules[y+1][x] && m == c.modules[y+1][x+1] {
+					p += 3
+				}
+			}
+		}
+	}
+
+	total := c.size * c.size
+	p += abs(dark*20-total*10) / total * 10
+
+	return p
+}
+
+// linePenalty scores the runs of a color and the finder-like patterns of a
+// row or a column.
+func linePenalty(line []bool) int {
+	var p int
+
+	run := 1
+	for i := 1; i <= len(line); i++ {
+		if i < len(line) && line[i] == line[i-1] {
+			run++
+			continue
+		}
+
+		if run >= 5 {
+			p += 3 + run - 5
+		}
+		run = 1
+	}
+
+	finder := []bool{true, false, true, true, true, false, true}
+	for i := 0; i+len(finder) <= len(line); i++ {
+		if !equal(line[i:i+len(finder)], finder) {
+			continue
+		}
+
+		before := i >= 4 && !anyDark(line[i-4:i])
+		after := i+len(finder)+4 <= len(line) && !anyDark(line[i+len(finder):i+len(finder)+4])
+		if before || after {
+			p += 40
+		}
+	}
+
+	return p
+}
+
+// =============================================================================
+
+// rsDivisor returns the generator polynomial of degree n, without its
+// leading term.
+func rsDivisor(n int) []byte {
+	result := make([]byte, n)
+	result[n-1] = 1
+
+	root := byte(1)
+	for range n {
+		for j := range n {
+			result[j] = gfMul(result[j], root)
+			if j+1 < n {
+				result[j] ^= result[j+1]
+			}
+		}
+		root = gfMul(root, 0x02)
+	}
+
+	return result
+}
+
+// rsRemainder returns the error correction codewords of data.
+func rsRemainder(data []byte, divisor []byte) []byte {
+	result := make([]byte, len(divisor))
+	for _, b := range data {
+		factor := b ^ result[0]
+		copy(result, result[1:])
+		result[len(result)-1] = 0
+
+		for i := range result {
+			result[i] ^= gfMul(divisor[i], factor)
+		}
+	}
+
+	return result
+}
+
+// gfMul multiplies in GF(2^8) modulo x^8 + x^4 + x^3 + x^2 + 1.
+func gfMul(x byte, y byte) byte {
+	var z int
+	for i := 7; i >= 0; i-- {
+		z = (z << 1) ^ ((z >> 7) * 0x11d)
+		z ^= int((y>>i)&1) * int(x)
+	}
+	return byte(z)
+}
+
+// =============================================================================
+
+type bitWriter struct {
+	bytes []byte
+	n     int
+}
+
+func (w *bitWriter) write(v int, bits int) {
+	for i := bits - 1; i >= 0; i-- {
+		if w.n%8 == 0 {
+			w.bytes = append(w.bytes, 0)
+		}
+		if bit(v, i) {
+			w.bytes[len(w.bytes)-1] |= 1 << (7 - w.n%8)
+		}
+		w.n++
+	}
+}
+
+func bit(v int, i int) bool {
+	return (v>>i)&1 != 0
+}
+
+func abs(v int) int {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
+
+func equal(a []bool, b []bool) bool {
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func anyDark(line []bool) bool {
+	for _, m := range line {
+		if m {
+			return true
+		}
+	}
+	return false
+}
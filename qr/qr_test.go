@@ -0,0 +1,191 @@
+package qr_test
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/hamidoujand/echo/qr"
+)
+
+func Test_Encode(t *testing.T) {
+	tests := []struct {
+		n    int
+		size int
+	}{
+		{n: 14, size: 21},
+		{n: 15, size: 25},
+		{n: 213, size: 57},
+		{n: 2331, size: 177},
+	}
+
+	for _, tt := range tests {
+		c, err := qr.Encode([]byte(strings.Repeat("e", tt.n)))
+		if err != nil {
+			t.Fatalf("Should be able to encode %d bytes: %s", tt.n, err)
+		}
+
+		if c.Size() != tt.size {
+			t.Logf("got: %d", c.Size())
+			t.Logf("exp: %d", tt.size)
+			t.Fatalf("Should pick the smallest version for %d bytes.", tt.n)
+		}
+
+		//the finder pattern in the top left corner.
+		for y := range 7 {
+			for x := range 7 {
+				dist := max(abs(x-3), abs(y-3))
+				if c.Dark(x, y) != (dist != 2) {
+					t.Fatalf("Should draw the finder pattern at %d, %d.", x, y)
+				}
+			}
+		}
+
+		//both copies of the format carry level M and a valid code.
+		var first, second int
+		for i := range 15 {
+			if c.Dark(formatFirst(i)) {
+				first |= 1 << i
+			}
+			if c.Dark(formatSecond(c.Size(), i)) {
+				second |= 1 << i
+			}
+		}
+
+		if first != second {
+			t.Fatalf("Should draw the same format twice: %015b, %015b", first, second)
+		}
+
+		format := first ^ 0x5412
+		if format>>13 != 0 {
+			t.Fatalf("Should use level M: %015b", format)
+		}
+
+		rem := format >> 10
+		for range 10 {
+			rem = (rem << 1) ^ ((rem >> 9) * 0x537)
+		}
+		if rem != format&0x3ff {
+			t.Fatalf("Should protect the format with its BCH code: %015b", format)
+		}
+	}
+
+	if _, err := qr.Encode(make([]byte, 2332)); !errors.Is(err, qr.ErrTooLong) {
+		t.Fatalf("Should refuse data that does not fit: %v", err)
+	}
+}
+
+// The codes in testdata were made by github.com/skip2/go-qrcode, level M
+// with no quiet zone. The first line is the quoted payload, then a line per
+// row with # for a dark module.
+func Test_EncodeGolden(t *testing.T) {
+	files, err := filepath.Glob(filepath.Join("testdata", "*.txt"))
+	if err != nil || len(files) == 0 {
+		t.Fatalf("Should find the golden codes: %v", err)
+	}
+
+	for _, file := range files {
+		t.Run(filepath.Base(file), func(t *testing.T) {
+			data, err := os.ReadFile(file)
+			if err != nil {
+				t.Fatalf("Should be able to read the golden code: %s", err)
+			}
+
+			lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+			payload, err := strconv.Unquote(lines[0])
+			if err != nil {
+				t.Fatalf("Should be able to read the payload: %s", err)
+			}
+			rows := lines[1:]
+
+			c, err := qr.Encode([]byte(payload))
+			if err != nil {
+				t.Fatalf("Should be able to encode %d bytes: %s", len(payload), err)
+			}
+
+			if c.Size() != len(rows) {
+				t.Fatalf("Should have size %d, got %d", len(rows), c.Size())
+			}
+
+			var bad int
+			for y, row := range rows {
+				for x, m := range row {
+					if c.Dark(x, y) != (m == '#') {
+						bad++
+					}
+				}
+			}
+
+			if bad != 0 {
+				t.Fatalf("Should match the reference encoder, %d modules differ", bad)
+			}
+		})
+	}
+}
+
+func Test_HalfBlocks(t *testing.T) {
+	c, err := qr.Encode([]byte("echo"))
+	if err != nil {
+		t.Fatalf("Should be able to encode: %s", err)
+	}
+
+	lines := strings.Split(strings.TrimSuffix(c.HalfBlocks(2), "\n"), "\n")
+
+	//21 modules and a quiet zone of 2 on each side, two rows per line.
+	if len(lines) != 13 {
+		t.Fatalf("Should draw 13 lines, got %d", len(lines))
+	}
+
+	if strings.TrimSpace(lines[0]) != "" {
+		t.Fatalf("Should start with the quiet zone: %q", lines[0])
+	}
+
+	//the second line holds the first two rows of the top left finder.
+	if !strings.HasPrefix(lines[1], "  █▀▀▀▀▀█ ") {
+		t.Fatalf("Should draw the finder pattern: %q", lines[1])
+	}
+
+	for _, l := range lines {
+		if n := len([]rune(l)); n != 25 {
+			t.Fatalf("Should draw 25 columns, got %d", n)
+		}
+	}
+}
+
+// =============================================================================
+
+// formatFirst returns the module of bit i of the format next to the top left
+// finder.
+func formatFirst(i int) (int, int) {
+	switch {
+	case i <= 5:
+		return 8, i
+	case i == 6:
+		return 8, 7
+	case i == 7:
+		return 8, 8
+	case i == 8:
+		return 7, 8
+	default:
+		return 14 - i, 8
+	}
+}
+
+// formatSecond returns the module of bit i of the format split between the
+// other finders.
+func formatSecond(size int, i int) (int, int) {
+	if i < 8 {
+		return size - 1 - i, 8
+	}
+	return 8, size - 15 + i
+}
+
+func abs(v int) int {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
@@ -0,0 +1,21 @@
+package web
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// Decode reads the JSON body of the request into v, unknown fields are rejected.
+func Decode(r *http.Request, v any) error {
+	const maxBodySize = 1 << 20
+
+	d := json.NewDecoder(http.MaxBytesReader(nil, r.Body, maxBodySize))
+	d.DisallowUnknownFields()
+
+	if err := d.Decode(v); err != nil {
+		return fmt.Errorf("decode request body: %w", err)
+	}
+
+	return nil
+}